@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/blogservice"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/mailservice"
+	"github.com/sushihentaime/blogist/internal/seed"
+	"github.com/sushihentaime/blogist/internal/userservice"
+	"github.com/sushihentaime/blogist/migrations"
+)
+
+// errUsage is returned by a command whose arguments are wrong. The usage of the command is printed with it.
+var errUsage = errors.New("invalid arguments")
+
+// cli runs the commands that operate the service. They go through the services the server uses, built from the same configuration. The sessions and permissions they change are evicted from the shared cache straight away when CACHE_BACKEND is redis; with the memory cache each server keeps serving what it cached for up to AUTH_CACHE_TTL.
+type cli struct {
+	cfg    *Config
+	db     *sql.DB
+	logger *slog.Logger
+	in     io.Reader
+	out    io.Writer
+	// json prints the result as JSON instead of text.
+	json bool
+
+	c       common.Cache
+	closers []io.Closer
+}
+
+// command is a subcommand of the binary, such as "user create". run defines the flags of the command on fs, parses args with c.parse and returns the result to print.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// migrates is set for the commands that change the schema, which run before the schema is checked.
+	migrates bool
+	run      func(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error)
+}
+
+var commands = []command{
+	{name: "serve", summary: "serve the API, the default command"},
+	{name: "migrate up", summary: "apply the pending migrations", migrates: true, run: migrateUp},
+	{name: "migrate down", args: "[N]", summary: "revert the last N migrations, 1 by default", migrates: true, run: migrateDown},
+	{name: "migrate status", summary: "print the version of the schema", migrates: true, run: migrateStatus},
+	{name: "migrate force", args: "VERSION", summary: "set the version of the schema once a failed migration was fixed by hand", migrates: true, run: migrateForce},
+	{name: "user create", args: "--username NAME --email EMAIL (--password PASSWORD | --password-stdin)", summary: "create a user, who is sent the activation email", run: userCreate},
+	{name: "user activate", args: "USERNAME", summary: "activate a user without the activation token", run: userActivate},
+	{name: "user grant", args: "USERNAME PERMISSION...", summary: "grant permissions to a user, e.g. admin:access", run: userGrant},
+	{name: "user revoke-sessions", args: "USERNAME", summary: "log a user out of every session", run: userRevokeSessions},
+	{name: "blog reindex", summary: "rebuild the indexes of the blog posts and drop the listings cached in redis", run: blogReindex},
+	{name: "cache flush", summary: "delete every entry of the shared cache", run: cacheFlush},
+	{name: "mail test", args: "ADDRESS", summary: "send a test email with the mail settings", run: mailTest},
+	{name: "outbox replay", args: "--since DURATION", summary: "publish again the messages sent within DURATION and retry the failed ones now", run: outboxReplay},
+	{name: "seed", args: "[--users N] [--blogs-per-user N] [--follows-per-user N] [--seed N] [--copy]", summary: "fill the database with example users, blog posts and follows, outside of production", run: seedData},
+}
+
+// findCommand returns the command named by the first arguments and the arguments that follow its name. No arguments select serve.
+func findCommand(args []string) (*command, []string, bool) {
+	if len(args) == 0 {
+		return &commands[0], nil, true
+	}
+
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return &commands[i], args[len(words):], true
+		}
+	}
+
+	return nil, nil, false
+}
+
+// printUsage writes the usage of the binary to w.
+func printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "usage: blogist [flags] [command]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+	fmt.Fprintf(w, "\nthe commands other than serve accept --json to print their result as JSON\n\nflags:\n")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// run runs cmd with args, the arguments that follow its name, and prints its result.
+func (c *cli) run(ctx context.Context, cmd *command, args []string) error {
+	defer c.close()
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&c.json, "json", false, "print the result as JSON")
+
+	result, err := cmd.run(ctx, c, fs, args)
+	if errors.Is(err, errUsage) || errors.Is(err, flag.ErrHelp) {
+		return fmt.Errorf("%w\nusage: blogist %s", err, strings.TrimSpace(cmd.name+" "+cmd.args))
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.print(result)
+}
+
+// parse parses args with fs and returns the positional arguments, of which there must be between minArgs and maxArgs. A negative maxArgs allows any number.
+func (c *cli) parse(fs *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errUsage, err)
+	}
+
+	n := fs.NArg()
+	if n < minArgs || (maxArgs >= 0 && n > maxArgs) {
+		return nil, errUsage
+	}
+
+	return fs.Args(), nil
+}
+
+func (c *cli) close() {
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+}
+
+// print writes the result as indented JSON, or as one "name: value" line per field named by its json tag. A result that is a fmt.Stringer writes itself.
+func (c *cli) print(result any) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	if s, ok := result.(fmt.Stringer); ok {
+		_, err := fmt.Fprintln(c.out, s)
+		return err
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(result))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		_, err := fmt.Fprintf(c.out, "%s: %s\n", name, formatValue(v.Field(i)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func formatValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Time:
+		return value.Format(time.RFC3339)
+	case time.Duration:
+		return value.String()
+	}
+
+	if v.Kind() == reflect.Slice {
+		values := make([]string, v.Len())
+		for i := range values {
+			values[i] = formatValue(v.Index(i))
+		}
+		return strings.Join(values, ", ")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// cache returns the cache of the configuration, which the services share.
+func (c *cli) cache() (common.Cache, error) {
+	if c.c != nil {
+		return c.c, nil
+	}
+
+	cache, err := newCache(c.cfg, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := cache.(io.Closer); ok {
+		c.closers = append(c.closers, closer)
+	}
+	c.c = cache
+
+	return cache, nil
+}
+
+// warnMemoryCache warns that the running servers keep serving the cached entries a change leaves stale for up to ttl, since the memory cache of each process is out of reach of the command.
+func (c *cli) warnMemoryCache(stale, ttl string) {
+	if c.cfg.CacheBackend == "redis" {
+		return
+	}
+
+	c.logger.Warn(fmt.Sprintf("CACHE_BACKEND is not redis, the running servers keep the cached %s for up to %s", stale, ttl))
+}
+
+func (c *cli) users() (*userservice.UserService, error) {
+	cache, err := c.cache()
+	if err != nil {
+		return nil, err
+	}
+
+	return userservice.NewUserService(userservice.NewPostgresStore(c.db), cache, c.cfg.AuthCacheTTL), nil
+}
+
+// user returns the service of the users and the user named by username.
+func (c *cli) user(ctx context.Context, username string) (*userservice.UserService, *userservice.User, error) {
+	users, err := c.users()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := users.GetUserByUsername(ctx, username)
+	if errors.Is(err, common.ErrRecordNotFound) {
+		return nil, nil, fmt.Errorf("there is no user named %q", username)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return users, u, nil
+}
+
+func (c *cli) migrator() (*common.Migrator, error) {
+	m, err := common.NewMigrator(c.db, migrations.FS)
+	if err != nil {
+		return nil, err
+	}
+	c.closers = append(c.closers, m)
+
+	return m, nil
+}
+
+func migrateUp(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return c.migrate(func(m *common.Migrator) error { return m.Up() })
+}
+
+func migrateDown(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	args, err := c.parse(fs, args, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	n := 1
+	if len(args) == 1 {
+		n, err = strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number of migrations %q", errUsage, args[0])
+		}
+	}
+
+	return c.migrate(func(m *common.Migrator) error { return m.Down(n) })
+}
+
+func migrateForce(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	args, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid version %q", errUsage, args[0])
+	}
+
+	return c.migrate(func(m *common.Migrator) error { return m.Force(version) })
+}
+
+func migrateStatus(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	return c.migrate(func(m *common.Migrator) error { return nil })
+}
+
+// migrate runs change with the migrator and returns the status of the schema afterwards.
+func (c *cli) migrate(change func(m *common.Migrator) error) (any, error) {
+	m, err := c.migrator()
+	if err != nil {
+		return nil, err
+	}
+
+	err = change(m)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	return schemaStatus(status), nil
+}
+
+func userCreate(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	username := fs.String("username", "", "the username")
+	email := fs.String("email", "", "the email address")
+	password := fs.String("password", "", "the password, which is visible to the other users of the machine")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of the standard input")
+	locale := fs.String("locale", "", "the locale of the emails, en by default")
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	if *passwordStdin {
+		if *password != "" {
+			return nil, fmt.Errorf("%w: --password and --password-stdin are exclusive", errUsage)
+		}
+
+		line, err := bufio.NewReader(c.in).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	users, err := c.users()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = users.CreateUser(ctx, *username, *email, *password, *locale)
+	if err != nil {
+		return nil, err
+	}
+
+	return users.GetUserByUsername(ctx, *username)
+}
+
+func userActivate(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	args, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	users, u, err := c.user(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = users.ActivateUserByID(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return users.GetUserByUsername(ctx, u.Username)
+}
+
+type grantResult struct {
+	UserID   int                      `json:"user_id"`
+	Username string                   `json:"username"`
+	Granted  []userservice.Permission `json:"granted"`
+}
+
+func userGrant(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	args, err := c.parse(fs, args, 2, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	users, u, err := c.user(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make([]userservice.Permission, len(args)-1)
+	for i, p := range args[1:] {
+		permissions[i] = userservice.Permission(p)
+	}
+
+	err = users.GrantPermission(ctx, u.ID, permissions...)
+	if err != nil {
+		return nil, err
+	}
+	c.warnMemoryCache("permissions of the user", "AUTH_CACHE_TTL")
+
+	return grantResult{UserID: u.ID, Username: u.Username, Granted: permissions}, nil
+}
+
+type revokeSessionsResult struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Revoked  bool   `json:"revoked"`
+}
+
+func userRevokeSessions(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	args, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	users, u, err := c.user(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = users.RevokeSessions(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.warnMemoryCache("sessions of the user", "AUTH_CACHE_TTL")
+
+	return revokeSessionsResult{UserID: u.ID, Username: u.Username, Revoked: true}, nil
+}
+
+type reindexResult struct {
+	Table    string        `json:"table"`
+	Duration time.Duration `json:"duration"`
+}
+
+func blogReindex(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	cache, err := c.cache()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	err = blogservice.NewBlogService(blogservice.NewPostgresStore(c.db), cache).Reindex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.warnMemoryCache("listings of the blog posts", cacheExpiration.String())
+
+	return reindexResult{Table: "blogs", Duration: time.Since(start)}, nil
+}
+
+type cacheFlushResult struct {
+	Backend string `json:"backend"`
+	Flushed bool   `json:"flushed"`
+}
+
+func cacheFlush(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+
+	// The memory cache of each server lives in its process, out of reach of the command.
+	if c.cfg.CacheBackend != "redis" {
+		return nil, fmt.Errorf("CACHE_BACKEND is %s, only the redis cache can be flushed, restart the servers to empty theirs", c.cfg.CacheBackend)
+	}
+
+	cache, err := c.cache()
+	if err != nil {
+		return nil, err
+	}
+	cache.Flush()
+
+	return cacheFlushResult{Backend: c.cfg.CacheBackend, Flushed: true}, nil
+}
+
+type mailTestResult struct {
+	Recipient string `json:"recipient"`
+	Transport string `json:"transport"`
+}
+
+func mailTest(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	args, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := mailservice.NewTransport(c.cfg.MailTransport, c.cfg.MailHost, c.cfg.MailPort, c.cfg.MailUser, c.cfg.MailPassword, c.cfg.MailDir, c.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := mailservice.NewTemplates(c.cfg.MailTemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]any{"BaseURL": publicBaseURL(c.cfg)}
+	err = mailservice.NewMailer(transport, c.cfg.MailSender, templates).Send(args[0], "", mailservice.TemplateTest, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mailTestResult{Recipient: args[0], Transport: c.cfg.MailTransport}, nil
+}
+
+type outboxReplayResult struct {
+	Since     time.Time `json:"since"`
+	Scheduled int64     `json:"scheduled"`
+}
+
+func outboxReplay(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	since := fs.Duration("since", 0, fmt.Sprintf("publish again the messages sent within this duration, e.g. 1h; the sent messages are kept for %s", common.OutboxRetention))
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+	if *since <= 0 {
+		return nil, fmt.Errorf("%w: --since must be positive", errUsage)
+	}
+
+	from := time.Now().Add(-*since)
+	n, err := common.ReplayOutbox(ctx, c.db, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return outboxReplayResult{Since: from, Scheduled: n}, nil
+}
+
+type seedResult struct {
+	Mode     string        `json:"mode"`
+	Seed     uint64        `json:"seed"`
+	Users    int           `json:"users"`
+	Blogs    int           `json:"blogs"`
+	Follows  int           `json:"follows"`
+	Password string        `json:"password"`
+	Duration time.Duration `json:"duration"`
+}
+
+func seedData(ctx context.Context, c *cli, fs *flag.FlagSet, args []string) (any, error) {
+	opts := seed.Options{Now: time.Now()}
+	fs.IntVar(&opts.Users, "users", 20, "number of users, the first one is the admin")
+	fs.IntVar(&opts.BlogsPerUser, "blogs-per-user", 5, "average number of blog posts of a user")
+	fs.IntVar(&opts.FollowsPerUser, "follows-per-user", 3, "number of authors each user follows")
+	fs.Uint64Var(&opts.Seed, "seed", 1, "seed of the generated data, the same seed gives the same data")
+	bulk := fs.Bool("copy", false, "bulk-load the rows with COPY, skipping the services, their events and the caches")
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return nil, err
+	}
+	if opts.Users <= 0 || opts.BlogsPerUser < 0 || opts.FollowsPerUser < 0 {
+		return nil, fmt.Errorf("%w: --users must be positive and the other counts not negative", errUsage)
+	}
+
+	// The generated users share a known password.
+	if c.cfg.Environment == "production" {
+		return nil, errors.New("refusing to seed a production database")
+	}
+
+	var (
+		res  seed.Result
+		err  error
+		mode = "services"
+	)
+	if *bulk {
+		mode = "copy"
+		// A failed load is rolled back as a whole.
+		res, err = seed.Copy(ctx, c.db, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var cache common.Cache
+		cache, err = c.cache()
+		if err != nil {
+			return nil, err
+		}
+		users := userservice.NewUserService(userservice.NewPostgresStore(c.db), cache, c.cfg.AuthCacheTTL)
+		res, err = seed.Services(ctx, users, blogservice.NewBlogService(blogservice.NewPostgresStore(c.db), cache), opts)
+		if err != nil {
+			return nil, fmt.Errorf("%w, after %d users, %d blog posts and %d follows", err, res.Users, res.Blogs, res.Follows)
+		}
+	}
+
+	return seedResult{
+		Mode:     mode,
+		Seed:     opts.Seed,
+		Users:    res.Users,
+		Blogs:    res.Blogs,
+		Follows:  res.Follows,
+		Password: res.Password,
+		Duration: res.Duration,
+	}, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func TestFindCommand(t *testing.T) {
+	cmd, args, ok := findCommand(nil)
+	assert.True(t, ok)
+	assert.Equal(t, "serve", cmd.name)
+	assert.Empty(t, args)
+
+	cmd, args, ok = findCommand([]string{"user", "grant", "alice", "admin:access"})
+	assert.True(t, ok)
+	assert.Equal(t, "user grant", cmd.name)
+	assert.Equal(t, []string{"alice", "admin:access"}, args)
+
+	_, _, ok = findCommand([]string{"user"})
+	assert.False(t, ok)
+	_, _, ok = findCommand([]string{"user", "delete", "alice"})
+	assert.False(t, ok)
+}
+
+func TestCLIUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"migrate", "down", "one"}, "invalid arguments: invalid number of migrations \"one\"\nusage: blogist migrate down [N]"},
+		{[]string{"migrate", "status", "now"}, "invalid arguments\nusage: blogist migrate status"},
+		{[]string{"user", "grant", "alice"}, "invalid arguments\nusage: blogist user grant USERNAME PERMISSION..."},
+		{[]string{"user", "create", "--username"}, "invalid arguments: flag needs an argument: -username\nusage: blogist user create --username NAME --email EMAIL (--password PASSWORD | --password-stdin)"},
+		{[]string{"outbox", "replay"}, "invalid arguments: --since must be positive\nusage: blogist outbox replay --since DURATION"},
+		{[]string{"seed", "--users", "0"}, "invalid arguments: --users must be positive and the other counts not negative\nusage: blogist seed [--users N] [--blogs-per-user N] [--follows-per-user N] [--seed N] [--copy]"},
+	}
+
+	for _, tt := range tests {
+		cmd, args, ok := findCommand(tt.args)
+		if !assert.True(t, ok, tt.args) {
+			continue
+		}
+
+		c := &cli{cfg: &Config{}, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), out: io.Discard}
+		err := c.run(context.Background(), cmd, args)
+		assert.ErrorIs(t, err, errUsage)
+		assert.EqualError(t, err, tt.want)
+	}
+}
+
+func TestCLISeedProduction(t *testing.T) {
+	cmd, args, _ := findCommand([]string{"seed"})
+	c := &cli{cfg: &Config{Environment: "production"}, logger: slog.New(slog.NewTextHandler(io.Discard, nil)), out: io.Discard}
+	assert.EqualError(t, c.run(context.Background(), cmd, args), "refusing to seed a production database")
+}
+
+func TestCLICacheFlush(t *testing.T) {
+	cmd, args, _ := findCommand([]string{"cache", "flush"})
+
+	c := &cli{cfg: &Config{CacheBackend: "memory"}, out: io.Discard}
+	err := c.run(context.Background(), cmd, args)
+	assert.EqualError(t, err, "CACHE_BACKEND is memory, only the redis cache can be flushed, restart the servers to empty theirs")
+}
+
+func TestCLIWarnMemoryCache(t *testing.T) {
+	var logs bytes.Buffer
+	c := &cli{cfg: &Config{CacheBackend: "memory"}, logger: slog.New(slog.NewTextHandler(&logs, nil))}
+
+	c.warnMemoryCache("sessions of the user", "AUTH_CACHE_TTL")
+	assert.Contains(t, logs.String(), `level=WARN msg="CACHE_BACKEND is not redis, the running servers keep the cached sessions of the user for up to AUTH_CACHE_TTL"`)
+
+	// The redis cache is shared with the servers, which see the evictions straight away.
+	logs.Reset()
+	c.cfg.CacheBackend = "redis"
+	c.warnMemoryCache("sessions of the user", "AUTH_CACHE_TTL")
+	assert.Empty(t, logs.String())
+}
+
+func TestCLIMailTest(t *testing.T) {
+	dir := t.TempDir()
+	cmd, args, _ := findCommand([]string{"mail", "test", "--json", "ops@example.com"})
+
+	var out bytes.Buffer
+	c := &cli{cfg: &Config{MailTransport: "file", MailDir: dir, MailSender: "blogist@example.com", Port: ":8000"}, out: &out}
+	err := c.run(context.Background(), cmd, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result mailTestResult
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, mailTestResult{Recipient: "ops@example.com", Transport: "file"}, result)
+}
+
+func TestCLIPrint(t *testing.T) {
+	var out bytes.Buffer
+	c := &cli{out: &out}
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(t, c.print(&userservice.User{ID: 7, Username: "alice", Email: "alice@example.com", Activated: true, Locale: "en", CreatedAt: created, Permissions: userservice.Permissions{userservice.PermissionWriteBlog, userservice.PermissionAdmin}}))
+	assert.Equal(t, `id: 7
+username: alice
+email: alice@example.com
+activated: true
+suspended: false
+locale: en
+created_at: 2024-05-01T12:00:00Z
+updated_at: 0001-01-01T00:00:00Z
+version: 0
+permissions: blog:write, admin:access
+`, out.String())
+
+	out.Reset()
+	c.json = true
+	assert.NoError(t, c.print(grantResult{UserID: 7, Username: "alice", Granted: []userservice.Permission{userservice.PermissionAdmin}}))
+	assert.JSONEq(t, `{"user_id": 7, "username": "alice", "granted": ["admin:access"]}`, out.String())
+}
@@ -1,31 +1,61 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/spf13/viper"
+	"github.com/sushihentaime/blogist/internal/userservice"
 )
 
+// Config is the configuration of the application. Each setting is named by its mapstructure tag, and the settings tagged secret are redacted when the configuration is printed and have no command line flag.
 type Config struct {
 	Port           string   `mapstructure:"PORT"`
 	Environment    string   `mapstructure:"ENVIRONMENT"`
 	Version        string   `mapstructure:"VERSION"`
 	TrustedOrigins []string `mapstructure:"TRUSTED_ORIGINS"`
+	// PublicBaseURL is the URL the users reach the application at, e.g. "https://blogist.example.com" when it runs behind Caddy. The links in the emails start with it.
+	PublicBaseURL string `mapstructure:"PUBLIC_BASE_URL"`
+	// SigningSecret signs the links that are trusted without a login, such as the unsubscribe links in the emails. It must be at least 32 bytes long and the same on every replica.
+	SigningSecret string `mapstructure:"SIGNING_SECRET" secret:"true"`
+	// ShutdownDelay is how long the server keeps serving after it started failing the readiness probe on shutdown, so that Caddy stops sending it requests before it stops accepting them. It should be longer than the interval of the health checks of Caddy. It is 5 seconds by default.
+	ShutdownDelay time.Duration `mapstructure:"SHUTDOWN_DELAY"`
 
 	DBHost string `mapstructure:"POSTGRES_HOST"`
 	// DBPort     string `mapstructure:"POSTGRES_PORT"`
 	DBUser     string `mapstructure:"POSTGRES_USER"`
-	DBPassword string `mapstructure:"POSTGRES_PASSWORD"`
+	DBPassword string `mapstructure:"POSTGRES_PASSWORD" secret:"true"`
 	DBName     string `mapstructure:"POSTGRES_DB"`
+	// MigrateOnStart applies the pending migrations before the server starts. The replicas that start together take turns, and the first one migrates.
+	MigrateOnStart bool `mapstructure:"MIGRATE_ON_START"`
 
 	MailHost     string `mapstructure:"MAIL_HOST"`
 	MailPort     int    `mapstructure:"MAIL_PORT"`
 	MailUser     string `mapstructure:"MAIL_USER"`
-	MailPassword string `mapstructure:"MAIL_PASSWORD"`
+	MailPassword string `mapstructure:"MAIL_PASSWORD" secret:"true"`
 	MailSender   string `mapstructure:"MAIL_SENDER"`
+	// MailTransport is "smtp", "file", "log" or "memory". The file transport writes .eml files to MailDir and the log transport logs the emails, both are meant for local development.
+	MailTransport string `mapstructure:"MAIL_TRANSPORT"`
+	MailDir       string `mapstructure:"MAIL_DIR"`
+	// MailTemplatesDir holds templates that replace the embedded email templates at the same path, e.g. en/activation.html or partials/footer.html.
+	MailTemplatesDir string `mapstructure:"MAIL_TEMPLATES_DIR"`
 
-	MQHost string `mapstructure:"RABBITMQ_HOST"`
+	// BrokerBackend is either "rabbitmq" or "memory". The memory broker keeps messages inside the process, which is only suitable for development and tests.
+	BrokerBackend string `mapstructure:"BROKER_BACKEND"`
+	MQHost        string `mapstructure:"RABBITMQ_HOST"`
 	// MQPort     string `mapstructure:"RABBITMQ_PORT"`
 	MQUser     string `mapstructure:"RABBITMQ_USER"`
-	MQPassword string `mapstructure:"RABBITMQ_PASSWORD"`
+	MQPassword string `mapstructure:"RABBITMQ_PASSWORD" secret:"true"`
 
 	// Rate Limiter Configuration
 	RateLimitRPS     int  `mapstructure:"RATE_LIMIT_RPS"`
@@ -36,23 +66,327 @@ type Config struct {
 	TLSCertFile string `mapstructure:"TLS_CERT_FILE"`
 	TLSKeyFile  string `mapstructure:"TLS_KEY_FILE"`
 
+	// AuthCacheTTL bounds how long an access token lookup is trusted from the cache, e.g. "1m".
+	AuthCacheTTL time.Duration `mapstructure:"AUTH_CACHE_TTL"`
+
+	// Cache Configuration
+	// CacheBackend is either "memory" or "redis". Use redis when more than one replica is running so that every replica sees the same entries and invalidations.
+	CacheBackend  string `mapstructure:"CACHE_BACKEND"`
+	RedisAddr     string `mapstructure:"REDIS_ADDR"`
+	RedisPassword string `mapstructure:"REDIS_PASSWORD" secret:"true"`
+	RedisDB       int    `mapstructure:"REDIS_DB"`
+
+	// Digest Configuration
+	// DigestInterval is how often the due digests are looked for, e.g. "1h". A digest is due a day or a week after the previous one, depending on the frequency the user chose.
+	DigestInterval time.Duration `mapstructure:"DIGEST_INTERVAL"`
+	// DigestPostLimit is the maximum number of posts in a digest.
+	DigestPostLimit int `mapstructure:"DIGEST_POST_LIMIT"`
+
+	// Webhook Configuration
+	// WebhookTimeout is how long an endpoint has to answer a delivery, e.g. "10s".
+	WebhookTimeout time.Duration `mapstructure:"WEBHOOK_TIMEOUT"`
+	// WebhookAllowPrivate lets the deliveries reach loopback and private addresses. Only enable it for local development.
+	WebhookAllowPrivate bool `mapstructure:"WEBHOOK_ALLOW_PRIVATE"`
+
 	// Metrics Configuration
 	MetricsEnabled bool `mapstructure:"METRICS_ENABLED"`
+	// MetricsAddr is the address of a separate listener that only serves /metrics, e.g. ":9090". Keep it off the internet. When it is empty /metrics is served on the main port.
+	MetricsAddr string `mapstructure:"METRICS_ADDR"`
+	// MetricsToken is the bearer token the scrapers must send. It is required when /metrics is served on the main port, which refuses every scrape without it.
+	MetricsToken string `mapstructure:"METRICS_TOKEN" secret:"true"`
+
+	// Tracing Configuration
+	// OTLPEndpoint is the host and port of the OTLP/HTTP collector the traces are exported to, e.g. "otel-collector:4318". Nothing is traced when it is empty.
+	OTLPEndpoint string `mapstructure:"OTLP_ENDPOINT"`
+	// OTLPInsecure exports the traces over plain HTTP instead of HTTPS.
+	OTLPInsecure bool `mapstructure:"OTLP_INSECURE"`
+	// TraceSampleRatio is the share of the traces that are kept, between 0 and 1. Every trace is kept by default, and at 0 only the traces the callers sampled are.
+	TraceSampleRatio float64 `mapstructure:"TRACE_SAMPLE_RATIO"`
+
+	// Logging Configuration
+	// LogFormat is "text" or "json". The logs are written as text by default.
+	LogFormat string `mapstructure:"LOG_FORMAT"`
+}
+
+const (
+	defaultConfigFile     = ".env"
+	defaultDigestInterval = time.Hour
+	defaultDigestLimit    = 10
+	defaultWebhookTimeout = 10 * time.Second
+	defaultShutdownDelay  = 5 * time.Second
+)
+
+// configDefaults are the settings used when no other source sets them. The rate limiter is enabled in every environment, set RATE_LIMIT_ENABLED=false to turn it off for local development.
+var configDefaults = map[string]any{
+	"ENVIRONMENT":        "development",
+	"BROKER_BACKEND":     "rabbitmq",
+	"CACHE_BACKEND":      "memory",
+	"MAIL_TRANSPORT":     "smtp",
+	"LOG_FORMAT":         "text",
+	"RATE_LIMIT_ENABLED": true,
+	"RATE_LIMIT_RPS":     2,
+	"RATE_LIMIT_BURST":   4,
+	"AUTH_CACHE_TTL":     userservice.DefaultAuthCacheTTL,
+	"DIGEST_INTERVAL":    defaultDigestInterval,
+	"DIGEST_POST_LIMIT":  defaultDigestLimit,
+	"WEBHOOK_TIMEOUT":    defaultWebhookTimeout,
+	"SHUTDOWN_DELAY":     defaultShutdownDelay,
+	"TRACE_SAMPLE_RATIO": 1.0,
+}
+
+// configKeys returns the names of the settings in the order of the fields of Config.
+func configKeys() []string {
+	t := reflect.TypeOf(Config{})
+
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, t.Field(i).Tag.Get("mapstructure"))
+	}
+
+	return keys
+}
+
+// flagName returns the command line flag of a setting, e.g. --postgres-host for POSTGRES_HOST.
+func flagName(key string) string {
+	return strings.ReplaceAll(strings.ToLower(key), "_", "-")
+}
+
+// configFlags defines a flag on fs for every setting but the secrets, since the command line of a process is visible to the other users of the host. The secrets are set with the environment, the env file or a _FILE variable instead. The returned function gives the settings whose flag was set once fs is parsed.
+func configFlags(fs *flag.FlagSet) func() map[string]string {
+	t := reflect.TypeOf(Config{})
+
+	keys := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("secret") == "true" {
+			continue
+		}
+		key := field.Tag.Get("mapstructure")
+		name := flagName(key)
+		keys[name] = key
+		fs.String(name, "", "overrides "+key)
+	}
+
+	return func() map[string]string {
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			if key, ok := keys[f.Name]; ok {
+				set[key] = f.Value.String()
+			}
+		})
+		return set
+	}
 }
 
-func loadConfig(path string) (*Config, error) {
-	viper.SetConfigType("env")
-	viper.SetConfigFile(path)
-	if err := viper.ReadInConfig(); err != nil {
+// loadConfig loads the configuration from, in increasing order of precedence, the defaults, the env file at path, the environment variables and the flags. The file is optional when path is empty, in which case .env is read if it exists. A setting can be read from a file named by the variable with the _FILE suffix, e.g. POSTGRES_PASSWORD_FILE=/run/secrets/db_password, which suits Docker secrets. The configuration is not validated.
+func loadConfig(path string, flags map[string]string) (*Config, error) {
+	v := viper.New()
+	for key, value := range configDefaults {
+		v.SetDefault(key, value)
+	}
+
+	required := path != ""
+	if !required {
+		path = defaultConfigFile
+	}
+	v.SetConfigType("env")
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err != nil && (required || !errors.Is(err, fs.ErrNotExist)) {
 		return nil, err
 	}
 
-	viper.AutomaticEnv()
+	env, err := configEnv()
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range env {
+		v.Set(key, value)
+	}
+	for key, value := range flags {
+		v.Set(key, value)
+	}
 
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
+	if err := v.Unmarshal(&config); err != nil {
 		return nil, err
 	}
 
 	return &config, nil
 }
+
+// configEnv returns the settings set by the environment variables. The empty variables are ignored.
+func configEnv() (map[string]string, error) {
+	env := make(map[string]string)
+	var errs []error
+
+	for _, key := range configKeys() {
+		value := os.Getenv(key)
+		file := os.Getenv(key + "_FILE")
+
+		switch {
+		case file != "" && value != "":
+			errs = append(errs, fmt.Errorf("%s and %s_FILE are both set", key, key))
+		case file != "":
+			b, err := os.ReadFile(file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s_FILE: %w", key, err))
+				continue
+			}
+			env[key] = strings.TrimRight(string(b), "\r\n")
+		case value != "":
+			env[key] = value
+		}
+	}
+
+	return env, errors.Join(errs...)
+}
+
+// validate reports every problem of the configuration at once.
+func (c *Config) validate() error {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problem("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), value)
+	}
+	required := func(key, value string) {
+		if value == "" {
+			problem("%s is required", key)
+		}
+	}
+	nonNegative := func(key string, d time.Duration) {
+		if d < 0 {
+			problem("%s must not be negative", key)
+		}
+	}
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			problem("%s must be positive", key)
+		}
+	}
+
+	if c.Port == "" {
+		problem("PORT is required")
+	} else if _, port, err := net.SplitHostPort(listenAddr(c)); err != nil || !validPort(port) {
+		problem("PORT must be a port, e.g. 8000 or :8000, got %q", c.Port)
+	}
+	required("ENVIRONMENT", c.Environment)
+	if c.PublicBaseURL != "" {
+		u, err := url.Parse(c.PublicBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("PUBLIC_BASE_URL must be an http or https URL, got %q", c.PublicBaseURL)
+		}
+	}
+	if c.SigningSecret != "" && len(c.SigningSecret) < 32 {
+		problem("SIGNING_SECRET must be at least 32 bytes long")
+	}
+	nonNegative("SHUTDOWN_DELAY", c.ShutdownDelay)
+
+	required("POSTGRES_HOST", c.DBHost)
+	required("POSTGRES_USER", c.DBUser)
+	required("POSTGRES_DB", c.DBName)
+
+	oneOf("MAIL_TRANSPORT", c.MailTransport, "smtp", "file", "log", "memory")
+	switch c.MailTransport {
+	case "smtp":
+		required("MAIL_HOST", c.MailHost)
+		if !validPort(strconv.Itoa(c.MailPort)) {
+			problem("MAIL_PORT must be a port between 1 and 65535, got %d", c.MailPort)
+		}
+	case "file":
+		required("MAIL_DIR", c.MailDir)
+	}
+	required("MAIL_SENDER", c.MailSender)
+
+	oneOf("BROKER_BACKEND", c.BrokerBackend, "rabbitmq", "memory")
+	if c.BrokerBackend == "rabbitmq" {
+		required("RABBITMQ_HOST", c.MQHost)
+		required("RABBITMQ_USER", c.MQUser)
+	}
+
+	if c.RateLimitEnabled {
+		if c.RateLimitRPS <= 0 {
+			problem("RATE_LIMIT_RPS must be positive when the rate limiter is enabled")
+		}
+		if c.RateLimitBurst <= 0 {
+			problem("RATE_LIMIT_BURST must be positive when the rate limiter is enabled")
+		}
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problem("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	nonNegative("AUTH_CACHE_TTL", c.AuthCacheTTL)
+
+	oneOf("CACHE_BACKEND", c.CacheBackend, "memory", "redis")
+	if c.CacheBackend == "redis" {
+		required("REDIS_ADDR", c.RedisAddr)
+	}
+	if c.RedisDB < 0 {
+		problem("REDIS_DB must not be negative")
+	}
+
+	positive("DIGEST_INTERVAL", c.DigestInterval)
+	if c.DigestPostLimit <= 0 {
+		problem("DIGEST_POST_LIMIT must be positive")
+	}
+	positive("WEBHOOK_TIMEOUT", c.WebhookTimeout)
+
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		problem("TRACE_SAMPLE_RATIO must be between 0 and 1, got %v", c.TraceSampleRatio)
+	}
+
+	oneOf("LOG_FORMAT", c.LogFormat, "text", "json")
+
+	return errors.Join(errs...)
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// listenAddr returns the address the server listens on. PORT is either an address such as ":8000" or a bare port.
+func listenAddr(cfg *Config) string {
+	if strings.Contains(cfg.Port, ":") {
+		return cfg.Port
+	}
+
+	return ":" + cfg.Port
+}
+
+// print writes the configuration to w in the env file format, with the secrets redacted.
+func (c *Config) print(w io.Writer) error {
+	v := reflect.ValueOf(*c)
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		var value string
+		switch f := v.Field(i).Interface().(type) {
+		case []string:
+			value = strings.Join(f, ",")
+		default:
+			value = fmt.Sprint(f)
+		}
+		if field.Tag.Get("secret") == "true" && value != "" {
+			value = "[redacted]"
+		}
+
+		_, err := fmt.Fprintf(w, "%s=%s\n", field.Tag.Get("mapstructure"), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
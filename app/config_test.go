@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -39,7 +47,7 @@ RABBITMQ_PASSWORD=testpassword
 	}
 
 	// Load the config from the temporary file
-	config, err := loadConfig(tempFile.Name())
+	config, err := loadConfig(tempFile.Name(), nil)
 	if err != nil {
 		t.Fatalf("Failed to load config: %v", err)
 	}
@@ -62,4 +70,143 @@ RABBITMQ_PASSWORD=testpassword
 	assert.Equal(t, "testuser", config.MQUser)
 	assert.Equal(t, "testpassword", config.MQPassword)
 
+	// The settings the file leaves out have their defaults.
+	assert.Equal(t, "rabbitmq", config.BrokerBackend)
+	assert.Equal(t, defaultWebhookTimeout, config.WebhookTimeout)
+	assert.Equal(t, 1.0, config.TraceSampleRatio)
+	assert.True(t, config.RateLimitEnabled)
+	assert.NoError(t, config.validate())
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.env")
+	assert.NoError(t, os.WriteFile(path, []byte("PORT=8000\nMAIL_HOST=file.example.com\nMAIL_PORT=25\nENVIRONMENT=production\n"), 0o600))
+
+	secret := filepath.Join(dir, "mail_password")
+	assert.NoError(t, os.WriteFile(secret, []byte("from-secret\n"), 0o600))
+
+	t.Setenv("MAIL_HOST", "env.example.com")
+	t.Setenv("MAIL_PORT", "587")
+	t.Setenv("MAIL_PASSWORD_FILE", secret)
+	// A ratio of 0 is kept rather than replaced by the default.
+	t.Setenv("TRACE_SAMPLE_RATIO", "0")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	settings := configFlags(fs)
+	assert.NoError(t, fs.Parse([]string{"--mail-port", "2525"}))
+	// The secrets have no flag, so they never show up in the command line of the process.
+	assert.Nil(t, fs.Lookup("mail-password"))
+
+	config, err := loadConfig(path, settings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "8000", config.Port)
+	assert.Equal(t, "env.example.com", config.MailHost)
+	assert.Equal(t, 2525, config.MailPort)
+	assert.Equal(t, "from-secret", config.MailPassword)
+	assert.Zero(t, config.TraceSampleRatio)
+	assert.True(t, config.RateLimitEnabled)
+
+	t.Setenv("MAIL_PASSWORD", "from-env")
+	_, err = loadConfig(path, nil)
+	assert.EqualError(t, err, "MAIL_PASSWORD and MAIL_PASSWORD_FILE are both set")
+}
+
+func TestLoadConfig_File(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	defer os.Chdir(wd)
+
+	// Without a .env file the configuration comes from the environment.
+	t.Setenv("PORT", "8000")
+	config, err := loadConfig("", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "8000", config.Port)
+
+	// A file that was asked for must exist.
+	_, err = loadConfig("missing.env", nil)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestValidate(t *testing.T) {
+	config := &Config{
+		Port:             "80a",
+		Environment:      "production",
+		SigningSecret:    "short",
+		MailTransport:    "smtp",
+		MailSender:       "sender@example.com",
+		BrokerBackend:    "memory",
+		CacheBackend:     "redis",
+		RateLimitEnabled: true,
+		RateLimitRPS:     2,
+		RateLimitBurst:   4,
+		TraceSampleRatio: 2,
+		LogFormat:        "xml",
+		DBHost:           "localhost",
+		DBUser:           "postgres",
+		DBName:           "blogist",
+	}
+
+	err := config.validate()
+	assert.EqualError(t, err, strings.Join([]string{
+		`PORT must be a port, e.g. 8000 or :8000, got "80a"`,
+		"SIGNING_SECRET must be at least 32 bytes long",
+		"MAIL_HOST is required",
+		"MAIL_PORT must be a port between 1 and 65535, got 0",
+		"REDIS_ADDR is required",
+		"DIGEST_INTERVAL must be positive",
+		"DIGEST_POST_LIMIT must be positive",
+		"WEBHOOK_TIMEOUT must be positive",
+		"TRACE_SAMPLE_RATIO must be between 0 and 1, got 2",
+		`LOG_FORMAT must be one of text, json, got "xml"`,
+	}, "\n"))
+}
+
+func TestPrintConfig(t *testing.T) {
+	var buf bytes.Buffer
+	config := &Config{
+		Port:           ":8000",
+		TrustedOrigins: []string{"http://a.example.com", "http://b.example.com"},
+		DBPassword:     "hunter2",
+		WebhookTimeout: 10 * time.Second,
+	}
+	assert.NoError(t, config.print(&buf))
+
+	out := buf.String()
+	assert.Contains(t, out, "PORT=:8000\n")
+	assert.Contains(t, out, "TRUSTED_ORIGINS=http://a.example.com,http://b.example.com\n")
+	assert.Contains(t, out, "POSTGRES_PASSWORD=[redacted]\n")
+	assert.Contains(t, out, "MAIL_PASSWORD=\n")
+	assert.Contains(t, out, "WEBHOOK_TIMEOUT=10s\n")
+	assert.NotContains(t, out, "hunter2")
+}
+
+func TestPublicBaseURL(t *testing.T) {
+	assert.Equal(t, "http://localhost:8080", publicBaseURL(&Config{Port: "8080"}))
+	assert.Equal(t, "http://localhost:8000", publicBaseURL(&Config{Port: ":8000"}))
+	assert.Equal(t, "https://blogist.example.com", publicBaseURL(&Config{Port: "8080", PublicBaseURL: "https://blogist.example.com/"}))
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger, err := newLogger(&Config{LogFormat: "json"}, &buf)
+	assert.NoError(t, err)
+	logger.Info("message", slog.String("key", "value"))
+
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "value", line["key"])
+
+	_, err = newLogger(&Config{}, &buf)
+	assert.NoError(t, err)
+
+	_, err = newLogger(&Config{LogFormat: "xml"}, &buf)
+	assert.Error(t, err)
 }
@@ -2,17 +2,31 @@ package main
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
 
+	"github.com/sushihentaime/blogist/internal/common"
 	"github.com/sushihentaime/blogist/internal/userservice"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey        = contextKey("user")
+	requestUserContextKey = contextKey("request_user")
+)
 
+// createUserContext sets the user of the request. An authenticated user is added to the logger of the request and to the log line of logRequest.
 func (app *application) createUserContext(r *http.Request, user *userservice.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
+
+	if !user.IsAnonymous() {
+		if userID, ok := ctx.Value(requestUserContextKey).(*int); ok {
+			*userID = user.ID
+		}
+		ctx = common.WithLogger(ctx, common.Logger(ctx, app.logger).With(slog.Int("user_id", user.ID)))
+	}
+
 	return r.WithContext(ctx)
 }
 
@@ -23,3 +37,8 @@ func (app *application) getUserContext(r *http.Request) *userservice.User {
 	}
 	return user
 }
+
+// requestLogger returns the logger of the request, which carries its ID and user.
+func (app *application) requestLogger(r *http.Request) *slog.Logger {
+	return common.Logger(r.Context(), app.logger)
+}
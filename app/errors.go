@@ -3,18 +3,19 @@ package main
 import (
 	"log/slog"
 	"net/http"
-	"runtime/debug"
 )
 
-func (app *application) logError(r *http.Request, err error) {
+const serverErrorMessage = "the server encountered a problem and could not process your request"
+
+// logError logs err with the logger of the request, so that it carries the request and user IDs.
+func (app *application) logError(r *http.Request, err error, attrs ...any) {
 	var (
 		method  = r.Method
 		url     = r.URL.RequestURI()
 		message = err.Error()
-		debug   = debug.Stack()
 	)
 
-	app.logger.Error(message, slog.String("method", method), slog.String("url", url), slog.String("stack", string(debug)))
+	app.requestLogger(r).Error(message, append([]any{slog.String("method", method), slog.String("url", url)}, attrs...)...)
 }
 
 func (app *application) writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
@@ -28,8 +29,7 @@ func (app *application) writeErrorResponse(w http.ResponseWriter, r *http.Reques
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.logError(r, err)
-	message := "the server encountered a problem and could not process your request"
-	app.writeErrorResponse(w, r, http.StatusInternalServerError, message)
+	app.writeErrorResponse(w, r, http.StatusInternalServerError, serverErrorMessage)
 }
 
 func (app *application) badRequestErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
@@ -52,6 +52,10 @@ func (app *application) unAuthorizedErrorResponse(w http.ResponseWriter, r *http
 	app.writeErrorResponse(w, r, http.StatusUnauthorized, "unauthorized access")
 }
 
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	app.writeErrorResponse(w, r, http.StatusForbidden, "your user account has been suspended")
+}
+
 func (app *application) methodNotAllowedErrorResponse(w http.ResponseWriter, r *http.Request) {
 	app.writeErrorResponse(w, r, http.StatusMethodNotAllowed, "method not allowed")
 }
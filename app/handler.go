@@ -2,17 +2,26 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/sushihentaime/blogist/internal/blogservice"
 	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/mailservice"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
 	"github.com/sushihentaime/blogist/internal/userservice"
+	"github.com/sushihentaime/blogist/internal/webhookservice"
 )
 
 type registerUserRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Locale is optional, the emails are sent in English when it is not set.
+	Locale string `json:"locale"`
 }
 
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -26,7 +35,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Call the user service
-	token, err := app.userService.CreateUser(r.Context(), input.Username, input.Email, input.Password)
+	token, err := app.userService.CreateUser(r.Context(), input.Username, input.Email, input.Password, input.Locale)
 	if err != nil {
 		switch {
 		case errors.Is(err, userservice.ErrDuplicateEmail):
@@ -87,6 +96,119 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// activatePageHandler serves the page the activation link in the email opens. Opening the link does not activate the account, since mail scanners follow links too, it shows a form that does.
+func (app *application) activatePageHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	err := app.userService.CheckActivationToken(r.Context(), token)
+	if err != nil {
+		app.activationErrorPage(w, r, err)
+		return
+	}
+
+	app.renderPage(w, r, http.StatusOK, "activate", map[string]string{"Token": token})
+}
+
+// activateFormHandler activates the account when the form of the activation page is submitted.
+func (app *application) activateFormHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.renderPage(w, r, http.StatusBadRequest, "activation_failed", nil)
+		return
+	}
+
+	err = app.userService.ActivateUser(r.Context(), r.PostForm.Get("token"))
+	if err != nil {
+		app.activationErrorPage(w, r, err)
+		return
+	}
+
+	app.renderPage(w, r, http.StatusOK, "activated", nil)
+}
+
+func (app *application) activationErrorPage(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, common.ErrRecordNotFound):
+		app.renderPage(w, r, http.StatusNotFound, "activation_failed", nil)
+	case errors.As(err, &common.ValidationError{}):
+		app.renderPage(w, r, http.StatusBadRequest, "activation_failed", nil)
+	default:
+		app.serverErrorPage(w, r, err)
+	}
+}
+
+type requestPasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// requestPasswordResetHandler always answers the same way for a valid email address, so it cannot be used to find out who has an account.
+func (app *application) requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var input requestPasswordResetRequest
+
+	// Parse the request body
+	err := app.parseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.userService.RequestPasswordReset(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "an email will be sent to you containing password reset instructions"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (app *application) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input resetPasswordRequest
+
+	// Parse the request body
+	err := app.parseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.userService.ResetPassword(r.Context(), input.Token, input.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.failedValidationErrorResponse(w, r, map[string]string{"token": "invalid or expired password reset token"})
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
 type loginUserRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -110,6 +232,8 @@ func (app *application) loginUserHandler(w http.ResponseWriter, r *http.Request)
 			app.invalidCredentialsErrorResponse(w, r)
 		case errors.Is(err, userservice.ErrAuthenticationFailure):
 			app.invalidCredentialsErrorResponse(w, r)
+		case errors.Is(err, userservice.ErrAccountSuspended):
+			app.accountSuspendedResponse(w, r)
 		case errors.As(err, &common.ValidationError{}):
 			validationErr := err.(common.ValidationError)
 			app.failedValidationErrorResponse(w, r, validationErr.Errors)
@@ -144,13 +268,31 @@ func (app *application) logoutUserHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
-type createBlogRequest struct {
-	Title   string `json:"title"`
-	Content string `json:"content"`
+func (app *application) getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	prefs, err := app.userService.GetNotificationPreferences(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"notifications": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 }
 
-func (app *application) createBlogHandler(w http.ResponseWriter, r *http.Request) {
-	var input createBlogRequest
+// updateNotificationPreferencesRequest holds the preferences to change, those left out are kept.
+type updateNotificationPreferencesRequest struct {
+	Comments  *bool                  `json:"comments"`
+	NewPosts  *bool                  `json:"new_posts"`
+	Frequency *userservice.Frequency `json:"frequency"`
+}
+
+func (app *application) updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	var input updateNotificationPreferencesRequest
 
 	// Parse the request body
 	err := app.parseJSON(w, r, &input)
@@ -159,45 +301,42 @@ func (app *application) createBlogHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// get the user from the context
 	user := app.getUserContext(r)
 
-	req := &blogservice.CreateBlogRequest{
-		Title:   input.Title,
-		Content: input.Content,
-		UserID:  user.ID,
-	}
-
-	// Call the blog service
-	err = app.blogService.CreateBlog(r.Context(), req)
+	prefs, err := app.userService.UpdateNotificationPreferences(r.Context(), user.ID, userservice.NotificationPreferencesUpdate{
+		Comments:  input.Comments,
+		NewPosts:  input.NewPosts,
+		Frequency: input.Frequency,
+	})
 	if err != nil {
 		switch {
 		case errors.As(err, &common.ValidationError{}):
 			validationErr := err.(common.ValidationError)
 			app.failedValidationErrorResponse(w, r, validationErr.Errors)
-		case errors.Is(err, blogservice.ErrUserForeignKey):
-			app.unAuthorizedErrorResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"message": "blog created"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"notifications": prefs}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) getBlogHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r, "id")
+// followUserHandler makes the user follow the author, whose new posts are then listed in the user's digest. Following an author twice is not an error.
+func (app *application) followUserHandler(w http.ResponseWriter, r *http.Request) {
+	authorId, err := app.readIDParam(r, "userid")
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
-	blog, err := app.blogService.GetBlogByID(r.Context(), id)
+	user := app.getUserContext(r)
+
+	err = app.userService.FollowUser(r.Context(), user.ID, authorId)
 	if err != nil {
 		switch {
 		case errors.Is(err, common.ErrRecordNotFound):
@@ -211,30 +350,15 @@ func (app *application) getBlogHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"blog": blog}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user followed"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-type updateBlogRequest struct {
-	Title   string `json:"title"`
-	Content string `json:"content"`
-}
-
-func (app *application) updateBlogHandler(w http.ResponseWriter, r *http.Request) {
-	var input updateBlogRequest
-
-	// id is a URL parameter
-	id, err := app.readIDParam(r, "id")
-	if err != nil {
-		app.badRequestErrorResponse(w, r, err)
-		return
-	}
-
-	// Parse the request body
-	err = app.parseJSON(w, r, &input)
+func (app *application) unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
+	authorId, err := app.readIDParam(r, "userid")
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
@@ -242,29 +366,46 @@ func (app *application) updateBlogHandler(w http.ResponseWriter, r *http.Request
 
 	user := app.getUserContext(r)
 
-	// get the blog from the database
-	dbBlog, err := app.blogService.GetBlogByID(r.Context(), id)
+	err = app.userService.UnfollowUser(r.Context(), user.ID, authorId)
 	if err != nil {
 		switch {
 		case errors.Is(err, common.ErrRecordNotFound):
 			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	if dbBlog.User.ID != user.ID {
-		app.unAuthorizedErrorResponse(w, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user unfollowed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
 
-	// Call the blog service
-	err = app.blogService.UpdateBlog(r.Context(), input.Title, input.Content, &dbBlog.ID, &user.ID, &dbBlog.Version)
+// getNotificationsHandler returns a page of the in-app notifications of the user, newest first, with the number of unread notifications. The next page is requested with the cursor query parameter set to the next_cursor of the page, which is left out on the last page.
+func (app *application) getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := notificationservice.DefaultPageSize
+	if query.Get("limit") != "" {
+		l, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			app.badRequestErrorResponse(w, r, errors.New("invalid limit parameter"))
+			return
+		}
+		limit = l
+	}
+
+	user := app.getUserContext(r)
+
+	page, err := app.notificationService.GetNotifications(r.Context(), user.ID, query.Get("cursor"), limit)
 	if err != nil {
 		switch {
-		case errors.Is(err, common.ErrRecordNotFound):
-			app.notFoundErrorResponse(w, r)
 		case errors.As(err, &common.ValidationError{}):
 			validationErr := err.(common.ValidationError)
 			app.failedValidationErrorResponse(w, r, validationErr.Errors)
@@ -274,119 +415,170 @@ func (app *application) updateBlogHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "blog updated"}, nil)
+	data := envelope{"notifications": page.Notifications, "unread_count": page.UnreadCount}
+	if page.NextCursor != "" {
+		data["next_cursor"] = page.NextCursor
+	}
+
+	err = app.writeJSON(w, http.StatusOK, data, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) deleteBlogHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) markNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r, "id")
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
-	dbBlog, err := app.blogService.GetBlogByID(r.Context(), id)
+	user := app.getUserContext(r)
+
+	err = app.notificationService.MarkRead(r.Context(), user.ID, int64(id))
 	if err != nil {
 		switch {
 		case errors.Is(err, common.ErrRecordNotFound):
 			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	user := app.getUserContext(r)
-
-	if dbBlog.User.ID != user.ID {
-		app.unAuthorizedErrorResponse(w, r)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "notification marked as read"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
+}
 
-	// Call the blog service
-	err = app.blogService.DeleteBlog(r.Context(), id, user.ID)
+func (app *application) markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	n, err := app.notificationService.MarkAllRead(r.Context(), user.ID)
 	if err != nil {
 		switch {
-		case errors.Is(err, common.ErrRecordNotFound):
-			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "blog deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "notifications marked as read", "marked": n}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) getAllBlogsHandler(w http.ResponseWriter, r *http.Request) {
-	// get the limit and offset query parameters
-	limit, offset, err := app.readLimitOffsetParams(r)
+// unsubscribePageHandler serves the page the unsubscribe link in a notification email opens. Like the activation page it asks for a confirmation, so a mail scanner following the link does not unsubscribe the user.
+func (app *application) unsubscribePageHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	_, kind, err := mailservice.ParseUnsubscribeToken(app.signer, token)
 	if err != nil {
-		app.badRequestErrorResponse(w, r, err)
+		app.renderPage(w, r, http.StatusBadRequest, "unsubscribe_failed", nil)
 		return
 	}
 
-	blogs, err := app.blogService.GetBlogs(r.Context(), limit, offset)
+	app.renderPage(w, r, http.StatusOK, "unsubscribe", map[string]string{"Token": token, "Kind": kind})
+}
+
+// unsubscribeHandler unsubscribes the user when the form of the unsubscribe page is submitted, and when a mail client posts to the link of the List-Unsubscribe header, in which case the token is in the query string.
+func (app *application) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+
+	err := r.ParseForm()
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.renderPage(w, r, http.StatusBadRequest, "unsubscribe_failed", nil)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"blogs": blogs}, nil)
+	userID, kind, err := mailservice.ParseUnsubscribeToken(app.signer, r.Form.Get("token"))
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		app.renderPage(w, r, http.StatusBadRequest, "unsubscribe_failed", nil)
 		return
 	}
-}
 
-func (app *application) searchBlogsHandler(w http.ResponseWriter, r *http.Request) {
-	title, err := app.readStringParam(r, "q")
+	err = app.userService.Unsubscribe(r.Context(), userID, kind)
 	if err != nil {
-		app.badRequestErrorResponse(w, r, err)
-		return
+		switch {
+		// A user that no longer exists does not receive any email either.
+		case errors.Is(err, common.ErrRecordNotFound):
+		case errors.As(err, &common.ValidationError{}):
+			app.renderPage(w, r, http.StatusBadRequest, "unsubscribe_failed", nil)
+			return
+		default:
+			app.serverErrorPage(w, r, err)
+			return
+		}
 	}
 
-	// get the limit and offset query parameters
-	limit, offset, err := app.readLimitOffsetParams(r)
+	app.renderPage(w, r, http.StatusOK, "unsubscribed", map[string]string{"Kind": kind})
+}
+
+type createBlogRequest struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+func (app *application) createBlogHandler(w http.ResponseWriter, r *http.Request) {
+	var input createBlogRequest
+
+	// Parse the request body
+	err := app.parseJSON(w, r, &input)
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
-	blogs, err := app.blogService.GetBlogsByTitle(r.Context(), title, limit, offset)
+	// get the user from the context
+	user := app.getUserContext(r)
+
+	req := &blogservice.CreateBlogRequest{
+		Title:   input.Title,
+		Content: input.Content,
+		UserID:  user.ID,
+	}
+
+	// Call the blog service
+	err = app.blogService.CreateBlog(r.Context(), req)
 	if err != nil {
 		switch {
 		case errors.As(err, &common.ValidationError{}):
 			validationErr := err.(common.ValidationError)
 			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		case errors.Is(err, blogservice.ErrUserForeignKey):
+			app.unAuthorizedErrorResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"blogs": blogs}, nil)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"message": "blog created"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 }
 
-func (app *application) getBlogsByUserIdHandler(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r, "userid")
+func (app *application) getBlogHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
 	if err != nil {
 		app.badRequestErrorResponse(w, r, err)
 		return
 	}
 
-	blogs, err := app.blogService.GetBlogsByUserId(r.Context(), id)
+	blog, err := app.blogService.GetBlogByID(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, common.ErrRecordNotFound):
@@ -400,7 +592,563 @@ func (app *application) getBlogsByUserIdHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"blogs": blogs}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"blog": blog}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+type updateBlogRequest struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+func (app *application) updateBlogHandler(w http.ResponseWriter, r *http.Request) {
+	var input updateBlogRequest
+
+	// id is a URL parameter
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	// Parse the request body
+	err = app.parseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	// get the blog from the database
+	dbBlog, err := app.blogService.GetBlogByID(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if dbBlog.User.ID != user.ID {
+		app.unAuthorizedErrorResponse(w, r)
+		return
+	}
+
+	// Call the blog service
+	err = app.blogService.UpdateBlog(r.Context(), input.Title, input.Content, &dbBlog.ID, &user.ID, &dbBlog.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "blog updated"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) deleteBlogHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	dbBlog, err := app.blogService.GetBlogByID(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	if dbBlog.User.ID != user.ID {
+		app.unAuthorizedErrorResponse(w, r)
+		return
+	}
+
+	// Call the blog service
+	err = app.blogService.DeleteBlog(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "blog deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getAllBlogsHandler(w http.ResponseWriter, r *http.Request) {
+	// get the limit and offset query parameters
+	limit, offset, err := app.readLimitOffsetParams(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	blogs, err := app.blogService.GetBlogs(r.Context(), limit, offset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"blogs": blogs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) searchBlogsHandler(w http.ResponseWriter, r *http.Request) {
+	title, err := app.readStringParam(r, "q")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	// get the limit and offset query parameters
+	limit, offset, err := app.readLimitOffsetParams(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	blogs, err := app.blogService.GetBlogsByTitle(r.Context(), title, limit, offset)
+	if err != nil {
+		switch {
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"blogs": blogs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getBlogsByUserIdHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "userid")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	blogs, err := app.blogService.GetBlogsByUserId(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"blogs": blogs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+type deadLetterResponse struct {
+	Exchange   common.Exchange   `json:"exchange"`
+	RoutingKey common.BindingKey `json:"routing_key"`
+	Headers    map[string]any    `json:"headers"`
+	Body       string            `json:"body"`
+	Timestamp  time.Time         `json:"timestamp"`
+}
+
+// defaultDeadLetterLimit is the number of dead letters listed or replayed when no limit is given.
+const defaultDeadLetterLimit = 20
+
+// readDeadLetterQueue returns the dead letter queue named by the queue parameter, the one of user.created by default.
+func readDeadLetterQueue(r *http.Request) (common.Queue, error) {
+	queue := common.Queue(r.URL.Query().Get("queue"))
+	if queue == "" {
+		return common.UserCreatedDLQ, nil
+	}
+
+	if !slices.Contains(common.DeadLetterQueues, queue) {
+		return "", fmt.Errorf("unknown dead letter queue %q", queue)
+	}
+
+	return queue, nil
+}
+
+func (app *application) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _, err := app.readLimitOffsetParams(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+	if limit <= 0 {
+		limit = defaultDeadLetterLimit
+	}
+
+	queue, err := readDeadLetterQueue(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	messages, err := app.broker.Peek(queue, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	deadLetters := make([]deadLetterResponse, len(messages))
+	for i, m := range messages {
+		deadLetters[i] = deadLetterResponse{
+			Exchange:   m.Exchange,
+			RoutingKey: m.RoutingKey,
+			Headers:    m.Headers,
+			Body:       string(m.Body),
+			Timestamp:  m.Timestamp,
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"dead_letters": deadLetters}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) replayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	limit, _, err := app.readLimitOffsetParams(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+	if limit <= 0 {
+		limit = defaultDeadLetterLimit
+	}
+
+	queue, err := readDeadLetterQueue(r)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	replayed, err := app.broker.Replay(r.Context(), queue, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"replayed": replayed}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// createWebhookHandler registers a webhook endpoint of the user. The signing secret of the endpoint is only returned here. Only admins can subscribe an endpoint to the events of every user.
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input webhookservice.CreateEndpointRequest
+
+	err := app.parseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	if input.AllUsers && !user.HasPermission(userservice.PermissionAdmin) {
+		app.unAuthorizedErrorResponse(w, r)
+		return
+	}
+
+	input.UserID = user.ID
+
+	endpoint, err := app.webhooks.CreateEndpoint(r.Context(), &input)
+	if err != nil {
+		switch {
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": endpoint, "secret": endpoint.Secret}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	endpoints, err := app.webhooks.GetEndpoints(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": endpoints}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	endpoint, err := app.webhooks.GetEndpoint(r.Context(), user.ID, int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": endpoint}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// updateWebhookHandler changes the URL, the events or the state of a webhook endpoint. Enabling an endpoint that was disabled after failing clears its failures.
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input webhookservice.UpdateEndpointRequest
+
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.parseJSON(w, r, &input)
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	endpoint, err := app.webhooks.UpdateEndpoint(r.Context(), user.ID, int64(id), &input)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": endpoint}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	err = app.webhooks.DeleteEndpoint(r.Context(), user.ID, int64(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// getWebhookDeliveriesHandler returns the latest deliveries of a webhook endpoint, newest first. The limit query parameter sets how many.
+func (app *application) getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	limit := webhookservice.DefaultDeliveriesLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			app.badRequestErrorResponse(w, r, errors.New("invalid limit parameter"))
+			return
+		}
+	}
+
+	user := app.getUserContext(r)
+
+	deliveries, err := app.webhooks.GetDeliveries(r.Context(), user.ID, int64(id), limit)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// getWebhookDeliveryHandler returns a delivery together with its log of attempts.
+func (app *application) getWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	deliveryId, err := app.readIDParam(r, "delivery")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	delivery, attempts, err := app.webhooks.GetDelivery(r.Context(), user.ID, int64(id), int64(deliveryId))
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"delivery": delivery, "attempts": attempts}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+}
+
+// redeliverWebhookHandler sends a delivery that succeeded or failed again.
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r, "id")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	deliveryId, err := app.readIDParam(r, "delivery")
+	if err != nil {
+		app.badRequestErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.getUserContext(r)
+
+	err = app.webhooks.Redeliver(r.Context(), user.ID, int64(id), int64(deliveryId))
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			app.notFoundErrorResponse(w, r)
+		case errors.As(err, &common.ValidationError{}):
+			validationErr := err.(common.ValidationError)
+			app.failedValidationErrorResponse(w, r, validationErr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "delivery queued"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/mailservice"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
 	"github.com/sushihentaime/blogist/internal/userservice"
+	"github.com/sushihentaime/blogist/internal/webhookservice"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -306,6 +320,26 @@ func TestLogoutUserHandler(t *testing.T) {
 	}
 }
 
+func TestLogoutRejectsToken(t *testing.T) {
+	app, db := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+
+	token, _, err := createTestUser(app, db, &userservice.User{Username: "testuser", Email: "testuser@example.com"})
+	assert.NoError(t, err)
+
+	// authenticate once so that the session is cached
+	status, _, _ := ts.post(t, "/api/v1/blogs/create", map[string]any{"title": "Test Blog", "content": "This is a test blog."}, token)
+	assert.Equal(t, http.StatusCreated, status)
+
+	status, _, _ = ts.delete(t, "/api/v1/users/logout", token)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _, gotBody := ts.post(t, "/api/v1/blogs/create", map[string]any{"title": "Test Blog", "content": "This is a test blog."}, token)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.JSONEq(t, envelope{"error": "invalid or missing authentication token"}.JSON(), gotBody.JSON())
+}
+
 func createTestUser(app *application, db *sql.DB, u *userservice.User) (*string, *int, error) {
 	// set the password for the test user
 	b, err := bcrypt.GenerateFromPassword([]byte("Test_1234!"), bcrypt.DefaultCost)
@@ -920,3 +954,677 @@ func TestConcurrentGetAndUpdate(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestDeadLettersHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+
+	token, _, err := createTestUser(app, db, &userservice.User{Username: "testuser", Email: "testuser@example.com"})
+	assert.NoError(t, err)
+
+	// only admins may inspect the dead letters
+	status, _, gotBody := ts.get(t, "/api/v1/admin/dead-letters", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.JSONEq(t, envelope{"error": "unauthorized access"}.JSON(), gotBody.JSON())
+
+	token, userId, err := createTestUser(app, db, &userservice.User{Username: "adminuser", Email: "adminuser@example.com"})
+	assert.NoError(t, err)
+
+	_, err = db.Exec("INSERT INTO user_permissions (user_id, permission) VALUES ($1, $2)", *userId, string(userservice.PermissionAdmin))
+	assert.NoError(t, err)
+
+	status, _, gotBody = ts.get(t, "/api/v1/admin/dead-letters", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, envelope{"dead_letters": []any{}}.JSON(), gotBody.JSON())
+
+	status, _, gotBody = ts.post(t, "/api/v1/admin/dead-letters/replay", nil, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, envelope{"replayed": 0}.JSON(), gotBody.JSON())
+
+	// The other dead letter queues are selected by name.
+	headers := map[string]any{"x-death": []any{map[string]any{"exchange": string(common.UserExchange), "routing-keys": []any{string(common.UserPasswordResetKey)}, "reason": "rejected"}}}
+	err = app.broker.Publish(context.Background(), []byte("reset"), common.UserPasswordResetKey, common.DeadLetterExchange, common.WithHeaders(headers))
+	assert.NoError(t, err)
+
+	status, _, gotBody = ts.get(t, "/api/v1/admin/dead-letters?queue=user_password_reset_dlq", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	var list struct {
+		DeadLetters []deadLetterResponse `json:"dead_letters"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(gotBody.JSON()), &list))
+	if assert.Len(t, list.DeadLetters, 1) {
+		assert.Equal(t, "reset", list.DeadLetters[0].Body)
+	}
+
+	status, _, gotBody = ts.get(t, "/api/v1/admin/dead-letters", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, envelope{"dead_letters": []any{}}.JSON(), gotBody.JSON())
+
+	status, _, gotBody = ts.post(t, "/api/v1/admin/dead-letters/replay?queue=user_password_reset_dlq", nil, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, envelope{"replayed": 1}.JSON(), gotBody.JSON())
+
+	status, _, gotBody = ts.get(t, "/api/v1/admin/dead-letters?queue=user_created_queue", token, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, envelope{"error": `unknown dead letter queue "user_created_queue"`}.JSON(), gotBody.JSON())
+}
+
+func TestPasswordResetHandler(t *testing.T) {
+	app, db, transport := newTestApplicationWithMail(t)
+	ts := newTestServer(t, app.routes())
+
+	// Deliver the emails end to end, from the outbox to the mail transport.
+	relay := common.NewOutboxRelay(db, app.broker, app.logger)
+	relay.Start()
+	t.Cleanup(relay.Close)
+	app.mailService.Start()
+	t.Cleanup(app.mailService.Close)
+
+	u := &userservice.User{Username: "testuser", Email: "testuser@example.com"}
+	_, _, err := createTestUser(app, db, u)
+	assert.NoError(t, err)
+
+	status, _, body := ts.post(t, "/api/v1/users/password-reset", map[string]any{"email": "unknown@example.com"}, nil)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.JSONEq(t, envelope{"message": "an email will be sent to you containing password reset instructions"}.JSON(), body.JSON())
+
+	status, _, _ = ts.post(t, "/api/v1/users/password-reset", map[string]any{"email": u.Email}, nil)
+	assert.Equal(t, http.StatusAccepted, status)
+
+	msg := transport.AssertSent(t, u.Email, 5*time.Second)
+	if !assert.NotNil(t, msg) {
+		return
+	}
+	assert.Equal(t, "Reset your Blogist password", msg.Subject)
+	transport.AssertNotSent(t, "unknown@example.com")
+
+	match := regexp.MustCompile(`"token": "([A-Z2-7]{26})"`).FindStringSubmatch(msg.PlainBody)
+	if !assert.Len(t, match, 2) {
+		return
+	}
+
+	status, _, body = ts.put(t, "/api/v1/users/password", nil, map[string]any{"token": match[1], "password": "New_1234!"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, envelope{"message": "your password was successfully reset"}.JSON(), body.JSON())
+
+	status, _, body = ts.put(t, "/api/v1/users/password", nil, map[string]any{"token": match[1], "password": "Other_1234!"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.JSONEq(t, envelope{"error": map[string]string{"token": "invalid or expired password reset token"}}.JSON(), body.JSON())
+
+	status, _, _ = ts.post(t, "/api/v1/users/login", map[string]any{"username": u.Username, "password": "New_1234!"}, nil)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestActivationPage(t *testing.T) {
+	app, db, transport := newTestApplicationWithMail(t)
+	ts := newTestServer(t, app.routes())
+
+	relay := common.NewOutboxRelay(db, app.broker, app.logger)
+	relay.Start()
+	t.Cleanup(relay.Close)
+	app.mailService.Start()
+	t.Cleanup(app.mailService.Close)
+
+	status, _, _ := ts.post(t, "/api/v1/users/register", map[string]any{"username": "testuser", "email": "testuser@example.com", "password": "Test_1234!"}, nil)
+	assert.Equal(t, http.StatusCreated, status)
+
+	msg := transport.AssertSent(t, "testuser@example.com", 5*time.Second)
+	if !assert.NotNil(t, msg) {
+		return
+	}
+
+	match := regexp.MustCompile(`/activate\?token=([A-Z2-7]{26})`).FindStringSubmatch(msg.PlainBody)
+	if !assert.Len(t, match, 2) {
+		return
+	}
+	assert.Contains(t, msg.HTMLBody, `href="`+publicBaseURL(app.config)+match[0]+`"`)
+
+	page := func(res *http.Response, err error) (int, string) {
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+		assert.Contains(t, res.Header.Get("Content-Security-Policy"), "form-action 'self'")
+
+		return res.StatusCode, string(body)
+	}
+
+	// Opening the link only shows the confirmation form.
+	status, body := page(http.Get(ts.URL + match[0]))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `<form method="post">`)
+	assert.Contains(t, body, `value="`+match[1]+`"`)
+
+	status, body = page(http.PostForm(ts.URL+"/activate", url.Values{"token": {match[1]}}))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Your account is active")
+
+	status, _, _ = ts.post(t, "/api/v1/users/login", map[string]any{"username": "testuser", "password": "Test_1234!"}, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	// The link can only be used once.
+	for _, res := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return http.Get(ts.URL + match[0]) },
+		func() (*http.Response, error) {
+			return http.PostForm(ts.URL+"/activate", url.Values{"token": {match[1]}})
+		},
+	} {
+		status, body = page(res())
+		assert.Equal(t, http.StatusNotFound, status)
+		assert.Contains(t, body, "This link does not work")
+	}
+
+	status, body = page(http.Get(ts.URL + "/activate?token=invalid"))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "This link does not work")
+}
+
+func TestNotificationPreferencesHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token, _, err := createTestUser(app, db, &userservice.User{Username: "testuser", Email: "testuser@example.com"})
+	assert.NoError(t, err)
+
+	status, _, _ := ts.get(t, "/api/v1/users/me/notifications", nil, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _, body := ts.get(t, "/api/v1/users/me/notifications", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	prefs := body["notifications"].(map[string]any)
+	assert.Equal(t, true, prefs["comments"])
+	assert.Equal(t, true, prefs["new_posts"])
+	assert.Equal(t, "instant", prefs["frequency"])
+
+	status, _, body = ts.put(t, "/api/v1/users/me/notifications", token, map[string]any{"frequency": "monthly"})
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.JSONEq(t, envelope{"error": map[string]string{"frequency": "must be instant, daily, weekly or off"}}.JSON(), body.JSON())
+
+	// The preferences left out are kept.
+	status, _, body = ts.put(t, "/api/v1/users/me/notifications", token, map[string]any{"comments": false, "frequency": "daily"})
+	assert.Equal(t, http.StatusOK, status)
+	prefs = body["notifications"].(map[string]any)
+	assert.Equal(t, false, prefs["comments"])
+	assert.Equal(t, true, prefs["new_posts"])
+	assert.Equal(t, "daily", prefs["frequency"])
+
+	status, _, body = ts.get(t, "/api/v1/users/me/notifications", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "daily", body["notifications"].(map[string]any)["frequency"])
+}
+
+func TestFollowHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token, userID, err := createTestUser(app, db, &userservice.User{Username: "reader", Email: "reader@example.com"})
+	assert.NoError(t, err)
+	_, authorID, err := createTestUser(app, db, &userservice.User{Username: "writer", Email: "writer@example.com"})
+	assert.NoError(t, err)
+
+	path := fmt.Sprintf("/api/v1/follows/%d", *authorID)
+
+	status, _, _ := ts.post(t, path, nil, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// Following twice is harmless.
+	for range 2 {
+		status, _, body := ts.post(t, path, nil, token)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "user followed", body["message"])
+	}
+
+	authors, err := app.userService.GetFollowedAuthors(context.Background(), *userID)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{*authorID}, authors)
+
+	status, _, body := ts.post(t, fmt.Sprintf("/api/v1/follows/%d", *userID), nil, token)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.JSONEq(t, envelope{"error": map[string]string{"user_id": "cannot follow yourself"}}.JSON(), body.JSON())
+
+	status, _, _ = ts.post(t, "/api/v1/follows/999999", nil, token)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _, body = ts.delete(t, path, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "user unfollowed", body["message"])
+
+	status, _, _ = ts.delete(t, path, token)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestNotificationsHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token, userID, err := createTestUser(app, db, &userservice.User{Username: "writer", Email: "writer@example.com"})
+	assert.NoError(t, err)
+	otherToken, _, err := createTestUser(app, db, &userservice.User{Username: "reader", Email: "reader@example.com"})
+	assert.NoError(t, err)
+
+	status, _, _ := ts.get(t, "/api/v1/notifications", nil, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	// The follows are published straight to the broker, the outbox relay does not run in the tests.
+	for i := range 3 {
+		body, err := json.Marshal(map[string]any{"UserID": *userID, "FollowerID": i + 100, "FollowerUsername": fmt.Sprintf("follower%d", i), "At": time.Now()})
+		assert.NoError(t, err)
+		assert.NoError(t, app.broker.Publish(context.Background(), body, common.UserFollowedKey, common.UserExchange))
+	}
+
+	app.notificationService.Start()
+
+	assert.Eventually(t, func() bool {
+		_, _, body := ts.get(t, "/api/v1/notifications", token, nil)
+		count, _ := body["unread_count"].(float64)
+		return count == 3
+	}, 5*time.Second, 50*time.Millisecond)
+
+	status, _, body := ts.get(t, "/api/v1/notifications?limit=2", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	notifications := body["notifications"].([]any)
+	assert.Len(t, notifications, 2)
+	first := notifications[0].(map[string]any)
+	assert.Equal(t, "new_follower", first["kind"])
+	assert.Equal(t, "follower2", first["data"].(map[string]any)["follower_username"])
+	cursor := body["next_cursor"].(string)
+
+	status, _, body = ts.get(t, "/api/v1/notifications?limit=2&cursor="+cursor, token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, body["notifications"].([]any), 1)
+	assert.NotContains(t, body, "next_cursor")
+
+	status, _, _ = ts.get(t, "/api/v1/notifications?cursor=bogus", token, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	id := int(first["id"].(float64))
+	status, _, _ = ts.put(t, fmt.Sprintf("/api/v1/notifications/read/%d", id), otherToken, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _, _ = ts.put(t, fmt.Sprintf("/api/v1/notifications/read/%d", id), token, nil)
+	assert.Equal(t, http.StatusOK, status)
+
+	status, _, body = ts.get(t, "/api/v1/notifications", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(2), body["unread_count"])
+
+	status, _, body = ts.put(t, "/api/v1/notifications/read-all", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(2), body["marked"])
+
+	status, _, body = ts.get(t, "/api/v1/notifications", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, float64(0), body["unread_count"])
+}
+
+func TestStreamHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token, userID, err := createTestUser(app, db, &userservice.User{Username: "writer", Email: "writer@example.com"})
+	assert.NoError(t, err)
+
+	status, _, _ := ts.get(t, "/api/v1/stream", nil, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	assert.NoError(t, app.streams.Start())
+	app.notificationService.Start()
+
+	// open connects to the stream and returns the lines of its events, without the blank lines between them.
+	open := func(lastEventID string) (<-chan string, func()) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/stream", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+*token)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(res.Body)
+			for scanner.Scan() {
+				if scanner.Text() != "" {
+					lines <- scanner.Text()
+				}
+			}
+		}()
+
+		return lines, func() { res.Body.Close() }
+	}
+
+	next := func(lines <-chan string) string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("no line received")
+			return ""
+		}
+	}
+
+	lines, closeStream := open("")
+	assert.Equal(t, "retry: 3000", next(lines))
+	readyID := strings.TrimPrefix(next(lines), "id: ")
+	assert.Equal(t, "event: ready", next(lines))
+	assert.Equal(t, `data: {"truncated":false}`, next(lines))
+
+	body, err := json.Marshal(map[string]any{"UserID": *userID, "FollowerID": 100, "FollowerUsername": "follower", "At": time.Now()})
+	assert.NoError(t, err)
+	assert.NoError(t, app.broker.Publish(context.Background(), body, common.UserFollowedKey, common.UserExchange))
+
+	id := next(lines)
+	assert.True(t, strings.HasPrefix(id, "id: "))
+	assert.Equal(t, "event: notification", next(lines))
+	assert.Contains(t, next(lines), `"follower_username":"follower"`)
+	closeStream()
+
+	// Resuming after the ready event replays the notification.
+	lines, closeStream = open(readyID)
+	defer closeStream()
+	assert.Equal(t, "retry: 3000", next(lines))
+	assert.Equal(t, id, next(lines))
+	assert.Equal(t, "event: notification", next(lines))
+	next(lines)
+	assert.Equal(t, id, next(lines))
+	assert.Equal(t, "event: ready", next(lines))
+}
+
+func TestUnsubscribeHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token, userID, err := createTestUser(app, db, &userservice.User{Username: "testuser", Email: "testuser@example.com"})
+	assert.NoError(t, err)
+
+	unsubscribe := mailservice.UnsubscribeToken(app.signer, *userID, userservice.NotificationComments)
+
+	page := func(res *http.Response, err error) (int, string) {
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "text/html; charset=utf-8", res.Header.Get("Content-Type"))
+
+		return res.StatusCode, string(body)
+	}
+
+	// Opening the link only shows the confirmation form.
+	status, body := page(http.Get(ts.URL + "/unsubscribe?token=" + unsubscribe))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "emails about the comments on your posts")
+	assert.Contains(t, body, `<form method="post">`)
+
+	status, _, got := ts.get(t, "/api/v1/users/me/notifications", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, got["notifications"].(map[string]any)["comments"])
+
+	// A mail client posts to the link of the List-Unsubscribe header.
+	status, body = page(http.Post(ts.URL+"/unsubscribe?token="+unsubscribe, "application/x-www-form-urlencoded", strings.NewReader("List-Unsubscribe=One-Click")))
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "You are unsubscribed")
+
+	status, _, got = ts.get(t, "/api/v1/users/me/notifications", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, false, got["notifications"].(map[string]any)["comments"])
+	assert.Equal(t, true, got["notifications"].(map[string]any)["new_posts"])
+
+	// The confirmation form unsubscribes too, and doing it twice is harmless.
+	status, _ = page(http.PostForm(ts.URL+"/unsubscribe", url.Values{"token": {unsubscribe}}))
+	assert.Equal(t, http.StatusOK, status)
+
+	other, err := common.NewSigner(bytes.Repeat([]byte("o"), 32))
+	assert.NoError(t, err)
+	forged := mailservice.UnsubscribeToken(other, *userID, userservice.NotificationNewPosts)
+
+	status, body = page(http.Get(ts.URL + "/unsubscribe?token=" + forged))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "This link does not work")
+
+	status, _ = page(http.PostForm(ts.URL+"/unsubscribe", url.Values{"token": {forged}}))
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestWebhooksHandler(t *testing.T) {
+	app, db := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+
+	token, _, err := createTestUser(app, db, &userservice.User{Username: "writer", Email: "writer@example.com"})
+	assert.NoError(t, err)
+	otherToken, _, err := createTestUser(app, db, &userservice.User{Username: "reader", Email: "reader@example.com"})
+	assert.NoError(t, err)
+
+	received := make(chan *http.Request, 10)
+	receiver := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+
+	status, _, _ := ts.post(t, "/api/v1/webhooks", map[string]any{"url": receiver.URL}, nil)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, _, _ = ts.post(t, "/api/v1/webhooks", map[string]any{"url": receiver.URL, "events": []string{"blog.published"}, "all_users": true}, token)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _, body := ts.post(t, "/api/v1/webhooks", map[string]any{"url": "ftp://example.com", "events": []string{"comment.created"}}, token)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	assert.Contains(t, body["error"], "url")
+	assert.Contains(t, body["error"], "events")
+
+	status, _, body = ts.post(t, "/api/v1/webhooks", map[string]any{"url": receiver.URL, "events": []string{"blog.published"}}, token)
+	assert.Equal(t, http.StatusCreated, status)
+	secret, _ := body["secret"].(string)
+	assert.NotEmpty(t, secret)
+	webhook := body["webhook"].(map[string]any)
+	assert.NotContains(t, webhook, "secret")
+	path := fmt.Sprintf("/api/v1/webhooks/%d", int(webhook["id"].(float64)))
+
+	status, _, body = ts.get(t, "/api/v1/webhooks", token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, body["webhooks"], 1)
+
+	status, _, _ = ts.get(t, path, otherToken, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// The blog events and the deliveries both go through the outbox.
+	app.outboxRelay = common.NewOutboxRelay(db, app.broker, app.logger)
+	app.outboxRelay.Start()
+	t.Cleanup(app.outboxRelay.Close)
+	app.webhooks.Start()
+
+	status, _, _ = ts.post(t, "/api/v1/blogs/create", map[string]any{"title": "Test Blog", "content": "This is a test blog."}, token)
+	assert.Equal(t, http.StatusCreated, status)
+
+	select {
+	case r := <-received:
+		assert.Equal(t, "blog.published", r.Header.Get(webhookservice.EventHeader))
+		assert.True(t, strings.HasPrefix(r.Header.Get(webhookservice.SignatureHeader), "sha256="))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the webhook was not delivered")
+	}
+
+	var deliveries []any
+	assert.Eventually(t, func() bool {
+		_, _, body := ts.get(t, path+"/deliveries", token, nil)
+		deliveries, _ = body["deliveries"].([]any)
+		return len(deliveries) == 1 && deliveries[0].(map[string]any)["status"] == "succeeded"
+	}, 5*time.Second, 50*time.Millisecond)
+	if !assert.Len(t, deliveries, 1) {
+		return
+	}
+	deliveryPath := fmt.Sprintf("%s/deliveries/%d", path, int(deliveries[0].(map[string]any)["id"].(float64)))
+
+	status, _, body = ts.get(t, deliveryPath, token, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, body["attempts"], 1)
+
+	status, _, body = ts.post(t, deliveryPath+"/redeliver", nil, token)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "delivery queued", body["message"])
+
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the webhook was not redelivered")
+	}
+
+	status, _, body = ts.put(t, path, token, map[string]any{"enabled": false})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, false, body["webhook"].(map[string]any)["enabled"])
+
+	status, _, body = ts.delete(t, path, token)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "webhook deleted", body["message"])
+
+	status, _, _ = ts.get(t, path, token, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestActivationTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := newTracerProvider(&Config{TraceSampleRatio: 1}, exporter)
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	installTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	app, db, transport := newTestApplicationWithMail(t)
+	ts := newTestServer(t, app.routes())
+
+	relay := common.NewOutboxRelay(db, app.broker, app.logger)
+	relay.Start()
+	t.Cleanup(relay.Close)
+	app.mailService.Start()
+	t.Cleanup(app.mailService.Close)
+
+	status, _, _ := ts.post(t, "/api/v1/users/register", map[string]any{"username": "testuser", "email": "testuser@example.com", "password": "Test_1234!"}, nil)
+	assert.Equal(t, http.StatusCreated, status)
+
+	transport.AssertSent(t, "testuser@example.com", 5*time.Second)
+
+	// The request, its queries, the publication by the relay and the email are one trace.
+	var request, mail tracetest.SpanStub
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, tp.ForceFlush(context.Background()))
+		for _, s := range exporter.GetSpans() {
+			switch s.Name {
+			case "POST /api/v1/users/register":
+				request = s
+			case string(common.UserCreatedQueue) + " process":
+				mail = s
+			}
+		}
+		return request.SpanContext.IsValid() && mail.SpanContext.IsValid()
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, request.SpanContext.TraceID(), mail.SpanContext.TraceID())
+
+	var queries int
+	for _, s := range exporter.GetSpans() {
+		if s.SpanContext.TraceID() == request.SpanContext.TraceID() && strings.HasPrefix(s.Name, "sql.") {
+			queries++
+		}
+	}
+	assert.Positive(t, queries)
+}
+
+func TestReadinessHandler(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	broker := common.NewMemoryBroker()
+	t.Cleanup(func() { broker.Close() })
+	assert.NoError(t, common.SetupUserExchange(broker))
+
+	// No event is published, so the notification store is never used.
+	app := &application{
+		config:              &Config{},
+		logger:              logger,
+		broker:              broker,
+		notificationService: notificationservice.NewNotificationService(notificationservice.NewPostgresStore(nil), broker, slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}
+	t.Cleanup(app.notificationService.Close)
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	probe := func(t *testing.T, path string) (int, map[string]any) {
+		res, err := http.Get(ts.URL + path)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		var body map[string]any
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+
+		return res.StatusCode, body
+	}
+
+	component := func(body map[string]any, name string) map[string]any {
+		components, _ := body["components"].(map[string]any)
+		c, _ := components[name].(map[string]any)
+		return c
+	}
+
+	// The consumers have not started yet.
+	code, body := probe(t, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", body["status"])
+	assert.Equal(t, "up", component(body, "broker")["status"])
+	assert.Equal(t, "down", component(body, "notification_consumers")["status"])
+
+	app.notificationService.Start()
+
+	code, body = probe(t, "/health/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", body["status"])
+	assert.Equal(t, "up", component(body, "notification_consumers")["status"])
+	assert.Contains(t, component(body, "broker"), "latency_ms")
+
+	// The consumers stop with the broker.
+	assert.NoError(t, broker.Close())
+	assert.Eventually(t, func() bool {
+		code, body := probe(t, "/health/ready")
+		return code == http.StatusServiceUnavailable && component(body, "notification_consumers")["status"] == "down"
+	}, time.Second, 10*time.Millisecond)
+
+	_, body = probe(t, "/health/ready")
+	assert.Equal(t, "down", component(body, "broker")["status"])
+	// The cause is logged, not returned.
+	assert.NotContains(t, component(body, "broker"), "error")
+	assert.Contains(t, logs.String(), "component=broker error=\"not connected\"")
+
+	// The probe fails during the shutdown, while the process is still alive.
+	app.shuttingDown.Store(true)
+	code, body = probe(t, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "shutting down", body["status"])
+
+	code, body = probe(t, "/health/live")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "alive", body["status"])
+}
+
+func TestRunCheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// A check that hangs fails once the probe times out.
+	hang := make(chan struct{})
+	defer close(hang)
+	err := runCheck(ctx, func(context.Context) error {
+		<-hang
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
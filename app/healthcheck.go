@@ -1,6 +1,18 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds each check of the readiness probe, so that a dependency that hangs fails the probe instead of holding it up.
+const readinessTimeout = 2 * time.Second
+
+var errBrokerDisconnected = errors.New("not connected")
 
 func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
@@ -13,7 +25,131 @@ func (app *application) healthCheckHandler(w http.ResponseWriter, r *http.Reques
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
 	if err != nil {
-		app.logger.Error(err.Error())
-		http.Error(w, "the server encountered a problem and could not process your request", http.StatusInternalServerError)
+		app.logError(r, err)
+		http.Error(w, serverErrorMessage, http.StatusInternalServerError)
+	}
+}
+
+// livenessHandler reports that the process serves requests. It checks no dependency, so that an outage of one does not get the container restarted.
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// healthCheck is a dependency the readiness probe checks.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// componentStatus is the result of a check of the readiness probe. The probe is public, so the error of a failed check is logged rather than returned.
+type componentStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// readinessChecks returns the checks of the dependencies the application was built with.
+func (app *application) readinessChecks() []healthCheck {
+	var checks []healthCheck
+
+	if app.db != nil {
+		checks = append(checks, healthCheck{"database", app.db.PingContext})
+	}
+	if app.broker != nil {
+		checks = append(checks, healthCheck{"broker", func(context.Context) error {
+			if !app.broker.Connected() {
+				return errBrokerDisconnected
+			}
+			return nil
+		}})
+	}
+
+	if app.mailService != nil {
+		checks = append(checks, consumerCheck("mail_consumers", app.mailService.Ready))
+	}
+	if app.notificationService != nil {
+		checks = append(checks, consumerCheck("notification_consumers", app.notificationService.Ready))
+	}
+	if app.webhooks != nil {
+		checks = append(checks, consumerCheck("webhook_consumers", app.webhooks.Ready))
+	}
+	if app.streams != nil {
+		checks = append(checks, consumerCheck("stream_consumer", app.streams.Ready))
+	}
+
+	return checks
+}
+
+// consumerCheck checks that the consumers of a service run.
+func consumerCheck(name string, ready func() error) healthCheck {
+	return healthCheck{name, func(context.Context) error { return ready() }}
+}
+
+// readinessHandler reports whether the application can serve traffic: the database answers, the broker is connected and the consumers run. Each component is reported with its status and the time its check took, the errors only go to the logs, and the probe fails with 503 when one of them is down. It fails as soon as the server starts shutting down, so that the proxy stops sending requests before the server stops accepting them.
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if app.shuttingDown.Load() {
+		err := app.writeJSON(w, http.StatusServiceUnavailable, envelope{"status": "shutting down"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	checks := app.readinessChecks()
+	results := make(map[string]componentStatus, len(checks))
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(ctx, c.check)
+			result := componentStatus{Status: "up", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = "down"
+				app.requestLogger(r).Warn("readiness check failed", slog.String("component", c.name), slog.String("error", err.Error()))
+			}
+
+			mu.Lock()
+			results[c.name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	status, code := "ready", http.StatusOK
+	for _, result := range results {
+		if result.Status != "up" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	err := app.writeJSON(w, code, envelope{"status": status, "components": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// runCheck returns the error of check, or the error of ctx when check does not return in time.
+func runCheck(ctx context.Context, check func(context.Context) error) error {
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// component is a part of the application that runs in the background between its start and its stop.
+type component struct {
+	name  string
+	start func() error
+	// stop returns once the work in progress is done, or with the error of ctx when it is cut short.
+	stop func(ctx context.Context) error
+}
+
+// lifecycle starts the components in the order they were added, each one after the components it depends on, and stops them in the reverse order.
+type lifecycle struct {
+	logger     *slog.Logger
+	components []component
+	// started is the number of components that were started, the first ones.
+	started int
+}
+
+func newLifecycle(logger *slog.Logger) *lifecycle {
+	return &lifecycle{logger: logger}
+}
+
+func (l *lifecycle) add(name string, start func() error, stop func(ctx context.Context) error) {
+	l.components = append(l.components, component{name: name, start: start, stop: stop})
+}
+
+// start starts the components. When one of them fails to start, the ones started before it are stopped within timeout and its error is returned.
+func (l *lifecycle) start(timeout time.Duration) error {
+	for _, c := range l.components[l.started:] {
+		err := c.start()
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			l.stop(ctx)
+
+			return fmt.Errorf("could not start the %s: %w", c.name, err)
+		}
+
+		l.logger.Info("started component", slog.String("component", c.name))
+		l.started++
+	}
+
+	return nil
+}
+
+// stop stops the started components in the reverse order. They share the deadline of ctx, a component that misses it is cut short and the next ones are still stopped.
+func (l *lifecycle) stop(ctx context.Context) error {
+	var errs []error
+
+	for ; l.started > 0; l.started-- {
+		c := l.components[l.started-1]
+
+		start := time.Now()
+		err := c.stop(ctx)
+		if err != nil {
+			l.logger.Error("could not stop component", slog.String("component", c.name), slog.Duration("duration", time.Since(start)), slog.String("error", err.Error()))
+			errs = append(errs, fmt.Errorf("could not stop the %s: %w", c.name, err))
+			continue
+		}
+
+		l.logger.Info("stopped component", slog.String("component", c.name), slog.Duration("duration", time.Since(start)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// noError adapts a start or stop that cannot fail.
+func noError(f func()) func() error {
+	return func() error {
+		f()
+		return nil
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycle(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var events []string
+	add := func(l *lifecycle, name string, startErr, stopErr error) {
+		l.add(name, func() error {
+			events = append(events, "start "+name)
+			return startErr
+		}, func(context.Context) error {
+			events = append(events, "stop "+name)
+			return stopErr
+		})
+	}
+
+	t.Run("stops in the reverse order", func(t *testing.T) {
+		events = nil
+		l := newLifecycle(logger)
+		add(l, "relay", nil, nil)
+		add(l, "consumers", nil, context.DeadlineExceeded)
+		add(l, "server", nil, nil)
+
+		assert.NoError(t, l.start(time.Second))
+
+		// A component that misses the deadline does not keep the others running.
+		err := l.stop(context.Background())
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorContains(t, err, "could not stop the consumers")
+
+		assert.Equal(t, []string{"start relay", "start consumers", "start server", "stop server", "stop consumers", "stop relay"}, events)
+	})
+
+	t.Run("stops the started components when one fails to start", func(t *testing.T) {
+		events = nil
+		l := newLifecycle(logger)
+		add(l, "relay", nil, nil)
+		add(l, "server", errors.New("address in use"), nil)
+		add(l, "metrics", nil, nil)
+
+		err := l.start(time.Second)
+		assert.EqualError(t, err, "could not start the server: address in use")
+
+		assert.Equal(t, []string{"start relay", "start server", "stop relay"}, events)
+		assert.NoError(t, l.stop(context.Background()))
+		assert.Len(t, events, 3)
+	})
+}
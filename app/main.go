@@ -1,15 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sushihentaime/blogist/internal/blogservice"
 	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/digestservice"
 	"github.com/sushihentaime/blogist/internal/mailservice"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+	"github.com/sushihentaime/blogist/internal/streamservice"
 	"github.com/sushihentaime/blogist/internal/userservice"
+	"github.com/sushihentaime/blogist/internal/webhookservice"
 )
 
 type application struct {
@@ -19,26 +35,91 @@ type application struct {
 	userService *userservice.UserService
 	blogService *blogservice.BlogService
 	mailService *mailservice.MailService
-	broker      *common.MessageBroker
+	// notificationService keeps the in-app notifications, which it makes of the domain events on the broker.
+	notificationService *notificationservice.NotificationService
+	broker              common.Broker
+	outboxRelay         *common.OutboxRelay
+	digests             *digestservice.DigestService
+	signer              *common.Signer
+	// streams pushes the new notifications and posts to the users connected to this replica.
+	streams *streamservice.Hub
+	// webhooks posts the blog events to the endpoints registered by the users.
+	webhooks *webhookservice.WebhookService
+	// metrics is nil unless METRICS_ENABLED is set.
+	metrics *metrics
+	// db is pinged by the readiness probe.
+	db *sql.DB
+	// shuttingDown is set once the server starts shutting down, which fails the readiness probe.
+	shuttingDown atomic.Bool
 }
 
 func main() {
-	// Initialize the logger
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	digestDryRun := flag.String("digest-dry-run", "", "write the digests that are due to .eml files in this directory instead of sending them, then exit")
+	configFile := flag.String("config", "", "read the settings from this env file instead of .env")
+	printConfig := flag.Bool("print-config", false, "print the configuration with the secrets redacted, then exit")
+	settings := configFlags(flag.CommandLine)
+	flag.Usage = func() { printUsage(flag.CommandLine.Output(), flag.CommandLine) }
+	flag.Parse()
+
+	cmd, args, ok := findCommand(flag.Args())
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(flag.Args(), " "))
+		flag.Usage()
+		os.Exit(2)
+	}
+	serve := cmd.run == nil
+	if serve && len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "serve takes no arguments\n")
+		os.Exit(2)
+	}
 
 	// Load the configuration
-	cfg, err := loadConfig(".env")
+	cfg, err := loadConfig(*configFile, settings())
 	if err != nil {
-		logger.Error("failed to load configuration", slog.String("error", err.Error()))
+		slog.Error("failed to load configuration", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 
-	if cfg.Environment == "development" {
-		cfg.RateLimitEnabled = false
-	} else {
-		cfg.RateLimitEnabled = true
+	if *printConfig {
+		err = cfg.print(os.Stdout)
+		if err != nil {
+			slog.Error("failed to print the configuration", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		return
 	}
 
+	// Initialize the logger, the commands keep the standard output for their result
+	logOutput := os.Stdout
+	if !serve {
+		logOutput = os.Stderr
+	}
+	logger, err := newLogger(cfg, logOutput)
+	if err != nil {
+		slog.Error("failed to initialize the logger", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Export the traces
+	shutdownTracing, err := setupTracing(cfg)
+	if err != nil {
+		logger.Error("failed to initialize the tracing", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+
 	// Initialize the database
 	db, err := common.NewDB(cfg.DBHost, cfg.DBUser, cfg.DBPassword, cfg.DBName, 10, 5, 15*time.Minute)
 	if err != nil {
@@ -47,14 +128,56 @@ func main() {
 	}
 	defer common.CloseDB(db)
 
+	// Migrate the database when asked to, and refuse to run against an older schema, unless the command fixes the schema
+	if !cmd.migrates {
+		err = prepareSchema(cfg, db, logger)
+		if err != nil {
+			logger.Error("the database schema is not ready", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	// Run the operator commands
+	if !serve {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		c := &cli{cfg: cfg, db: db, logger: logger, in: os.Stdin, out: os.Stdout}
+		err = c.run(ctx, cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "blogist %s: %s\n", cmd.name, err)
+			if errors.Is(err, errUsage) {
+				os.Exit(2)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Render the due digests for review without sending them
+	if *digestDryRun != "" {
+		err = runDigestDryRun(cfg, db, *digestDryRun, logger)
+		if err != nil {
+			logger.Error("failed to render the digests", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize the message broker
-	// Create the URI and connect to the message broker
-	URI := fmt.Sprintf("amqp://%s:%s@%s/", cfg.MQUser, cfg.MQPassword, cfg.MQHost)
-	broker, err := common.NewMessageBroker(URI)
+	broker, err := newBroker(cfg, logger)
 	if err != nil {
 		logger.Error("failed to connect to the message broker", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
+
+	// The broker and the cache count what goes through them when the metrics are enabled
+	var collectors []prometheus.Collector
+	if cfg.MetricsEnabled {
+		metered := common.NewMeteredBroker(broker)
+		collectors = append(collectors, metered)
+		broker = metered
+	}
 	defer broker.Close()
 
 	// Setup the exchange, queue, and binding key
@@ -64,25 +187,188 @@ func main() {
 		os.Exit(1)
 	}
 
-	cache := common.NewCache(5*time.Minute, 10*time.Minute)
+	err = common.SetupBlogExchange(broker)
+	if err != nil {
+		logger.Error("failed to setup the blog exchange", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	err = common.SetupWebhookExchange(broker)
+	if err != nil {
+		logger.Error("failed to setup the webhook exchange", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Initialize the cache
+	cache, err := newCache(cfg, logger)
+	if err != nil {
+		logger.Error("failed to initialize the cache", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	if c, ok := cache.(io.Closer); ok {
+		defer c.Close()
+	}
+	if cfg.MetricsEnabled {
+		metered := common.NewMeteredCache(cache)
+		collectors = append(collectors, metered)
+		cache = metered
+	}
+
+	// Initialize the mail transport
+	transport, err := mailservice.NewTransport(cfg.MailTransport, cfg.MailHost, cfg.MailPort, cfg.MailUser, cfg.MailPassword, cfg.MailDir, logger)
+	if err != nil {
+		logger.Error("failed to initialize the mail transport", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Parse the email templates
+	templates, err := mailservice.NewTemplates(cfg.MailTemplatesDir)
+	if err != nil {
+		logger.Error("failed to parse the email templates", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Initialize the signer of the links in the emails
+	signer, err := newSigner(cfg, logger)
+	if err != nil {
+		logger.Error("failed to initialize the signer", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	// Initialize the hub of the event streams
+	streams, err := streamservice.NewHub(broker, streamservice.NewPostgresStore(db), streamservice.DefaultBuffer, logger)
+	if err != nil {
+		logger.Error("failed to initialize the event streams", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
 
 	// Initialize the services
+	userService := userservice.NewUserService(userservice.NewPostgresStore(db), cache, cfg.AuthCacheTTL)
 	app := &application{
-		config:      cfg,
-		logger:      logger,
-		userService: userservice.NewUserService(db, broker, cache),
-		blogService: blogservice.NewBlogService(db, cache),
-		broker:      broker,
-		mailService: mailservice.NewMailService(broker, cfg.MailHost, cfg.MailUser, cfg.MailPassword, cfg.MailSender, cfg.MailPort, logger),
+		config:              cfg,
+		logger:              logger,
+		userService:         userService,
+		blogService:         blogservice.NewBlogService(blogservice.NewPostgresStore(db), cache),
+		broker:              broker,
+		outboxRelay:         common.NewOutboxRelay(db, broker, logger),
+		digests:             newDigestService(cfg, db, logger),
+		mailService:         mailservice.NewMailService(broker, transport, templates, cfg.MailSender, publicBaseURL(cfg), userService, signer, logger),
+		notificationService: notificationservice.NewNotificationService(notificationservice.NewPostgresStore(db), broker, logger),
+		signer:              signer,
+		streams:             streams,
+		webhooks:            webhookservice.NewWebhookService(webhookservice.NewPostgresStore(db), broker, webhookservice.NewHTTPClient(cfg.WebhookTimeout, cfg.WebhookAllowPrivate), logger),
+		db:                  db,
 	}
 
-	// Initialize the consumer
-	go app.mailService.SendActivationEmail()
+	// Initialize the metrics
+	if cfg.MetricsEnabled {
+		app.metrics, err = newMetrics(db, append(collectors, app.mailService)...)
+		if err != nil {
+			logger.Error("failed to initialize the metrics", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
 
-	// Start the HTTP server
-	err = app.serve(cfg.Port)
+		if cfg.MetricsAddr == "" && cfg.MetricsToken == "" {
+			logger.Warn("the metrics are served on the main port without METRICS_TOKEN, every scrape will be refused")
+		}
+	}
+
+	// Start the components and the HTTP server, and stop them in order on shutdown
+	err = app.serve()
 	if err != nil {
-		logger.Error("failed to start the server", slog.String("error", err.Error()))
+		logger.Error("failed to run the server", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 }
+
+// newBroker connects to the message broker selected in the configuration.
+func newBroker(cfg *Config, logger *slog.Logger) (common.Broker, error) {
+	switch cfg.BrokerBackend {
+	case "", "rabbitmq":
+		URI := fmt.Sprintf("amqp://%s:%s@%s/", cfg.MQUser, cfg.MQPassword, cfg.MQHost)
+		return common.NewMessageBroker(URI, logger)
+	case "memory":
+		return common.NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unknown broker backend %q", cfg.BrokerBackend)
+	}
+}
+
+// cacheExpiration is how long the entries of the cache are kept when they are not given their own expiration.
+const cacheExpiration = 5 * time.Minute
+
+// newCache creates the cache backend selected in the configuration.
+func newCache(cfg *Config, logger *slog.Logger) (common.Cache, error) {
+	switch cfg.CacheBackend {
+	case "", "memory":
+		return common.NewMemoryCache(cacheExpiration, 10*time.Minute), nil
+	case "redis":
+		return common.NewRedisCache(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cacheExpiration, logger)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.CacheBackend)
+	}
+}
+
+// newLogger writes the logs to w as text, or as JSON when LOG_FORMAT is json.
+func newLogger(cfg *Config, w io.Writer) (*slog.Logger, error) {
+	switch cfg.LogFormat {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, nil)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", cfg.LogFormat)
+	}
+}
+
+// publicBaseURL returns the URL the users reach the application at. It defaults to the port the server listens on, which is only right when nothing runs in front of it.
+func publicBaseURL(cfg *Config) string {
+	if cfg.PublicBaseURL == "" {
+		_, port, _ := net.SplitHostPort(listenAddr(cfg))
+		return "http://localhost:" + port
+	}
+
+	return strings.TrimRight(cfg.PublicBaseURL, "/")
+}
+
+// newSigner creates the signer of the links in the emails. Without a configured secret a random one is used, so the links stop working when the server restarts and are only accepted by the replica that sent them.
+func newSigner(cfg *Config, logger *slog.Logger) (*common.Signer, error) {
+	if cfg.SigningSecret != "" {
+		return common.NewSigner([]byte(cfg.SigningSecret))
+	}
+
+	logger.Warn("SIGNING_SECRET is not set, the links in the emails will stop working when the server restarts")
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return common.NewSigner(key)
+}
+
+// newDigestService creates the digest service, which sends at most DIGEST_POST_LIMIT posts per digest.
+func newDigestService(cfg *Config, db *sql.DB, logger *slog.Logger) *digestservice.DigestService {
+	return digestservice.NewDigestService(digestservice.NewPostgresStore(db), cfg.DigestPostLimit, logger)
+}
+
+// runDigestDryRun renders the digests that are due now to .eml files in dir with the configured templates. Nothing is published or recorded, so the digests are still sent by the next run.
+func runDigestDryRun(cfg *Config, db *sql.DB, dir string, logger *slog.Logger) error {
+	templates, err := mailservice.NewTemplates(cfg.MailTemplatesDir)
+	if err != nil {
+		return err
+	}
+
+	transport, err := mailservice.NewFileTransport(dir)
+	if err != nil {
+		return err
+	}
+
+	n, err := newDigestService(cfg, db, logger).Preview(context.Background(), time.Now(), mailservice.NewMailer(transport, cfg.MailSender, templates))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("rendered the due digests", slog.Int("count", n), slog.String("dir", dir))
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sushihentaime/blogist/internal/common"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const routeContextKey = contextKey("route")
+
+// unmatchedRoute labels the requests that did not reach a route, such as the ones answered with 404 or rejected by the rate limiter.
+const unmatchedRoute = "unmatched"
+
+// metrics holds the registry /metrics is served from and the metrics of the requests.
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// newMetrics creates the registry of the Go runtime, the process, the connection pool of db, the requests and the given collectors.
+func newMetrics(db *sql.DB, cs ...prometheus.Collector) (*metrics, error) {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: common.MetricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests, by method, route pattern and status.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: common.MetricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by method, route pattern and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+	}
+
+	cs = append(cs,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, common.MetricsNamespace),
+		m.requests,
+		m.duration,
+	)
+
+	for _, c := range cs {
+		if err := m.registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// routeRecorder is a router that tells the metrics and the trace of a request the pattern of the route that matched, so that the requests are not labelled with their raw URI.
+type routeRecorder struct {
+	*httprouter.Router
+}
+
+func (rr routeRecorder) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rr.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setRoute(r, path)
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+// setRoute labels the metrics of the request with the pattern of its route, and names its span after it.
+func setRoute(r *http.Request, pattern string) {
+	if route, ok := r.Context().Value(routeContextKey).(*string); ok {
+		*route = pattern
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(semconv.HTTPRoute(pattern))
+}
+
+// recordMetrics counts the requests and measures how long they take.
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	if app.metrics == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := unmatchedRoute
+		r = r.WithContext(context.WithValue(r.Context(), routeContextKey, &route))
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		start := time.Now()
+		next.ServeHTTP(sw, r)
+
+		status := strconv.Itoa(sw.status)
+		app.metrics.requests.WithLabelValues(r.Method, route, status).Inc()
+		app.metrics.duration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+func (app *application) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(app.metrics.registry, promhttp.HandlerOpts{ErrorLog: slog.NewLogLogger(app.logger.Handler(), slog.LevelError)})
+}
+
+// serveMetrics answers /metrics on the main port ahead of the other middleware, since authenticate would take the metrics token for an access token.
+func (app *application) serveMetrics(next http.Handler) http.Handler {
+	h := app.requireMetricsToken(app.metricsHandler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRoute(r, "/metrics")
+		if r.Method != http.MethodGet {
+			app.methodNotAllowedErrorResponse(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// metricsRoutes is the handler of the separate metrics listener. The token is only checked when one is configured.
+func (app *application) metricsRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	h := app.metricsHandler()
+	if app.config.MetricsToken != "" {
+		h = app.requireMetricsToken(h)
+	}
+	mux.Handle("GET /metrics", h)
+
+	return mux
+}
+
+// requireMetricsToken refuses the scrapes without the metrics token, and every scrape when there is no token.
+func (app *application) requireMetricsToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := app.config.MetricsToken
+		if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"runtime/debug"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sushihentaime/blogist/internal/common"
 	"github.com/sushihentaime/blogist/internal/userservice"
 	"github.com/tomasen/realip"
@@ -19,7 +22,9 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 		defer func() {
 			if err := recover(); err != nil {
 				w.Header().Set("Connection", "close")
-				app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+				// Unlike the errors that are returned, a panic is only understood with the stack that led to it.
+				app.logError(r, fmt.Errorf("%s", err), slog.String("stack", string(debug.Stack())))
+				app.writeErrorResponse(w, r, http.StatusInternalServerError, serverErrorMessage)
 			}
 		}()
 
@@ -27,6 +32,44 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requestID tags the request with the ID sent in X-Request-ID by the client or a proxy in front of the server, or with a new one, and sends it back in the response. The request gets a logger that carries the ID, which the handlers and the services log with.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(common.RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(common.RequestIDHeader, id)
+
+		ctx := common.WithRequestID(r.Context(), id)
+		ctx = common.WithLogger(ctx, app.logger.With(slog.String("request_id", id)))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// maxRequestIDLength bounds the request IDs accepted from the clients, which end up in every log line of the request.
+const maxRequestIDLength = 128
+
+// validRequestID reports whether id can be used as it is: not empty, not too long and made of letters, digits and "-_.:" only, so that it cannot forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// logRequest logs each request once it is served, with the status and size of the response and the user who sent it.
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var (
@@ -36,12 +79,58 @@ func (app *application) logRequest(next http.Handler) http.Handler {
 			uri    = r.URL.RequestURI()
 		)
 
+		// The user is only known once authenticate ran, further down the chain, so it fills this in.
+		userID := 0
+		r = r.WithContext(context.WithValue(r.Context(), requestUserContextKey, &userID))
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
 		startTime := time.Now()
-		next.ServeHTTP(w, r)
-		app.logger.Info("request from", slog.String("method", method), slog.String("uri", uri), slog.String("remote_addr", ip), slog.String("proto", proto), slog.Duration("duration", time.Since(startTime)))
+		next.ServeHTTP(sw, r)
+
+		attrs := []any{
+			slog.String("method", method),
+			slog.String("uri", uri),
+			slog.String("remote_addr", ip),
+			slog.String("proto", proto),
+			slog.Int("status", sw.status),
+			slog.Int("bytes", sw.bytes),
+			slog.Duration("duration", time.Since(startTime)),
+		}
+		if userID != 0 {
+			attrs = append(attrs, slog.Int("user_id", userID))
+		}
+
+		app.requestLogger(r).Info("request from", attrs...)
 	})
 }
 
+// statusResponseWriter remembers the status and the size of the response. Unwrap lets http.ResponseController reach the Flush and deadlines of the underlying writer.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
@@ -203,35 +292,3 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-
-// func (app *application) metrics(next http.Handler) http.Handler {
-// 	var (
-// 		totalRequestsReceived *expvar.Int
-// 		totalResponsesSent    *expvar.Int
-// 		totalProcessingTime   *expvar.Int
-// 	)
-
-// 	if !app.config.MetricsEnabled {
-// 		return next
-// 	}
-
-// 	totalRequestsReceived = expvar.NewInt("total_requests_received")
-// 	totalResponsesSent = expvar.NewInt("total_responses_sent")
-// 	totalProcessingTime = expvar.NewInt("total_processing_time")
-
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		if !app.config.MetricsEnabled {
-// 			next.ServeHTTP(w, r)
-// 			return
-// 		}
-
-// 		start := time.Now()
-// 		totalRequestsReceived.Add(1)
-
-// 		next.ServeHTTP(w, r)
-// 		totalResponsesSent.Add(1)
-
-// 		duration := time.Since(start).Microseconds()
-// 		totalProcessingTime.Add(duration)
-// 	})
-// }
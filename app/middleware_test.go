@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sushihentaime/blogist/internal/userservice"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -279,34 +288,201 @@ func TestRateLimit(t *testing.T) {
 	}
 }
 
-// func TestMetrics(t *testing.T) {
-// 	app := &application{
-// 		config: &Config{
-// 			MetricsEnabled: true,
-// 		},
-// 	}
+func TestMetrics(t *testing.T) {
+	db, err := sql.Open("postgres", "")
+	assert.NoError(t, err)
 
-// 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		time.Sleep(2 * time.Millisecond)
-// 		w.WriteHeader(http.StatusOK)
-// 	})
+	app := &application{
+		config: &Config{MetricsToken: "secret"},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	app.metrics, err = newMetrics(db)
+	assert.NoError(t, err)
 
-// 	middleware := app.metrics(handler)
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	scrape := func(t *testing.T, url, token string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
 
-// 	server := httptest.NewServer(middleware)
-// 	defer server.Close()
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+
+		return res.StatusCode, string(body)
+	}
 
-// 	res, err := http.Get(server.URL)
-// 	assert.NoError(t, err)
+	for _, id := range []string{"abc", "def"} {
+		res, err := http.Get(ts.URL + "/api/v1/blogs/view/" + id)
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	}
+
+	res, err := http.Get(ts.URL + "/missing")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	status, _ := scrape(t, ts.URL+"/metrics", "")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = scrape(t, ts.URL+"/metrics", "wrong")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	status, body := scrape(t, ts.URL+"/metrics", "secret")
+	assert.Equal(t, http.StatusOK, status)
+	// The requests are labelled with the pattern of their route.
+	assert.Contains(t, body, `blogist_http_requests_total{method="GET",route="/api/v1/blogs/view/:id",status="400"} 2`)
+	assert.Contains(t, body, `blogist_http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, `blogist_http_requests_total{method="GET",route="/metrics",status="403"} 2`)
+	assert.Contains(t, body, "go_sql_open_connections")
+
+	// The separate listener only checks the token when there is one.
+	app.config.MetricsToken = ""
+	admin := httptest.NewServer(app.metricsRoutes())
+	defer admin.Close()
+
+	status, body = scrape(t, admin.URL+"/metrics", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "blogist_http_request_duration_seconds")
+}
+
+func TestTraceRequests(t *testing.T) {
+	app := &application{
+		config: &Config{TraceSampleRatio: 1},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := newTracerProvider(app.config, exporter)
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	installTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	ts := httptest.NewServer(app.routes())
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/blogs/view/abc", nil)
+	assert.NoError(t, err)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	res, err = http.Get(ts.URL + "/missing")
+	assert.NoError(t, err)
+	res.Body.Close()
+
+	assert.NoError(t, tp.ForceFlush(context.Background()))
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+
+	// The span is named after the route and continues the trace of the caller.
+	assert.Equal(t, "GET /api/v1/blogs/view/:id", spans[0].Name)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[0].SpanContext.TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", spans[0].Parent.SpanID().String())
+	assert.Contains(t, spans[0].Attributes, semconv.HTTPRoute("/api/v1/blogs/view/:id"))
+
+	assert.Equal(t, "GET", spans[1].Name)
+	assert.False(t, spans[1].Parent.IsValid())
+}
 
-// 	assert.Equal(t, http.StatusOK, res.StatusCode)
+func TestTraceSampleRatio(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
 
-// 	// Verify the metrics
-// 	totalRequestsReceived := expvar.Get("total_requests_received").(*expvar.Int)
-// 	totalResponsesSent := expvar.Get("total_responses_sent").(*expvar.Int)
-// 	totalProcessingTime := expvar.Get("total_processing_time").(*expvar.Int)
+	// At 0 the traces that start here are dropped, but the ones the caller sampled are kept.
+	tp := newTracerProvider(&Config{TraceSampleRatio: 0}, exporter)
+	ctx, span := tp.Tracer("test").Start(context.Background(), "root")
+	assert.False(t, span.SpanContext().IsSampled())
+	span.End()
 
-// 	assert.Equal(t, int64(1), totalRequestsReceived.Value())
-// 	assert.Equal(t, int64(1), totalResponsesSent.Value())
-// 	assert.Greater(t, totalProcessingTime.Value(), int64(2000))
-// }
+	parent := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{1}, TraceFlags: trace.FlagsSampled, Remote: true})
+	_, span = tp.Tracer("test").Start(trace.ContextWithRemoteSpanContext(ctx, parent), "child")
+	assert.True(t, span.SpanContext().IsSampled())
+	span.End()
+
+	tp = newTracerProvider(&Config{TraceSampleRatio: 1}, exporter)
+	_, span = tp.Tracer("test").Start(context.Background(), "root")
+	assert.True(t, span.SpanContext().IsSampled())
+	span.End()
+}
+
+func TestRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	app := &application{
+		config: &Config{},
+		logger: slog.New(slog.NewJSONHandler(&logs, nil)),
+	}
+
+	// The handler logs on behalf of an authenticated user, as the services do.
+	handler := app.requestID(app.logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.createUserContext(r, &userservice.User{ID: 7})
+		app.requestLogger(r).Info("handled")
+		app.writeJSON(w, http.StatusCreated, envelope{"message": "created"}, nil)
+	})))
+
+	readLogs := func(t *testing.T) []map[string]any {
+		var lines []map[string]any
+		dec := json.NewDecoder(&logs)
+		for dec.More() {
+			var line map[string]any
+			assert.NoError(t, dec.Decode(&line))
+			lines = append(lines, line)
+		}
+		return lines
+	}
+
+	t.Run("keeps the ID of the client", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/blogs/create", nil)
+		req.Header.Set("X-Request-ID", "client-id.1")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		assert.Equal(t, "client-id.1", res.Header().Get("X-Request-ID"))
+
+		lines := readLogs(t)
+		if !assert.Len(t, lines, 2) {
+			return
+		}
+
+		assert.Equal(t, "handled", lines[0]["msg"])
+		assert.Equal(t, "client-id.1", lines[0]["request_id"])
+		assert.Equal(t, float64(7), lines[0]["user_id"])
+
+		assert.Equal(t, "client-id.1", lines[1]["request_id"])
+		assert.Equal(t, float64(7), lines[1]["user_id"])
+		assert.Equal(t, float64(http.StatusCreated), lines[1]["status"])
+		assert.Equal(t, float64(res.Body.Len()), lines[1]["bytes"])
+	})
+
+	t.Run("replaces an invalid ID", func(t *testing.T) {
+		for _, id := range []string{"", "forged\nlevel=ERROR", strings.Repeat("a", maxRequestIDLength+1)} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Request-ID", id)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			generated := res.Header().Get("X-Request-ID")
+			assert.NotEqual(t, id, generated)
+			assert.True(t, validRequestID(generated))
+
+			for _, line := range readLogs(t) {
+				assert.Equal(t, generated, line["request_id"])
+			}
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/migrations"
+)
+
+// schemaStatus prints the status of the schema as a sentence.
+type schemaStatus common.SchemaStatus
+
+func (s schemaStatus) String() string {
+	state := "up to date"
+	switch {
+	case s.Dirty:
+		state = "dirty, fix the failed migration and force the version"
+	case s.Version < s.Latest:
+		state = fmt.Sprintf("%d pending", s.Latest-s.Version)
+	case s.Version > s.Latest:
+		state = "ahead of this binary"
+	}
+
+	return fmt.Sprintf("version %d of %d, %s", s.Version, s.Latest, state)
+}
+
+// prepareSchema applies the pending migrations when MIGRATE_ON_START is set, then checks that the schema is what the binary expects.
+func prepareSchema(cfg *Config, db *sql.DB, logger *slog.Logger) error {
+	m, err := common.NewMigrator(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if cfg.MigrateOnStart {
+		err = m.Up()
+		if err != nil {
+			return fmt.Errorf("failed to apply the migrations: %w", err)
+		}
+	}
+
+	err = m.Check()
+	if err != nil {
+		if errors.Is(err, common.ErrSchemaBehind) {
+			return fmt.Errorf("%w, run blogist migrate up or set MIGRATE_ON_START", err)
+		}
+		return err
+	}
+
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	logger.Info("checked the database schema", slog.Uint64("version", uint64(status.Version)))
+
+	return nil
+}
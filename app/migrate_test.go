@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func TestSchemaStatus(t *testing.T) {
+	tests := []struct {
+		status common.SchemaStatus
+		want   string
+	}{
+		{common.SchemaStatus{Version: 16, Latest: 16}, "version 16 of 16, up to date"},
+		{common.SchemaStatus{Version: 14, Latest: 16}, "version 14 of 16, 2 pending"},
+		{common.SchemaStatus{Version: 17, Latest: 16}, "version 17 of 16, ahead of this binary"},
+		{common.SchemaStatus{Version: 15, Latest: 16, Dirty: true}, "version 15 of 16, dirty, fix the failed migration and force the version"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, schemaStatus(tt.status).String())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed pages
+var pageFS embed.FS
+
+// pages holds the HTML pages served to browsers, such as the page the activation link in the email opens. Each page defines "title" and "content", which the "page" layout wraps, and can use the templates in partials.html.
+var pages = parsePages("activate", "activated", "activation_failed", "unsubscribe", "unsubscribed", "unsubscribe_failed", "error")
+
+func parsePages(names ...string) map[string]*template.Template {
+	parsed := make(map[string]*template.Template, len(names))
+	for _, name := range names {
+		parsed[name] = template.Must(template.ParseFS(pageFS, "pages/layout.html", "pages/partials.html", "pages/"+name+".html"))
+	}
+
+	return parsed
+}
+
+// renderPage writes the page with the status. The page is rendered to a buffer first so a template error still results in an error page rather than half a page.
+func (app *application) renderPage(w http.ResponseWriter, r *http.Request, status int, page string, data any) {
+	buf := new(bytes.Buffer)
+	err := pages[page].ExecuteTemplate(buf, "page", data)
+	if err != nil {
+		app.logError(r, err)
+
+		buf.Reset()
+		status = http.StatusInternalServerError
+		if err := pages["error"].ExecuteTemplate(buf, "page", nil); err != nil {
+			app.logError(r, err)
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	// The pages do not load anything, and the forms only post back to the application.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (app *application) serverErrorPage(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+	app.renderPage(w, r, http.StatusInternalServerError, "error", nil)
+}
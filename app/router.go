@@ -1,7 +1,6 @@
 package main
 
 import (
-	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -9,19 +8,51 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	router := httprouter.New()
+	router := routeRecorder{httprouter.New()}
 
 	router.NotFound = http.HandlerFunc(app.notFoundErrorResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedErrorResponse)
 
 	// health check
 	router.HandlerFunc(http.MethodGet, "/health", app.healthCheckHandler)
+	router.HandlerFunc(http.MethodGet, "/health/live", app.livenessHandler)
+	router.HandlerFunc(http.MethodGet, "/health/ready", app.readinessHandler)
+
+	// pages opened from the emails
+	router.HandlerFunc(http.MethodGet, "/activate", app.activatePageHandler)
+	router.HandlerFunc(http.MethodPost, "/activate", app.activateFormHandler)
+	router.HandlerFunc(http.MethodGet, "/unsubscribe", app.unsubscribePageHandler)
+	router.HandlerFunc(http.MethodPost, "/unsubscribe", app.unsubscribeHandler)
 
 	// user service
 	router.HandlerFunc(http.MethodPost, "/api/v1/users/register", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/api/v1/users/activate", app.activateUserHandler)
 	router.HandlerFunc(http.MethodPost, "/api/v1/users/login", app.loginUserHandler)
 	router.HandlerFunc(http.MethodDelete, "/api/v1/users/logout", app.logoutUserHandler)
+	router.HandlerFunc(http.MethodPost, "/api/v1/users/password-reset", app.requestPasswordResetHandler)
+	router.HandlerFunc(http.MethodPut, "/api/v1/users/password", app.resetPasswordHandler)
+	router.HandlerFunc(http.MethodGet, "/api/v1/users/me/notifications", app.requireAuthUser(app.getNotificationPreferencesHandler))
+	router.HandlerFunc(http.MethodPut, "/api/v1/users/me/notifications", app.requireAuthUser(app.updateNotificationPreferencesHandler))
+	router.HandlerFunc(http.MethodPost, "/api/v1/follows/:userid", app.requireActivatedUser(http.HandlerFunc(app.followUserHandler)))
+	router.HandlerFunc(http.MethodDelete, "/api/v1/follows/:userid", app.requireActivatedUser(http.HandlerFunc(app.unfollowUserHandler)))
+
+	// Notification routes
+	router.HandlerFunc(http.MethodGet, "/api/v1/notifications", app.requireAuthUser(app.getNotificationsHandler))
+	router.HandlerFunc(http.MethodPut, "/api/v1/notifications/read/:id", app.requireAuthUser(app.markNotificationReadHandler))
+	router.HandlerFunc(http.MethodPut, "/api/v1/notifications/read-all", app.requireAuthUser(app.markAllNotificationsReadHandler))
+
+	// event stream, which sets its own write deadlines instead of the WriteTimeout of the server
+	router.HandlerFunc(http.MethodGet, "/api/v1/stream", app.requireAuthUser(app.streamHandler))
+
+	// webhooks
+	router.HandlerFunc(http.MethodPost, "/api/v1/webhooks", app.requireActivatedUser(http.HandlerFunc(app.createWebhookHandler)))
+	router.HandlerFunc(http.MethodGet, "/api/v1/webhooks", app.requireActivatedUser(http.HandlerFunc(app.getWebhooksHandler)))
+	router.HandlerFunc(http.MethodGet, "/api/v1/webhooks/:id", app.requireActivatedUser(http.HandlerFunc(app.getWebhookHandler)))
+	router.HandlerFunc(http.MethodPut, "/api/v1/webhooks/:id", app.requireActivatedUser(http.HandlerFunc(app.updateWebhookHandler)))
+	router.HandlerFunc(http.MethodDelete, "/api/v1/webhooks/:id", app.requireActivatedUser(http.HandlerFunc(app.deleteWebhookHandler)))
+	router.HandlerFunc(http.MethodGet, "/api/v1/webhooks/:id/deliveries", app.requireActivatedUser(http.HandlerFunc(app.getWebhookDeliveriesHandler)))
+	router.HandlerFunc(http.MethodGet, "/api/v1/webhooks/:id/deliveries/:delivery", app.requireActivatedUser(http.HandlerFunc(app.getWebhookDeliveryHandler)))
+	router.HandlerFunc(http.MethodPost, "/api/v1/webhooks/:id/deliveries/:delivery/redeliver", app.requireActivatedUser(http.HandlerFunc(app.redeliverWebhookHandler)))
 
 	// blog service
 	router.HandlerFunc(http.MethodGet, "/api/v1/blogs", app.getAllBlogsHandler)
@@ -32,8 +63,16 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPut, "/api/v1/blogs/update/:id", app.requirePermission(app.updateBlogHandler, userservice.PermissionWriteBlog))
 	router.HandlerFunc(http.MethodDelete, "/api/v1/blogs/delete/:id", app.requirePermission(app.deleteBlogHandler, userservice.PermissionWriteBlog))
 
-	// Add a metrics handler
-	router.HandlerFunc(http.MethodGet, "/metrics", expvar.Handler().ServeHTTP)
+	// admin
+	router.HandlerFunc(http.MethodGet, "/api/v1/admin/dead-letters", app.requirePermission(app.listDeadLettersHandler, userservice.PermissionAdmin))
+	router.HandlerFunc(http.MethodPost, "/api/v1/admin/dead-letters/replay", app.requirePermission(app.replayDeadLettersHandler, userservice.PermissionAdmin))
+
+	handler := app.requestID(app.logRequest(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))))
+
+	// metrics, unless they have a listener of their own
+	if app.metrics != nil && app.config.MetricsAddr == "" {
+		handler = app.serveMetrics(handler)
+	}
 
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.logRequest(app.authenticate(router)))))
+	return app.traceRequests(app.recordMetrics(handler))
 }
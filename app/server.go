@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,53 +12,121 @@ import (
 	"time"
 )
 
-func (app *application) serve(port string) error {
+// shutdownTimeout bounds the shutdown of every component together, from the drain of the requests to the last message being handled.
+const shutdownTimeout = 30 * time.Second
+
+// serve starts the components of the application and serves until a signal asks it to stop or a server fails. The components are then stopped in the reverse order.
+func (app *application) serve() error {
+	serverErrs := make(chan error, 2)
+	l := app.components(serverErrs)
+
+	err := l.start(shutdownTimeout)
+	if err != nil {
+		return err
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+
+	var serveErr error
+	select {
+	case s := <-quit:
+		app.logger.Info("shutting down server", slog.String("signal", s.String()))
+	case serveErr = <-serverErrs:
+		app.logger.Error("server failed, shutting down", slog.String("error", serveErr.Error()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = errors.Join(serveErr, l.stop(ctx))
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("stopped server")
+
+	return nil
+}
+
+// components returns the lifecycle of the components of the application in dependency order. The outbox relay starts first and stops last, so that it publishes what the others wrote to the outbox while they stopped. The servers start last and stop first, so that no request starts work after the components it needs stopped. The errors of the servers once they started are sent to serverErrs.
+func (app *application) components(serverErrs chan<- error) *lifecycle {
+	l := newLifecycle(app.logger)
+
+	l.add("outbox relay", noError(app.outboxRelay.Start), app.outboxRelay.Shutdown)
+	l.add("mail consumers", noError(app.mailService.Start), app.mailService.Shutdown)
+	l.add("notification consumers", noError(app.notificationService.Start), app.notificationService.Shutdown)
+	l.add("webhook consumers", noError(app.webhooks.Start), app.webhooks.Shutdown)
+	l.add("event streams", app.streams.Start, func(context.Context) error {
+		app.streams.Close()
+		return nil
+	})
+	l.add("digest scheduler", func() error {
+		app.digests.Start(app.config.DigestInterval)
+		return nil
+	}, app.digests.Shutdown)
+
+	// The metrics get a listener of their own when an address is configured for them.
+	if app.metrics != nil && app.config.MetricsAddr != "" {
+		srv := &http.Server{
+			Addr:         app.config.MetricsAddr,
+			Handler:      app.metricsRoutes(),
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		}
+		l.add("metrics server", app.startServer(srv, serverErrs), srv.Shutdown)
+	}
 
 	srv := &http.Server{
-		Addr:         port,
+		Addr:         listenAddr(app.config),
 		Handler:      app.routes(),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
 		IdleTimeout:  120 * time.Second,
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 	}
+	// Shutdown does not wait for the streams to end on their own, it closes them.
+	srv.RegisterOnShutdown(app.streams.Close)
+	l.add("http server", app.startServer(srv, serverErrs), app.drainServer(srv))
 
-	shutdownError := make(chan error)
-
-	go func() {
-		quit := make(chan os.Signal, 1)
-
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-
-		s := <-quit
-
-		app.logger.Info("shutting down server", slog.String("signal", s.String()))
-
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+	return l
+}
 
-		err := srv.Shutdown(ctx)
+// startServer returns the start of srv. The server listens before the start returns, so that an address in use fails the start, and the errors it serves with afterwards are sent to errs.
+func (app *application) startServer(srv *http.Server, errs chan<- error) func() error {
+	return func() error {
+		ln, err := net.Listen("tcp", srv.Addr)
 		if err != nil {
-			shutdownError <- err
+			return err
 		}
 
-		shutdownError <- nil
-
-	}()
+		app.logger.Info("starting server", slog.String("addr", srv.Addr), slog.String("env", app.config.Environment))
 
-	app.logger.Info("starting server", slog.String("port", port), slog.String("env", app.config.Environment))
+		go func() {
+			err := srv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
 
-	err := srv.ListenAndServe()
-	if !errors.Is(err, http.ErrServerClosed) {
-		return err
+		return nil
 	}
+}
 
-	err = <-shutdownError
-	if err != nil {
-		return err
-	}
+// drainServer returns the stop of srv. The readiness probe fails from then on, and the server keeps serving until the proxy noticed and sends the requests to the other replicas. It then stops accepting requests and waits for the ones in progress.
+func (app *application) drainServer(srv *http.Server) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		app.shuttingDown.Store(true)
 
-	app.logger.Info("stopped server", slog.String("addr", srv.Addr))
+		delay := app.config.ShutdownDelay
+		app.logger.Info("draining requests", slog.Duration("delay", delay))
 
-	return nil
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+
+		return srv.Shutdown(ctx)
+	}
 }
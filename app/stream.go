@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/streamservice"
+)
+
+const (
+	// streamHeartbeat is how often an idle stream sends a comment, so proxies and clients do not drop the connection.
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout bounds each write to a stream. It replaces the WriteTimeout of the server, which would cut every stream off, and ends the streams of clients that stopped reading.
+	streamWriteTimeout = 10 * time.Second
+	// streamRetry is how long the client waits before reconnecting.
+	streamRetry = 3 * time.Second
+)
+
+// streamHandler streams the new notifications of the user and the new posts of the authors the user follows as Server-Sent Events. A client that reconnects with the Last-Event-ID header, or the last_event_id query parameter for clients that cannot set headers, first gets the events it missed, up to a ready event.
+func (app *application) streamHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.getUserContext(r)
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	stream, replay, err := app.streams.Subscribe(r.Context(), user.ID, lastEventID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer stream.Close()
+
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(f func(io.Writer) error) bool {
+		err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err == nil {
+			err = f(w)
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			app.requestLogger(r).Debug("closing the stream", slog.Int("user_id", user.ID), slog.String("error", err.Error()))
+			return false
+		}
+		return true
+	}
+
+	ok := write(func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+		return err
+	})
+	if !ok {
+		return
+	}
+
+	for _, e := range replay {
+		if !write(func(w io.Writer) error { return writeEvent(w, e) }) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, open := <-stream.Events():
+			if !open {
+				return
+			}
+			ok = write(func(w io.Writer) error { return writeEvent(w, e) })
+
+		case <-heartbeat.C:
+			ok = write(func(w io.Writer) error {
+				_, err := io.WriteString(w, ": heartbeat\n\n")
+				return err
+			})
+
+		case <-r.Context().Done():
+			return
+		}
+
+		if !ok {
+			return
+		}
+	}
+}
+
+// writeEvent writes the event in the text/event-stream format.
+func writeEvent(w io.Writer, e streamservice.Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
@@ -16,7 +16,10 @@ import (
 	"github.com/sushihentaime/blogist/internal/blogservice"
 	"github.com/sushihentaime/blogist/internal/common"
 	"github.com/sushihentaime/blogist/internal/mailservice"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+	"github.com/sushihentaime/blogist/internal/streamservice"
 	"github.com/sushihentaime/blogist/internal/userservice"
+	"github.com/sushihentaime/blogist/internal/webhookservice"
 )
 
 type testServer struct {
@@ -50,30 +53,62 @@ func readResponse(t *testing.T, res *http.Response) (int, http.Header, envelope)
 }
 
 func newTestApplication(t *testing.T) (*application, *sql.DB) {
+	app, db, _ := newTestApplicationWithMail(t)
+	return app, db
+}
+
+// newTestApplicationWithMail also returns the transport the emails of the application are sent to.
+func newTestApplicationWithMail(t *testing.T) (*application, *sql.DB, *mailservice.MemoryTransport) {
 	db := common.TestDB("file://../migrations", t)
 	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
-	rabbitURI := common.TestRabbitMQ(t)
-	rabbitmq, err := common.NewMessageBroker(rabbitURI)
+	broker := common.NewMemoryBroker()
+	t.Cleanup(func() { broker.Close() })
+
+	err := common.SetupUserExchange(broker)
 	assert.NoError(t, err)
 
-	err = common.SetupUserExchange(rabbitmq)
+	err = common.SetupBlogExchange(broker)
 	assert.NoError(t, err)
 
-	cfg, err := loadConfig("../.test.env")
+	err = common.SetupWebhookExchange(broker)
 	assert.NoError(t, err)
 
-	cache := common.NewCache(5*time.Minute, 10*time.Minute)
+	cfg, err := loadConfig("../.test.env", nil)
+	assert.NoError(t, err)
+
+	cache := common.NewMemoryCache(5*time.Minute, 10*time.Minute)
+
+	templates, err := mailservice.NewTemplates("")
+	assert.NoError(t, err)
 
+	transport := mailservice.NewMemoryTransport()
+
+	signer, err := common.NewSigner(bytes.Repeat([]byte("s"), 32))
+	assert.NoError(t, err)
+
+	userService := userservice.NewUserService(userservice.NewPostgresStore(db), cache, cfg.AuthCacheTTL)
 	app := &application{
-		config:      cfg,
-		logger:      logger,
-		userService: userservice.NewUserService(db, rabbitmq, cache),
-		mailService: mailservice.NewMailService(rabbitmq, cfg.MailHost, cfg.MailUser, cfg.MailPassword, cfg.MailSender, cfg.MailPort, logger),
-		broker:      rabbitmq,
-		blogService: blogservice.NewBlogService(db, cache),
-	}
+		config:              cfg,
+		logger:              logger,
+		userService:         userService,
+		mailService:         mailservice.NewMailService(broker, transport, templates, cfg.MailSender, publicBaseURL(cfg), userService, signer, logger),
+		broker:              broker,
+		blogService:         blogservice.NewBlogService(blogservice.NewPostgresStore(db), cache),
+		signer:              signer,
+		notificationService: notificationservice.NewNotificationService(notificationservice.NewPostgresStore(db), broker, logger),
+		db:                  db,
+	}
+	t.Cleanup(app.notificationService.Close)
+
+	app.streams, err = streamservice.NewHub(broker, streamservice.NewPostgresStore(db), streamservice.DefaultBuffer, logger)
+	assert.NoError(t, err)
+	t.Cleanup(app.streams.Close)
 
-	return app, db
+	// The receivers of the tests listen on the loopback address.
+	app.webhooks = webhookservice.NewWebhookService(webhookservice.NewPostgresStore(db), broker, webhookservice.NewHTTPClient(time.Second, true), logger)
+	t.Cleanup(app.webhooks.Close)
+
+	return app, db, transport
 }
 
 func (ts *testServer) post(t *testing.T, path string, data any, token *string) (int, http.Header, envelope) {
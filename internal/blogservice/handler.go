@@ -2,14 +2,15 @@ package blogservice
 
 import (
 	"context"
-	"database/sql"
-	"fmt"
+	"encoding/json"
+	"log/slog"
+	"time"
 
 	"github.com/sushihentaime/blogist/internal/common"
 )
 
-func NewBlogService(db *sql.DB, c *common.Cache) *BlogService {
-	return &BlogService{m: newBlogModel(db), c: c}
+func NewBlogService(store Store, c common.Cache) *BlogService {
+	return &BlogService{store: store, c: c}
 }
 
 type CreateBlogRequest struct {
@@ -30,7 +31,40 @@ func (s *BlogService) CreateBlog(ctx context.Context, req *CreateBlogRequest) er
 
 	content := sanitizeMarkdown(req.Content)
 
-	return s.m.insert(req.Title, content, req.UserID)
+	blog := Blog{
+		Title:   req.Title,
+		Content: content,
+		UserID:  req.UserID,
+	}
+
+	err := s.store.WithTx(ctx, func(tx Tx) error {
+		err := tx.InsertBlog(ctx, &blog)
+		if err != nil {
+			return err
+		}
+
+		// The author's username is part of the events.
+		stored, err := tx.GetBlogByID(ctx, blog.ID)
+		if err != nil {
+			return err
+		}
+
+		// There are no drafts, so a post is published as soon as it is created.
+		err = enqueueBlogEvent(ctx, tx, common.BlogCreatedKey, stored)
+		if err != nil {
+			return err
+		}
+
+		return enqueueBlogEvent(ctx, tx, common.BlogPublishedKey, stored)
+	})
+	if err != nil {
+		return err
+	}
+
+	// A new post shows up in every listing, so drop them.
+	s.invalidate(ctx, common.NamespaceBlogs, common.NamespaceBlogsByUser(req.UserID))
+
+	return nil
 }
 
 // GetBlogByID returns a blog post by its ID.
@@ -41,21 +75,22 @@ func (s *BlogService) GetBlogByID(ctx context.Context, id int) (*Blog, error) {
 		return nil, v.ValidationError()
 	}
 
-	fmt.Println("I am working")
+	// Take the namespace snapshot before querying the database so that a write landing in between is not cached.
+	ns := s.c.Namespace(common.NamespaceBlog(id))
+
 	// Check cache first before querying the database.
-	if blog, ok := s.c.Get(common.CacheKeyBlog(id)); ok {
-		return blog.(*Blog), nil
+	var cached Blog
+	if common.TracedGet(ctx, ns, common.CacheKeyBlog(id), &cached) {
+		return &cached, nil
 	}
 
-	fmt.Println("I am working 2")
-
-	blog, err := s.m.getBlogById(id)
+	blog, err := s.store.GetBlogByID(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	// Cache the pointer to the blog post.
-	s.c.Set(common.CacheKeyBlog(id), blog)
+	// Cache the blog post.
+	ns.Set(common.CacheKeyBlog(id), blog)
 
 	return blog, nil
 }
@@ -96,7 +131,26 @@ func (s *BlogService) UpdateBlog(ctx context.Context, title, content string, id,
 		Version: *version,
 	}
 
-	return s.m.updateBlog(&blog)
+	err := s.store.WithTx(ctx, func(tx Tx) error {
+		err := tx.UpdateBlog(ctx, &blog)
+		if err != nil {
+			return err
+		}
+
+		stored, err := tx.GetBlogByID(ctx, blog.ID)
+		if err != nil {
+			return err
+		}
+
+		return enqueueBlogEvent(ctx, tx, common.BlogUpdatedKey, stored)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.invalidateBlog(ctx, blog.ID, blog.UserID)
+
+	return nil
 }
 
 // DeleteBlog deletes a blog post. Only the user who created the blog post can delete it.
@@ -108,7 +162,74 @@ func (s *BlogService) DeleteBlog(ctx context.Context, blogId, userId int) error
 		return v.ValidationError()
 	}
 
-	return s.m.deleteBlog(blogId, userId)
+	err := s.store.WithTx(ctx, func(tx Tx) error {
+		// The event describes the blog post as it was before it was deleted.
+		stored, err := tx.GetBlogByID(ctx, blogId)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteBlog(ctx, blogId, userId)
+		if err != nil {
+			return err
+		}
+
+		return enqueueBlogEvent(ctx, tx, common.BlogDeletedKey, stored)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.invalidateBlog(ctx, blogId, userId)
+
+	return nil
+}
+
+// enqueueBlogEvent queues a blog event, which the outbox relay publishes once the transaction commits. The blog post must be read with GetBlogByID, which sets its User.
+func enqueueBlogEvent(ctx context.Context, tx Tx, key common.BindingKey, blog *Blog) error {
+	data, err := json.Marshal(struct {
+		BlogID    int
+		UserID    int
+		Author    string
+		Title     string
+		CreatedAt time.Time
+		UpdatedAt time.Time
+	}{
+		BlogID:    blog.ID,
+		UserID:    blog.User.ID,
+		Author:    blog.User.Username,
+		Title:     blog.Title,
+		CreatedAt: blog.CreatedAt,
+		UpdatedAt: blog.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.EnqueueOutbox(ctx, common.BlogExchange, key, data)
+}
+
+// invalidateBlog drops the cached blog post and every listing that may contain it.
+func (s *BlogService) invalidateBlog(ctx context.Context, id, userId int) {
+	s.invalidate(ctx, common.NamespaceBlog(id), common.NamespaceBlogs, common.NamespaceBlogsByUser(userId))
+}
+
+// invalidate drops the cached namespaces. The write it follows is already committed, so a failure is logged rather than returned, and the stale entries are served until they expire.
+func (s *BlogService) invalidate(ctx context.Context, namespaces ...string) {
+	err := s.c.Invalidate(namespaces...)
+	if err != nil {
+		common.Logger(ctx, slog.Default()).Error("failed to invalidate the cached blog posts", slog.String("error", err.Error()))
+	}
+}
+
+// Reindex rebuilds the indexes of the blog posts and drops the cached listings and searches, so that they are read from the database again.
+func (s *BlogService) Reindex(ctx context.Context) error {
+	err := s.store.Reindex(ctx)
+	if err != nil {
+		return err
+	}
+
+	return s.c.Invalidate(common.NamespaceBlogs)
 }
 
 // GetBlogsByUserId returns all blog posts by a user.
@@ -119,18 +240,21 @@ func (s *BlogService) GetBlogsByUserId(ctx context.Context, userID int) (*[]Blog
 		return nil, v.ValidationError()
 	}
 
+	ns := s.c.Namespace(common.NamespaceBlogsByUser(userID))
+
 	// Check cache first before querying the database.
-	if blogs, ok := s.c.Get(common.CacheKeyBlogsByUserId(userID)); ok {
-		return blogs.(*[]Blog), nil
+	var cached []Blog
+	if common.TracedGet(ctx, ns, common.CacheKeyBlogsByUserId(userID), &cached) {
+		return &cached, nil
 	}
 
-	blogs, err := s.m.getBlogsByUserId(userID)
+	blogs, err := s.store.GetBlogsByUserID(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Cache the pointer to the slice of blog posts.
-	s.c.Set(common.CacheKeyBlogsByUserId(userID), blogs)
+	// Cache the slice of blog posts.
+	ns.Set(common.CacheKeyBlogsByUserId(userID), blogs)
 
 	return blogs, nil
 }
@@ -145,18 +269,21 @@ func (s *BlogService) GetBlogs(ctx context.Context, limit, offset int) (*[]Blog,
 		offset = 0
 	}
 
+	ns := s.c.Namespace(common.NamespaceBlogs)
+
 	// Check cache first before querying the database.
-	if blogs, ok := s.c.Get(common.CacheKeyBlogs(limit, offset)); ok {
-		return blogs.(*[]Blog), nil
+	var cached []Blog
+	if common.TracedGet(ctx, ns, common.CacheKeyBlogs(limit, offset), &cached) {
+		return &cached, nil
 	}
 
-	blogs, err := s.m.getBlogs(ctx, limit, offset)
+	blogs, err := s.store.GetBlogs(ctx, limit, offset)
 	if err != nil {
 		return nil, err
 	}
 
-	// Cache the pointer to the slice of blog posts.
-	s.c.Set(common.CacheKeyBlogs(limit, offset), blogs)
+	// Cache the slice of blog posts.
+	ns.Set(common.CacheKeyBlogs(limit, offset), blogs)
 
 	return blogs, nil
 }
@@ -176,18 +303,21 @@ func (s *BlogService) GetBlogsByTitle(ctx context.Context, title string, limit,
 		offset = 0
 	}
 
+	ns := s.c.Namespace(common.NamespaceBlogs)
+
 	// Check cache first before querying the database.
-	if blogs, ok := s.c.Get(title); ok {
-		return blogs.(*[]Blog), nil
+	var cached []Blog
+	if common.TracedGet(ctx, ns, common.CacheKeyBlogsByTitle(title, limit, offset), &cached) {
+		return &cached, nil
 	}
 
-	blogs, err := s.m.getBlogsByTitle(ctx, title, limit, offset)
+	blogs, err := s.store.GetBlogsByTitle(ctx, title, limit, offset)
 	if err != nil {
 		return nil, err
 	}
 
-	// Cache the pointer to the slice of blog posts.
-	s.c.Set(title, blogs)
+	// Cache the slice of blog posts.
+	ns.Set(common.CacheKeyBlogsByTitle(title, limit, offset), blogs)
 
 	return blogs, nil
 }
@@ -4,11 +4,13 @@ import (
 	"context"
 	"crypto/rand"
 	"database/sql"
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
 )
 
 // setupTestUser is a helper function to create a test user in the database.
@@ -36,7 +38,7 @@ func setupTestUser(db *sql.DB) (*int, error) {
 
 func setupTestEnvironment(t *testing.T) (*BlogService, *sql.DB, func() error, *int, error) {
 	db := common.TestDB("file://../../migrations", t)
-	cache := common.NewCache(5*time.Minute, 10*time.Minute)
+	cache := common.NewMemoryCache(5*time.Minute, 10*time.Minute)
 
 	// set the password
 	randomBytes := make([]byte, 16)
@@ -61,7 +63,7 @@ func setupTestEnvironment(t *testing.T) (*BlogService, *sql.DB, func() error, *i
 		return nil
 	}
 
-	return NewBlogService(db, cache), db, cleanup, id, nil
+	return NewBlogService(NewPostgresStore(db), cache), db, cleanup, id, nil
 }
 
 func createRandomBlog(db *sql.DB, userId int) (*int, *int, error) {
@@ -519,3 +521,219 @@ func TestGetBlogsByTitle(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheInvalidation(t *testing.T) {
+	s, db, cleanup, userId, err := setupTestEnvironment(t)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		write func(ctx context.Context, blogId, version int) error
+		check func(t *testing.T, ctx context.Context, blogId int)
+	}{
+		{
+			name: "create",
+			write: func(ctx context.Context, blogId, version int) error {
+				return s.CreateBlog(ctx, &CreateBlogRequest{Title: "Second Blog", Content: "This is another blog.", UserID: *userId})
+			},
+			check: func(t *testing.T, ctx context.Context, blogId int) {
+				blogs, err := s.GetBlogs(ctx, 10, 0)
+				assert.NoError(t, err)
+				assert.Len(t, *blogs, 2)
+
+				blogs, err = s.GetBlogsByUserId(ctx, *userId)
+				assert.NoError(t, err)
+				assert.Len(t, *blogs, 2)
+
+				blogs, err = s.GetBlogsByTitle(ctx, "Second Blog", 10, 0)
+				assert.NoError(t, err)
+				assert.Len(t, *blogs, 1)
+			},
+		},
+		{
+			name: "update",
+			write: func(ctx context.Context, blogId, version int) error {
+				return s.UpdateBlog(ctx, "Updated Blog", "This is an updated blog.", &blogId, userId, &version)
+			},
+			check: func(t *testing.T, ctx context.Context, blogId int) {
+				blog, err := s.GetBlogByID(ctx, blogId)
+				assert.NoError(t, err)
+				assert.Equal(t, "Updated Blog", blog.Title)
+				assert.Equal(t, "This is an updated blog.", blog.Content)
+
+				blogs, err := s.GetBlogs(ctx, 10, 0)
+				assert.NoError(t, err)
+				assert.Equal(t, "Updated Blog", (*blogs)[0].Title)
+
+				blogs, err = s.GetBlogsByUserId(ctx, *userId)
+				assert.NoError(t, err)
+				assert.Equal(t, "Updated Blog", (*blogs)[0].Title)
+
+				blogs, err = s.GetBlogsByTitle(ctx, "Test Blog", 10, 0)
+				assert.NoError(t, err)
+				assert.Nil(t, *blogs)
+			},
+		},
+		{
+			name: "delete",
+			write: func(ctx context.Context, blogId, version int) error {
+				return s.DeleteBlog(ctx, blogId, *userId)
+			},
+			check: func(t *testing.T, ctx context.Context, blogId int) {
+				_, err := s.GetBlogByID(ctx, blogId)
+				assert.Equal(t, common.ErrRecordNotFound, err)
+
+				blogs, err := s.GetBlogs(ctx, 10, 0)
+				assert.NoError(t, err)
+				assert.Nil(t, *blogs)
+
+				_, err = s.GetBlogsByUserId(ctx, *userId)
+				assert.Equal(t, common.ErrRecordNotFound, err)
+
+				blogs, err = s.GetBlogsByTitle(ctx, "Test Blog", 10, 0)
+				assert.NoError(t, err)
+				assert.Nil(t, *blogs)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			blogId, version, err := createRandomBlog(db, *userId)
+			assert.NoError(t, err)
+
+			// warm every cache entry that the write could make stale
+			_, err = s.GetBlogByID(ctx, *blogId)
+			assert.NoError(t, err)
+			_, err = s.GetBlogs(ctx, 10, 0)
+			assert.NoError(t, err)
+			_, err = s.GetBlogsByUserId(ctx, *userId)
+			assert.NoError(t, err)
+			_, err = s.GetBlogsByTitle(ctx, "Test Blog", 10, 0)
+			assert.NoError(t, err)
+			_, err = s.GetBlogsByTitle(ctx, "Second Blog", 10, 0)
+			assert.NoError(t, err)
+
+			err = tc.write(ctx, *blogId, *version)
+			assert.NoError(t, err)
+
+			tc.check(t, ctx, *blogId)
+
+			t.Cleanup(func() {
+				err := cleanup()
+				assert.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestGetBlogsByTitleCacheKey(t *testing.T) {
+	s, db, cleanup, userId, err := setupTestEnvironment(t)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, _, err := createRandomBlog(db, *userId)
+		assert.NoError(t, err)
+	}
+
+	ctx := context.Background()
+
+	blogs, err := s.GetBlogsByTitle(ctx, "Test Blog", 2, 0)
+	assert.NoError(t, err)
+	assert.Len(t, *blogs, 2)
+
+	// a different page of the same search must not be served from the first page's entry
+	blogs, err = s.GetBlogsByTitle(ctx, "Test Blog", 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, *blogs, 5)
+
+	t.Cleanup(func() {
+		err := cleanup()
+		assert.NoError(t, err)
+	})
+}
+
+func TestCreateBlogEvent(t *testing.T) {
+	ctx := context.Background()
+	users := userservice.NewMemoryStore(common.NewMemoryOutbox())
+	outbox := common.NewMemoryOutbox()
+	s := NewBlogService(NewMemoryStore(users, outbox), common.NewMemoryCache(5*time.Minute, 10*time.Minute))
+
+	u := userservice.User{Username: "testuser", Email: "testuser@example.com"}
+	assert.NoError(t, users.InsertUser(ctx, &u))
+
+	err := s.CreateBlog(ctx, &CreateBlogRequest{Title: "Test Blog", Content: "This is a test blog.", UserID: u.ID})
+	assert.NoError(t, err)
+
+	// A blog post that is not stored publishes nothing.
+	err = s.CreateBlog(ctx, &CreateBlogRequest{Title: "Test Blog", Content: "This is a test blog.", UserID: u.ID + 1})
+	assert.ErrorIs(t, err, ErrUserForeignKey)
+
+	msgs := outbox.Messages()
+	if !assert.Len(t, msgs, 2) {
+		return
+	}
+	assert.Equal(t, common.BlogCreatedKey, msgs[0].RoutingKey)
+	assert.Equal(t, common.BlogPublishedKey, msgs[1].RoutingKey)
+
+	for _, msg := range msgs {
+		assert.Equal(t, common.BlogExchange, msg.Exchange)
+
+		var event struct {
+			BlogID int
+			UserID int
+			Author string
+			Title  string
+		}
+		assert.NoError(t, json.Unmarshal(msg.Payload, &event))
+		assert.NotZero(t, event.BlogID)
+		assert.Equal(t, u.ID, event.UserID)
+		assert.Equal(t, "testuser", event.Author)
+		assert.Equal(t, "Test Blog", event.Title)
+	}
+}
+
+func TestUpdateDeleteBlogEvents(t *testing.T) {
+	ctx := context.Background()
+	users := userservice.NewMemoryStore(common.NewMemoryOutbox())
+	outbox := common.NewMemoryOutbox()
+	s := NewBlogService(NewMemoryStore(users, outbox), common.NewMemoryCache(5*time.Minute, 10*time.Minute))
+
+	u := userservice.User{Username: "testuser", Email: "testuser@example.com"}
+	assert.NoError(t, users.InsertUser(ctx, &u))
+
+	assert.NoError(t, s.CreateBlog(ctx, &CreateBlogRequest{Title: "Test Blog", Content: "This is a test blog.", UserID: u.ID}))
+	id := outbox.Messages()[0].ID
+	blogs, err := s.GetBlogsByUserId(ctx, u.ID)
+	assert.NoError(t, err)
+	if !assert.Len(t, *blogs, 1) {
+		return
+	}
+	blog := (*blogs)[0]
+
+	// Changes that are refused publish nothing.
+	other := u.ID + 1
+	version := blog.Version
+	assert.ErrorIs(t, s.UpdateBlog(ctx, "Updated", "", &blog.ID, &other, &version), common.ErrRecordNotFound)
+	assert.ErrorIs(t, s.DeleteBlog(ctx, blog.ID, other), common.ErrRecordNotFound)
+
+	assert.NoError(t, s.UpdateBlog(ctx, "Updated Blog", "", &blog.ID, &u.ID, &version))
+	assert.NoError(t, s.DeleteBlog(ctx, blog.ID, u.ID))
+
+	var keys []common.BindingKey
+	var titles []string
+	for _, msg := range outbox.Messages() {
+		if msg.ID <= id+1 {
+			continue
+		}
+		keys = append(keys, msg.RoutingKey)
+
+		var event struct{ Title string }
+		assert.NoError(t, json.Unmarshal(msg.Payload, &event))
+		titles = append(titles, event.Title)
+	}
+	assert.Equal(t, []common.BindingKey{common.BlogUpdatedKey, common.BlogDeletedKey}, keys)
+	assert.Equal(t, []string{"Updated Blog", "Updated Blog"}, titles)
+}
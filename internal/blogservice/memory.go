@@ -0,0 +1,228 @@
+package blogservice
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+// MemoryStore keeps the blog posts in a map for the tests of the handlers. It pages, orders and rejects them as PostgresStore does.
+type MemoryStore struct {
+	mu     sync.Mutex
+	blogs  map[int]Blog
+	nextID int
+	// users stands in for the users table, it checks that authors exist and provides their username.
+	users  userservice.UserStore
+	outbox *common.MemoryOutbox
+}
+
+// memoryTx works on a copy of the blog posts, which replaces the blog posts of the store when the transaction commits.
+type memoryTx struct {
+	*MemoryStore
+	msgs []common.OutboxMessage
+}
+
+// NewMemoryStore creates an empty store. The messages of committed transactions are appended to outbox.
+func NewMemoryStore(users userservice.UserStore, outbox *common.MemoryOutbox) *MemoryStore {
+	return &MemoryStore{
+		blogs:  make(map[int]Blog),
+		users:  users,
+		outbox: outbox,
+	}
+}
+
+// WithTx holds the lock of the store for the whole transaction, so the transactions and the writes outside of them happen one at a time.
+func (s *MemoryStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{MemoryStore: &MemoryStore{blogs: maps.Clone(s.blogs), nextID: s.nextID, users: s.users}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.blogs = tx.blogs
+	s.nextID = tx.nextID
+	s.outbox.Append(tx.msgs...)
+
+	return nil
+}
+
+// Reindex has nothing to rebuild, the memory store has no indexes.
+func (s *MemoryStore) Reindex(ctx context.Context) error {
+	return nil
+}
+
+func (tx *memoryTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	tx.msgs = append(tx.msgs, common.OutboxMessage{Exchange: exchange, RoutingKey: key, Payload: payload, Headers: common.MessageHeaders(ctx, nil)})
+	return nil
+}
+
+func (s *MemoryStore) InsertBlog(ctx context.Context, blog *Blog) error {
+	_, err := s.users.GetUserByID(ctx, blog.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			return ErrUserForeignKey
+		default:
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	now := time.Now()
+
+	blog.ID = s.nextID
+	blog.CreatedAt = now
+	blog.UpdatedAt = now
+	blog.Version = 1
+
+	s.blogs[blog.ID] = Blog{
+		ID:        blog.ID,
+		Title:     blog.Title,
+		Content:   blog.Content,
+		UserID:    blog.UserID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) GetBlogByID(ctx context.Context, id int) (*Blog, error) {
+	s.mu.Lock()
+	b, ok := s.blogs[id]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, common.ErrRecordNotFound
+	}
+
+	u, err := s.users.GetUserByID(ctx, b.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	blog := listed(b)
+	blog.User.Username = u.Username
+
+	return &blog, nil
+}
+
+func (s *MemoryStore) UpdateBlog(ctx context.Context, blog *Blog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blogs[blog.ID]
+	if !ok || b.Version != blog.Version || b.UserID != blog.UserID {
+		return common.ErrRecordNotFound
+	}
+
+	if blog.Title != "" {
+		b.Title = blog.Title
+	}
+	if blog.Content != "" {
+		b.Content = blog.Content
+	}
+	b.Version++
+	b.UpdatedAt = time.Now()
+	s.blogs[b.ID] = b
+
+	blog.Version = b.Version
+	blog.CreatedAt = b.CreatedAt
+	blog.UpdatedAt = b.UpdatedAt
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteBlog(ctx context.Context, id, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.blogs[id]
+	if !ok || b.UserID != userID {
+		return common.ErrRecordNotFound
+	}
+
+	delete(s.blogs, id)
+
+	return nil
+}
+
+func (s *MemoryStore) GetBlogsByUserID(ctx context.Context, userID int) (*[]Blog, error) {
+	blogs := s.list(func(b Blog) bool { return b.UserID == userID }, -1, 0)
+	if len(blogs) == 0 {
+		return nil, common.ErrRecordNotFound
+	}
+
+	return &blogs, nil
+}
+
+func (s *MemoryStore) GetBlogs(ctx context.Context, limit, offset int) (*[]Blog, error) {
+	blogs := s.list(func(b Blog) bool { return true }, limit, offset)
+	return &blogs, nil
+}
+
+func (s *MemoryStore) GetBlogsByTitle(ctx context.Context, title string, limit, offset int) (*[]Blog, error) {
+	blogs := s.list(func(b Blog) bool { return strings.Contains(b.Title, title) }, limit, offset)
+	return &blogs, nil
+}
+
+// list returns a page of the blog posts matching keep, newest first. A negative limit returns every blog post.
+func (s *MemoryStore) list(keep func(Blog) bool, limit, offset int) []Blog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []Blog
+	for _, b := range s.blogs {
+		if keep(b) {
+			matched = append(matched, b)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		}
+		return matched[i].ID > matched[j].ID
+	})
+
+	if offset >= len(matched) {
+		return nil
+	}
+	matched = matched[offset:]
+	if limit >= 0 && limit < len(matched) {
+		matched = matched[:limit]
+	}
+
+	var blogs []Blog
+	for _, b := range matched {
+		blogs = append(blogs, listed(b))
+	}
+
+	return blogs
+}
+
+// listed returns the blog post as the queries return it, with the author in User rather than UserID.
+func listed(b Blog) Blog {
+	return Blog{
+		ID:        b.ID,
+		Title:     b.Title,
+		Content:   b.Content,
+		User:      userservice.User{ID: b.UserID},
+		CreatedAt: b.CreatedAt,
+		UpdatedAt: b.UpdatedAt,
+		Version:   b.Version,
+	}
+}
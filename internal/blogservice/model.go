@@ -15,8 +15,33 @@ var (
 	ErrUserForeignKey = errors.New("user_id does not exist")
 )
 
-func newBlogModel(db *sql.DB) *BlogModel {
-	return &BlogModel{db: db}
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db, q: db}
+}
+
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&postgresTx{PostgresStore: PostgresStore{db: s.db, q: tx}, tx: tx})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Reindex rebuilds the indexes of the blogs table, which the title searches and the listings use.
+func (s *PostgresStore) Reindex(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "REINDEX TABLE CONCURRENTLY blogs")
+	return err
+}
+
+func (t *postgresTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	return common.EnqueueOutbox(ctx, t.tx, exchange, key, payload)
 }
 
 // ForeignKeyError is a helper function to check if the error is a foreign key constraint error.
@@ -31,15 +56,16 @@ func ForeignKeyError(err error, name string) bool {
 	return false
 }
 
-func (m *BlogModel) insert(title, content string, id int) error {
+func (s *PostgresStore) InsertBlog(ctx context.Context, blog *Blog) error {
 	query := `
 		INSERT INTO blogs (title, content, user_id)
-		VALUES ($1, $2, $3)`
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at, version`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := m.db.ExecContext(ctx, query, title, content, id)
+	err := s.q.QueryRowContext(ctx, query, blog.Title, blog.Content, blog.UserID).Scan(&blog.ID, &blog.CreatedAt, &blog.UpdatedAt, &blog.Version)
 	if err != nil {
 		switch {
 		case ForeignKeyError(err, "blogs_user_id_fkey"):
@@ -52,18 +78,18 @@ func (m *BlogModel) insert(title, content string, id int) error {
 	return nil
 }
 
-// getBlogById is a method to get a blog by its ID joining the users table to get the user's name.
-func (m *BlogModel) getBlogById(id int) (*Blog, error) {
+// GetBlogByID is a method to get a blog by its ID joining the users table to get the user's name.
+func (s *PostgresStore) GetBlogByID(ctx context.Context, id int) (*Blog, error) {
 	query := `
 		SELECT b.id, b.title, b.content, b.user_id, b.created_at, b.updated_at, b.version, u.username
 		FROM blogs b
 		JOIN users u ON b.user_id = u.id
 		WHERE b.id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	row := m.db.QueryRowContext(ctx, query, id)
+	row := s.q.QueryRowContext(ctx, query, id)
 
 	var blog Blog
 	err := row.Scan(&blog.ID, &blog.Title, &blog.Content, &blog.User.ID, &blog.CreatedAt, &blog.UpdatedAt, &blog.Version, &blog.User.Username)
@@ -80,7 +106,7 @@ func (m *BlogModel) getBlogById(id int) (*Blog, error) {
 
 }
 
-func (m *BlogModel) updateBlog(blog *Blog) error {
+func (s *PostgresStore) UpdateBlog(ctx context.Context, blog *Blog) error {
 	query := `
 		UPDATE blogs
 		SET
@@ -90,10 +116,10 @@ func (m *BlogModel) updateBlog(blog *Blog) error {
 		WHERE id = $3 AND version = $4 AND user_id = $5
 		RETURNING version, created_at, updated_at`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.db.QueryRowContext(ctx, query, blog.Title, blog.Content, blog.ID, blog.Version, blog.UserID).Scan(&blog.Version, &blog.CreatedAt, &blog.UpdatedAt)
+	err := s.q.QueryRowContext(ctx, query, blog.Title, blog.Content, blog.ID, blog.Version, blog.UserID).Scan(&blog.Version, &blog.CreatedAt, &blog.UpdatedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -106,15 +132,15 @@ func (m *BlogModel) updateBlog(blog *Blog) error {
 	return nil
 }
 
-func (m *BlogModel) deleteBlog(blogId, userId int) error {
+func (s *PostgresStore) DeleteBlog(ctx context.Context, blogId, userId int) error {
 	query := `
 		DELETE FROM blogs
 		WHERE id = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	res, err := m.db.ExecContext(ctx, query, blogId, userId)
+	res, err := s.q.ExecContext(ctx, query, blogId, userId)
 	if err != nil {
 		return err
 	}
@@ -136,17 +162,17 @@ func (m *BlogModel) deleteBlog(blogId, userId int) error {
 	return nil
 }
 
-func (m *BlogModel) getBlogsByUserId(userID int) (*[]Blog, error) {
+func (s *PostgresStore) GetBlogsByUserID(ctx context.Context, userID int) (*[]Blog, error) {
 	query := `
 		SELECT id, title, content, user_id, created_at, updated_at, version
 		FROM blogs
 		WHERE user_id = $1
-		ORDER BY created_at DESC`
+		ORDER BY created_at DESC, id DESC`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	rows, err := m.db.QueryContext(ctx, query, userID)
+	rows, err := s.q.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
@@ -177,15 +203,18 @@ func (m *BlogModel) getBlogsByUserId(userID int) (*[]Blog, error) {
 	return &blogs, nil
 }
 
-// getBlogs to get all blogs. set limit and offset to get paginated results and sort the results by created_at descending order
-func (m *BlogModel) getBlogs(ctx context.Context, limit, offset int) (*[]Blog, error) {
+// GetBlogs to get all blogs. set limit and offset to get paginated results and sort the results by created_at descending order
+func (s *PostgresStore) GetBlogs(ctx context.Context, limit, offset int) (*[]Blog, error) {
 	query := `
 		SELECT id, title, content, user_id, created_at, updated_at, version
 		FROM blogs
-		ORDER BY created_at DESC
+		ORDER BY created_at DESC, id DESC
 		LIMIT $1 OFFSET $2`
 
-	rows, err := m.db.QueryContext(ctx, query, limit, offset)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -208,16 +237,19 @@ func (m *BlogModel) getBlogs(ctx context.Context, limit, offset int) (*[]Blog, e
 	return &blogs, nil
 }
 
-// getBlogsByTitle is a method to get blogs by title. This method is used to demonstrate the use of LIKE operator in SQL query.
-func (m *BlogModel) getBlogsByTitle(ctx context.Context, title string, limit, offset int) (*[]Blog, error) {
+// GetBlogsByTitle is a method to get blogs by title. This method is used to demonstrate the use of LIKE operator in SQL query.
+func (s *PostgresStore) GetBlogsByTitle(ctx context.Context, title string, limit, offset int) (*[]Blog, error) {
 	query := `
 		SELECT id, title, content, user_id, created_at, updated_at, version
 		FROM blogs
 		WHERE title LIKE $1
-		ORDER BY created_at DESC
+		ORDER BY created_at DESC, id DESC
 		LIMIT $2 OFFSET $3`
 
-	rows, err := m.db.QueryContext(ctx, query, "%"+title+"%", limit, offset)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, "%"+title+"%", limit, offset)
 	if err != nil {
 		return nil, err
 	}
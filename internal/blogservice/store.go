@@ -0,0 +1,40 @@
+package blogservice
+
+import (
+	"context"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// Store is the persistence layer of the blog service. PostgresStore is used in production and MemoryStore in tests, both follow the same contract, which is checked by the conformance suite in store_test.go.
+type Store interface {
+	BlogStore
+
+	// WithTx runs fn in a transaction, so a blog post is only stored together with the outbox message of its event. The transaction commits when fn returns nil.
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
+	// Reindex rebuilds the indexes of the blog posts without blocking the reads and writes. It cannot run in a transaction.
+	Reindex(ctx context.Context) error
+}
+
+// Tx writes the blog posts and their events within the transaction of WithTx.
+type Tx interface {
+	BlogStore
+	common.OutboxWriter
+}
+
+type BlogStore interface {
+	// InsertBlog stores the blog post and sets its ID, timestamps and version. It returns ErrUserForeignKey when the user does not exist.
+	InsertBlog(ctx context.Context, blog *Blog) error
+	// GetBlogByID returns the blog post together with the ID and username of its author.
+	GetBlogByID(ctx context.Context, id int) (*Blog, error)
+	// UpdateBlog replaces the title and content that are not empty, if the blog post belongs to blog.UserID and is still at blog.Version. The blog is updated with the new version and timestamps.
+	UpdateBlog(ctx context.Context, blog *Blog) error
+	// DeleteBlog deletes the blog post if it belongs to the user.
+	DeleteBlog(ctx context.Context, id, userID int) error
+	// GetBlogsByUserID returns the blog posts of the user, newest first. It returns common.ErrRecordNotFound when the user has none.
+	GetBlogsByUserID(ctx context.Context, userID int) (*[]Blog, error)
+	// GetBlogs returns a page of blog posts, newest first.
+	GetBlogs(ctx context.Context, limit, offset int) (*[]Blog, error)
+	// GetBlogsByTitle returns a page of the blog posts whose title contains title, newest first.
+	GetBlogsByTitle(ctx context.Context, title string, limit, offset int) (*[]Blog, error)
+}
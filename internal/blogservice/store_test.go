@@ -0,0 +1,192 @@
+package blogservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) (Store, userservice.UserStore) {
+		users := userservice.NewMemoryStore(common.NewMemoryOutbox())
+		return NewMemoryStore(users, common.NewMemoryOutbox()), users
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+
+	testStore(t, func(t *testing.T) (Store, userservice.UserStore) {
+		t.Cleanup(func() {
+			for _, table := range []string{"blogs", "outbox", "users"} {
+				_, err := db.Exec("DELETE FROM " + table)
+				assert.NoError(t, err)
+			}
+		})
+
+		return NewPostgresStore(db), userservice.NewPostgresStore(db)
+	})
+}
+
+// testStore checks the contract of Store that the service relies on. newStore returns an empty store together with the store of its users.
+func testStore(t *testing.T, newStore func(t *testing.T) (Store, userservice.UserStore)) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (Store, int) {
+		s, users := newStore(t)
+
+		u := userservice.User{Username: "testuser", Email: "testuser@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &u))
+
+		return s, u.ID
+	}
+
+	insert := func(t *testing.T, s BlogStore, title string, userID int) *Blog {
+		blog := Blog{Title: title, Content: "This is a test blog.", UserID: userID}
+		assert.NoError(t, s.InsertBlog(ctx, &blog))
+		return &blog
+	}
+
+	titles := func(blogs *[]Blog) []string {
+		var titles []string
+		for _, b := range *blogs {
+			titles = append(titles, b.Title)
+		}
+		return titles
+	}
+
+	t.Run("insert blog", func(t *testing.T) {
+		s, userID := setup(t)
+		blog := insert(t, s, "Test Blog", userID)
+		assert.NotZero(t, blog.ID)
+		assert.Equal(t, 1, blog.Version)
+		assert.False(t, blog.CreatedAt.IsZero())
+
+		got, err := s.GetBlogByID(ctx, blog.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Test Blog", got.Title)
+		assert.Equal(t, "This is a test blog.", got.Content)
+		assert.Equal(t, userID, got.User.ID)
+		assert.Equal(t, "testuser", got.User.Username)
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		s, userID := setup(t)
+
+		blog := Blog{Title: "Test Blog", Content: "This is a test blog.", UserID: userID + 1}
+		assert.ErrorIs(t, s.InsertBlog(ctx, &blog), ErrUserForeignKey)
+	})
+
+	t.Run("blog not found", func(t *testing.T) {
+		s, userID := setup(t)
+
+		_, err := s.GetBlogByID(ctx, 1)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+		_, err = s.GetBlogsByUserID(ctx, userID)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+		assert.ErrorIs(t, s.DeleteBlog(ctx, 1, userID), common.ErrRecordNotFound)
+	})
+
+	t.Run("update blog", func(t *testing.T) {
+		s, userID := setup(t)
+		blog := insert(t, s, "Test Blog", userID)
+
+		stale := Blog{ID: blog.ID, Title: "Stale", UserID: userID, Version: 2}
+		assert.ErrorIs(t, s.UpdateBlog(ctx, &stale), common.ErrRecordNotFound)
+
+		other := Blog{ID: blog.ID, Title: "Other", UserID: userID + 1, Version: 1}
+		assert.ErrorIs(t, s.UpdateBlog(ctx, &other), common.ErrRecordNotFound)
+
+		update := Blog{ID: blog.ID, Title: "Updated", UserID: userID, Version: 1}
+		assert.NoError(t, s.UpdateBlog(ctx, &update))
+		assert.Equal(t, 2, update.Version)
+
+		// An empty content keeps the current one.
+		got, err := s.GetBlogByID(ctx, blog.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Updated", got.Title)
+		assert.Equal(t, "This is a test blog.", got.Content)
+		assert.Equal(t, 2, got.Version)
+	})
+
+	t.Run("delete blog", func(t *testing.T) {
+		s, userID := setup(t)
+		blog := insert(t, s, "Test Blog", userID)
+
+		assert.ErrorIs(t, s.DeleteBlog(ctx, blog.ID, userID+1), common.ErrRecordNotFound)
+		assert.NoError(t, s.DeleteBlog(ctx, blog.ID, userID))
+
+		_, err := s.GetBlogByID(ctx, blog.ID)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("list blogs", func(t *testing.T) {
+		s, userID := setup(t)
+		for _, title := range []string{"First Blog", "Second Post", "Third Blog"} {
+			insert(t, s, title, userID)
+		}
+
+		blogs, err := s.GetBlogsByUserID(ctx, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Third Blog", "Second Post", "First Blog"}, titles(blogs))
+
+		blogs, err = s.GetBlogs(ctx, 2, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Third Blog", "Second Post"}, titles(blogs))
+
+		blogs, err = s.GetBlogs(ctx, 2, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"First Blog"}, titles(blogs))
+
+		blogs, err = s.GetBlogs(ctx, 2, 3)
+		assert.NoError(t, err)
+		assert.Empty(t, *blogs)
+
+		blogs, err = s.GetBlogsByTitle(ctx, "Blog", 10, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Third Blog", "First Blog"}, titles(blogs))
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		s, userID := setup(t)
+
+		var id int
+		err := s.WithTx(ctx, func(tx Tx) error {
+			id = insert(t, tx, "Test Blog", userID).ID
+			return tx.EnqueueOutbox(ctx, common.BlogExchange, common.BlogPublishedKey, []byte("{}"))
+		})
+		assert.NoError(t, err)
+
+		_, err = s.GetBlogByID(ctx, id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		s, userID := setup(t)
+
+		rollback := errors.New("rollback")
+		var id int
+		err := s.WithTx(ctx, func(tx Tx) error {
+			id = insert(t, tx, "Test Blog", userID).ID
+			return rollback
+		})
+		assert.ErrorIs(t, err, rollback)
+
+		_, err = s.GetBlogByID(ctx, id)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("reindex", func(t *testing.T) {
+		s, userID := setup(t)
+		id := insert(t, s, "Test Blog", userID).ID
+
+		assert.NoError(t, s.Reindex(ctx))
+
+		_, err := s.GetBlogByID(ctx, id)
+		assert.NoError(t, err)
+	})
+}
@@ -20,11 +20,18 @@ type Blog struct {
 	Version   int              `json:"version"`
 }
 
-type BlogModel struct {
+// PostgresStore keeps the blog posts in the blogs table, and reads their authors from users.
+type PostgresStore struct {
 	db *sql.DB
+	q  common.Querier
+}
+
+type postgresTx struct {
+	PostgresStore
+	tx *sql.Tx
 }
 
 type BlogService struct {
-	m *BlogModel
-	c *common.Cache
+	store Store
+	c     common.Cache
 }
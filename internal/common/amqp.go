@@ -2,114 +2,715 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-type Exchange string
+const (
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
 
-type Queue string
+	// consumerPrefetch is the number of unacknowledged deliveries a consumer may hold at a time.
+	consumerPrefetch = 10
+)
 
-type BindingKey string
+// MessageBroker is a RabbitMQ client that survives broker restarts. It watches the connection and its channels, reopens them with backoff, declares the registered topologies again and resumes every consumer on the same delivery channel.
+type MessageBroker struct {
+	uri    string
+	logger *slog.Logger
 
-type MessageProducer interface {
-	Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange) error
-}
+	mu         sync.RWMutex
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	topologies []Topology
+	consumers  []*consumer
 
-type MessageConsumer interface {
-	Consume(key BindingKey, exchange Exchange, queue Queue) (<-chan amqp.Delivery, error)
+	closed     chan struct{}
+	closeOnce  sync.Once
+	supervisor sync.WaitGroup
+	forwarders sync.WaitGroup
 }
 
-const (
-	UserExchange     Exchange   = "user_exchange"
-	UserCreatedQueue Queue      = "user_created_queue"
-	UserCreatedKey   BindingKey = "user.created"
-)
-
-type MessageBroker struct {
-	conn *amqp.Connection
-	ch   *amqp.Channel
+// consumer is a subscription to a queue. Its out channel stays open across reconnects and is only closed by MessageBroker.Close.
+type consumer struct {
+	queue Queue
+	out   chan Delivery
+	// ch is the channel the consumer receives on, guarded by the mutex of the broker.
+	ch *amqp.Channel
 }
 
-func NewMessageBroker(URI string) (*MessageBroker, error) {
-	conn, ch, err := connectAMQP(URI)
-	if err != nil {
+func NewMessageBroker(URI string, logger *slog.Logger) (*MessageBroker, error) {
+	mb := &MessageBroker{
+		uri:    URI,
+		logger: logger,
+		closed: make(chan struct{}),
+	}
+
+	if err := mb.connect(); err != nil {
 		return nil, err
 	}
 
-	return &MessageBroker{
-		conn: conn,
-		ch:   ch,
-	}, nil
+	mb.supervisor.Add(1)
+	go mb.supervise()
+
+	return mb, nil
 }
 
-func connectAMQP(URI string) (*amqp.Connection, *amqp.Channel, error) {
-	conn, err := amqp.Dial(URI)
+// connect dials the broker, declares the known topologies and starts the known consumers.
+func (mb *MessageBroker) connect() error {
+	conn, err := amqp.Dial(mb.uri)
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not connect to AMQP: %w", err)
+		return fmt.Errorf("could not connect to AMQP: %w", err)
 	}
 
-	ch, err := conn.Channel()
+	ch, err := openPublishChannel(conn)
 	if err != nil {
 		conn.Close()
-		return nil, nil, fmt.Errorf("could not open channel: %w", err)
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for _, t := range mb.topologies {
+		if err := declare(conn, t); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	for _, c := range mb.consumers {
+		if err := mb.startConsumer(conn, c); err != nil {
+			conn.Close()
+			return err
+		}
 	}
 
-	return conn, ch, nil
+	mb.conn = conn
+	mb.ch = ch
+
+	return nil
 }
 
-// Close closes the connection and channel of the message broker.
-func (mb *MessageBroker) Close() error {
-	err := mb.ch.Close()
+// openPublishChannel opens the channel Publish uses.
+func openPublishChannel(conn *amqp.Connection) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
 	if err != nil {
+		return nil, fmt.Errorf("could not open channel: %w", err)
+	}
+
+	// Publisher confirms let Publish wait until the broker has taken responsibility for the message.
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not enable publisher confirms: %w", err)
+	}
+
+	return ch, nil
+}
+
+// supervise waits for the connection or the publish channel to close and restores them until the broker is closed.
+func (mb *MessageBroker) supervise() {
+	defer mb.supervisor.Done()
+
+	var (
+		conn       *amqp.Connection
+		connClosed chan *amqp.Error
+	)
+	for {
+		mb.mu.RLock()
+		if mb.conn != conn {
+			conn = mb.conn
+			connClosed = conn.NotifyClose(make(chan *amqp.Error, 1))
+		}
+		chClosed := mb.ch.NotifyClose(make(chan *amqp.Error, 1))
+		mb.mu.RUnlock()
+
+		var err *amqp.Error
+		select {
+		case err = <-connClosed:
+		case err = <-chClosed:
+		case <-mb.closed:
+			return
+		}
+
+		msg := "lost the channel to the message broker"
+		if conn.IsClosed() {
+			msg = "lost connection to the message broker"
+		}
+		if err != nil {
+			mb.logger.Error(msg, slog.String("error", err.Error()))
+		} else {
+			mb.logger.Error(msg)
+		}
+
+		mb.mu.Lock()
+		mb.ch = nil
+		mb.mu.Unlock()
+
+		for attempt := 0; ; attempt++ {
+			delay := reconnectBackoff(attempt)
+			select {
+			case <-time.After(delay):
+			case <-mb.closed:
+				return
+			}
+
+			reconnected, err := mb.restore()
+			if err == nil {
+				msg := "reopened the channel to the message broker"
+				if reconnected {
+					msg = "reconnected to the message broker"
+				}
+				mb.logger.Info(msg, slog.Int("attempt", attempt+1))
+				break
+			}
+
+			mb.logger.Info("delaying reconnect to the message broker", slog.Int("attempt", attempt+1), slog.Duration("delay", delay), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// restore reopens the publish channel, or reconnects when the connection is closed too.
+func (mb *MessageBroker) restore() (bool, error) {
+	mb.mu.Lock()
+	conn := mb.conn
+	if !conn.IsClosed() {
+		defer mb.mu.Unlock()
+
+		ch, err := openPublishChannel(conn)
+		if err != nil {
+			return false, err
+		}
+		mb.ch = ch
+
+		return false, nil
+	}
+	mb.mu.Unlock()
+
+	return true, mb.connect()
+}
+
+// reconnectBackoff returns the delay before the given reconnect attempt, using exponential backoff with jitter.
+func reconnectBackoff(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = min(reconnectBaseDelay<<attempt, reconnectMaxDelay)
+	}
+
+	return delay/2 + time.Duration(rand.Int64N(int64(delay/2)+1))
+}
+
+// Connected reports whether the broker can publish and every consumer is receiving.
+func (mb *MessageBroker) Connected() bool {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	if mb.ch == nil || mb.ch.IsClosed() || mb.conn.IsClosed() {
+		return false
+	}
+
+	for _, c := range mb.consumers {
+		if c.ch.IsClosed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Close closes the connection and channel of the message broker and the delivery channels of its consumers.
+func (mb *MessageBroker) Close() error {
+	var err error
+
+	mb.closeOnce.Do(func() {
+		close(mb.closed)
+
+		mb.mu.RLock()
+		conn := mb.conn
+		mb.mu.RUnlock()
+
+		if !conn.IsClosed() {
+			err = conn.Close()
+		}
+
+		mb.supervisor.Wait()
+		mb.forwarders.Wait()
+
+		mb.mu.Lock()
+		for _, c := range mb.consumers {
+			close(c.out)
+		}
+		mb.consumers = nil
+		mb.mu.Unlock()
+	})
+
+	return err
+}
+
+// Declare declares the topology now and again after every reconnect.
+func (mb *MessageBroker) Declare(t Topology) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.ch == nil {
+		return ErrBrokerNotConnected
+	}
+
+	if err := declare(mb.conn, t); err != nil {
 		return err
 	}
 
-	err = mb.conn.Close()
+	mb.topologies = append(mb.topologies, t)
+
+	return nil
+}
+
+// declare uses a channel of its own because a failed declaration closes the channel it was made on.
+func declare(conn *amqp.Connection, t Topology) error {
+	ch, err := conn.Channel()
 	if err != nil {
-		return err
+		return fmt.Errorf("could not open channel: %w", err)
+	}
+	defer ch.Close()
+
+	for _, e := range t.Exchanges {
+		err := ch.ExchangeDeclare(string(e.Name), e.Kind, true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		_, err := ch.QueueDeclare(string(q.Name), !q.Exclusive, q.Exclusive, q.Exclusive, false, q.Args)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		err := ch.QueueBind(string(b.Queue), string(b.Key), string(b.Exchange), false, nil)
+		if err != nil {
+			return fmt.Errorf("could not bind queue %s: %w", b.Queue, err)
+		}
+	}
+
+	// The replacements are bound by now, so the messages moved out of a retired queue reach them.
+	retired := make(map[Queue][]BindingSpec)
+	var queues []Queue
+	for _, b := range t.Retired {
+		if _, ok := retired[b.Queue]; !ok {
+			queues = append(queues, b.Queue)
+		}
+		retired[b.Queue] = append(retired[b.Queue], b)
+	}
+
+	for _, queue := range queues {
+		if err := retire(conn, queue, retired[queue]); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func SetupUserExchange(mb *MessageBroker) error {
-	err := mb.ch.ExchangeDeclare(string(UserExchange), "direct", true, false, false, false, nil)
+// retire unbinds a queue, publishes its messages again to the exchanges they came from and deletes it. A queue that no longer exists is already retired. A queue that still has consumers is kept, since they may be older replicas; the next declaration tries again.
+func retire(conn *amqp.Connection, queue Queue, bindings []BindingSpec) error {
+	ch, err := conn.Channel()
 	if err != nil {
-		return err
+		return fmt.Errorf("could not open channel: %w", err)
 	}
+	defer ch.Close()
 
-	_, err = mb.ch.QueueDeclare(string(UserCreatedQueue), true, false, false, false, nil)
+	q, err := ch.QueueDeclarePassive(string(queue), true, false, false, false, nil)
 	if err != nil {
-		return err
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			return nil
+		}
+		return fmt.Errorf("could not inspect queue %s: %w", queue, err)
 	}
 
-	err = mb.ch.QueueBind(string(UserCreatedQueue), string(UserCreatedKey), string(UserExchange), false, nil)
+	for _, b := range bindings {
+		err := ch.QueueUnbind(string(b.Queue), string(b.Key), string(b.Exchange), nil)
+		if err != nil {
+			return fmt.Errorf("could not unbind queue %s: %w", b.Queue, err)
+		}
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		return fmt.Errorf("could not put channel into confirm mode: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// A message that is not acknowledged goes back to the queue when the channel closes.
+	for moved := 0; moved < q.Messages; moved++ {
+		d, ok, err := ch.Get(string(queue), false)
+		if err != nil {
+			return fmt.Errorf("could not read queue %s: %w", queue, err)
+		}
+		if !ok {
+			break
+		}
+
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, d.Exchange, d.RoutingKey, false, false, amqp.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Headers:      d.Headers,
+			Timestamp:    d.Timestamp,
+			Expiration:   d.Expiration,
+			Body:         d.Body,
+		})
+		if err != nil {
+			return fmt.Errorf("could not move message out of queue %s: %w", queue, err)
+		}
+
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			return fmt.Errorf("could not move message out of queue %s: %w", queue, err)
+		}
+		if !acked {
+			return fmt.Errorf("could not move message out of queue %s: %w", queue, ErrMessageNotAcked)
+		}
+
+		if err := d.Ack(false); err != nil {
+			return fmt.Errorf("could not acknowledge message: %w", err)
+		}
+	}
+
+	_, err = ch.QueueDelete(string(queue), true, true, false)
 	if err != nil {
-		return err
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+			return nil
+		}
+		return fmt.Errorf("could not delete queue %s: %w", queue, err)
 	}
 
 	return nil
 }
 
-func (mb *MessageBroker) Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange) error {
-	err := mb.ch.PublishWithContext(ctx, string(exchange), string(key), false, false, amqp.Publishing{
-		ContentType: "text/plain",
-		Body:        msg,
-	})
+// Publish publishes the message and waits for the broker to confirm it. A nil error means the broker has accepted the message.
+func (mb *MessageBroker) Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange, opts ...PublishOption) error {
+	var o PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	ctx, span := startPublishSpan(ctx, key, exchange, &o)
+	err := mb.publish(ctx, msg, key, exchange, o)
+	EndSpan(span, err)
+
+	return err
+}
+
+func (mb *MessageBroker) publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange, o PublishOptions) error {
+	publishing := amqp.Publishing{
+		ContentType:  "text/plain",
+		DeliveryMode: amqp.Persistent,
+		Headers:      amqp.Table(o.Headers),
+		Body:         msg,
+	}
+	if o.Expiration > 0 {
+		publishing.Expiration = strconv.FormatInt(o.Expiration.Milliseconds(), 10)
+	}
+
+	mb.mu.RLock()
+	ch := mb.ch
+	mb.mu.RUnlock()
+
+	if ch == nil {
+		return fmt.Errorf("could not publish message: %w", ErrBrokerNotConnected)
+	}
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, string(exchange), string(key), false, false, publishing)
 	if err != nil {
 		return fmt.Errorf("could not publish message: %w", err)
 	}
 
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("could not publish message: %w", err)
+	}
+
+	if !acked {
+		return fmt.Errorf("could not publish message: %w", ErrMessageNotAcked)
+	}
+
 	return nil
 }
 
-func (mb *MessageBroker) Consume(key BindingKey, exchange Exchange, queue Queue) (<-chan amqp.Delivery, error) {
-	msgs, err := mb.ch.Consume(string(queue), string(key), false, false, false, false, nil)
+// Consume subscribes to the queue. The returned channel keeps delivering across reconnects and is closed when the broker is closed.
+func (mb *MessageBroker) Consume(key BindingKey, exchange Exchange, queue Queue) (<-chan Delivery, error) {
+	c := &consumer{
+		queue: queue,
+		out:   make(chan Delivery),
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	select {
+	case <-mb.closed:
+		return nil, fmt.Errorf("could not consume message: %w", ErrBrokerClosed)
+	default:
+	}
+
+	if mb.ch == nil {
+		return nil, fmt.Errorf("could not consume message: %w", ErrBrokerNotConnected)
+	}
+
+	if err := mb.startConsumer(mb.conn, c); err != nil {
+		return nil, err
+	}
+
+	mb.consumers = append(mb.consumers, c)
+
+	return c.out, nil
+}
+
+// startConsumer opens a channel for the consumer on conn and forwards its deliveries until the channel closes. It is called with the mutex held.
+func (mb *MessageBroker) startConsumer(conn *amqp.Connection, c *consumer) error {
+	ch, err := conn.Channel()
 	if err != nil {
-		return nil, fmt.Errorf("could not consume message: %w", err)
+		return fmt.Errorf("could not open channel: %w", err)
 	}
 
-	return msgs, nil
+	if err := ch.Qos(consumerPrefetch, 0, false); err != nil {
+		ch.Close()
+		return fmt.Errorf("could not set prefetch: %w", err)
+	}
+
+	msgs, err := ch.Consume(string(c.queue), "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("could not consume message: %w", err)
+	}
+
+	c.ch = ch
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	cancelled := ch.NotifyCancel(make(chan string, 1))
+
+	mb.forwarders.Add(1)
+	go func() {
+		defer mb.forwarders.Done()
+
+		for msg := range msgs {
+			select {
+			case c.out <- fromAMQP(msg):
+			case <-mb.closed:
+				// The delivery is requeued by the broker once the connection closes.
+				return
+			}
+		}
+
+		select {
+		case <-mb.closed:
+			return
+		default:
+		}
+
+		// A closed connection is restored by the supervisor, which restarts every consumer.
+		if conn.IsClosed() {
+			return
+		}
+
+		attrs := []any{slog.String("queue", string(c.queue))}
+		select {
+		case err := <-closed:
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+		case <-cancelled:
+			attrs = append(attrs, slog.String("error", "cancelled by the broker"))
+		default:
+		}
+		mb.logger.Error("lost the consumer channel to the message broker", attrs...)
+
+		ch.Close()
+		mb.restartConsumer(conn, c)
+	}()
+
+	return nil
+}
+
+// restartConsumer starts the consumer again on conn with backoff, unless conn closes in the meantime.
+func (mb *MessageBroker) restartConsumer(conn *amqp.Connection, c *consumer) {
+	for attempt := 0; ; attempt++ {
+		delay := reconnectBackoff(attempt)
+		select {
+		case <-time.After(delay):
+		case <-mb.closed:
+			return
+		}
+
+		mb.mu.Lock()
+		if mb.conn != conn || conn.IsClosed() {
+			mb.mu.Unlock()
+			return
+		}
+		err := mb.startConsumer(conn, c)
+		mb.mu.Unlock()
+
+		if err == nil {
+			mb.logger.Info("restarted the consumer", slog.String("queue", string(c.queue)), slog.Int("attempt", attempt+1))
+			return
+		}
+
+		mb.logger.Info("delaying restart of the consumer", slog.String("queue", string(c.queue)), slog.Int("attempt", attempt+1), slog.Duration("delay", delay), slog.String("error", err.Error()))
+	}
+}
+
+// Peek returns up to limit messages from the head of the queue and leaves them in it.
+func (mb *MessageBroker) Peek(queue Queue, limit int) ([]Delivery, error) {
+	ch, err := mb.channel()
+	if err != nil {
+		return nil, err
+	}
+	// Closing the channel hands every message that was fetched back to the queue.
+	defer ch.Close()
+
+	messages := []Delivery{}
+	for len(messages) < limit {
+		d, ok, err := ch.Get(string(queue), false)
+		if err != nil {
+			return nil, fmt.Errorf("could not read queue %s: %w", queue, err)
+		}
+		if !ok {
+			break
+		}
+
+		delivery := fromAMQP(d)
+		delivery.Acknowledger = nil
+		messages = append(messages, delivery)
+	}
+
+	return messages, nil
+}
+
+// Replay publishes up to limit dead lettered messages back to where they came from and removes them from the queue.
+func (mb *MessageBroker) Replay(ctx context.Context, queue Queue, limit int) (int, error) {
+	ch, err := mb.channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	// Only replay the messages present now, so that a message which fails again cannot be picked up twice.
+	q, err := ch.QueueDeclarePassive(string(queue), true, false, false, false, nil)
+	if err != nil {
+		return 0, fmt.Errorf("could not inspect queue %s: %w", queue, err)
+	}
+	limit = min(limit, q.Messages)
+
+	var replayed int
+	for replayed < limit {
+		d, ok, err := ch.Get(string(queue), false)
+		if err != nil {
+			return replayed, fmt.Errorf("could not read queue %s: %w", queue, err)
+		}
+		if !ok {
+			break
+		}
+
+		exchange, key, ok := deadLetterOrigin(fromTable(d.Headers))
+		if !ok {
+			d.Nack(false, true)
+			return replayed, fmt.Errorf("message in %s was not dead lettered by the broker", queue)
+		}
+
+		// The replayed message continues the trace and the request of the original one.
+		headers := republishHeaders(fromTable(d.Headers))
+		err = mb.Publish(ExtractRequestID(ExtractTrace(ctx, headers), headers), d.Body, key, exchange, WithHeaders(headers))
+		if err != nil {
+			d.Nack(false, true)
+			return replayed, err
+		}
+
+		if err := d.Ack(false); err != nil {
+			return replayed, fmt.Errorf("could not acknowledge message: %w", err)
+		}
+
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// channel opens a short lived channel on the current connection.
+func (mb *MessageBroker) channel() (*amqp.Channel, error) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	if mb.ch == nil {
+		return nil, ErrBrokerNotConnected
+	}
+
+	ch, err := mb.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not open channel: %w", err)
+	}
+
+	return ch, nil
+}
+
+// amqpAcknowledger settles a RabbitMQ delivery.
+type amqpAcknowledger struct {
+	d amqp.Delivery
+}
+
+func (a amqpAcknowledger) Ack() error {
+	return a.d.Ack(false)
+}
+
+func (a amqpAcknowledger) Nack(requeue bool) error {
+	return a.d.Nack(false, requeue)
+}
+
+func fromAMQP(d amqp.Delivery) Delivery {
+	return Delivery{
+		Exchange:     Exchange(d.Exchange),
+		RoutingKey:   BindingKey(d.RoutingKey),
+		Headers:      fromTable(d.Headers),
+		Body:         d.Body,
+		Timestamp:    d.Timestamp,
+		Acknowledger: amqpAcknowledger{d: d},
+	}
+}
+
+// fromTable converts the header tables decoded by RabbitMQ, including the nested ones, to plain maps.
+func fromTable(t amqp.Table) map[string]any {
+	if t == nil {
+		return nil
+	}
+
+	m := make(map[string]any, len(t))
+	for k, v := range t {
+		m[k] = fromField(v)
+	}
+
+	return m
+}
+
+func fromField(v any) any {
+	switch f := v.(type) {
+	case amqp.Table:
+		return fromTable(f)
+	case []any:
+		s := make([]any, len(f))
+		for i, e := range f {
+			s[i] = fromField(e)
+		}
+		return s
+	default:
+		return v
+	}
 }
@@ -0,0 +1,274 @@
+package common
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		delay := reconnectBackoff(attempt)
+		ceiling := reconnectMaxDelay
+		if attempt < 16 {
+			ceiling = min(reconnectBaseDelay<<attempt, reconnectMaxDelay)
+		}
+
+		assert.GreaterOrEqual(t, delay, ceiling/2)
+		assert.LessOrEqual(t, delay, ceiling)
+	}
+}
+
+func TestMessageBroker_RetiredQueue(t *testing.T) {
+	uri := TestRabbitMQ(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	mb, err := NewMessageBroker(uri, logger)
+	assert.NoError(t, err)
+	defer mb.Close()
+
+	// An earlier release declared the queue without a dead letter exchange, and left a message in it.
+	legacy := Topology{
+		Exchanges: []ExchangeSpec{{Name: UserExchange, Kind: "direct"}},
+		Queues:    []QueueSpec{{Name: LegacyUserCreatedQueue}},
+		Bindings:  []BindingSpec{{Queue: LegacyUserCreatedQueue, Key: UserCreatedKey, Exchange: UserExchange}},
+	}
+	assert.NoError(t, mb.Declare(legacy))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, mb.Publish(ctx, []byte("waiting"), UserCreatedKey, UserExchange))
+
+	assert.NoError(t, SetupUserExchange(mb))
+
+	msgs, err := mb.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "waiting", string(msg.Body))
+		assert.NoError(t, msg.Ack())
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not receive the message of the retired queue")
+	}
+
+	// The retired queue is deleted.
+	_, err = mb.Peek(LegacyUserCreatedQueue, 1)
+	assert.Error(t, err)
+}
+
+func TestMessageBroker_Reconnect(t *testing.T) {
+	uri := TestRabbitMQ(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	mb, err := NewMessageBroker(uri, logger)
+	assert.NoError(t, err)
+	defer mb.Close()
+
+	assert.NoError(t, SetupUserExchange(mb))
+
+	msgs, err := mb.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	receive := func(want string) {
+		select {
+		case msg := <-msgs:
+			assert.Equal(t, want, string(msg.Body))
+			assert.NoError(t, msg.Ack())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("did not receive %q", want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, mb.Publish(ctx, []byte("before"), UserCreatedKey, UserExchange))
+	receive("before")
+
+	// Drop the connection underneath the broker, as a broker restart would.
+	mb.mu.RLock()
+	mb.conn.Close()
+	mb.mu.RUnlock()
+
+	assert.Eventually(t, mb.Connected, 10*time.Second, 50*time.Millisecond)
+
+	assert.NoError(t, mb.Publish(ctx, []byte("after"), UserCreatedKey, UserExchange))
+	receive("after")
+
+	assert.NoError(t, mb.Close())
+
+	_, ok := <-msgs
+	assert.False(t, ok)
+}
+
+func TestMessageBroker_ChannelClose(t *testing.T) {
+	uri := TestRabbitMQ(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	mb, err := NewMessageBroker(uri, logger)
+	assert.NoError(t, err)
+	defer mb.Close()
+
+	assert.NoError(t, SetupUserExchange(mb))
+
+	msgs, err := mb.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	receive := func(want string) {
+		select {
+		case msg := <-msgs:
+			assert.Equal(t, want, string(msg.Body))
+			assert.NoError(t, msg.Ack())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("did not receive %q", want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	mb.mu.RLock()
+	conn := mb.conn
+	mb.mu.RUnlock()
+
+	// Publishing to an exchange that does not exist closes the publish channel, not the connection.
+	assert.Error(t, mb.Publish(ctx, []byte("lost"), UserCreatedKey, Exchange("missing_exchange")))
+	assert.Eventually(t, mb.Connected, 10*time.Second, 50*time.Millisecond)
+
+	assert.NoError(t, mb.Publish(ctx, []byte("after publish channel"), UserCreatedKey, UserExchange))
+	receive("after publish channel")
+
+	// Closing the channel of the consumer stops its deliveries until it is restarted.
+	mb.mu.RLock()
+	mb.consumers[0].ch.Close()
+	mb.mu.RUnlock()
+	assert.False(t, mb.Connected())
+	assert.Eventually(t, mb.Connected, 10*time.Second, 50*time.Millisecond)
+
+	assert.NoError(t, mb.Publish(ctx, []byte("after consumer channel"), UserCreatedKey, UserExchange))
+	receive("after consumer channel")
+
+	mb.mu.RLock()
+	assert.Same(t, conn, mb.conn)
+	mb.mu.RUnlock()
+}
+
+func TestDeadLetterOrigin(t *testing.T) {
+	tests := []struct {
+		name         string
+		headers      map[string]any
+		wantExchange Exchange
+		wantKey      BindingKey
+		wantOK       bool
+	}{
+		{
+			name: "rejected message",
+			headers: map[string]any{"x-death": []any{
+				map[string]any{"exchange": "user_exchange", "routing-keys": []any{"user.created"}, "reason": "rejected"},
+				map[string]any{"exchange": "retry_exchange", "routing-keys": []any{"user_created_queue.retry.5s"}, "reason": "expired"},
+			}},
+			wantExchange: UserExchange,
+			wantKey:      UserCreatedKey,
+			wantOK:       true,
+		},
+		{
+			name: "decoded by rabbitmq",
+			headers: fromTable(amqp.Table{"x-death": []any{
+				amqp.Table{"exchange": "user_exchange", "routing-keys": []any{"user.created"}, "reason": "rejected"},
+			}}),
+			wantExchange: UserExchange,
+			wantKey:      UserCreatedKey,
+			wantOK:       true,
+		},
+		{
+			name:    "published directly",
+			headers: map[string]any{},
+		},
+		{
+			name:    "no routing keys",
+			headers: map[string]any{"x-death": []any{map[string]any{"exchange": "user_exchange"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exchange, key, ok := deadLetterOrigin(tt.headers)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantExchange, exchange)
+			assert.Equal(t, tt.wantKey, key)
+		})
+	}
+}
+
+func TestMessageBroker_DeadLetters(t *testing.T) {
+	uri := TestRabbitMQ(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	mb, err := NewMessageBroker(uri, logger)
+	assert.NoError(t, err)
+	defer mb.Close()
+
+	assert.NoError(t, SetupUserExchange(mb))
+
+	msgs, err := mb.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	receive := func() Delivery {
+		select {
+		case msg := <-msgs:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("did not receive a message")
+			return Delivery{}
+		}
+	}
+
+	// A message published to a retry queue comes back once its TTL expires.
+	delay := UserCreatedRetryDelays[0]
+	err = mb.Publish(ctx, []byte("retry"), BindingKey(RetryQueue(UserCreatedQueue, delay)), RetryExchange, WithHeaders(map[string]any{RetryCountHeader: int32(1), "x-test": "value"}), WithExpiration(100*time.Millisecond))
+	assert.NoError(t, err)
+
+	msg := receive()
+	assert.Equal(t, "retry", string(msg.Body))
+	assert.Equal(t, int32(1), msg.Headers[RetryCountHeader])
+
+	// A rejected message is moved to the dead letter queue.
+	assert.NoError(t, msg.Nack(false))
+
+	assert.Eventually(t, func() bool {
+		messages, err := mb.Peek(UserCreatedDLQ, 10)
+		return err == nil && len(messages) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Peeking leaves the message in place.
+	messages, err := mb.Peek(UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "retry", string(messages[0].Body))
+	assert.Equal(t, DeadLetterExchange, messages[0].Exchange)
+
+	replayed, err := mb.Replay(ctx, UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	msg = receive()
+	assert.Equal(t, "retry", string(msg.Body))
+	assert.NotContains(t, msg.Headers, RetryCountHeader)
+	assert.NotContains(t, msg.Headers, "x-death")
+	assert.Equal(t, "value", msg.Headers["x-test"])
+	assert.NoError(t, msg.Ack())
+
+	messages, err = mb.Peek(UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
@@ -0,0 +1,457 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Exchange string
+
+type Queue string
+
+type BindingKey string
+
+type MessageProducer interface {
+	Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange, opts ...PublishOption) error
+}
+
+type MessageConsumer interface {
+	Consume(key BindingKey, exchange Exchange, queue Queue) (<-chan Delivery, error)
+}
+
+// Broker is a message broker with exchanges, queues and routing keys that follow AMQP semantics. MessageBroker talks to RabbitMQ, and MemoryBroker runs inside the process.
+type Broker interface {
+	MessageProducer
+	MessageConsumer
+
+	// Declare declares the topology, and declares it again whenever the broker has to reconnect.
+	Declare(t Topology) error
+	// Peek returns up to limit messages from the head of the queue without removing them.
+	Peek(queue Queue, limit int) ([]Delivery, error)
+	// Replay moves up to limit messages from a dead letter queue back to the exchange and routing key they were dead lettered from. Replayed messages start over with no retries counted. It returns the number of messages replayed.
+	Replay(ctx context.Context, queue Queue, limit int) (int, error)
+	// Connected reports whether the broker can currently publish and deliver messages.
+	Connected() bool
+	Close() error
+}
+
+var (
+	_ Broker = (*MessageBroker)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+)
+
+// Delivery is a message handed to a consumer. Every delivery must be settled with either Ack or Nack.
+type Delivery struct {
+	Exchange   Exchange
+	RoutingKey BindingKey
+	Headers    map[string]any
+	Body       []byte
+	Timestamp  time.Time
+
+	// Acknowledger settles the delivery with the broker it came from. Deliveries returned by Peek have none.
+	Acknowledger Acknowledger
+}
+
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+// Ack tells the broker the message was handled and can be removed.
+func (d Delivery) Ack() error {
+	if d.Acknowledger == nil {
+		return ErrDeliveryNotAcknowledgeable
+	}
+	return d.Acknowledger.Ack()
+}
+
+// Nack tells the broker the message could not be handled. It is put back in the queue when requeue is set, and dead lettered or dropped otherwise.
+func (d Delivery) Nack(requeue bool) error {
+	if d.Acknowledger == nil {
+		return ErrDeliveryNotAcknowledgeable
+	}
+	return d.Acknowledger.Nack(requeue)
+}
+
+const (
+	UserExchange     Exchange   = "user_exchange"
+	UserCreatedQueue Queue      = "mail_user_created_queue"
+	UserCreatedKey   BindingKey = "user.created"
+	// LegacyUserCreatedQueue was declared without a dead letter exchange. A queue cannot be redeclared with other arguments, so UserTopology retires it in favour of UserCreatedQueue.
+	LegacyUserCreatedQueue Queue = "user_created_queue"
+
+	UserPasswordResetQueue Queue      = "user_password_reset_queue"
+	UserPasswordResetKey   BindingKey = "user.password_reset"
+
+	UserDigestQueue Queue      = "user_digest_queue"
+	UserDigestKey   BindingKey = "user.digest"
+
+	// UserFollowedKey, UserSuspendedKey and UserReinstatedKey are domain events rather than emails. The notification service keeps them as in-app notifications.
+	UserFollowedKey   BindingKey = "user.followed"
+	UserSuspendedKey  BindingKey = "user.suspended"
+	UserReinstatedKey BindingKey = "user.reinstated"
+
+	NotificationFollowedQueue   Queue = "notification_user_followed_queue"
+	NotificationSuspendedQueue  Queue = "notification_user_suspended_queue"
+	NotificationReinstatedQueue Queue = "notification_user_reinstated_queue"
+
+	// NotificationCreatedKey is published once a notification is stored, for the streams of every replica to push it to the user.
+	NotificationCreatedKey BindingKey = "notification.created"
+
+	// BlogExchange is a topic exchange, so a queue can bind to every blog event with "blog.*".
+	BlogExchange     Exchange   = "blog_exchange"
+	BlogCreatedKey   BindingKey = "blog.created"
+	BlogUpdatedKey   BindingKey = "blog.updated"
+	BlogDeletedKey   BindingKey = "blog.deleted"
+	BlogPublishedKey BindingKey = "blog.published"
+
+	// WebhookExchange routes the deliveries of the webhooks, and the blog events the webhook service retries, so that a retry is not broadcast to the other consumers of the blog events.
+	WebhookExchange    Exchange   = "webhook_exchange"
+	WebhookDeliveryKey BindingKey = "webhook.delivery"
+
+	WebhookBlogCreatedQueue   Queue = "webhook_blog_created_queue"
+	WebhookBlogUpdatedQueue   Queue = "webhook_blog_updated_queue"
+	WebhookBlogDeletedQueue   Queue = "webhook_blog_deleted_queue"
+	WebhookBlogPublishedQueue Queue = "webhook_blog_published_queue"
+	WebhookDeliveryQueue      Queue = "webhook_delivery_queue"
+
+	// DeadLetterExchange receives the messages that consumers gave up on. Each dead letter keeps the routing key it was originally published with.
+	DeadLetterExchange   Exchange = "dead_letter_exchange"
+	UserCreatedDLQ       Queue    = "user_created_dlq"
+	UserPasswordResetDLQ Queue    = "user_password_reset_dlq"
+	UserDigestDLQ        Queue    = "user_digest_dlq"
+
+	NotificationFollowedDLQ   Queue = "notification_user_followed_dlq"
+	NotificationSuspendedDLQ  Queue = "notification_user_suspended_dlq"
+	NotificationReinstatedDLQ Queue = "notification_user_reinstated_dlq"
+
+	WebhookBlogCreatedDLQ   Queue = "webhook_blog_created_dlq"
+	WebhookBlogUpdatedDLQ   Queue = "webhook_blog_updated_dlq"
+	WebhookBlogDeletedDLQ   Queue = "webhook_blog_deleted_dlq"
+	WebhookBlogPublishedDLQ Queue = "webhook_blog_published_dlq"
+	WebhookDeliveryDLQ      Queue = "webhook_delivery_dlq"
+
+	// RetryExchange routes messages to the retry queue named by the routing key. See RetryQueue.
+	RetryExchange Exchange = "retry_exchange"
+
+	// RetryCountHeader holds the number of times a message has been sent back for a retry.
+	RetryCountHeader = "x-retry-count"
+)
+
+// DeadLetterQueues lists the dead letter queues of the topologies.
+var DeadLetterQueues = []Queue{
+	UserCreatedDLQ,
+	UserPasswordResetDLQ,
+	UserDigestDLQ,
+	NotificationFollowedDLQ,
+	NotificationSuspendedDLQ,
+	NotificationReinstatedDLQ,
+	WebhookBlogCreatedDLQ,
+	WebhookBlogUpdatedDLQ,
+	WebhookBlogDeletedDLQ,
+	WebhookBlogPublishedDLQ,
+	WebhookDeliveryDLQ,
+}
+
+// UserCreatedRetryDelays are the delays between attempts at handling a user.created message. A message that still fails after the last retry is dead lettered.
+var UserCreatedRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+// UserPasswordResetRetryDelays are shorter than UserCreatedRetryDelays, since a reset link that arrives late is of little use.
+var UserPasswordResetRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute}
+
+// UserDigestRetryDelays are longer than the others, since a digest is not urgent and is often sent to many users at once.
+var UserDigestRetryDelays = []time.Duration{time.Minute, 10 * time.Minute, time.Hour}
+
+// WebhookEventRetryDelays are the delays between attempts at queueing the deliveries of a blog event, which only fails while the database is unavailable.
+var WebhookEventRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+// WebhookDeliveryRetryDelays back off exponentially, so an endpoint that is down for a few hours still receives the delivery.
+var WebhookDeliveryRetryDelays = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour}
+
+// NotificationRetryDelays are the delays between attempts at storing an in-app notification, which only fails while the database is unavailable.
+var NotificationRetryDelays = []time.Duration{5 * time.Second, 30 * time.Second, 2 * time.Minute, 10 * time.Minute}
+
+var (
+	ErrBrokerNotConnected = errors.New("message broker is not connected")
+	ErrBrokerClosed       = errors.New("message broker is closed")
+	ErrMessageNotAcked    = errors.New("message was not acknowledged by the broker")
+
+	ErrDeliveryNotAcknowledgeable = errors.New("delivery cannot be acknowledged")
+)
+
+type ExchangeSpec struct {
+	Name Exchange
+	Kind string
+}
+
+type QueueSpec struct {
+	Name Queue
+	Args map[string]any
+	// Exclusive queues belong to the connection that declared them and are deleted when it closes, instead of being durable. They suit the broadcasts every replica needs a copy of while it runs, and are declared again after a reconnect like the rest of the topology.
+	Exclusive bool
+}
+
+type BindingSpec struct {
+	Queue    Queue
+	Key      BindingKey
+	Exchange Exchange
+}
+
+// Topology describes the exchanges, queues and bindings an application relies on. A topology is declared again every time the broker reconnects.
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+	// Retired holds the bindings of the queues an earlier release declared and this topology replaces. Declaring the topology removes them, sends the messages left in those queues back through the exchanges they were published to, and deletes the queues once no consumer is left on them.
+	Retired []BindingSpec
+}
+
+// UserTopology declares the user events together with their dead letter queue and retry queues. It retires LegacyUserCreatedQueue: the replicas that start with it move the waiting user.created messages to UserCreatedQueue, and the first one to start after the older replicas have stopped deletes the legacy queue. An older replica that reconnects while the upgrade rolls out binds the legacy queue again, which only delays its removal.
+var UserTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: UserExchange, Kind: "direct"},
+		{Name: DeadLetterExchange, Kind: "direct"},
+		{Name: RetryExchange, Kind: "direct"},
+	},
+	Queues: []QueueSpec{
+		{Name: UserCreatedQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+		{Name: UserCreatedDLQ},
+		{Name: UserPasswordResetQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+		{Name: UserPasswordResetDLQ},
+		{Name: UserDigestQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+		{Name: UserDigestDLQ},
+		{Name: NotificationFollowedQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+		{Name: NotificationFollowedDLQ},
+		{Name: NotificationSuspendedQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+		{Name: NotificationSuspendedDLQ},
+		{Name: NotificationReinstatedQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+		{Name: NotificationReinstatedDLQ},
+	},
+	Bindings: []BindingSpec{
+		{Queue: UserCreatedQueue, Key: UserCreatedKey, Exchange: UserExchange},
+		{Queue: UserCreatedDLQ, Key: UserCreatedKey, Exchange: DeadLetterExchange},
+		{Queue: UserPasswordResetQueue, Key: UserPasswordResetKey, Exchange: UserExchange},
+		{Queue: UserPasswordResetDLQ, Key: UserPasswordResetKey, Exchange: DeadLetterExchange},
+		{Queue: UserDigestQueue, Key: UserDigestKey, Exchange: UserExchange},
+		{Queue: UserDigestDLQ, Key: UserDigestKey, Exchange: DeadLetterExchange},
+		{Queue: NotificationFollowedQueue, Key: UserFollowedKey, Exchange: UserExchange},
+		{Queue: NotificationFollowedDLQ, Key: UserFollowedKey, Exchange: DeadLetterExchange},
+		{Queue: NotificationSuspendedQueue, Key: UserSuspendedKey, Exchange: UserExchange},
+		{Queue: NotificationSuspendedDLQ, Key: UserSuspendedKey, Exchange: DeadLetterExchange},
+		{Queue: NotificationReinstatedQueue, Key: UserReinstatedKey, Exchange: UserExchange},
+		{Queue: NotificationReinstatedDLQ, Key: UserReinstatedKey, Exchange: DeadLetterExchange},
+	},
+	Retired: []BindingSpec{
+		{Queue: LegacyUserCreatedQueue, Key: UserCreatedKey, Exchange: UserExchange},
+	},
+}.With(retryTopology(UserCreatedQueue, UserCreatedKey, UserExchange, UserCreatedRetryDelays)).
+	With(retryTopology(UserPasswordResetQueue, UserPasswordResetKey, UserExchange, UserPasswordResetRetryDelays)).
+	With(retryTopology(UserDigestQueue, UserDigestKey, UserExchange, UserDigestRetryDelays)).
+	With(retryTopology(NotificationFollowedQueue, UserFollowedKey, UserExchange, NotificationRetryDelays)).
+	With(retryTopology(NotificationSuspendedQueue, UserSuspendedKey, UserExchange, NotificationRetryDelays)).
+	With(retryTopology(NotificationReinstatedQueue, UserReinstatedKey, UserExchange, NotificationRetryDelays))
+
+func SetupUserExchange(mb Broker) error {
+	return mb.Declare(UserTopology)
+}
+
+// BlogTopology declares the exchange of the blog events. The services that react to them declare their own queues.
+var BlogTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: BlogExchange, Kind: "topic"},
+	},
+}
+
+func SetupBlogExchange(mb Broker) error {
+	return mb.Declare(BlogTopology)
+}
+
+// WebhookTopology declares the queues of the webhook service. Each blog event has its own queue, bound to the blog exchange and to the webhook exchange its retries come back through.
+var WebhookTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: BlogExchange, Kind: "topic"},
+		{Name: WebhookExchange, Kind: "direct"},
+		{Name: DeadLetterExchange, Kind: "direct"},
+		{Name: RetryExchange, Kind: "direct"},
+	},
+}.With(webhookEventTopology(WebhookBlogCreatedQueue, WebhookBlogCreatedDLQ, BlogCreatedKey)).
+	With(webhookEventTopology(WebhookBlogUpdatedQueue, WebhookBlogUpdatedDLQ, BlogUpdatedKey)).
+	With(webhookEventTopology(WebhookBlogDeletedQueue, WebhookBlogDeletedDLQ, BlogDeletedKey)).
+	With(webhookEventTopology(WebhookBlogPublishedQueue, WebhookBlogPublishedDLQ, BlogPublishedKey)).
+	With(Topology{
+		Queues: []QueueSpec{
+			{Name: WebhookDeliveryQueue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+			{Name: WebhookDeliveryDLQ},
+		},
+		Bindings: []BindingSpec{
+			{Queue: WebhookDeliveryQueue, Key: WebhookDeliveryKey, Exchange: WebhookExchange},
+			{Queue: WebhookDeliveryDLQ, Key: WebhookDeliveryKey, Exchange: DeadLetterExchange},
+		},
+	}).
+	With(retryTopology(WebhookDeliveryQueue, WebhookDeliveryKey, WebhookExchange, WebhookDeliveryRetryDelays))
+
+func webhookEventTopology(queue, dlq Queue, key BindingKey) Topology {
+	return Topology{
+		Queues: []QueueSpec{
+			{Name: queue, Args: map[string]any{"x-dead-letter-exchange": string(DeadLetterExchange)}},
+			{Name: dlq},
+		},
+		Bindings: []BindingSpec{
+			{Queue: queue, Key: key, Exchange: BlogExchange},
+			{Queue: queue, Key: key, Exchange: WebhookExchange},
+			{Queue: dlq, Key: key, Exchange: DeadLetterExchange},
+		},
+	}.With(retryTopology(queue, key, WebhookExchange, WebhookEventRetryDelays))
+}
+
+func SetupWebhookExchange(mb Broker) error {
+	return mb.Declare(WebhookTopology)
+}
+
+// With returns a topology that declares everything in t and in other.
+func (t Topology) With(other Topology) Topology {
+	return Topology{
+		Exchanges: append(append([]ExchangeSpec{}, t.Exchanges...), other.Exchanges...),
+		Queues:    append(append([]QueueSpec{}, t.Queues...), other.Queues...),
+		Bindings:  append(append([]BindingSpec{}, t.Bindings...), other.Bindings...),
+		Retired:   append(append([]BindingSpec{}, t.Retired...), other.Retired...),
+	}
+}
+
+// RetryQueue returns the name of the queue that holds the messages of queue while they wait delay for another attempt. Messages are routed to it by publishing them to RetryExchange with the queue name as the routing key.
+func RetryQueue(queue Queue, delay time.Duration) Queue {
+	return Queue(fmt.Sprintf("%s.retry.%s", queue, delay))
+}
+
+// RetryCount returns the number of retries a message has already had, as counted by RetryCountHeader.
+func RetryCount(headers map[string]any) int {
+	switch n := headers[RetryCountHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	default:
+		return 0
+	}
+}
+
+// RetryResult tells what Retry did with a message.
+type RetryResult struct {
+	// Attempt is the number of the attempt that failed, starting at 1.
+	Attempt int
+	// Delay is how long the message waits in its retry queue. It is zero when the message was dead lettered.
+	Delay time.Duration
+	// DeadLettered is set when every delay had been used and the message was rejected.
+	DeadLettered bool
+}
+
+// Retry sends a message that failed to the retry queue for its next attempt, so that the backoff happens in the broker and the consumer can carry on with other messages. The message keeps its headers, with the trace context and the request ID, and RetryCountHeader counts the attempt. Once every delay has been used the message is rejected, and the broker moves it to the dead letter queue. When the retry cannot be published the message is handed back to its queue, so it is not lost, and the error is returned.
+func Retry(ctx context.Context, producer MessageProducer, msg Delivery, queue Queue, delays []time.Duration) (RetryResult, error) {
+	attempt := RetryCount(msg.Headers)
+	if attempt >= len(delays) {
+		msg.Nack(false)
+		return RetryResult{Attempt: attempt + 1, DeadLettered: true}, nil
+	}
+
+	result := RetryResult{Attempt: attempt + 1, Delay: delays[attempt]}
+
+	headers := republishHeaders(msg.Headers)
+	headers[RetryCountHeader] = int32(result.Attempt)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := producer.Publish(ctx, msg.Body, BindingKey(RetryQueue(queue, result.Delay)), RetryExchange, WithHeaders(headers), WithExpiration(result.Delay))
+	if err != nil {
+		msg.Nack(true)
+		return result, err
+	}
+
+	msg.Ack()
+	return result, nil
+}
+
+// retryTopology declares a retry queue for every delay. The queues have no consumers. A message is published to one of them with a per-message TTL equal to the delay of the queue, and once it expires it is dead lettered back to the exchange and routing key the consumer listens on. Since every message in a queue has the same TTL, they expire in order and a long backoff never holds up a short one.
+func retryTopology(queue Queue, key BindingKey, exchange Exchange, delays []time.Duration) Topology {
+	var t Topology
+
+	for _, delay := range delays {
+		name := RetryQueue(queue, delay)
+		t.Queues = append(t.Queues, QueueSpec{Name: name, Args: map[string]any{
+			"x-dead-letter-exchange":    string(exchange),
+			"x-dead-letter-routing-key": string(key),
+		}})
+		t.Bindings = append(t.Bindings, BindingSpec{Queue: name, Key: BindingKey(name), Exchange: RetryExchange})
+	}
+
+	return t
+}
+
+// PublishOptions are the optional properties of a published message.
+type PublishOptions struct {
+	Headers map[string]any
+	// Expiration is the per-message TTL. A message that stays in a queue for longer is dropped or dead lettered.
+	Expiration time.Duration
+}
+
+type PublishOption func(*PublishOptions)
+
+func WithHeaders(headers map[string]any) PublishOption {
+	return func(o *PublishOptions) {
+		o.Headers = headers
+	}
+}
+
+func WithExpiration(expiration time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.Expiration = expiration
+	}
+}
+
+// republishHeaders returns the headers a message is published again with, by a replay or a retry: its own, without the death records of the broker and the retry count.
+func republishHeaders(headers map[string]any) map[string]any {
+	replayed := make(map[string]any, len(headers))
+	for k, v := range headers {
+		if k == "x-death" || k == RetryCountHeader || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		replayed[k] = v
+	}
+
+	return replayed
+}
+
+// deadLetterOrigin reads the exchange and routing key a message was last dead lettered from out of the x-death header the broker adds to it.
+func deadLetterOrigin(headers map[string]any) (Exchange, BindingKey, bool) {
+	deaths, ok := headers["x-death"].([]any)
+	if !ok || len(deaths) == 0 {
+		return "", "", false
+	}
+
+	death, ok := deaths[0].(map[string]any)
+	if !ok {
+		return "", "", false
+	}
+
+	exchange, ok := death["exchange"].(string)
+	if !ok {
+		return "", "", false
+	}
+
+	keys, ok := death["routing-keys"].([]any)
+	if !ok || len(keys) == 0 {
+		return "", "", false
+	}
+
+	key, ok := keys[0].(string)
+	if !ok {
+		return "", "", false
+	}
+
+	return Exchange(exchange), BindingKey(key), true
+}
@@ -1,34 +1,158 @@
 package common
 
 import (
+	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 )
 
-type Cache struct {
-	*cache.Cache
+// Cache is a key value store for values that can be recomputed from the database. Get copies the cached value into dst, which must be a pointer to the type that was stored, so callers never share state with the cache.
+type Cache interface {
+	Set(key string, value interface{}, expiration ...time.Duration)
+	Get(key string, dst interface{}) bool
+	Delete(key string)
+	Flush()
+
+	// Namespace returns a snapshot of the namespace at its current generation. Entries read and written through the snapshot are only visible while the namespace has not been invalidated, so a value computed before an invalidation can never be served after it.
+	Namespace(name string) *Namespace
+	// Invalidate drops every entry stored under the given namespaces by moving them to a new generation. The old entries are left to expire on their own.
+	// It returns an error when the new generation could not be stored, the old entries are then served until they expire.
+	Invalidate(namespaces ...string) error
+}
+
+// MemoryCache is a Cache kept in the memory of the current process. It is only suitable when a single replica is running.
+type MemoryCache struct {
+	c *cache.Cache
+
+	// mu serializes namespace generation bumps so that concurrent invalidations are never lost.
+	mu sync.Mutex
 }
 
-func NewCache(expirationTime, cleanupTime time.Duration) *Cache {
-	return &Cache{cache.New(expirationTime, cleanupTime)}
+func NewMemoryCache(expirationTime, cleanupTime time.Duration) *MemoryCache {
+	return &MemoryCache{c: cache.New(expirationTime, cleanupTime)}
 }
 
-func (c *Cache) Set(key string, value interface{}, expiration ...time.Duration) {
+func (c *MemoryCache) Set(key string, value interface{}, expiration ...time.Duration) {
 	if len(expiration) > 0 {
-		c.Cache.Set(key, value, expiration[0])
+		c.c.Set(key, value, expiration[0])
+		return
+	}
+	c.c.Set(key, value, cache.DefaultExpiration)
+}
+
+func (c *MemoryCache) Get(key string, dst interface{}) bool {
+	value, ok := c.c.Get(key)
+	if !ok {
+		return false
+	}
+
+	return assign(dst, value)
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.c.Delete(key)
+}
+
+func (c *MemoryCache) Flush() {
+	c.c.Flush()
+}
+
+func (c *MemoryCache) Namespace(name string) *Namespace {
+	return &Namespace{c: c, name: name, gen: c.generation(name)}
+}
+
+func (c *MemoryCache) Invalidate(namespaces ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ns := range namespaces {
+		c.c.Set(namespaceGenerationKey(ns), c.generation(ns)+1, cache.NoExpiration)
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) generation(name string) int64 {
+	if gen, ok := c.c.Get(namespaceGenerationKey(name)); ok {
+		return gen.(int64)
+	}
+
+	return 0
+}
+
+// assign copies value into the variable dst points to. A pointer value is dereferenced until it matches the type of the destination.
+func assign(dst, value interface{}) bool {
+	d := reflect.ValueOf(dst)
+	if d.Kind() != reflect.Pointer || d.IsNil() {
+		return false
+	}
+
+	v := reflect.ValueOf(value)
+	for v.IsValid() && !v.Type().AssignableTo(d.Elem().Type()) {
+		if v.Kind() != reflect.Pointer || v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+
+	if !v.IsValid() {
+		return false
+	}
+
+	d.Elem().Set(v)
+
+	return true
+}
+
+func namespaceGenerationKey(name string) string {
+	return "ns:" + name
+}
+
+// Namespace is a view of the cache that is scoped to a single generation of a namespace.
+type Namespace struct {
+	c    Cache
+	name string
+	gen  int64
+
+	// disabled is set when the generation could not be read, in which case the snapshot neither serves nor stores anything.
+	disabled bool
+}
+
+func (n *Namespace) key(key string) string {
+	return n.name + "@" + strconv.FormatInt(n.gen, 10) + ":" + key
+}
+
+func (n *Namespace) Set(key string, value interface{}, expiration ...time.Duration) {
+	if n.disabled {
 		return
 	}
-	c.Cache.Set(key, value, cache.DefaultExpiration)
+	n.c.Set(n.key(key), value, expiration...)
 }
 
-func (c *Cache) Get(key string) (interface{}, bool) {
-	return c.Cache.Get(key)
+func (n *Namespace) Get(key string, dst interface{}) bool {
+	if n.disabled {
+		return false
+	}
+	return n.c.Get(n.key(key), dst)
 }
 
-func (c *Cache) Flush() {
-	c.Cache.Flush()
+// Cache namespaces group entries that are invalidated together.
+const (
+	// NamespaceBlogs holds every listing that can contain any blog post, such as the paginated list and the title search.
+	NamespaceBlogs = "blogs"
+)
+
+// NamespaceBlog holds the entries of a single blog post.
+func NamespaceBlog(id int) string {
+	return "blog:" + strconv.Itoa(id)
+}
+
+// NamespaceBlogsByUser holds the listings of the blog posts written by a single user.
+func NamespaceBlogsByUser(id int) string {
+	return "blogs_by_user:" + strconv.Itoa(id)
 }
 
 func CacheKeyBlog(id int) string {
@@ -43,6 +167,10 @@ func CacheKeyBlogs(limit, offset int) string {
 	return "blogs:" + strconv.Itoa(limit) + ":" + strconv.Itoa(offset)
 }
 
+func CacheKeyBlogsByTitle(title string, limit, offset int) string {
+	return "blogs_by_title:" + strconv.Itoa(limit) + ":" + strconv.Itoa(offset) + ":" + title
+}
+
 func CacheKeyUserByAccessToken(token []byte) string {
 	return "user_by_access_token:" + string(token)
 }
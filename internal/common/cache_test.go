@@ -1,50 +1,253 @@
 package common
 
-import "testing"
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
 
-func setupTestEnvironment(t *testing.T) (*Cache, func()) {
+	"github.com/alicebob/miniredis/v2"
+)
+
+type cachedValue struct {
+	Name  string
+	Count int
+}
+
+// testCaches returns every cache backend so that each test checks both implementations behave the same.
+func testCaches(t *testing.T) map[string]Cache {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	redisCache, err := NewRedisCache(mr.Addr(), "", 0, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("could not create redis cache: %v", err)
+	}
+	t.Cleanup(func() {
+		redisCache.Close()
+	})
+
+	return map[string]Cache{
+		"memory": NewMemoryCache(time.Minute, time.Minute),
+		"redis":  redisCache,
+	}
+}
+
+func setupTestEnvironment(t *testing.T) (map[string]Cache, func()) {
 	t.Helper()
 
 	// Set up the test environment
-	cache := NewCache(0, 0)
+	caches := testCaches(t)
 
 	cleanup := func() {
-		cache.Flush()
+		for _, cache := range caches {
+			cache.Flush()
+		}
 	}
 
-	return cache, cleanup
+	return caches, cleanup
 }
 
 func TestCache_Set(t *testing.T) {
-	cache, cleanup := setupTestEnvironment(t)
+	caches, cleanup := setupTestEnvironment(t)
 	defer cleanup()
 
-	cache.Set("key", "value")
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Set("key", "value")
 
-	if _, ok := cache.Get("key"); !ok {
-		t.Error("expected key to be set")
+			var got string
+			if !cache.Get("key", &got) {
+				t.Error("expected key to be set")
+			}
+		})
 	}
 }
 
 func TestCache_Get(t *testing.T) {
-	cache, cleanup := setupTestEnvironment(t)
+	caches, cleanup := setupTestEnvironment(t)
 	defer cleanup()
 
-	cache.Set("key", "value")
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			want := &cachedValue{Name: "value", Count: 1}
+			cache.Set("key", want)
+
+			var got cachedValue
+			if !cache.Get("key", &got) {
+				t.Fatal("expected key to be set")
+			}
+
+			if got != *want {
+				t.Errorf("expected %+v, got %+v", *want, got)
+			}
 
-	if _, ok := cache.Get("key"); !ok {
-		t.Error("expected key to be set")
+			// the cached value must not be shared with the caller
+			got.Count = 2
+			var again cachedValue
+			cache.Get("key", &again)
+			if again.Count != 1 {
+				t.Error("expected the cached value to be a copy")
+			}
+
+			if cache.Get("missing", &got) {
+				t.Error("expected missing key not to be found")
+			}
+		})
 	}
 }
 
 func TestCache_Flush(t *testing.T) {
-	cache, cleanup := setupTestEnvironment(t)
+	caches, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Set("key", "value")
+			cache.Flush()
+
+			var got string
+			if cache.Get("key", &got) {
+				t.Error("expected cache to be flushed")
+			}
+		})
+	}
+}
+
+func TestCache_Delete(t *testing.T) {
+	caches, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Set("key", "value")
+			cache.Delete("key")
+
+			var got string
+			if cache.Get("key", &got) {
+				t.Error("expected key to be deleted")
+			}
+		})
+	}
+}
+
+func TestCache_Namespace(t *testing.T) {
+	caches, cleanup := setupTestEnvironment(t)
 	defer cleanup()
 
-	cache.Set("key", "value")
-	cache.Flush()
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Namespace("ns").Set("key", "value")
+
+			var got string
+			if !cache.Namespace("ns").Get("key", &got) {
+				t.Error("expected key to be set in the namespace")
+			}
+
+			if cache.Namespace("other").Get("key", &got) {
+				t.Error("expected key to be scoped to its namespace")
+			}
+
+			if cache.Get("key", &got) {
+				t.Error("expected namespaced key not to collide with a plain key")
+			}
+		})
+	}
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	caches, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			cache.Namespace("a").Set("key", "value")
+			cache.Namespace("b").Set("key", "value")
+
+			cache.Invalidate("a")
+
+			var got string
+			if cache.Namespace("a").Get("key", &got) {
+				t.Error("expected namespace a to be invalidated")
+			}
+
+			if !cache.Namespace("b").Get("key", &got) {
+				t.Error("expected namespace b to be untouched")
+			}
+		})
+	}
+}
+
+func TestCache_InvalidateDuringRead(t *testing.T) {
+	caches, cleanup := setupTestEnvironment(t)
+	defer cleanup()
+
+	for name, cache := range caches {
+		t.Run(name, func(t *testing.T) {
+			// A reader takes its snapshot, then a writer invalidates before the reader stores what it loaded.
+			ns := cache.Namespace("a")
+			cache.Invalidate("a")
+			ns.Set("key", "stale")
+
+			var got string
+			if cache.Namespace("a").Get("key", &got) {
+				t.Error("expected a value loaded before the invalidation not to be served")
+			}
+		})
+	}
+}
+
+func TestRedisCache_CrossReplicaInvalidation(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	replicaA, err := NewRedisCache(mr.Addr(), "", 0, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaA.Close()
+
+	replicaB, err := NewRedisCache(mr.Addr(), "", 0, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicaB.Close()
+
+	replicaA.Set("session", "user")
+	replicaA.Namespace("blogs").Set("key", "value")
+
+	replicaB.Delete("session")
+	if err := replicaB.Invalidate("blogs"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	if replicaA.Get("session", &got) {
+		t.Error("expected a delete on one replica to be seen by the other")
+	}
+
+	if replicaA.Namespace("blogs").Get("key", &got) {
+		t.Error("expected an invalidation on one replica to be seen by the other")
+	}
+}
+
+func TestRedisCache_Unavailable(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	cache, err := NewRedisCache(mr.Addr(), "", 0, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Namespace("ns").Set("key", "value")
+	mr.Close()
+
+	var got string
+	if cache.Namespace("ns").Get("key", &got) {
+		t.Error("expected lookups to miss while redis is unavailable")
+	}
 
-	if _, ok := cache.Get("key"); ok {
-		t.Error("expected cache to be flushed")
+	if err := cache.Invalidate("ns"); err == nil {
+		t.Error("expected an invalidation to fail while redis is unavailable")
 	}
 }
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrNoConsumers is returned by ConsumerGroup.Check before any consumer was started.
+var ErrNoConsumers = errors.New("no consumer was started")
+
+// ConsumerGroup runs the consumers of a service. It records which of them are running, so that the readiness probe can tell when one stopped, and stops them without losing the messages they were handed. The zero value is ready to use.
+type ConsumerGroup struct {
+	mu       sync.Mutex
+	running  map[Queue]bool
+	stopping chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Consume handles the deliveries of msgs, taken from queue, with handle in the background until the group is stopped or msgs is closed.
+func (g *ConsumerGroup) Consume(queue Queue, msgs <-chan Delivery, handle func(Delivery)) {
+	stopping := g.stoppingChan()
+	g.set(queue, true)
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.set(queue, false)
+
+		for {
+			// A delivery that is ready does not hold up the stop.
+			select {
+			case <-stopping:
+				requeue(msgs)
+				return
+			default:
+			}
+
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				handle(msg)
+
+			case <-stopping:
+				requeue(msgs)
+				return
+			}
+		}
+	}()
+}
+
+// requeue hands the deliveries that are already waiting back to the broker, so that another consumer handles them.
+func requeue(msgs <-chan Delivery) {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			msg.Nack(true)
+		default:
+			return
+		}
+	}
+}
+
+// Failed records that the consumer of queue could not start.
+func (g *ConsumerGroup) Failed(queue Queue) {
+	g.set(queue, false)
+}
+
+func (g *ConsumerGroup) set(queue Queue, running bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.running == nil {
+		g.running = make(map[Queue]bool)
+	}
+	g.running[queue] = running
+}
+
+func (g *ConsumerGroup) stoppingChan() chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.stopping == nil {
+		g.stopping = make(chan struct{})
+	}
+	return g.stopping
+}
+
+// Check returns an error naming the queues whose consumer is not running.
+func (g *ConsumerGroup) Check() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.running) == 0 {
+		return ErrNoConsumers
+	}
+
+	var stopped []string
+	for queue, running := range g.running {
+		if !running {
+			stopped = append(stopped, string(queue))
+		}
+	}
+	if len(stopped) > 0 {
+		slices.Sort(stopped)
+		return fmt.Errorf("not consuming %s", strings.Join(stopped, ", "))
+	}
+
+	return nil
+}
+
+// Stop tells the consumers to take no more deliveries. The deliveries being handled are finished, and the ones that are waiting are requeued.
+func (g *ConsumerGroup) Stop() {
+	stopping := g.stoppingChan()
+	g.stopOnce.Do(func() { close(stopping) })
+}
+
+// Shutdown stops the consumers and waits for the deliveries being handled until ctx is done, when it returns the error of ctx.
+func (g *ConsumerGroup) Shutdown(ctx context.Context) error {
+	g.Stop()
+
+	return Wait(ctx, &g.wg)
+}
+
+// Wait waits for wg until ctx is done, when it returns the error of ctx.
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerGroup(t *testing.T) {
+	var g ConsumerGroup
+	assert.ErrorIs(t, g.Check(), ErrNoConsumers)
+
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	err := b.Declare(Topology{
+		Exchanges: []ExchangeSpec{{Name: "direct", Kind: "direct"}},
+		Queues:    []QueueSpec{{Name: "a"}},
+		Bindings:  []BindingSpec{{Queue: "a", Key: "key", Exchange: "direct"}},
+	})
+	assert.NoError(t, err)
+
+	msgs, err := b.Consume("key", "direct", "a")
+	assert.NoError(t, err)
+
+	handling := make(chan string)
+	release := make(chan struct{})
+	g.Consume("a", msgs, func(msg Delivery) {
+		handling <- string(msg.Body)
+		<-release
+		msg.Ack()
+	})
+	g.Failed("b")
+	assert.EqualError(t, g.Check(), "not consuming b")
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, []byte("first"), "key", "direct"))
+	assert.Equal(t, "first", <-handling)
+
+	// The shutdown waits for the delivery being handled, up to its deadline.
+	expired, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, g.Shutdown(expired), context.DeadlineExceeded)
+
+	// The stopped group takes no more deliveries.
+	assert.NoError(t, b.Publish(ctx, []byte("second"), "key", "direct"))
+	close(release)
+	assert.NoError(t, g.Shutdown(ctx))
+	assert.EqualError(t, g.Check(), "not consuming a, b")
+
+	select {
+	case body := <-handling:
+		t.Errorf("handled %q after the shutdown", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConsumerGroup_Requeue(t *testing.T) {
+	var g ConsumerGroup
+
+	acks := &countingAcknowledger{}
+	msgs := make(chan Delivery, 2)
+	msgs <- Delivery{Body: []byte("first"), Acknowledger: acks}
+	msgs <- Delivery{Body: []byte("second"), Acknowledger: acks}
+
+	// The deliveries that were handed to the group but not handled go back to the broker.
+	g.Stop()
+	g.Consume("a", msgs, func(msg Delivery) { msg.Ack() })
+	assert.NoError(t, g.Shutdown(context.Background()))
+
+	assert.Equal(t, 0, acks.acked)
+	assert.Equal(t, 2, acks.requeued)
+}
+
+type countingAcknowledger struct {
+	acked, requeued int
+}
+
+func (a *countingAcknowledger) Ack() error {
+	a.acked++
+	return nil
+}
+
+func (a *countingAcknowledger) Nack(requeue bool) error {
+	if requeue {
+		a.requeued++
+	}
+	return nil
+}
@@ -6,13 +6,22 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var (
 	ErrRecordNotFound = fmt.Errorf("record not found")
 )
 
+// Querier runs queries on a *sql.DB or a *sql.Tx.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 func NewDB(host, user, password, name string, maxOpenConns, maxIdleConns int, maxIdleTime time.Duration) (*sql.DB, error) {
 	URI := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable", user, password, host, name)
 	return connectDB(URI, maxOpenConns, maxIdleConns, maxIdleTime)
@@ -20,7 +29,7 @@ func NewDB(host, user, password, name string, maxOpenConns, maxIdleConns int, ma
 
 // connectDB connects to the database and returns the connection
 func connectDB(URI string, maxOpenConns int, maxIdleConns int, maxIdleTime time.Duration) (*sql.DB, error) {
-	db, err := sql.Open("postgres", URI)
+	db, err := openDB(URI)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open the database connection: %w", err)
 	}
@@ -40,6 +49,11 @@ func connectDB(URI string, maxOpenConns int, maxIdleConns int, maxIdleTime time.
 	return db, nil
 }
 
+// openDB opens a pool of connections whose queries are traced as children of the span in their context.
+func openDB(URI string) (*sql.DB, error) {
+	return otelsql.Open("postgres", URI, otelsql.WithAttributes(semconv.DBSystemPostgreSQL), otelsql.WithSpanOptions(sqlSpans))
+}
+
 // CloseDB closes the database connection
 func CloseDB(db *sql.DB) error {
 	return db.Close()
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"log/slog"
+)
+
+// RequestIDHeader carries the ID of a request, in the HTTP headers and in the headers of the messages published while serving it.
+const RequestIDHeader = "X-Request-ID"
+
+type contextKey string
+
+const (
+	requestIDContextKey = contextKey("request_id")
+	loggerContextKey    = contextKey("logger")
+)
+
+// WithRequestID returns ctx carrying the ID of the request it serves.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestID returns the ID of the request ctx serves, or "" when there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// WithLogger returns ctx carrying logger, which Logger hands to whatever runs on behalf of the request.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+// Logger returns the logger of ctx. Without one it returns fallback, with the request ID of ctx when there is one, so that the consumers of a message log the request that published it.
+func Logger(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+
+	if id := RequestID(ctx); id != "" {
+		return fallback.With(slog.String("request_id", id))
+	}
+
+	return fallback
+}
+
+// MessageHeaders returns a copy of headers with the trace context and the request ID of ctx added, so that whoever handles the message continues both. The headers are returned as they are when ctx carries neither.
+func MessageHeaders(ctx context.Context, headers map[string]any) map[string]any {
+	headers = InjectTrace(ctx, headers)
+
+	id := RequestID(ctx)
+	if id == "" {
+		return headers
+	}
+
+	carrier := make(map[string]any, len(headers)+1)
+	for k, v := range headers {
+		carrier[k] = v
+	}
+	carrier[RequestIDHeader] = id
+
+	return carrier
+}
+
+// ExtractRequestID returns ctx carrying the request ID found in the headers of a message, if any.
+func ExtractRequestID(ctx context.Context, headers map[string]any) context.Context {
+	id, _ := headers[RequestIDHeader].(string)
+	if id == "" {
+		return ctx
+	}
+
+	return WithRequestID(ctx, id)
+}
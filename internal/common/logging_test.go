@@ -0,0 +1,43 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageHeaders(t *testing.T) {
+	ctx := context.Background()
+
+	// Without a trace or a request there is nothing to add.
+	assert.Nil(t, MessageHeaders(ctx, nil))
+
+	headers := map[string]any{"x-test": "value"}
+	ctx = WithRequestID(ctx, "request")
+	withID := MessageHeaders(ctx, headers)
+
+	assert.Equal(t, map[string]any{"x-test": "value", RequestIDHeader: "request"}, withID)
+	assert.Len(t, headers, 1, "the headers are copied")
+
+	assert.Equal(t, "request", RequestID(ExtractRequestID(context.Background(), withID)))
+	assert.Equal(t, "", RequestID(ExtractRequestID(context.Background(), headers)))
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	fallback := slog.New(slog.NewTextHandler(&buf, nil))
+
+	assert.Same(t, fallback, Logger(context.Background(), fallback))
+
+	// A message carries the ID of its request into the logs of the consumer.
+	ctx := WithRequestID(context.Background(), "request")
+	Logger(ctx, fallback).Info("consumed")
+	assert.Contains(t, buf.String(), "request_id=request")
+
+	// The logger of the request is used as it is.
+	logger := fallback.With(slog.Int("user_id", 7))
+	assert.Same(t, logger, Logger(WithLogger(ctx, logger), fallback))
+}
@@ -0,0 +1,566 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is a Broker that routes messages inside the current process. It supports direct, topic and fanout exchanges, per-message and per-queue TTLs and dead letter exchanges, which is enough to run the application and its tests without RabbitMQ. Messages do not survive a restart.
+type MemoryBroker struct {
+	// mu guards the exchanges, the queues and everything inside them.
+	mu        sync.Mutex
+	exchanges map[Exchange]string
+	queues    map[Queue]*memoryQueue
+	bindings  []BindingSpec
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type memoryQueue struct {
+	spec      QueueSpec
+	ready     []*memoryMessage
+	consumers []chan Delivery
+	next      int
+	// unacked holds the deliveries that were handed out and not settled yet, in the order they were handed out.
+	unacked []*memoryAcknowledger
+
+	// wake is signalled whenever a message or a consumer is added.
+	wake chan struct{}
+}
+
+type memoryMessage struct {
+	exchange   Exchange
+	key        BindingKey
+	headers    map[string]any
+	body       []byte
+	timestamp  time.Time
+	expiration time.Duration
+
+	// expires is when the message is dropped or dead lettered from the queue it sits in. It is zero for messages without a TTL.
+	expires time.Time
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: make(map[Exchange]string),
+		queues:    make(map[Queue]*memoryQueue),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (b *MemoryBroker) Declare(t Topology) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isClosed() {
+		return ErrBrokerClosed
+	}
+
+	for _, e := range t.Exchanges {
+		switch e.Kind {
+		case "direct", "topic", "fanout":
+		default:
+			return fmt.Errorf("could not declare exchange %s: unsupported kind %q", e.Name, e.Kind)
+		}
+
+		if kind, ok := b.exchanges[e.Name]; ok && kind != e.Kind {
+			return fmt.Errorf("could not declare exchange %s: already declared as %s", e.Name, kind)
+		}
+		b.exchanges[e.Name] = e.Kind
+	}
+
+	for _, spec := range t.Queues {
+		if q, ok := b.queues[spec.Name]; ok {
+			if !reflect.DeepEqual(q.spec.Args, spec.Args) {
+				return fmt.Errorf("could not declare queue %s: already declared with different arguments", spec.Name)
+			}
+			continue
+		}
+
+		q := &memoryQueue{spec: spec, wake: make(chan struct{}, 1)}
+		b.queues[spec.Name] = q
+
+		b.wg.Add(1)
+		go b.run(q)
+	}
+
+	for _, binding := range t.Bindings {
+		if _, ok := b.exchanges[binding.Exchange]; !ok {
+			return fmt.Errorf("could not bind queue %s: exchange %s not found", binding.Queue, binding.Exchange)
+		}
+		if _, ok := b.queues[binding.Queue]; !ok {
+			return fmt.Errorf("could not bind queue %s: queue not found", binding.Queue)
+		}
+
+		if !b.hasBinding(binding) {
+			b.bindings = append(b.bindings, binding)
+		}
+	}
+
+	// A retired queue is unbound and emptied into its replacements. It is not deleted, since nothing outlives the process anyway.
+	for _, retired := range t.Retired {
+		b.bindings = slices.DeleteFunc(b.bindings, func(binding BindingSpec) bool { return binding == retired })
+
+		q, ok := b.queues[retired.Queue]
+		if !ok {
+			continue
+		}
+		for _, msg := range q.ready {
+			if err := b.route(msg); err != nil {
+				return fmt.Errorf("could not move message out of queue %s: %w", retired.Queue, err)
+			}
+		}
+		q.ready = nil
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) hasBinding(binding BindingSpec) bool {
+	for _, existing := range b.bindings {
+		if existing == binding {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange, opts ...PublishOption) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("could not publish message: %w", err)
+	}
+
+	var o PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	_, span := startPublishSpan(ctx, key, exchange, &o)
+	err := b.publish(msg, key, exchange, o)
+	EndSpan(span, err)
+
+	return err
+}
+
+func (b *MemoryBroker) publish(msg []byte, key BindingKey, exchange Exchange, o PublishOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isClosed() {
+		return fmt.Errorf("could not publish message: %w", ErrBrokerClosed)
+	}
+
+	err := b.route(&memoryMessage{
+		exchange:   exchange,
+		key:        key,
+		headers:    o.Headers,
+		body:       msg,
+		timestamp:  time.Now(),
+		expiration: o.Expiration,
+	})
+	if err != nil {
+		return fmt.Errorf("could not publish message: %w", err)
+	}
+
+	return nil
+}
+
+// route delivers a copy of the message to every queue bound to its exchange with a matching key. Like RabbitMQ, a message that matches no binding is dropped. The caller must hold mu.
+func (b *MemoryBroker) route(msg *memoryMessage) error {
+	kind, ok := b.exchanges[msg.exchange]
+	if !ok {
+		return fmt.Errorf("exchange %s not found", msg.exchange)
+	}
+
+	routed := make(map[Queue]bool)
+	for _, binding := range b.bindings {
+		if binding.Exchange != msg.exchange || routed[binding.Queue] || !routingMatch(kind, binding.Key, msg.key) {
+			continue
+		}
+		routed[binding.Queue] = true
+
+		b.enqueue(b.queues[binding.Queue], msg)
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) enqueue(q *memoryQueue, msg *memoryMessage) {
+	m := *msg
+	m.headers = copyHeaders(msg.headers)
+
+	ttl := m.expiration
+	if queueTTL, ok := durationArg(q.spec.Args["x-message-ttl"]); ok && (ttl == 0 || queueTTL < ttl) {
+		ttl = queueTTL
+	}
+	if ttl > 0 {
+		m.expires = time.Now().Add(ttl)
+	}
+
+	q.ready = append(q.ready, &m)
+	q.signal()
+}
+
+func (q *memoryQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the messages of the queue to its consumers in turn and expires the messages whose TTL has passed.
+func (b *MemoryBroker) run(q *memoryQueue) {
+	defer b.wg.Done()
+
+	for {
+		b.mu.Lock()
+		b.expire(q, time.Now())
+
+		var d *Delivery
+		var out chan Delivery
+		var wait <-chan time.Time
+
+		if len(q.ready) > 0 && len(q.consumers) > 0 {
+			delivery := b.delivery(q, q.ready[0], true)
+			d = &delivery
+			q.ready = q.ready[1:]
+			out = q.consumers[q.next%len(q.consumers)]
+			q.next++
+		} else if len(q.ready) > 0 && !q.ready[0].expires.IsZero() {
+			wait = time.After(time.Until(q.ready[0].expires))
+		}
+		b.mu.Unlock()
+
+		if d != nil {
+			select {
+			case out <- *d:
+			case <-b.closed:
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-wait:
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// expire removes the expired messages at the head of the queue. As in RabbitMQ, only the head is checked, so a message never overtakes the ones before it. The caller must hold mu.
+func (b *MemoryBroker) expire(q *memoryQueue, now time.Time) {
+	for len(q.ready) > 0 && !q.ready[0].expires.IsZero() && !now.Before(q.ready[0].expires) {
+		msg := q.ready[0]
+		q.ready = q.ready[1:]
+		b.deadLetter(q, msg, "expired")
+	}
+}
+
+// deadLetter republishes the message to the dead letter exchange of the queue, or drops it when the queue has none. The caller must hold mu.
+func (b *MemoryBroker) deadLetter(q *memoryQueue, msg *memoryMessage, reason string) {
+	exchange, ok := q.spec.Args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+
+	key := msg.key
+	if k, ok := q.spec.Args["x-dead-letter-routing-key"].(string); ok {
+		key = BindingKey(k)
+	}
+
+	headers := copyHeaders(msg.headers)
+	if headers == nil {
+		headers = make(map[string]any)
+	}
+	headers["x-death"] = addDeath(headers["x-death"], map[string]any{
+		"queue":        string(q.spec.Name),
+		"reason":       reason,
+		"exchange":     string(msg.exchange),
+		"routing-keys": []any{string(msg.key)},
+		"time":         time.Now(),
+	})
+
+	// The TTL is not carried over, otherwise the dead letter would expire again straight away.
+	b.route(&memoryMessage{
+		exchange:  Exchange(exchange),
+		key:       key,
+		headers:   headers,
+		body:      msg.body,
+		timestamp: msg.timestamp,
+	})
+}
+
+// addDeath puts the death at the front of the x-death header. A message that dies in the same queue for the same reason again only has the count of the existing entry increased, as RabbitMQ does.
+func addDeath(header any, death map[string]any) []any {
+	deaths, _ := header.([]any)
+
+	var count int64 = 1
+	result := []any{death}
+	for _, d := range deaths {
+		existing, ok := d.(map[string]any)
+		if ok && existing["queue"] == death["queue"] && existing["reason"] == death["reason"] {
+			if n, ok := existing["count"].(int64); ok {
+				count += n
+			}
+			continue
+		}
+		result = append(result, d)
+	}
+	death["count"] = count
+
+	return result
+}
+
+// delivery returns the message as a delivery. An acknowledgeable delivery is unsettled until it is acked or nacked. The caller must hold mu.
+func (b *MemoryBroker) delivery(q *memoryQueue, msg *memoryMessage, acknowledgeable bool) Delivery {
+	d := Delivery{
+		Exchange:   msg.exchange,
+		RoutingKey: msg.key,
+		Headers:    copyHeaders(msg.headers),
+		Body:       msg.body,
+		Timestamp:  msg.timestamp,
+	}
+	if acknowledgeable {
+		a := &memoryAcknowledger{b: b, q: q, msg: msg}
+		q.unacked = append(q.unacked, a)
+		d.Acknowledger = a
+	}
+
+	return d
+}
+
+type memoryAcknowledger struct {
+	b       *MemoryBroker
+	q       *memoryQueue
+	msg     *memoryMessage
+	settled bool
+}
+
+var errDeliverySettled = errors.New("delivery has already been settled")
+
+func (a *memoryAcknowledger) Ack() error {
+	a.b.mu.Lock()
+	defer a.b.mu.Unlock()
+
+	return a.settle()
+}
+
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	a.b.mu.Lock()
+	defer a.b.mu.Unlock()
+
+	if err := a.settle(); err != nil {
+		return err
+	}
+
+	if requeue {
+		a.q.ready = append([]*memoryMessage{a.msg}, a.q.ready...)
+		a.q.signal()
+		return nil
+	}
+
+	a.b.deadLetter(a.q, a.msg, "rejected")
+
+	return nil
+}
+
+// settle marks the delivery as settled. The deliveries of a closed broker are back in their queue and cannot be settled anymore. The caller must hold mu.
+func (a *memoryAcknowledger) settle() error {
+	if a.b.isClosed() {
+		return ErrBrokerClosed
+	}
+	if a.settled {
+		return errDeliverySettled
+	}
+	a.settled = true
+	a.q.unacked = slices.DeleteFunc(a.q.unacked, func(u *memoryAcknowledger) bool { return u == a })
+
+	return nil
+}
+
+func (b *MemoryBroker) Consume(key BindingKey, exchange Exchange, queue Queue) (<-chan Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.isClosed() {
+		return nil, fmt.Errorf("could not consume message: %w", ErrBrokerClosed)
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("could not consume message: queue %s not found", queue)
+	}
+
+	out := make(chan Delivery)
+	q.consumers = append(q.consumers, out)
+	q.signal()
+
+	return out, nil
+}
+
+func (b *MemoryBroker) Peek(queue Queue, limit int) ([]Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("could not read queue %s: queue not found", queue)
+	}
+
+	messages := []Delivery{}
+	for _, msg := range q.ready[:min(limit, len(q.ready))] {
+		messages = append(messages, b.delivery(q, msg, false))
+	}
+
+	return messages, nil
+}
+
+func (b *MemoryBroker) Replay(ctx context.Context, queue Queue, limit int) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return 0, fmt.Errorf("could not read queue %s: queue not found", queue)
+	}
+
+	limit = min(limit, len(q.ready))
+
+	var replayed int
+	for replayed < limit {
+		msg := q.ready[0]
+
+		exchange, key, ok := deadLetterOrigin(msg.headers)
+		if !ok {
+			return replayed, fmt.Errorf("message in %s was not dead lettered by the broker", queue)
+		}
+
+		err := b.route(&memoryMessage{
+			exchange:  exchange,
+			key:       key,
+			headers:   republishHeaders(msg.headers),
+			body:      msg.body,
+			timestamp: time.Now(),
+		})
+		if err != nil {
+			return replayed, fmt.Errorf("could not publish message: %w", err)
+		}
+
+		q.ready = q.ready[1:]
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+func (b *MemoryBroker) Connected() bool {
+	return !b.isClosed()
+}
+
+// Close stops delivering messages and closes the delivery channels of the consumers. As in RabbitMQ, the unsettled deliveries go back to the front of their queue.
+func (b *MemoryBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+		b.wg.Wait()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for _, q := range b.queues {
+			requeued := make([]*memoryMessage, 0, len(q.unacked)+len(q.ready))
+			for _, a := range q.unacked {
+				a.settled = true
+				requeued = append(requeued, a.msg)
+			}
+			q.ready = append(requeued, q.ready...)
+			q.unacked = nil
+
+			for _, out := range q.consumers {
+				close(out)
+			}
+			q.consumers = nil
+		}
+	})
+
+	return nil
+}
+
+func (b *MemoryBroker) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// routingMatch reports whether a message published with key is routed through a binding of bindingKey on an exchange of the given kind.
+func routingMatch(kind string, bindingKey, key BindingKey) bool {
+	switch kind {
+	case "fanout":
+		return true
+	case "topic":
+		return topicMatch(strings.Split(string(bindingKey), "."), strings.Split(string(key), "."))
+	default:
+		return bindingKey == key
+	}
+}
+
+// topicMatch matches the words of a routing key against the words of a topic binding, where * stands for exactly one word and # for zero or more words.
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+	}
+}
+
+func copyHeaders(headers map[string]any) map[string]any {
+	if headers == nil {
+		return nil
+	}
+
+	c := make(map[string]any, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+
+	return c
+}
+
+// durationArg reads a queue argument given in milliseconds.
+func durationArg(v any) (time.Duration, bool) {
+	switch n := v.(type) {
+	case int:
+		return time.Duration(n) * time.Millisecond, true
+	case int32:
+		return time.Duration(n) * time.Millisecond, true
+	case int64:
+		return time.Duration(n) * time.Millisecond, true
+	default:
+		return 0, false
+	}
+}
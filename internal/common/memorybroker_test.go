@@ -0,0 +1,358 @@
+package common
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func receiveDelivery(t *testing.T, msgs <-chan Delivery) Delivery {
+	t.Helper()
+
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not receive a message")
+		return Delivery{}
+	}
+}
+
+func assertNoDelivery(t *testing.T, msgs <-chan Delivery) {
+	t.Helper()
+
+	select {
+	case msg := <-msgs:
+		t.Fatalf("unexpected message %q", msg.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"blog.created", "blog.created", true},
+		{"blog.created", "blog.deleted", false},
+		{"blog.*", "blog.created", true},
+		{"blog.*", "blog.created.v2", false},
+		{"blog.*", "blog", false},
+		{"blog.#", "blog", true},
+		{"blog.#", "blog.created.v2", true},
+		{"#", "user.created", true},
+		{"#.created", "blog.created", true},
+		{"*.created", "user.created", true},
+		{"*.created", "created", false},
+		{"user.#.created", "user.admin.created", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.key, func(t *testing.T) {
+			got := topicMatch(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMemoryBroker_Routing(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	err := b.Declare(Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: "direct", Kind: "direct"},
+			{Name: "topic", Kind: "topic"},
+			{Name: "fanout", Kind: "fanout"},
+		},
+		Queues: []QueueSpec{{Name: "a"}, {Name: "b"}},
+		Bindings: []BindingSpec{
+			{Queue: "a", Key: "user.created", Exchange: "direct"},
+			{Queue: "a", Key: "blog.*", Exchange: "topic"},
+			{Queue: "b", Key: "#", Exchange: "topic"},
+			{Queue: "a", Exchange: "fanout"},
+			{Queue: "b", Exchange: "fanout"},
+		},
+	})
+	assert.NoError(t, err)
+
+	a, err := b.Consume("", "", "a")
+	assert.NoError(t, err)
+	qb, err := b.Consume("", "", "b")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+
+	assert.NoError(t, b.Publish(ctx, []byte("direct"), "user.created", "direct"))
+	assert.Equal(t, "direct", string(receiveDelivery(t, a).Body))
+	assertNoDelivery(t, qb)
+
+	assert.NoError(t, b.Publish(ctx, []byte("unrouted"), "user.deleted", "direct"))
+	assertNoDelivery(t, a)
+
+	assert.NoError(t, b.Publish(ctx, []byte("topic"), "blog.created", "topic"))
+	assert.Equal(t, "topic", string(receiveDelivery(t, a).Body))
+	assert.Equal(t, "topic", string(receiveDelivery(t, qb).Body))
+
+	assert.NoError(t, b.Publish(ctx, []byte("fanout"), "anything", "fanout"))
+	msg := receiveDelivery(t, a)
+	assert.Equal(t, "fanout", string(msg.Body))
+	assert.Equal(t, Exchange("fanout"), msg.Exchange)
+	assert.Equal(t, BindingKey("anything"), msg.RoutingKey)
+	assert.Equal(t, "fanout", string(receiveDelivery(t, qb).Body))
+
+	err = b.Publish(ctx, []byte("missing"), "key", "missing")
+	assert.Error(t, err)
+}
+
+func TestMemoryBroker_Declare(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	assert.NoError(t, SetupUserExchange(b))
+	// declaring the same topology twice is allowed
+	assert.NoError(t, SetupUserExchange(b))
+
+	err := b.Declare(Topology{Exchanges: []ExchangeSpec{{Name: UserExchange, Kind: "topic"}}})
+	assert.Error(t, err)
+
+	err = b.Declare(Topology{Queues: []QueueSpec{{Name: UserCreatedQueue}}})
+	assert.Error(t, err)
+
+	err = b.Declare(Topology{Bindings: []BindingSpec{{Queue: "missing", Key: UserCreatedKey, Exchange: UserExchange}}})
+	assert.Error(t, err)
+
+	_, err = b.Consume(UserCreatedKey, UserExchange, "missing")
+	assert.Error(t, err)
+}
+
+func TestRetry(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	assert.NoError(t, SetupUserExchange(b))
+
+	msgs, err := b.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	delays := UserCreatedRetryDelays[:1]
+
+	// the retry keeps the headers of the message, its trace and request ID among them
+	ctx := WithRequestID(testSpanContext(context.Background()), "request-1")
+	assert.NoError(t, b.Publish(ctx, []byte("first"), UserCreatedKey, UserExchange, WithHeaders(map[string]any{"x-test": "value"})))
+
+	msg := receiveDelivery(t, msgs)
+	r, err := Retry(context.Background(), b, msg, UserCreatedQueue, delays)
+	assert.NoError(t, err)
+	assert.Equal(t, RetryResult{Attempt: 1, Delay: delays[0]}, r)
+
+	retried, err := b.Peek(RetryQueue(UserCreatedQueue, delays[0]), 10)
+	assert.NoError(t, err)
+	if assert.Len(t, retried, 1) {
+		headers := retried[0].Headers
+		assert.Equal(t, int32(1), headers[RetryCountHeader])
+		assert.Equal(t, "value", headers["x-test"])
+		assert.Equal(t, "request-1", headers[RequestIDHeader])
+		assert.Equal(t, trace.SpanContextFromContext(ctx).TraceID(), trace.SpanContextFromContext(ExtractTrace(context.Background(), headers)).TraceID())
+	}
+
+	// once every delay has been used the message is dead lettered
+	assert.NoError(t, b.Publish(ctx, []byte("second"), UserCreatedKey, UserExchange, WithHeaders(map[string]any{RetryCountHeader: int32(1)})))
+
+	msg = receiveDelivery(t, msgs)
+	r, err = Retry(context.Background(), b, msg, UserCreatedQueue, delays)
+	assert.NoError(t, err)
+	assert.Equal(t, RetryResult{Attempt: 2, DeadLettered: true}, r)
+
+	dead, err := b.Peek(UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, "second", string(dead[0].Body))
+	}
+}
+
+func TestMemoryBroker_RetiredQueue(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	// the queue of an earlier release still holds a message
+	legacy := Topology{
+		Exchanges: []ExchangeSpec{{Name: UserExchange, Kind: "direct"}},
+		Queues:    []QueueSpec{{Name: LegacyUserCreatedQueue}},
+		Bindings:  []BindingSpec{{Queue: LegacyUserCreatedQueue, Key: UserCreatedKey, Exchange: UserExchange}},
+	}
+	assert.NoError(t, b.Declare(legacy))
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, []byte("waiting"), UserCreatedKey, UserExchange))
+
+	assert.NoError(t, SetupUserExchange(b))
+
+	msgs, err := b.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	msg := receiveDelivery(t, msgs)
+	assert.Equal(t, "waiting", string(msg.Body))
+	assert.NoError(t, msg.Ack())
+
+	// the retired queue receives nothing anymore
+	assert.NoError(t, b.Publish(ctx, []byte("new"), UserCreatedKey, UserExchange))
+	msg = receiveDelivery(t, msgs)
+	assert.Equal(t, "new", string(msg.Body))
+	assert.NoError(t, msg.Ack())
+
+	queued, err := b.Peek(LegacyUserCreatedQueue, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, queued)
+}
+
+func TestMemoryBroker_Acknowledgement(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	assert.NoError(t, SetupUserExchange(b))
+
+	msgs, err := b.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, []byte("first"), UserCreatedKey, UserExchange, WithHeaders(map[string]any{"x-test": "value"})))
+
+	// a requeued message is delivered again
+	msg := receiveDelivery(t, msgs)
+	assert.Equal(t, "value", msg.Headers["x-test"])
+	assert.NoError(t, msg.Nack(true))
+
+	msg = receiveDelivery(t, msgs)
+	assert.Equal(t, "first", string(msg.Body))
+	assert.NoError(t, msg.Ack())
+	assert.Error(t, msg.Ack())
+
+	// a rejected message is dead lettered
+	assert.NoError(t, b.Publish(ctx, []byte("second"), UserCreatedKey, UserExchange, WithHeaders(map[string]any{"x-test": "value"})))
+	msg = receiveDelivery(t, msgs)
+	assert.NoError(t, msg.Nack(false))
+
+	dead, err := b.Peek(UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, "second", string(dead[0].Body))
+	assert.Equal(t, DeadLetterExchange, dead[0].Exchange)
+	assert.Error(t, dead[0].Ack())
+
+	// replaying sends it back to the queue it was rejected from, with its own headers but not its death
+	replayed, err := b.Replay(ctx, UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+
+	msg = receiveDelivery(t, msgs)
+	assert.Equal(t, "second", string(msg.Body))
+	assert.Equal(t, "value", msg.Headers["x-test"])
+	assert.NotContains(t, msg.Headers, "x-death")
+	assert.NoError(t, msg.Ack())
+
+	dead, err = b.Peek(UserCreatedDLQ, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, dead)
+}
+
+func TestMemoryBroker_Expiration(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	assert.NoError(t, SetupUserExchange(b))
+
+	msgs, err := b.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	// a message in a retry queue is dead lettered back to the user exchange once its TTL passes
+	delay := UserCreatedRetryDelays[0]
+	err = b.Publish(context.Background(), []byte("retry"), BindingKey(RetryQueue(UserCreatedQueue, delay)), RetryExchange,
+		WithHeaders(map[string]any{RetryCountHeader: int32(1)}),
+		WithExpiration(50*time.Millisecond))
+	assert.NoError(t, err)
+
+	assertNoDelivery(t, msgs)
+
+	msg := receiveDelivery(t, msgs)
+	assert.Equal(t, "retry", string(msg.Body))
+	assert.Equal(t, UserExchange, msg.Exchange)
+	assert.Equal(t, UserCreatedKey, msg.RoutingKey)
+	assert.Equal(t, int32(1), msg.Headers[RetryCountHeader])
+
+	exchange, key, ok := deadLetterOrigin(msg.Headers)
+	assert.True(t, ok)
+	assert.Equal(t, RetryExchange, exchange)
+	assert.Equal(t, BindingKey(RetryQueue(UserCreatedQueue, delay)), key)
+	assert.NoError(t, msg.Ack())
+}
+
+func TestMemoryBroker_QueueTTL(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	err := b.Declare(Topology{
+		Exchanges: []ExchangeSpec{{Name: "events", Kind: "direct"}, {Name: "dlx", Kind: "fanout"}},
+		Queues: []QueueSpec{
+			{Name: "short", Args: map[string]any{"x-message-ttl": int32(20), "x-dead-letter-exchange": "dlx"}},
+			{Name: "dead"},
+		},
+		Bindings: []BindingSpec{
+			{Queue: "short", Key: "event", Exchange: "events"},
+			{Queue: "dead", Exchange: "dlx"},
+		},
+	})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, []byte("first"), "event", "events"))
+	assert.NoError(t, b.Publish(ctx, []byte("second"), "event", "events"))
+
+	dead, err := b.Consume("", "", "dead")
+	assert.NoError(t, err)
+
+	msg := receiveDelivery(t, dead)
+	assert.Equal(t, "first", string(msg.Body))
+	deaths := msg.Headers["x-death"].([]any)
+	assert.Equal(t, "expired", deaths[0].(map[string]any)["reason"])
+
+	assert.Equal(t, "second", string(receiveDelivery(t, dead).Body))
+}
+
+func TestMemoryBroker_Close(t *testing.T) {
+	b := NewMemoryBroker()
+
+	assert.NoError(t, SetupUserExchange(b))
+
+	msgs, err := b.Consume(UserCreatedKey, UserExchange, UserCreatedQueue)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, b.Publish(ctx, []byte("first"), UserCreatedKey, UserExchange))
+	assert.NoError(t, b.Publish(ctx, []byte("second"), UserCreatedKey, UserExchange))
+	first := receiveDelivery(t, msgs)
+
+	assert.True(t, b.Connected())
+	assert.NoError(t, b.Close())
+	assert.False(t, b.Connected())
+
+	_, ok := <-msgs
+	assert.False(t, ok)
+
+	// The unsettled deliveries are requeued in order and cannot be settled anymore.
+	assert.ErrorIs(t, first.Ack(), ErrBrokerClosed)
+	queued, err := b.Peek(UserCreatedQueue, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, queued, 2) {
+		assert.Equal(t, "first", string(queued[0].Body))
+		assert.Equal(t, "second", string(queued[1].Body))
+	}
+
+	err = b.Publish(ctx, []byte("late"), UserCreatedKey, UserExchange)
+	assert.ErrorIs(t, err, ErrBrokerClosed)
+}
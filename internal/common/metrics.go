@@ -0,0 +1,184 @@
+package common
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsNamespace prefixes the names of the metrics of the application.
+const MetricsNamespace = "blogist"
+
+// MeteredBroker is a Broker that counts the messages published and consumed through it. It is a prometheus.Collector.
+type MeteredBroker struct {
+	Broker
+
+	published *prometheus.CounterVec
+	consumed  *prometheus.CounterVec
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ Broker               = (*MeteredBroker)(nil)
+	_ prometheus.Collector = (*MeteredBroker)(nil)
+)
+
+func NewMeteredBroker(b Broker) *MeteredBroker {
+	return &MeteredBroker{
+		Broker: b,
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "broker",
+			Name:      "published_total",
+			Help:      "Messages published to the broker, by exchange and result.",
+		}, []string{"exchange", "result"}),
+		consumed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "broker",
+			Name:      "consumed_total",
+			Help:      "Messages consumed from the broker, by queue and how they were settled: ack, nack or requeue.",
+		}, []string{"queue", "result"}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (b *MeteredBroker) Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange, opts ...PublishOption) error {
+	err := b.Broker.Publish(ctx, msg, key, exchange, opts...)
+	b.published.WithLabelValues(string(exchange), outcome(err)).Inc()
+
+	return err
+}
+
+// Consume counts each delivery when the consumer settles it.
+func (b *MeteredBroker) Consume(key BindingKey, exchange Exchange, queue Queue) (<-chan Delivery, error) {
+	msgs, err := b.Broker.Consume(key, exchange, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+
+	go func() {
+		defer close(out)
+
+		for msg := range msgs {
+			if msg.Acknowledger != nil {
+				msg.Acknowledger = &meteredAcknowledger{Acknowledger: msg.Acknowledger, queue: queue, consumed: b.consumed}
+			}
+
+			select {
+			case out <- msg:
+			case <-b.closed:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (b *MeteredBroker) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return b.Broker.Close()
+}
+
+func (b *MeteredBroker) Describe(ch chan<- *prometheus.Desc) {
+	b.published.Describe(ch)
+	b.consumed.Describe(ch)
+}
+
+func (b *MeteredBroker) Collect(ch chan<- prometheus.Metric) {
+	b.published.Collect(ch)
+	b.consumed.Collect(ch)
+}
+
+type meteredAcknowledger struct {
+	Acknowledger
+	queue    Queue
+	consumed *prometheus.CounterVec
+}
+
+func (a *meteredAcknowledger) Ack() error {
+	err := a.Acknowledger.Ack()
+	if err == nil {
+		a.consumed.WithLabelValues(string(a.queue), "ack").Inc()
+	}
+
+	return err
+}
+
+func (a *meteredAcknowledger) Nack(requeue bool) error {
+	err := a.Acknowledger.Nack(requeue)
+	if err == nil {
+		settled := "nack"
+		if requeue {
+			settled = "requeue"
+		}
+		a.consumed.WithLabelValues(string(a.queue), settled).Inc()
+	}
+
+	return err
+}
+
+// MeteredCache is a Cache that counts its hits and misses, including the ones of its namespaces. It is a prometheus.Collector.
+type MeteredCache struct {
+	Cache
+
+	requests *prometheus.CounterVec
+}
+
+var (
+	_ Cache                = (*MeteredCache)(nil)
+	_ prometheus.Collector = (*MeteredCache)(nil)
+)
+
+func NewMeteredCache(c Cache) *MeteredCache {
+	return &MeteredCache{
+		Cache: c,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "cache",
+			Name:      "requests_total",
+			Help:      "Cache lookups, by result: hit or miss.",
+		}, []string{"result"}),
+	}
+}
+
+func (c *MeteredCache) Get(key string, dst interface{}) bool {
+	ok := c.Cache.Get(key, dst)
+	if ok {
+		c.requests.WithLabelValues("hit").Inc()
+	} else {
+		c.requests.WithLabelValues("miss").Inc()
+	}
+
+	return ok
+}
+
+// Namespace returns the snapshot of the wrapped cache, reading and writing through c so that its lookups are counted too.
+func (c *MeteredCache) Namespace(name string) *Namespace {
+	ns := c.Cache.Namespace(name)
+	ns.c = c
+
+	return ns
+}
+
+func (c *MeteredCache) Describe(ch chan<- *prometheus.Desc) {
+	c.requests.Describe(ch)
+}
+
+func (c *MeteredCache) Collect(ch chan<- prometheus.Metric) {
+	c.requests.Collect(ch)
+}
+
+// outcome is the label of the outcome of an operation that returned err.
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
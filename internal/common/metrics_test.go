@@ -0,0 +1,74 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeteredBroker(t *testing.T) {
+	b := NewMeteredBroker(NewMemoryBroker())
+	defer b.Close()
+
+	err := b.Declare(Topology{
+		Exchanges: []ExchangeSpec{{Name: "direct", Kind: "direct"}},
+		Queues:    []QueueSpec{{Name: "a"}},
+		Bindings:  []BindingSpec{{Queue: "a", Key: "key", Exchange: "direct"}},
+	})
+	assert.NoError(t, err)
+
+	msgs, err := b.Consume("key", "direct", "a")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+
+	for range 3 {
+		assert.NoError(t, b.Publish(ctx, []byte("message"), "key", "direct"))
+	}
+	assert.Error(t, b.Publish(ctx, []byte("message"), "key", "missing"))
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(b.published.WithLabelValues("direct", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(b.published.WithLabelValues("missing", "failure")))
+
+	assert.NoError(t, receiveDelivery(t, msgs).Ack())
+	assert.NoError(t, receiveDelivery(t, msgs).Nack(false))
+	assert.NoError(t, receiveDelivery(t, msgs).Nack(true))
+	assert.NoError(t, receiveDelivery(t, msgs).Ack())
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(b.consumed.WithLabelValues("a", "ack")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(b.consumed.WithLabelValues("a", "nack")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(b.consumed.WithLabelValues("a", "requeue")))
+
+	// Closing the broker ends the consumers, even when nobody reads their deliveries.
+	assert.NoError(t, b.Publish(ctx, []byte("unread"), "key", "direct"))
+	assert.NoError(t, b.Close())
+	assert.Eventually(t, func() bool {
+		_, ok := <-msgs
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMeteredCache(t *testing.T) {
+	for name, cache := range testCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			c := NewMeteredCache(cache)
+
+			var v cachedValue
+			assert.False(t, c.Get("key", &v))
+			c.Set("key", cachedValue{Name: "value"})
+			assert.True(t, c.Get("key", &v))
+
+			// The lookups of a namespace go through the metered cache too.
+			ns := c.Namespace("ns")
+			assert.False(t, ns.Get("key", &v))
+			ns.Set("key", cachedValue{Name: "value"})
+			assert.True(t, ns.Get("key", &v))
+
+			assert.Equal(t, float64(2), testutil.ToFloat64(c.requests.WithLabelValues("hit")))
+			assert.Equal(t, float64(2), testutil.ToFloat64(c.requests.WithLabelValues("miss")))
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+var (
+	// ErrSchemaBehind is returned by Migrator.Check when the database misses migrations the binary expects.
+	ErrSchemaBehind = errors.New("the database schema is behind")
+	// ErrSchemaDirty is returned by Migrator.Check when a migration failed halfway. The schema has to be fixed by hand and the version forced.
+	ErrSchemaDirty = errors.New("the database schema is dirty")
+)
+
+// migrateLockTimeout bounds the wait for the migrations of another replica to finish.
+const migrateLockTimeout = time.Minute
+
+// SchemaStatus is the version of the database schema and the latest version of the migrations.
+type SchemaStatus struct {
+	// Version is 0 before the first migration.
+	Version uint `json:"version"`
+	Latest  uint `json:"latest"`
+	Dirty   bool `json:"dirty"`
+}
+
+// Migrator applies the migrations of fsys, e.g. the ones embedded in the binary, to the database. The migrations hold an advisory lock on the database while they run, so that the replicas that start together migrate one after the other and only the first one has anything to do.
+type Migrator struct {
+	m      *migrate.Migrate
+	latest uint
+}
+
+// NewMigrator uses a connection of db until it is closed. The migration files are at the root of fsys.
+func NewMigrator(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	src, err := iofs.New(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the migrations: %w", err)
+	}
+
+	latest, err := latestMigration(src)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+
+	// The driver is given a connection rather than db, which it would close with itself.
+	driver, err := postgres.WithConnection(context.Background(), conn, &postgres.Config{})
+	if err != nil {
+		src.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", src, "postgres", driver)
+	if err != nil {
+		src.Close()
+		driver.Close()
+		return nil, err
+	}
+	m.LockTimeout = migrateLockTimeout
+
+	return &Migrator{m: m, latest: latest}, nil
+}
+
+// latestMigration returns the version of the last migration of src.
+func latestMigration(src source.Driver) (uint, error) {
+	version, err := src.First()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the migrations: %w", err)
+	}
+
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the migrations: %w", err)
+		}
+		version = next
+	}
+}
+
+// Up applies the migrations that were not applied yet.
+func (m *Migrator) Up() error {
+	err := m.m.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	return nil
+}
+
+// Down reverts the last n migrations.
+func (m *Migrator) Down(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("the number of migrations to revert must be positive, got %d", n)
+	}
+
+	err := m.m.Steps(-n)
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	return nil
+}
+
+// Force sets the version of the schema without running a migration and clears the dirty flag, once a failed migration was fixed by hand.
+func (m *Migrator) Force(version int) error {
+	return m.m.Force(version)
+}
+
+// Status returns the version of the schema.
+func (m *Migrator) Status() (SchemaStatus, error) {
+	version, dirty, err := m.m.Version()
+	if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+		return SchemaStatus{}, err
+	}
+
+	return SchemaStatus{Version: version, Latest: m.latest, Dirty: dirty}, nil
+}
+
+// Check returns an error when the schema is dirty or behind the migrations. A schema ahead of them is accepted, so that the replicas of the previous release keep running while a new one rolls out.
+func (m *Migrator) Check() error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	if status.Dirty {
+		return fmt.Errorf("%w at version %d", ErrSchemaDirty, status.Version)
+	}
+	if status.Version < status.Latest {
+		return fmt.Errorf("%w: version %d, expected %d", ErrSchemaBehind, status.Version, status.Latest)
+	}
+
+	return nil
+}
+
+// Close releases the connection of the migrator.
+func (m *Migrator) Close() error {
+	srcErr, dbErr := m.m.Close()
+	return errors.Join(srcErr, dbErr)
+}
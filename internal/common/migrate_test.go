@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/migrations"
+)
+
+func TestLatestMigration(t *testing.T) {
+	src, err := iofs.New(fstest.MapFS{
+		"000001_create_a.up.sql":   {Data: []byte("CREATE TABLE a ();")},
+		"000001_create_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		"000003_create_b.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"000003_create_b.down.sql": {Data: []byte("DROP TABLE b;")},
+	}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := latestMigration(src)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(3), latest)
+}
+
+func TestMigrator(t *testing.T) {
+	db := TestDB("file://../../migrations", t)
+
+	m, err := NewMigrator(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	status, err := m.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, status.Latest, status.Version)
+	assert.NoError(t, m.Check())
+
+	// A schema behind the migrations is refused until they are applied.
+	assert.NoError(t, m.Down(2))
+	assert.ErrorIs(t, m.Check(), ErrSchemaBehind)
+
+	assert.NoError(t, m.Up())
+	assert.NoError(t, m.Check())
+
+	// The migrator does not close the pool it was given a connection of.
+	assert.NoError(t, m.Close())
+	assert.NoError(t, db.Ping())
+}
@@ -0,0 +1,320 @@
+package common
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// OutboxWriter adds messages to the outbox of a transaction.
+type OutboxWriter interface {
+	EnqueueOutbox(ctx context.Context, exchange Exchange, key BindingKey, payload []byte) error
+}
+
+// EnqueueOutbox writes a message to the outbox as part of tx. The message is published by the OutboxRelay once tx commits, so it is sent if and only if the domain change it describes is stored. The trace context and the request ID of ctx are kept with the message, so that its publication continues them.
+func EnqueueOutbox(ctx context.Context, tx *sql.Tx, exchange Exchange, key BindingKey, payload []byte) error {
+	query := `
+		INSERT INTO outbox (exchange, routing_key, payload, headers)
+		VALUES ($1, $2, $3, $4)`
+
+	var headers []byte
+	if h := MessageHeaders(ctx, nil); h != nil {
+		var err error
+		headers, err = json.Marshal(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, query, string(exchange), string(key), payload, headers)
+	return err
+}
+
+// OutboxMessage is a message waiting in the outbox.
+type OutboxMessage struct {
+	ID         int64
+	Exchange   Exchange
+	RoutingKey BindingKey
+	Payload    []byte
+	// Headers holds the trace context of the transaction that wrote the message.
+	Headers  map[string]any
+	Attempts int
+}
+
+const (
+	outboxPollInterval = 500 * time.Millisecond
+	outboxBatchSize    = 100
+	outboxBaseDelay    = time.Second
+	outboxMaxDelay     = 5 * time.Minute
+	// outboxPublishTimeout bounds the publication of one message.
+	outboxPublishTimeout = 5 * time.Second
+	// outboxClaimLease is how long a claimed batch is kept from the other relays.
+	outboxClaimLease     = time.Minute
+	outboxPruneInterval  = time.Hour
+	outboxPruneBatchSize = 1000
+)
+
+// OutboxRetention is how long the sent messages are kept in the outbox, which bounds how far back they can be replayed.
+const OutboxRetention = 7 * 24 * time.Hour
+
+// OutboxRelay publishes the pending messages of the outbox to the message broker. Several replicas can run a relay at the same time, each message is claimed by one of them.
+type OutboxRelay struct {
+	db       *sql.DB
+	producer MessageProducer
+	logger   *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// stopping is closed when the relay should stop after the batch in progress.
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func NewOutboxRelay(db *sql.DB, producer MessageProducer, logger *slog.Logger) *OutboxRelay {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &OutboxRelay{
+		db:       db,
+		producer: producer,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Start runs the relay in the background until Close is called.
+func (r *OutboxRelay) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+
+		// The first pass prunes the outbox, then once every outboxPruneInterval.
+		var pruned time.Time
+
+		for {
+			// Keep draining while there are full batches, otherwise wait for the next tick.
+			n, err := r.relay(r.ctx)
+			if err != nil && r.ctx.Err() == nil {
+				r.logger.Error("could not relay outbox messages", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-r.stopping:
+				return
+			default:
+			}
+
+			if time.Since(pruned) >= outboxPruneInterval {
+				pruned = time.Now()
+				if _, err := r.prune(r.ctx); err != nil && r.ctx.Err() == nil {
+					r.logger.Error("could not prune the outbox", slog.String("error", err.Error()))
+				}
+			}
+
+			if n == outboxBatchSize {
+				continue
+			}
+
+			select {
+			case <-ticker.C:
+			case <-r.stopping:
+				return
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the relay and waits for the batch in progress to finish.
+func (r *OutboxRelay) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// Shutdown stops the relay once the batch in progress is published. It waits for the batch until ctx is done, when it cancels it; the messages of a cancelled batch stay in the outbox and are claimed again once their lease has passed.
+func (r *OutboxRelay) Shutdown(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stopping) })
+
+	err := Wait(ctx, &r.wg)
+	r.Close()
+
+	return err
+}
+
+// relay publishes one batch of due messages and returns how many were claimed.
+func (r *OutboxRelay) relay(ctx context.Context) (int, error) {
+	msgs, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The claim lapses after outboxClaimLease, the messages not published by then are left to the next claim.
+	deadline := time.Now().Add(outboxClaimLease - outboxPublishTimeout)
+	for _, msg := range msgs {
+		if time.Now().After(deadline) {
+			break
+		}
+
+		publishCtx, cancel := context.WithTimeout(ExtractRequestID(ExtractTrace(ctx, msg.Headers), msg.Headers), outboxPublishTimeout)
+		err := r.producer.Publish(publishCtx, msg.Payload, msg.RoutingKey, msg.Exchange)
+		cancel()
+
+		if err != nil {
+			delay := outboxBackoff(msg.Attempts)
+			r.logger.Info("delaying outbox message", slog.Int64("id", msg.ID), slog.Int("attempt", msg.Attempts+1), slog.Duration("delay", delay), slog.String("error", err.Error()))
+
+			_, err = r.db.ExecContext(ctx, `
+				UPDATE outbox
+				SET attempts = attempts + 1, last_error = $1, available_at = $2
+				WHERE id = $3`, err.Error(), time.Now().Add(delay), msg.ID)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		_, err = r.db.ExecContext(ctx, "UPDATE outbox SET sent_at = NOW(), attempts = attempts + 1 WHERE id = $1", msg.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(msgs), nil
+}
+
+// claim takes a batch of due messages for this relay by pushing their availability past the claim lease. The claim commits at once, so no row stays locked while the messages are published; if the relay stops before it publishes them, another relay claims them again once the lease has passed.
+func (r *OutboxRelay) claim(ctx context.Context) ([]OutboxMessage, error) {
+	query := `
+		UPDATE outbox
+		SET available_at = $2
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE sent_at IS NULL AND available_at <= NOW()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, exchange, routing_key, payload, headers, attempts`
+
+	rows, err := r.db.QueryContext(ctx, query, outboxBatchSize, time.Now().Add(outboxClaimLease))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var headers []byte
+		err := rows.Scan(&msg.ID, &msg.Exchange, &msg.RoutingKey, &msg.Payload, &headers, &msg.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		if headers != nil {
+			// Headers that cannot be read only cost the message its trace.
+			json.Unmarshal(headers, &msg.Headers)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep the order of the subquery.
+	slices.SortFunc(msgs, func(a, b OutboxMessage) int { return cmp.Compare(a.ID, b.ID) })
+
+	return msgs, nil
+}
+
+// prune deletes the messages sent before the retention period, a batch at a time, and returns how many were deleted.
+func (r *OutboxRelay) prune(ctx context.Context) (int64, error) {
+	query := `
+		DELETE FROM outbox
+		WHERE id IN (
+			SELECT id
+			FROM outbox
+			WHERE sent_at < $1
+			LIMIT $2)`
+
+	var total int64
+	for {
+		res, err := r.db.ExecContext(ctx, query, time.Now().Add(-OutboxRetention), outboxPruneBatchSize)
+		if err != nil {
+			return total, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+
+		if n < outboxPruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// ReplayOutbox schedules messages of the outbox to be published again by the relays on their next poll: the messages sent since the given time, and the ones waiting for a retry after they failed. It returns how many messages were scheduled. The consumers receive the replayed messages a second time. The sent messages are only kept for OutboxRetention.
+func ReplayOutbox(ctx context.Context, db *sql.DB, since time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		UPDATE outbox
+		SET sent_at = NULL, available_at = NOW()
+		WHERE sent_at >= $1 OR (sent_at IS NULL AND attempts > 0)`, since)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// outboxBackoff returns how long to wait before retrying a message that failed the given number of times before.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts >= 16 {
+		return outboxMaxDelay
+	}
+
+	return min(outboxBaseDelay<<attempts, outboxMaxDelay)
+}
+
+// MemoryOutbox is the outbox of the in-memory stores. It only collects the committed messages, which tests read back with Messages.
+type MemoryOutbox struct {
+	mu       sync.Mutex
+	messages []OutboxMessage
+	nextID   int64
+}
+
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Append adds the messages of a committed transaction.
+func (o *MemoryOutbox) Append(msgs ...OutboxMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, msg := range msgs {
+		o.nextID++
+		msg.ID = o.nextID
+		o.messages = append(o.messages, msg)
+	}
+}
+
+// Messages returns a copy of the messages in the outbox.
+func (o *MemoryOutbox) Messages() []OutboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]OutboxMessage{}, o.messages...)
+}
@@ -0,0 +1,232 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type testProducer struct {
+	mu        sync.Mutex
+	failures  int
+	published [][]byte
+	// traces are the trace IDs in the contexts of the published messages.
+	traces []trace.TraceID
+}
+
+func (p *testProducer) Publish(ctx context.Context, msg []byte, key BindingKey, exchange Exchange, opts ...PublishOption) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+
+	p.published = append(p.published, msg)
+	p.traces = append(p.traces, trace.SpanContextFromContext(ctx).TraceID())
+	return nil
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, outboxBackoff(0))
+	assert.Equal(t, 2*time.Second, outboxBackoff(1))
+	assert.Equal(t, 8*time.Second, outboxBackoff(3))
+	assert.Equal(t, outboxMaxDelay, outboxBackoff(10))
+	assert.Equal(t, outboxMaxDelay, outboxBackoff(100))
+}
+
+func TestOutboxRelay(t *testing.T) {
+	db := TestDB("file://../../migrations", t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	enqueueCtx := func(ctx context.Context, payload string, commit bool) {
+		tx, err := db.Begin()
+		assert.NoError(t, err)
+
+		err = EnqueueOutbox(ctx, tx, UserExchange, UserCreatedKey, []byte(payload))
+		assert.NoError(t, err)
+
+		if commit {
+			assert.NoError(t, tx.Commit())
+		} else {
+			assert.NoError(t, tx.Rollback())
+		}
+	}
+	enqueue := func(payload string, commit bool) {
+		enqueueCtx(context.Background(), payload, commit)
+	}
+
+	t.Run("publishes committed messages", func(t *testing.T) {
+		producer := &testProducer{}
+		relay := NewOutboxRelay(db, producer, logger)
+
+		enqueue("committed", true)
+		enqueue("rolled back", false)
+
+		n, err := relay.relay(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, [][]byte{[]byte("committed")}, producer.published)
+
+		var pending int
+		err = db.QueryRow("SELECT COUNT(*) FROM outbox WHERE sent_at IS NULL").Scan(&pending)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, pending)
+
+		_, err = db.Exec("DELETE FROM outbox")
+		assert.NoError(t, err)
+	})
+
+	t.Run("retries failed messages later", func(t *testing.T) {
+		producer := &testProducer{failures: 1}
+		relay := NewOutboxRelay(db, producer, logger)
+
+		enqueue("retried", true)
+
+		_, err := relay.relay(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, producer.published)
+
+		var attempts int
+		var lastError string
+		err = db.QueryRow("SELECT attempts, last_error FROM outbox WHERE sent_at IS NULL").Scan(&attempts, &lastError)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, attempts)
+		assert.Equal(t, "broker unavailable", lastError)
+
+		// the message is not due yet
+		n, err := relay.relay(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		_, err = db.Exec("UPDATE outbox SET available_at = NOW()")
+		assert.NoError(t, err)
+
+		n, err = relay.relay(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, [][]byte{[]byte("retried")}, producer.published)
+
+		_, err = db.Exec("DELETE FROM outbox")
+		assert.NoError(t, err)
+	})
+
+	t.Run("keeps the trace context", func(t *testing.T) {
+		producer := &testProducer{}
+		relay := NewOutboxRelay(db, producer, logger)
+
+		ctx := testSpanContext(context.Background())
+		enqueueCtx(ctx, "traced", true)
+		enqueue("untraced", true)
+
+		_, err := relay.relay(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, []trace.TraceID{trace.SpanContextFromContext(ctx).TraceID(), {}}, producer.traces)
+
+		_, err = db.Exec("DELETE FROM outbox")
+		assert.NoError(t, err)
+	})
+
+	t.Run("replays sent and failed messages", func(t *testing.T) {
+		producer := &testProducer{}
+		relay := NewOutboxRelay(db, producer, logger)
+
+		enqueue("old", true)
+		enqueue("recent", true)
+		_, err := relay.relay(context.Background())
+		assert.NoError(t, err)
+
+		_, err = db.Exec("UPDATE outbox SET sent_at = NOW() - INTERVAL '2 hours' WHERE payload = 'old'")
+		assert.NoError(t, err)
+
+		producer.failures = 1
+		enqueue("failed", true)
+		_, err = relay.relay(context.Background())
+		assert.NoError(t, err)
+
+		n, err := ReplayOutbox(context.Background(), db, time.Now().Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+
+		producer.published = nil
+		_, err = relay.relay(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("recent"), []byte("failed")}, producer.published)
+
+		_, err = db.Exec("DELETE FROM outbox")
+		assert.NoError(t, err)
+	})
+
+	t.Run("claims a batch for one relay", func(t *testing.T) {
+		relay := NewOutboxRelay(db, &testProducer{}, logger)
+
+		enqueue("claimed", true)
+
+		msgs, err := relay.claim(context.Background())
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 1)
+
+		// The claim is committed, another relay skips the message until the lease has passed.
+		other := NewOutboxRelay(db, &testProducer{}, logger)
+		msgs, err = other.claim(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, msgs)
+
+		_, err = db.Exec("UPDATE outbox SET available_at = NOW()")
+		assert.NoError(t, err)
+
+		msgs, err = other.claim(context.Background())
+		assert.NoError(t, err)
+		assert.Len(t, msgs, 1)
+
+		_, err = db.Exec("DELETE FROM outbox")
+		assert.NoError(t, err)
+	})
+
+	t.Run("prunes old sent messages", func(t *testing.T) {
+		relay := NewOutboxRelay(db, &testProducer{}, logger)
+
+		enqueue("expired", true)
+		enqueue("kept", true)
+		enqueue("pending", true)
+		_, err := db.Exec("UPDATE outbox SET sent_at = $1 WHERE payload = 'expired'", time.Now().Add(-OutboxRetention-time.Hour))
+		assert.NoError(t, err)
+		_, err = db.Exec("UPDATE outbox SET sent_at = NOW() WHERE payload = 'kept'")
+		assert.NoError(t, err)
+
+		n, err := relay.prune(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		var left int
+		err = db.QueryRow("SELECT COUNT(*) FROM outbox").Scan(&left)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, left)
+
+		_, err = db.Exec("DELETE FROM outbox")
+		assert.NoError(t, err)
+	})
+
+	t.Run("runs in the background", func(t *testing.T) {
+		producer := &testProducer{}
+		relay := NewOutboxRelay(db, producer, logger)
+		relay.Start()
+		defer relay.Close()
+
+		enqueue("background", true)
+
+		assert.Eventually(t, func() bool {
+			producer.mu.Lock()
+			defer producer.mu.Unlock()
+			return len(producer.published) == 1
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}
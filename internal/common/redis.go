@@ -0,0 +1,148 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache is a Cache shared by every replica. Values are stored as JSON, and namespace generations live in Redis as well, so an invalidation on one replica is seen by all of them.
+type RedisCache struct {
+	client     *redis.Client
+	prefix     string
+	expiration time.Duration
+	// logger records the writes that failed, since the callers cannot act on them.
+	logger *slog.Logger
+}
+
+func NewRedisCache(addr, password string, db int, expiration time.Duration, logger *slog.Logger) (*RedisCache, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not connect to redis: %w", err)
+	}
+
+	return &RedisCache{
+		client:     client,
+		prefix:     "blogist:",
+		expiration: expiration,
+		logger:     logger,
+	}, nil
+}
+
+// Close closes the connection to redis.
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+// A cache lookup must never hold a request up for long, so every call gets a short deadline and failures are treated as misses.
+const redisTimeout = 500 * time.Millisecond
+
+func (c *RedisCache) Set(key string, value interface{}, expiration ...time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		c.logger.Error("failed to encode the cache entry", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+
+	exp := c.expiration
+	if len(expiration) > 0 {
+		exp = expiration[0]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	err = c.client.Set(ctx, c.prefix+key, data, exp).Err()
+	if err != nil {
+		c.logger.Warn("failed to store the cache entry", slog.String("key", key), slog.String("error", err.Error()))
+	}
+}
+
+func (c *RedisCache) Get(key string, dst interface{}) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := c.client.Get(ctx, c.prefix+key).Bytes()
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(data, dst) == nil
+}
+
+func (c *RedisCache) Delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	err := c.client.Del(ctx, c.prefix+key).Err()
+	if err != nil {
+		c.logger.Error("failed to delete the cache entry", slog.String("key", key), slog.String("error", err.Error()))
+	}
+}
+
+// Flush deletes every key written by the application. Other data in the same redis database is left alone.
+func (c *RedisCache) Flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		c.client.Del(ctx, iter.Val())
+	}
+}
+
+func (c *RedisCache) Namespace(name string) *Namespace {
+	gen, err := c.generation(name)
+	if err != nil {
+		return &Namespace{c: c, name: name, disabled: true}
+	}
+
+	return &Namespace{c: c, name: name, gen: gen}
+}
+
+func (c *RedisCache) Invalidate(namespaces ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	pipe := c.client.Pipeline()
+	for _, ns := range namespaces {
+		pipe.Incr(ctx, c.prefix+namespaceGenerationKey(ns))
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to invalidate the cache namespaces %v: %w", namespaces, err)
+	}
+
+	return nil
+}
+
+func (c *RedisCache) generation(name string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	gen, err := c.client.Get(ctx, c.prefix+namespaceGenerationKey(name)).Int64()
+	if err != nil {
+		switch {
+		case errors.Is(err, redis.Nil):
+			return 0, nil
+		default:
+			return 0, err
+		}
+	}
+
+	return gen, nil
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Signer signs values with HMAC-SHA256 so they can be handed out, in a link for example, and trusted when they come back. The values are encoded, not encrypted, so they must not be secret.
+type Signer struct {
+	key []byte
+}
+
+// NewSigner creates a signer with the key. Every replica must use the same key to verify the values signed by the others.
+func NewSigner(key []byte) (*Signer, error) {
+	if len(key) < 32 {
+		return nil, errors.New("the signing key must be at least 32 bytes long")
+	}
+
+	return &Signer{key: key}, nil
+}
+
+// Sign returns the value together with its signature, in a form that can be used in a URL.
+func (s *Signer) Sign(value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + base64.RawURLEncoding.EncodeToString(s.mac(value))
+}
+
+// Verify returns the value of a token created by Sign. It returns ErrInvalidSignature when the token was not signed with the key of the signer, or was changed since.
+func (s *Signer) Verify(token string) (string, error) {
+	encodedValue, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidSignature
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(encodedValue)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	if !hmac.Equal(sig, s.mac(string(value))) {
+		return "", ErrInvalidSignature
+	}
+
+	return string(value), nil
+}
+
+func (s *Signer) mac(value string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigner(t *testing.T) {
+	_, err := NewSigner([]byte("too short"))
+	assert.Error(t, err)
+
+	s, err := NewSigner(bytes.Repeat([]byte("a"), 32))
+	assert.NoError(t, err)
+	other, err := NewSigner(bytes.Repeat([]byte("b"), 32))
+	assert.NoError(t, err)
+
+	token := s.Sign("unsubscribe:1:comments")
+
+	value, err := s.Verify(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "unsubscribe:1:comments", value)
+
+	encodedValue, sig, _ := strings.Cut(token, ".")
+	tampered := s.Sign("unsubscribe:2:comments")
+	tamperedValue, _, _ := strings.Cut(tampered, ".")
+
+	for name, token := range map[string]string{
+		"other key":       token,
+		"changed value":   tamperedValue + "." + sig,
+		"no signature":    encodedValue,
+		"empty signature": encodedValue + ".",
+		"not base64":      "!!!." + sig,
+		"empty":           "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			verifier := s
+			if name == "other key" {
+				verifier = other
+			}
+
+			_, err := verifier.Verify(token)
+			assert.ErrorIs(t, err, ErrInvalidSignature)
+		})
+	}
+}
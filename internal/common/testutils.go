@@ -76,7 +76,7 @@ func TestDB(filepath string, t *testing.T) *sql.DB {
 		t.Fatalf("could not run migrations: %v", err)
 	}
 
-	db, err := sql.Open("postgres", connURL)
+	db, err := openDB(connURL)
 	if err != nil {
 		t.Fatalf("could not open database: %v", err)
 	}
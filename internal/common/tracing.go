@@ -0,0 +1,131 @@
+package common
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName names the tracer of the packages of the application.
+const TracerName = "github.com/sushihentaime/blogist"
+
+// Tracer returns the tracer of the application from the global provider, which does nothing until the application installs one.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// propagator carries the trace context in the headers of the messages. It is fixed rather than the global one so that a consumer always understands what a producer wrote.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// headerCarrier lets the propagator read and write the headers of a message.
+type headerCarrier map[string]any
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// InjectTrace returns a copy of headers with the trace context of ctx added, so that whoever handles the message continues the trace. The headers are returned as they are when ctx is not part of a trace.
+func InjectTrace(ctx context.Context, headers map[string]any) map[string]any {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return headers
+	}
+
+	carrier := make(headerCarrier, len(headers)+2)
+	for k, v := range headers {
+		carrier[k] = v
+	}
+	propagator.Inject(ctx, carrier)
+
+	return carrier
+}
+
+// ExtractTrace returns ctx carrying the trace context found in the headers of a message.
+func ExtractTrace(ctx context.Context, headers map[string]any) context.Context {
+	return propagator.Extract(ctx, headerCarrier(headers))
+}
+
+// startPublishSpan starts the span of publishing a message and adds its trace context and the request ID of ctx to the headers of the message.
+func startPublishSpan(ctx context.Context, key BindingKey, exchange Exchange, o *PublishOptions) (context.Context, trace.Span) {
+	ctx, span := Tracer().Start(ctx, fmt.Sprintf("%s publish", exchange),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingDestinationName(string(exchange)),
+			semconv.MessagingRabbitmqDestinationRoutingKey(string(key)),
+		))
+
+	o.Headers = MessageHeaders(ctx, o.Headers)
+
+	return ctx, span
+}
+
+// StartConsumeSpan starts the span of handling a message taken from queue, as a child of the span that published it. The returned context carries the request ID of the message too.
+func StartConsumeSpan(ctx context.Context, msg Delivery, queue Queue) (context.Context, trace.Span) {
+	ctx = ExtractRequestID(ExtractTrace(ctx, msg.Headers), msg.Headers)
+
+	return Tracer().Start(ctx, fmt.Sprintf("%s process", queue),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemRabbitmq,
+			semconv.MessagingDestinationName(string(msg.Exchange)),
+			semconv.MessagingRabbitmqDestinationRoutingKey(string(msg.RoutingKey)),
+			attribute.String("messaging.rabbitmq.queue", string(queue)),
+		))
+}
+
+// EndSpan records err on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// CacheGetter is a Cache or one of its Namespace snapshots.
+type CacheGetter interface {
+	Get(key string, dst interface{}) bool
+}
+
+// TracedGet looks key up in c within a span of ctx, so that the cache lookups show up in the trace of the request. The key is left out of the span since some keys are derived from access tokens.
+func TracedGet(ctx context.Context, c CacheGetter, key string, dst interface{}) bool {
+	_, span := Tracer().Start(ctx, "cache get")
+	defer span.End()
+
+	ok := c.Get(key, dst)
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+
+	return ok
+}
+
+// sqlSpans only traces the queries that are made on behalf of a traced operation, so that background polling such as the outbox relay does not start a trace of its own every time.
+var sqlSpans = otelsql.SpanOptions{
+	OmitConnResetSession: true,
+	OmitConnPrepare:      true,
+	OmitRows:             true,
+	OmitConnectorConnect: true,
+	SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+		return trace.SpanContextFromContext(ctx).IsValid()
+	},
+}
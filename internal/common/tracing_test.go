@@ -0,0 +1,128 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testTracer records the spans of the test in memory.
+func testTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		tp.Shutdown(context.Background())
+	})
+
+	return exporter
+}
+
+// testSpanContext returns ctx as part of a trace that was started elsewhere.
+func testSpanContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
+func TestInjectTrace(t *testing.T) {
+	ctx := context.Background()
+
+	// Without a trace the headers are left alone.
+	headers := map[string]any{RetryCountHeader: int32(1)}
+	assert.Equal(t, headers, InjectTrace(ctx, headers))
+	assert.Nil(t, InjectTrace(ctx, nil))
+
+	ctx = testSpanContext(ctx)
+	injected := InjectTrace(ctx, headers)
+	assert.Equal(t, int32(1), injected[RetryCountHeader])
+	assert.Equal(t, "00-01020300000000000000000000000000-0405060000000000-01", injected["traceparent"])
+	assert.NotContains(t, headers, "traceparent")
+
+	extracted := trace.SpanContextFromContext(ExtractTrace(context.Background(), injected))
+	assert.Equal(t, trace.SpanContextFromContext(ctx).TraceID(), extracted.TraceID())
+	assert.Equal(t, trace.SpanContextFromContext(ctx).SpanID(), extracted.SpanID())
+}
+
+func TestTracePropagation(t *testing.T) {
+	exporter := testTracer(t)
+
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	err := b.Declare(Topology{
+		Exchanges: []ExchangeSpec{{Name: "direct", Kind: "direct"}},
+		Queues:    []QueueSpec{{Name: "a"}},
+		Bindings:  []BindingSpec{{Queue: "a", Key: "key", Exchange: "direct"}},
+	})
+	assert.NoError(t, err)
+
+	msgs, err := b.Consume("key", "direct", "a")
+	assert.NoError(t, err)
+
+	ctx, root := Tracer().Start(context.Background(), "request")
+	assert.NoError(t, b.Publish(ctx, []byte("message"), "key", "direct"))
+	root.End()
+
+	msg := receiveDelivery(t, msgs)
+	_, span := StartConsumeSpan(context.Background(), msg, "a")
+	span.End()
+	assert.NoError(t, msg.Ack())
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+
+	names := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		names[s.Name] = s
+		assert.Equal(t, root.SpanContext().TraceID(), s.SpanContext.TraceID())
+	}
+
+	publish, consume := names["direct publish"], names["a process"]
+	assert.Equal(t, root.SpanContext().SpanID(), publish.Parent.SpanID())
+	assert.Equal(t, trace.SpanKindProducer, publish.SpanKind)
+	assert.Equal(t, publish.SpanContext.SpanID(), consume.Parent.SpanID())
+	assert.Equal(t, trace.SpanKindConsumer, consume.SpanKind)
+}
+
+func TestTracedGet(t *testing.T) {
+	exporter := testTracer(t)
+
+	c := NewMemoryCache(time.Minute, time.Minute)
+	c.Set("key", "value")
+
+	ctx, root := Tracer().Start(context.Background(), "request")
+
+	var v string
+	assert.True(t, TracedGet(ctx, c, "key", &v))
+	assert.False(t, TracedGet(ctx, c.Namespace("ns"), "key", &v))
+	root.End()
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+
+	for i, hit := range []bool{true, false} {
+		assert.Equal(t, "cache get", spans[i].Name)
+		assert.Equal(t, root.SpanContext().SpanID(), spans[i].Parent.SpanID())
+		assert.Contains(t, spans[i].Attributes, attribute.Bool("cache.hit", hit))
+	}
+}
@@ -0,0 +1,170 @@
+package digestservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/mailservice"
+)
+
+func NewDigestService(store Store, limit int, logger *slog.Logger) *DigestService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DigestService{
+		store:    store,
+		logger:   logger,
+		limit:    limit,
+		ctx:      ctx,
+		cancel:   cancel,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Start sends the due digests every interval in the background until Close is called. Every replica can run it: a digest is recorded together with its outbox message, and a digest recorded by another replica is skipped.
+func (s *DigestService) Start(interval time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			_, err := s.Send(s.ctx, time.Now())
+			if err != nil && s.ctx.Err() == nil {
+				s.logger.Error("could not send digests", slog.String("error", err.Error()))
+			}
+
+			select {
+			case <-ticker.C:
+			case <-s.stopping:
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the scheduler and waits for the digests in progress to be sent.
+func (s *DigestService) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Shutdown stops the scheduler once the digests in progress are sent. It waits for them until ctx is done, when it cancels them; the digests that were not recorded are sent by the next run.
+func (s *DigestService) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stopping) })
+
+	err := common.Wait(ctx, &s.wg)
+	s.Close()
+
+	return err
+}
+
+// Send publishes the digests due at now through the outbox and returns how many were published. A digest without new posts is recorded but not sent, so the next one starts at now. A failure for one user is logged and does not stop the others.
+func (s *DigestService) Send(ctx context.Context, now time.Time) (int, error) {
+	// Postgres stores microseconds, the runs must compare equal after a round trip.
+	now = now.Truncate(time.Microsecond)
+
+	recipients, err := s.store.DueRecipients(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, r := range recipients {
+		posts, err := s.store.NewPosts(ctx, r.UserID, r.Since, now, s.limit)
+		if err != nil {
+			s.logger.Error("could not get digest posts", slog.Int("user_id", r.UserID), slog.String("error", err.Error()))
+			continue
+		}
+
+		err = s.store.WithTx(ctx, func(tx Tx) error {
+			err := tx.RecordRun(ctx, &Run{UserID: r.UserID, Since: r.Since, Until: now, PostCount: len(posts)})
+			if err != nil {
+				return err
+			}
+
+			if len(posts) == 0 {
+				return nil
+			}
+
+			payload, err := json.Marshal(newDigestMessage(r, posts))
+			if err != nil {
+				return err
+			}
+
+			return tx.EnqueueOutbox(ctx, common.UserExchange, common.UserDigestKey, payload)
+		})
+		switch {
+		case errors.Is(err, ErrAlreadySent):
+			s.logger.Debug("digest already sent", slog.Int("user_id", r.UserID))
+		case err != nil:
+			s.logger.Error("could not send digest", slog.Int("user_id", r.UserID), slog.String("error", err.Error()))
+		case len(posts) > 0:
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// Preview renders the digests due at now with p instead of sending them, and returns how many were rendered. Nothing is recorded, so the same digests are sent by the next run.
+func (s *DigestService) Preview(ctx context.Context, now time.Time, p Previewer) (int, error) {
+	now = now.Truncate(time.Microsecond)
+
+	recipients, err := s.store.DueRecipients(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	rendered := 0
+	for _, r := range recipients {
+		posts, err := s.store.NewPosts(ctx, r.UserID, r.Since, now, s.limit)
+		if err != nil {
+			return rendered, err
+		}
+
+		if len(posts) == 0 {
+			continue
+		}
+
+		// The mail service renders the decoded event, round trip the message so the preview matches what is sent.
+		payload, err := json.Marshal(newDigestMessage(r, posts))
+		if err != nil {
+			return rendered, err
+		}
+
+		var data map[string]any
+		if err := json.Unmarshal(payload, &data); err != nil {
+			return rendered, err
+		}
+
+		err = p.Send(r.Email, r.Locale, mailservice.TemplateDigest, data, nil)
+		if err != nil {
+			return rendered, err
+		}
+		rendered++
+	}
+
+	return rendered, nil
+}
+
+func newDigestMessage(r Recipient, posts []Post) digestMessage {
+	blogs := make([]digestBlog, len(posts))
+	for i, p := range posts {
+		blogs[i] = digestBlog{ID: p.ID, Title: p.Title, Author: p.Author}
+	}
+
+	return digestMessage{
+		Email:    r.Email,
+		UserID:   r.UserID,
+		Username: r.Username,
+		Locale:   r.Locale,
+		Blogs:    blogs,
+	}
+}
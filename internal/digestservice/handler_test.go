@@ -0,0 +1,258 @@
+package digestservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/mailservice"
+)
+
+// fakeStore serves fixed recipients and posts, and keeps the runs and outbox messages like the digest_runs and outbox tables. It can be shared by several services to act as replicas.
+type fakeStore struct {
+	mu         sync.Mutex
+	recipients []Recipient
+	posts      map[int][]Post
+	runs       map[int][]Run
+	outbox     *common.MemoryOutbox
+}
+
+func newFakeStore(recipients []Recipient, posts map[int][]Post) *fakeStore {
+	return &fakeStore{recipients: recipients, posts: posts, runs: make(map[int][]Run), outbox: common.NewMemoryOutbox()}
+}
+
+func (s *fakeStore) DueRecipients(ctx context.Context, now time.Time) ([]Recipient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Recipient
+	for _, r := range s.recipients {
+		if runs := s.runs[r.UserID]; len(runs) > 0 {
+			r.Since = runs[len(runs)-1].Until
+		}
+		if !r.Since.After(now.Add(-24 * time.Hour)) {
+			due = append(due, r)
+		}
+	}
+
+	return due, nil
+}
+
+func (s *fakeStore) NewPosts(ctx context.Context, userID int, since, until time.Time, limit int) ([]Post, error) {
+	var posts []Post
+	for _, p := range s.posts[userID] {
+		if p.CreatedAt.After(since) && !p.CreatedAt.After(until) && len(posts) < limit {
+			posts = append(posts, p)
+		}
+	}
+
+	return posts, nil
+}
+
+func (s *fakeStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &fakeTx{store: s}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for _, run := range tx.runs {
+		s.runs[run.UserID] = append(s.runs[run.UserID], run)
+	}
+	s.outbox.Append(tx.msgs...)
+
+	return nil
+}
+
+type fakeTx struct {
+	store *fakeStore
+	runs  []Run
+	msgs  []common.OutboxMessage
+}
+
+func (t *fakeTx) RecordRun(ctx context.Context, run *Run) error {
+	for _, r := range t.store.runs[run.UserID] {
+		if r.Since.Equal(run.Since) {
+			return ErrAlreadySent
+		}
+	}
+	t.runs = append(t.runs, *run)
+
+	return nil
+}
+
+func (t *fakeTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	t.msgs = append(t.msgs, common.OutboxMessage{Exchange: exchange, RoutingKey: key, Payload: payload})
+	return nil
+}
+
+type preview struct {
+	recipient, locale, name string
+	data                    any
+}
+
+type fakePreviewer struct {
+	previews []preview
+}
+
+func (p *fakePreviewer) Send(recipient, locale, name string, data any, headers map[string]string) error {
+	p.previews = append(p.previews, preview{recipient: recipient, locale: locale, name: name, data: data})
+	return nil
+}
+
+func testDigest(t *testing.T) (*fakeStore, time.Time) {
+	t.Helper()
+
+	now := time.Date(2024, 6, 8, 9, 0, 0, 0, time.UTC)
+	since := now.Add(-7 * 24 * time.Hour)
+
+	return newFakeStore(
+		[]Recipient{
+			{UserID: 1, Username: "reader", Email: "reader@example.com", Locale: "en", Since: since},
+			{UserID: 2, Username: "quiet", Email: "quiet@example.com", Locale: "en", Since: since},
+		},
+		map[int][]Post{
+			1: {
+				{ID: 3, Title: "Newest", Author: "writer", CreatedAt: now.Add(-time.Hour)},
+				{ID: 2, Title: "Older", Author: "writer", CreatedAt: now.Add(-48 * time.Hour)},
+				{ID: 1, Title: "Before the last digest", Author: "writer", CreatedAt: since.Add(-time.Hour)},
+			},
+		},
+	), now
+}
+
+func TestSend(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Run("due digest", func(t *testing.T) {
+		store, now := testDigest(t)
+		s := NewDigestService(store, 10, logger)
+
+		n, err := s.Send(context.Background(), now)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		msgs := store.outbox.Messages()
+		if !assert.Len(t, msgs, 1) {
+			return
+		}
+		assert.Equal(t, common.UserExchange, msgs[0].Exchange)
+		assert.Equal(t, common.UserDigestKey, msgs[0].RoutingKey)
+
+		var got digestMessage
+		assert.NoError(t, json.Unmarshal(msgs[0].Payload, &got))
+		assert.Equal(t, "reader@example.com", got.Email)
+		assert.Equal(t, 1, got.UserID)
+		assert.Equal(t, []digestBlog{{ID: 3, Title: "Newest", Author: "writer"}, {ID: 2, Title: "Older", Author: "writer"}}, got.Blogs)
+
+		// The user without new posts gets no email, but the next digest starts now.
+		if !assert.Len(t, store.runs[2], 1) {
+			return
+		}
+		assert.Equal(t, 0, store.runs[2][0].PostCount)
+		assert.Equal(t, now, store.runs[2][0].Until)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		store, now := testDigest(t)
+		s := NewDigestService(store, 1, logger)
+
+		_, err := s.Send(context.Background(), now)
+		assert.NoError(t, err)
+
+		var got digestMessage
+		assert.NoError(t, json.Unmarshal(store.outbox.Messages()[0].Payload, &got))
+		assert.Len(t, got.Blogs, 1)
+		assert.Equal(t, "Newest", got.Blogs[0].Title)
+	})
+
+	t.Run("no double send", func(t *testing.T) {
+		store, now := testDigest(t)
+		s := NewDigestService(store, 10, logger)
+
+		_, err := s.Send(context.Background(), now)
+		assert.NoError(t, err)
+
+		// A restart runs again, the digests are not due anymore.
+		n, err := s.Send(context.Background(), now.Add(time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.Len(t, store.outbox.Messages(), 1)
+	})
+
+	t.Run("replicas", func(t *testing.T) {
+		store, now := testDigest(t)
+
+		// Both replicas read the due recipients before either records a run.
+		recipients, err := store.DueRecipients(context.Background(), now)
+		assert.NoError(t, err)
+		stale := &staleStore{fakeStore: store, recipients: recipients}
+
+		n, err := NewDigestService(store, 10, logger).Send(context.Background(), now)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		n, err = NewDigestService(stale, 10, logger).Send(context.Background(), now)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		assert.Len(t, store.outbox.Messages(), 1)
+	})
+}
+
+// staleStore returns the recipients read before another replica sent their digests.
+type staleStore struct {
+	*fakeStore
+	recipients []Recipient
+}
+
+func (s *staleStore) DueRecipients(ctx context.Context, now time.Time) ([]Recipient, error) {
+	return s.recipients, nil
+}
+
+func TestPreview(t *testing.T) {
+	store, now := testDigest(t)
+	s := NewDigestService(store, 10, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	p := &fakePreviewer{}
+	n, err := s.Preview(context.Background(), now, p)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	if !assert.Len(t, p.previews, 1) {
+		return
+	}
+	assert.Equal(t, "reader@example.com", p.previews[0].recipient)
+	assert.Equal(t, mailservice.TemplateDigest, p.previews[0].name)
+
+	// Nothing is recorded, the real run still sends the digest.
+	assert.Empty(t, store.runs)
+	assert.Empty(t, store.outbox.Messages())
+
+	sent, err := s.Send(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+}
+
+func TestPreviewRendersTemplate(t *testing.T) {
+	store, now := testDigest(t)
+	s := NewDigestService(store, 10, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	templates, err := mailservice.NewTemplates("")
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	transport, err := mailservice.NewFileTransport(dir)
+	assert.NoError(t, err)
+
+	n, err := s.Preview(context.Background(), now, mailservice.NewMailer(transport, "Blogist <no-reply@example.com>", templates))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
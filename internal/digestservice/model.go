@@ -0,0 +1,120 @@
+package digestservice
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db, q: db}
+}
+
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&postgresTx{PostgresStore: PostgresStore{db: s.db, q: tx}, tx: tx})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (t *postgresTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	return common.EnqueueOutbox(ctx, t.tx, exchange, key, payload)
+}
+
+func (s *PostgresStore) DueRecipients(ctx context.Context, now time.Time) ([]Recipient, error) {
+	query := `
+		SELECT u.id, u.username, u.email, u.locale, COALESCE(MAX(r.until), p.updated_at)
+		FROM notification_preferences p
+		INNER JOIN users u ON u.id = p.user_id
+		LEFT JOIN digest_runs r ON r.user_id = p.user_id
+		WHERE p.frequency IN ('daily', 'weekly') AND p.new_posts AND u.activated AND NOT u.suspended
+		GROUP BY u.id, p.frequency, p.updated_at
+		HAVING COALESCE(MAX(r.until), p.updated_at) <= $1::timestamptz - CASE p.frequency WHEN 'daily' THEN INTERVAL '1 day' ELSE INTERVAL '7 days' END
+		ORDER BY u.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []Recipient
+	for rows.Next() {
+		var r Recipient
+		if err := rows.Scan(&r.UserID, &r.Username, &r.Email, &r.Locale, &r.Since); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+
+	return recipients, rows.Err()
+}
+
+func (s *PostgresStore) NewPosts(ctx context.Context, userID int, since, until time.Time, limit int) ([]Post, error) {
+	query := `
+		SELECT b.id, b.title, u.username, b.created_at
+		FROM blogs b
+		INNER JOIN follows f ON f.author_id = b.user_id
+		INNER JOIN users u ON u.id = b.user_id
+		WHERE f.follower_id = $1 AND b.created_at > $2 AND b.created_at <= $3
+		ORDER BY b.created_at DESC, b.id DESC
+		LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, userID, since, until, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title, &p.Author, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+
+	return posts, rows.Err()
+}
+
+func (s *PostgresStore) RecordRun(ctx context.Context, run *Run) error {
+	query := `
+		INSERT INTO digest_runs (user_id, since, until, post_count)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, since) DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.q.ExecContext(ctx, query, run.UserID, run.Since, run.Until, run.PostCount)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAlreadySent
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package digestservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// Store is the persistence layer of the digest service. It reads the preferences and follows of the user service and the posts of the blog service, and keeps the digests that were sent.
+type Store interface {
+	// DueRecipients returns the users whose digest is due at now: their frequency is daily or weekly, they want new posts, and their last digest ended at least a day or a week before now. The first digest of a user starts when the user last changed the preferences.
+	DueRecipients(ctx context.Context, now time.Time) ([]Recipient, error)
+	// NewPosts returns the newest posts of the authors the user follows, published after since and up to until.
+	NewPosts(ctx context.Context, userID int, since, until time.Time, limit int) ([]Post, error)
+
+	// WithTx runs fn in a transaction. The run and the outbox messages are committed when fn returns nil and rolled back otherwise.
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
+}
+
+// Tx records a run together with the outbox message of its digest.
+type Tx interface {
+	// RecordRun stores the run. It returns ErrAlreadySent when a run of the user starting at the same time exists.
+	RecordRun(ctx context.Context, run *Run) error
+	common.OutboxWriter
+}
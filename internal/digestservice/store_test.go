@@ -0,0 +1,103 @@
+package digestservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/blogservice"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func TestPostgresStore(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+	ctx := context.Background()
+
+	users := userservice.NewPostgresStore(db)
+	blogs := blogservice.NewPostgresStore(db)
+	s := NewPostgresStore(db)
+
+	insertUser := func(t *testing.T, username string) int {
+		u := userservice.User{Username: username, Email: username + "@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &u))
+		assert.NoError(t, users.ActivateUser(ctx, u.ID, u.Version))
+		return u.ID
+	}
+
+	reader := insertUser(t, "reader")
+	writer := insertUser(t, "writer")
+	other := insertUser(t, "other")
+	_, err := users.Follow(ctx, reader, writer)
+	assert.NoError(t, err)
+
+	prefs := userservice.DefaultNotificationPreferences(reader)
+	prefs.Frequency = userservice.FrequencyWeekly
+	assert.NoError(t, users.UpdateNotificationPreferences(ctx, prefs))
+
+	// The first digest starts when the preferences changed, move that back so it is due.
+	start := time.Now().Add(-8 * 24 * time.Hour).Truncate(time.Microsecond)
+	_, err = db.Exec("UPDATE notification_preferences SET updated_at = $1", start)
+	assert.NoError(t, err)
+
+	for _, b := range []blogservice.Blog{
+		{Title: "First", Content: "This is a test blog.", UserID: writer},
+		{Title: "Second", Content: "This is a test blog.", UserID: writer},
+		{Title: "Not followed", Content: "This is a test blog.", UserID: other},
+	} {
+		assert.NoError(t, blogs.InsertBlog(ctx, &b))
+	}
+
+	now := time.Now().Add(time.Second).Truncate(time.Microsecond)
+
+	t.Run("due recipients", func(t *testing.T) {
+		recipients, err := s.DueRecipients(ctx, now)
+		assert.NoError(t, err)
+		if !assert.Len(t, recipients, 1) {
+			return
+		}
+		assert.Equal(t, reader, recipients[0].UserID)
+		assert.Equal(t, "reader@example.com", recipients[0].Email)
+		assert.True(t, start.Equal(recipients[0].Since))
+	})
+
+	t.Run("new posts", func(t *testing.T) {
+		posts, err := s.NewPosts(ctx, reader, start, now, 10)
+		assert.NoError(t, err)
+		var titles []string
+		for _, p := range posts {
+			titles = append(titles, p.Title)
+			assert.Equal(t, "writer", p.Author)
+		}
+		assert.Equal(t, []string{"Second", "First"}, titles)
+
+		posts, err = s.NewPosts(ctx, reader, start, now, 1)
+		assert.NoError(t, err)
+		assert.Len(t, posts, 1)
+	})
+
+	t.Run("record run", func(t *testing.T) {
+		run := Run{UserID: reader, Since: start, Until: now, PostCount: 2}
+		err := s.WithTx(ctx, func(tx Tx) error {
+			return tx.RecordRun(ctx, &run)
+		})
+		assert.NoError(t, err)
+
+		err = s.WithTx(ctx, func(tx Tx) error {
+			return tx.RecordRun(ctx, &run)
+		})
+		assert.ErrorIs(t, err, ErrAlreadySent)
+
+		// The next digest starts where the run ended, a week later.
+		recipients, err := s.DueRecipients(ctx, now)
+		assert.NoError(t, err)
+		assert.Empty(t, recipients)
+
+		recipients, err = s.DueRecipients(ctx, now.Add(7*24*time.Hour))
+		assert.NoError(t, err)
+		if assert.Len(t, recipients, 1) {
+			assert.True(t, now.Equal(recipients[0].Since))
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package digestservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// ErrAlreadySent is returned when the digest starting at the same time was already sent to the user, by another replica or before a restart.
+var ErrAlreadySent = errors.New("digest already sent")
+
+// DigestService sends every user who chose a daily or weekly notification frequency a digest of the new posts of the authors they follow.
+type DigestService struct {
+	store  Store
+	logger *slog.Logger
+	// limit is the maximum number of posts in a digest.
+	limit int
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// stopping is closed when the scheduler should stop after the digests in progress.
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+// Recipient is a user whose digest is due. The digest covers the posts published after Since.
+type Recipient struct {
+	UserID   int
+	Username string
+	Email    string
+	Locale   string
+	Since    time.Time
+}
+
+// Post is a post listed in a digest.
+type Post struct {
+	ID        int
+	Title     string
+	Author    string
+	CreatedAt time.Time
+}
+
+// Run records a digest, sent or found empty, so that the next one starts where it ended.
+type Run struct {
+	UserID    int
+	Since     time.Time
+	Until     time.Time
+	PostCount int
+}
+
+// Previewer renders and delivers an email, the dry run uses a mailer writing to files.
+type Previewer interface {
+	Send(recipient, locale, name string, data any, headers map[string]string) error
+}
+
+// digestMessage is the payload of the user.digest event, which the mail service renders with the digest template.
+type digestMessage struct {
+	Email    string
+	UserID   int
+	Username string
+	Locale   string
+	Blogs    []digestBlog
+}
+
+type digestBlog struct {
+	ID     int
+	Title  string
+	Author string
+}
+
+// PostgresStore reads the tables of the user and blog services and records the runs in digest_runs.
+type PostgresStore struct {
+	db *sql.DB
+	q  common.Querier
+}
+
+type postgresTx struct {
+	PostgresStore
+	tx *sql.Tx
+}
@@ -0,0 +1,47 @@
+package mailservice
+
+import (
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+// Event is a message from the broker that triggers an email. The message is a JSON object with the Email address of the recipient and an optional Locale, and the whole object is handed to the template as its data, together with the BaseURL of the application.
+type Event struct {
+	Key      common.BindingKey
+	Exchange common.Exchange
+	Queue    common.Queue
+	// RetryDelays are the delays between attempts at sending the email. The message is dead lettered once they are used up.
+	RetryDelays []time.Duration
+	// Template is the name of the template the email is rendered with.
+	Template string
+	// Preference is the kind of notification the email is, which the recipient can turn off. The message must then carry the UserID of the recipient. It is empty for the emails that are always sent, such as the activation email.
+	Preference string
+}
+
+// Events maps the events the mail service listens to onto their templates.
+var Events = []Event{
+	{
+		Key:         common.UserCreatedKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.UserCreatedQueue,
+		RetryDelays: common.UserCreatedRetryDelays,
+		Template:    TemplateActivation,
+	},
+	{
+		Key:         common.UserPasswordResetKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.UserPasswordResetQueue,
+		RetryDelays: common.UserPasswordResetRetryDelays,
+		Template:    TemplatePasswordReset,
+	},
+	{
+		Key:         common.UserDigestKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.UserDigestQueue,
+		RetryDelays: common.UserDigestRetryDelays,
+		Template:    TemplateDigest,
+		Preference:  userservice.NotificationDigest,
+	},
+}
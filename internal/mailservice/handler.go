@@ -4,86 +4,175 @@ import (
 	"context"
 	"encoding/json"
 	"log/slog"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sushihentaime/blogist/internal/common"
-	"golang.org/x/exp/rand"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
-func NewMailService(mb common.MessageConsumer, host, username, password, sender string, port int, logger *slog.Logger) *MailService {
+// NewMailService creates the mail service. baseURL is the public URL of the application, which the links in the emails start with. The notification emails are only sent to the users who want them according to prefs, with an unsubscribe link signed by signer.
+func NewMailService(mb MessageBroker, transport Transport, templates *Templates, sender, baseURL string, prefs Preferences, signer *common.Signer, logger *slog.Logger) *MailService {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &MailService{
-		mb:     mb,
-		m:      NewMailer(host, port, username, password, sender, NewTemplate()),
-		logger: logger,
-		ctx:    ctx,
-		cancel: cancel,
+		mb:      mb,
+		m:       NewMailer(transport, sender, templates),
+		events:  Events,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		prefs:   prefs,
+		signer:  signer,
+		sends:   newSendsCounter(),
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
-func (s *MailService) SendActivationEmail() {
-	msgs, err := s.mb.Consume(common.UserCreatedKey, common.UserExchange, common.UserCreatedQueue)
+// Start consumes the events of every email the service sends.
+func (s *MailService) Start() {
+	for _, e := range s.events {
+		s.consume(e)
+	}
+}
+
+func (s *MailService) consume(e Event) {
+	msgs, err := s.mb.Consume(e.Key, e.Exchange, e.Queue)
+	if err != nil {
+		s.logger.Error("could not consume message", slog.String("queue", string(e.Queue)), slog.String("error", err.Error()))
+		s.consumers.Failed(e.Queue)
+		return
+	}
+
+	s.consumers.Consume(e.Queue, msgs, func(msg common.Delivery) { s.handle(e, msg) })
+}
+
+func (s *MailService) handle(e Event, msg common.Delivery) {
+	// The span and the logs continue the trace and carry the ID of the request that triggered the email.
+	ctx, span := common.StartConsumeSpan(s.ctx, msg, e.Queue)
+	defer span.End()
+	span.SetAttributes(attribute.String("mail.template", e.Template))
+	logger := s.loggerFor(ctx)
+
+	var data map[string]any
+
+	err := json.Unmarshal(msg.Body, &data)
 	if err != nil {
-		s.logger.Error("could not consume message", slog.String("error", err.Error()))
+		// A malformed message will never succeed, so it goes straight to the dead letter queue.
+		logger.Error("could not unmarshal message", slog.String("error", err.Error()))
+		msg.Nack(false)
 		return
 	}
 
-	go func() {
-		for {
-			select {
-			case msg, ok := <-msgs:
-				if !ok {
-					return
-				}
-
-				var data struct {
-					Email string
-					Token string
-				}
-
-				err := json.Unmarshal(msg.Body, &data)
-				if err != nil {
-					s.logger.Error("could not unmarshal message", slog.String("error", err.Error()))
-					continue
-				}
-
-				payload := struct {
-					ActivationToken string
-				}{
-					ActivationToken: data.Token,
-				}
-
-				// using exponential backoff with jitter
-				const maxRetries = 5
-				const baseDelay = 500 * time.Millisecond
-
-				var attempt int
-				for attempt = 0; attempt < maxRetries; attempt++ {
-					err = s.m.send(data.Email, payload, "activation_email.html")
-					if err == nil {
-						s.logger.Info("activation email sent", slog.String("email", data.Email))
-						msg.Ack(false)
-						break
-					}
-
-					delay := time.Duration(rand.Int63n(int64(baseDelay) << uint(attempt)))
-					s.logger.Info("delaying activation email", slog.String("email", data.Email), slog.Int("attempt", attempt), slog.Duration("delay", delay))
-					time.Sleep(delay)
-				}
-
-				if attempt == maxRetries {
-					s.logger.Error("could not send activation email", slog.String("email", data.Email))
-					msg.Ack(false)
-				}
-
-			case <-s.ctx.Done():
-				s.logger.Info("stopping SendActivationEmail due to context cancellation")
-				return
-			}
+	email, _ := data["Email"].(string)
+	if email == "" {
+		logger.Error("message has no recipient", slog.String("queue", string(e.Queue)))
+		msg.Nack(false)
+		return
+	}
+
+	locale, _ := data["Locale"].(string)
+	data["BaseURL"] = s.baseURL
+
+	var headers map[string]string
+	if e.Preference != "" {
+		// JSON numbers are decoded as float64.
+		userID, _ := data["UserID"].(float64)
+		if userID <= 0 {
+			logger.Error("notification has no user", slog.String("queue", string(e.Queue)))
+			msg.Nack(false)
+			return
+		}
+
+		ok, err := s.prefs.WantsEmail(ctx, int(userID), e.Preference)
+		if err != nil {
+			s.retry(ctx, msg, e.Queue, e.RetryDelays, email, err)
+			return
+		}
+		if !ok {
+			logger.Info("email not wanted", slog.String("template", e.Template), slog.String("email", email))
+			msg.Ack()
+			return
 		}
-	}()
+
+		unsubscribeURL := s.baseURL + "/unsubscribe?token=" + UnsubscribeToken(s.signer, int(userID), e.Preference)
+		data["UnsubscribeURL"] = unsubscribeURL
+		headers = unsubscribeHeaders(unsubscribeURL)
+	}
+
+	err = s.m.send(email, locale, e.Template, data, headers)
+	if err != nil {
+		s.sends.WithLabelValues(e.Template, "failure").Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		s.retry(ctx, msg, e.Queue, e.RetryDelays, email, err)
+		return
+	}
+
+	s.sends.WithLabelValues(e.Template, "success").Inc()
+	logger.Info("email sent", slog.String("template", e.Template), slog.String("email", email))
+	msg.Ack()
+}
+
+// retry sends a failed message to the retry queue for its next attempt, so that the backoff happens in the broker and the consumer can carry on with other messages. Once every delay has been used the message is rejected, and the broker moves it to the dead letter queue.
+func (s *MailService) retry(ctx context.Context, msg common.Delivery, queue common.Queue, delays []time.Duration, email string, cause error) {
+	logger := s.loggerFor(ctx)
+
+	r, err := common.Retry(ctx, s.mb, msg, queue, delays)
+	switch {
+	case err != nil:
+		// The message is handed back to the queue, so it is not lost when the retry cannot be scheduled.
+		logger.Error("could not schedule email retry", slog.String("email", email), slog.String("error", err.Error()))
+	case r.DeadLettered:
+		logger.Error("could not send email, moving it to the dead letter queue", slog.String("email", email), slog.Int("attempts", r.Attempt), slog.String("error", cause.Error()))
+	default:
+		logger.Info("delaying email", slog.String("email", email), slog.Int("attempt", r.Attempt), slog.Duration("delay", r.Delay), slog.String("error", cause.Error()))
+	}
+}
+
+// loggerFor returns the logger of the request ctx carries the ID of, when the service logs with slog.
+func (s *MailService) loggerFor(ctx context.Context) MailLogger {
+	if l, ok := s.logger.(*slog.Logger); ok {
+		return common.Logger(ctx, l)
+	}
+
+	return s.logger
+}
+
+// Ready returns an error when one of the consumers of the service is not running.
+func (s *MailService) Ready() error {
+	return s.consumers.Check()
+}
+
+// Shutdown stops taking messages and waits for the ones being handled until ctx is done, when it cancels them. The messages that were not handled are requeued.
+func (s *MailService) Shutdown(ctx context.Context) error {
+	err := s.consumers.Shutdown(ctx)
+	s.cancel()
+
+	return err
 }
 
+// Close stops the consumers and cancels the messages being handled.
 func (s *MailService) Close() {
+	s.consumers.Stop()
 	s.cancel()
 }
+
+func newSendsCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: common.MetricsNamespace,
+		Subsystem: "mail",
+		Name:      "sends_total",
+		Help:      "Attempts at sending an email, by template and result. A failed attempt is retried until the retries are used up.",
+	}, []string{"template", "result"})
+}
+
+// Describe and Collect make the service a prometheus.Collector of its send counts.
+func (s *MailService) Describe(ch chan<- *prometheus.Desc) {
+	s.sends.Describe(ch)
+}
+
+func (s *MailService) Collect(ch chan<- prometheus.Metric) {
+	s.sends.Collect(ch)
+}
@@ -2,32 +2,44 @@ package mailservice
 
 import (
 	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestSendActivationEmail(t *testing.T) {
-	mockMC := new(MockMessageConsumer)
+	mockMC := new(MockMessageBroker)
 	mockMailer := new(MockMailer)
 	mockLogger := new(MockLogger)
 
-	expectedArgs := []interface{}{slog.Attr{Key: "email", Value: slog.StringValue("test@example.com")}}
-	mockLogger.On("Info", "activation email sent", expectedArgs).Return(nil)
+	expectedArgs := []interface{}{slog.String("template", TemplateActivation), slog.String("email", "test@example.com")}
+	mockLogger.On("Info", "email sent", expectedArgs).Return(nil)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &MailService{
 		mb:     mockMC,
 		m:      mockMailer,
+		events: Events[:1],
+		sends:  newSendsCounter(),
 		logger: mockLogger,
 		ctx:    ctx,
 		cancel: cancel,
 	}
 
-	go s.SendActivationEmail()
+	go s.Start()
 
 	time.Sleep(1 * time.Second)
 
@@ -46,3 +58,365 @@ func TestSendActivationEmail(t *testing.T) {
 		s.Close()
 	})
 }
+
+func TestActivationEmailRetry(t *testing.T) {
+	body := []byte(`{"Email": "test@example.com", "Token": "testtoken"}`)
+	delays := common.UserCreatedRetryDelays
+
+	tests := []struct {
+		name          string
+		body          []byte
+		headers       map[string]any
+		sendErr       error
+		wantPublished *MockPublishing
+		wantAcked     bool
+		wantNacked    bool
+	}{
+		{
+			name:      "sent",
+			body:      body,
+			wantAcked: true,
+		},
+		{
+			name:    "first failure is retried",
+			body:    body,
+			sendErr: errors.New("smtp unavailable"),
+			wantPublished: &MockPublishing{
+				Key:      common.BindingKey(common.RetryQueue(common.UserCreatedQueue, delays[0])),
+				Exchange: common.RetryExchange,
+				Body:     body,
+				Options: common.PublishOptions{
+					Headers:    map[string]any{common.RetryCountHeader: int32(1)},
+					Expiration: delays[0],
+				},
+			},
+			wantAcked: true,
+		},
+		{
+			name:    "later failure waits longer",
+			body:    body,
+			headers: map[string]any{common.RetryCountHeader: int32(2)},
+			sendErr: errors.New("smtp unavailable"),
+			wantPublished: &MockPublishing{
+				Key:      common.BindingKey(common.RetryQueue(common.UserCreatedQueue, delays[2])),
+				Exchange: common.RetryExchange,
+				Body:     body,
+				Options: common.PublishOptions{
+					Headers:    map[string]any{common.RetryCountHeader: int32(3)},
+					Expiration: delays[2],
+				},
+			},
+			wantAcked: true,
+		},
+		{
+			name:       "exhausted retries are dead lettered",
+			body:       body,
+			headers:    map[string]any{common.RetryCountHeader: int32(len(delays))},
+			sendErr:    errors.New("smtp unavailable"),
+			wantNacked: true,
+		},
+		{
+			name:       "malformed message is dead lettered",
+			body:       []byte("not json"),
+			wantNacked: true,
+		},
+		{
+			name:       "message without recipient is dead lettered",
+			body:       []byte(`{"Token": "testtoken"}`),
+			wantNacked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := new(MockMessageBroker)
+			ack := new(MockAcknowledger)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s := &MailService{
+				mb:     mb,
+				m:      &MockMailer{Err: tt.sendErr},
+				sends:  newSendsCounter(),
+				logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+				ctx:    ctx,
+				cancel: cancel,
+			}
+
+			s.handle(Events[0], common.Delivery{Acknowledger: ack, Headers: tt.headers, Body: tt.body})
+
+			published := mb.GetPublished()
+			if tt.wantPublished == nil {
+				assert.Empty(t, published)
+			} else {
+				assert.Equal(t, []MockPublishing{*tt.wantPublished}, published)
+			}
+
+			acked, nacked, requeue := ack.Settled()
+			assert.Equal(t, tt.wantAcked, acked)
+			assert.Equal(t, tt.wantNacked, nacked)
+			assert.False(t, requeue)
+
+			sent := testutil.ToFloat64(s.sends.WithLabelValues(TemplateActivation, "success"))
+			failed := testutil.ToFloat64(s.sends.WithLabelValues(TemplateActivation, "failure"))
+			switch {
+			case tt.sendErr != nil:
+				assert.Equal(t, []float64{0, 1}, []float64{sent, failed})
+			case tt.wantAcked:
+				assert.Equal(t, []float64{1, 0}, []float64{sent, failed})
+			default:
+				assert.Equal(t, []float64{0, 0}, []float64{sent, failed})
+			}
+		})
+	}
+}
+
+func TestEventTemplates(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        Event
+		body         string
+		wantTemplate string
+		wantLocale   string
+	}{
+		{
+			name:         "activation",
+			event:        Events[0],
+			body:         `{"Email": "test@example.com", "Token": "testtoken", "Locale": "es"}`,
+			wantTemplate: TemplateActivation,
+			wantLocale:   "es",
+		},
+		{
+			name:         "password reset",
+			event:        Events[1],
+			body:         `{"Email": "test@example.com", "Token": "testtoken"}`,
+			wantTemplate: TemplatePasswordReset,
+		},
+		{
+			name:         "digest",
+			event:        Events[2],
+			body:         `{"Email": "test@example.com", "UserID": 1, "Locale": "es", "Blogs": []}`,
+			wantTemplate: TemplateDigest,
+			wantLocale:   "es",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mailer := new(MockMailer)
+			ack := new(MockAcknowledger)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s := &MailService{
+				mb:      new(MockMessageBroker),
+				m:       mailer,
+				baseURL: "https://blogist.example.com",
+				prefs:   &MockPreferences{Wanted: map[string]bool{"digest": true}},
+				signer:  testSigner(t),
+				sends:   newSendsCounter(),
+				logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				ctx:     ctx,
+				cancel:  cancel,
+			}
+
+			s.handle(tt.event, common.Delivery{Acknowledger: ack, Body: []byte(tt.body)})
+
+			assert.Equal(t, "test@example.com", mailer.GetEmail())
+			assert.Equal(t, tt.wantTemplate, mailer.Template)
+			assert.Equal(t, tt.wantLocale, mailer.Locale)
+			assert.Equal(t, "https://blogist.example.com", mailer.Data.(map[string]any)["BaseURL"])
+
+			acked, _, _ := ack.Settled()
+			assert.True(t, acked)
+		})
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	event := Event{
+		Key:         common.UserDigestKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.UserDigestQueue,
+		RetryDelays: []time.Duration{time.Second},
+		Template:    TemplateDigest,
+		Preference:  userservice.NotificationDigest,
+	}
+	body := `{"Email": "test@example.com", "UserID": 7}`
+
+	tests := []struct {
+		name          string
+		body          string
+		prefs         *MockPreferences
+		wantSent      bool
+		wantAcked     bool
+		wantNacked    bool
+		wantPublished bool
+	}{
+		{
+			name:      "wanted",
+			body:      body,
+			prefs:     &MockPreferences{Wanted: map[string]bool{userservice.NotificationDigest: true}},
+			wantSent:  true,
+			wantAcked: true,
+		},
+		{
+			name:      "not wanted",
+			body:      body,
+			prefs:     &MockPreferences{Wanted: map[string]bool{userservice.NotificationNewPosts: true}},
+			wantAcked: true,
+		},
+		{
+			name:       "message without user is dead lettered",
+			body:       `{"Email": "test@example.com"}`,
+			prefs:      &MockPreferences{Wanted: map[string]bool{userservice.NotificationDigest: true}},
+			wantNacked: true,
+		},
+		{
+			name:          "preferences unavailable are retried",
+			body:          body,
+			prefs:         &MockPreferences{Err: errors.New("database unavailable")},
+			wantAcked:     true,
+			wantPublished: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := new(MockMessageBroker)
+			mailer := new(MockMailer)
+			ack := new(MockAcknowledger)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			signer := testSigner(t)
+			s := &MailService{
+				mb:      mb,
+				m:       mailer,
+				baseURL: "https://blogist.example.com",
+				prefs:   tt.prefs,
+				signer:  signer,
+				sends:   newSendsCounter(),
+				logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+				ctx:     ctx,
+				cancel:  cancel,
+			}
+
+			s.handle(event, common.Delivery{Acknowledger: ack, Body: []byte(tt.body)})
+
+			assert.Equal(t, tt.wantSent, mailer.IsCalled())
+			assert.Equal(t, tt.wantPublished, len(mb.GetPublished()) == 1)
+
+			acked, nacked, _ := ack.Settled()
+			assert.Equal(t, tt.wantAcked, acked)
+			assert.Equal(t, tt.wantNacked, nacked)
+
+			if !tt.wantSent {
+				return
+			}
+
+			unsubscribeURL := "https://blogist.example.com/unsubscribe?token=" + UnsubscribeToken(signer, 7, userservice.NotificationDigest)
+			assert.Equal(t, unsubscribeURL, mailer.Data.(map[string]any)["UnsubscribeURL"])
+			assert.Equal(t, map[string]string{
+				"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+				"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+			}, mailer.Headers)
+		})
+	}
+}
+
+func TestHandleContinuesTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &MailService{
+		mb:     new(MockMessageBroker),
+		m:      new(MockMailer),
+		sends:  newSendsCounter(),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	// The trace context the request that created the user left in the message.
+	parent := trace.NewSpanContext(trace.SpanContextConfig{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}, TraceFlags: trace.FlagsSampled, Remote: true})
+	headers := common.InjectTrace(trace.ContextWithSpanContext(context.Background(), parent), nil)
+
+	s.handle(Events[0], common.Delivery{Acknowledger: new(MockAcknowledger), Headers: headers, Body: []byte(`{"Email": "test@example.com", "Token": "testtoken"}`)})
+
+	spans := exporter.GetSpans()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	assert.Equal(t, string(Events[0].Queue)+" process", spans[0].Name)
+	assert.Equal(t, parent.TraceID(), spans[0].SpanContext.TraceID())
+	assert.Equal(t, parent.SpanID(), spans[0].Parent.SpanID())
+	assert.Contains(t, spans[0].Attributes, attribute.String("mail.template", TemplateActivation))
+}
+
+// blockingMailer sends an email once the test releases it.
+type blockingMailer struct {
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (m *blockingMailer) send(recipient, locale, name string, data any, headers map[string]string) error {
+	m.sending <- struct{}{}
+	<-m.release
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	mb := common.NewMemoryBroker()
+	defer mb.Close()
+	assert.NoError(t, common.SetupUserExchange(mb))
+
+	mailer := &blockingMailer{sending: make(chan struct{}), release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &MailService{
+		mb:     mb,
+		m:      mailer,
+		events: Events[:1],
+		sends:  newSendsCounter(),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.Start()
+	assert.NoError(t, s.Ready())
+
+	e := Events[0]
+	err := mb.Publish(context.Background(), []byte(`{"Email": "test@example.com", "Token": "testtoken"}`), e.Key, e.Exchange)
+	assert.NoError(t, err)
+	<-mailer.sending
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShutdown()
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(shutdownCtx) }()
+
+	// The shutdown waits for the email being sent.
+	select {
+	case <-done:
+		t.Fatal("the shutdown did not wait for the email being sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(mailer.release)
+	assert.NoError(t, <-done)
+	assert.Error(t, s.Ready())
+
+	// The email was acknowledged before the shutdown returned.
+	msgs, err := mb.Peek(e.Queue, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.sends.WithLabelValues(TemplateActivation, "success")))
+}
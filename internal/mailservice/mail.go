@@ -1,39 +1,38 @@
 package mailservice
 
-import (
-	"time"
-
-	"github.com/go-mail/mail/v2"
-)
-
-// NewMailer creates a new mailer with the given host, port, username, password, sender, and template.
-func NewMailer(host string, port int, username, password, sender string, tp *Template) *Mail {
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-
+// NewMailer creates a new mailer that renders the emails with the templates and delivers them with the transport.
+func NewMailer(transport Transport, sender string, tp *Templates) *Mail {
 	return &Mail{
-		dialer: dialer,
-		sender: sender,
-		parser: tp,
+		transport: transport,
+		sender:    sender,
+		parser:    tp,
 	}
 }
 
-func (m *Mail) send(recipient string, data any, templateFile string) error {
+// Send renders the named template in the locale of the recipient and sends it, for the callers outside of the mail service such as the digest dry run.
+func (m *Mail) Send(recipient, locale, name string, data any, headers map[string]string) error {
+	return m.send(recipient, locale, name, data, headers)
+}
+
+// send renders the named template in the locale of the recipient and sends it with the extra headers.
+func (m *Mail) send(recipient, locale, name string, data any, headers map[string]string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	subject, plainBody, htmlBody, err := m.parser.ParseTemplate(templateFile, data)
+	subject, plainBody, htmlBody, err := m.parser.Render(name, locale, data)
 	if err != nil {
 		return err
 	}
 
-	msg := mail.NewMessage()
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	msg := &Message{
+		From:      m.sender,
+		To:        recipient,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+		Headers:   headers,
+	}
 
-	err = m.dialer.DialAndSend(msg)
+	err = m.transport.Send(msg)
 	if err != nil {
 		return err
 	}
@@ -4,39 +4,37 @@ import (
 	"bytes"
 	"testing"
 
-	"github.com/go-mail/mail/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
 func TestSendEmail(t *testing.T) {
 	mockParser := new(MockTemplate)
-	mockDialer := new(MockDialer)
+	transport := NewMemoryTransport()
 
 	recipient := "test@example.com"
 	mailer := Mail{
-		dialer: mockDialer,
-		parser: mockParser,
-		sender: "sender@example.com",
+		transport: transport,
+		parser:    mockParser,
+		sender:    "sender@example.com",
 	}
 
 	subject := bytes.NewBufferString("Test Subject")
 	plainBody := bytes.NewBufferString("Test Plain Body")
 	htmlBody := bytes.NewBufferString("Test HTML Body")
-	mockParser.On("ParseTemplate", "template.html", mock.Anything).Return(subject, plainBody, htmlBody, nil)
+	mockParser.On("Render", TemplateActivation, "es", mock.Anything).Return(subject, plainBody, htmlBody, nil)
 
-	msg := mail.NewMessage()
-	msg.SetHeader("From", mailer.sender)
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	mockDialer.On("DialAndSend", mock.AnythingOfType("[]*mail.Message")).Return(nil)
-
-	err := mailer.send("test@example.com", msg, "template.html")
+	err := mailer.send(recipient, "es", TemplateActivation, nil, map[string]string{"List-Unsubscribe": "<https://blogist.example.com/unsubscribe>"})
 	assert.NoError(t, err)
 
+	assert.Equal(t, []Message{{
+		From:      "sender@example.com",
+		To:        recipient,
+		Subject:   "Test Subject",
+		PlainBody: "Test Plain Body",
+		HTMLBody:  "Test HTML Body",
+		Headers:   map[string]string{"List-Unsubscribe": "<https://blogist.example.com/unsubscribe>"},
+	}}, transport.Messages())
+
 	mockParser.AssertExpectations(t)
-	mockDialer.AssertExpectations(t)
 }
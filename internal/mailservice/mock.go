@@ -2,10 +2,10 @@ package mailservice
 
 import (
 	"bytes"
+	"context"
 	"sync"
 
 	"github.com/go-mail/mail/v2"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/stretchr/testify/mock"
 	"github.com/sushihentaime/blogist/internal/common"
 )
@@ -14,8 +14,8 @@ type MockTemplate struct {
 	mock.Mock
 }
 
-func (m *MockTemplate) ParseTemplate(name string, data any) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error) {
-	args := m.Called(name, data)
+func (m *MockTemplate) Render(name, locale string, data any) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error) {
+	args := m.Called(name, locale, data)
 	return args.Get(0).(*bytes.Buffer), args.Get(1).(*bytes.Buffer), args.Get(2).(*bytes.Buffer), args.Error(3)
 }
 
@@ -29,18 +29,28 @@ func (d *MockDialer) DialAndSend(m ...*mail.Message) error {
 }
 
 type MockMailer struct {
-	mu     sync.Mutex
-	Called bool
-	Email  string
+	mu       sync.Mutex
+	Called   bool
+	Email    string
+	Locale   string
+	Template string
+	Data     any
+	Headers  map[string]string
+	// Err is returned by send when set.
+	Err error
 	mock.Mock
 }
 
-func (m *MockMailer) send(recipient string, data any, templateFile string) error {
+func (m *MockMailer) send(recipient, locale, name string, data any, headers map[string]string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.Called = true
 	m.Email = recipient
-	return nil
+	m.Locale = locale
+	m.Template = name
+	m.Data = data
+	m.Headers = headers
+	return m.Err
 }
 
 func (m *MockMailer) IsCalled() bool {
@@ -55,24 +65,89 @@ func (m *MockMailer) GetEmail() string {
 	return m.Email
 }
 
-type MockMessageConsumer struct {
+type MockMessageBroker struct {
+	mu sync.Mutex
+	// Deliveries are sent to the consumer in order. A single activation message is sent when it is empty.
+	Deliveries []common.Delivery
+	Published  []MockPublishing
 	mock.Mock
 }
 
-func (m *MockMessageConsumer) Consume(key common.BindingKey, exchange common.Exchange, queue common.Queue) (<-chan amqp.Delivery, error) {
-	msgsChan := make(chan amqp.Delivery)
+type MockPublishing struct {
+	Key      common.BindingKey
+	Exchange common.Exchange
+	Body     []byte
+	Options  common.PublishOptions
+}
+
+func (m *MockMessageBroker) Consume(key common.BindingKey, exchange common.Exchange, queue common.Queue) (<-chan common.Delivery, error) {
+	msgsChan := make(chan common.Delivery)
+
+	deliveries := m.Deliveries
+	if len(deliveries) == 0 {
+		mockMessage := `{"Email": "test@example.com", "Token": "testtoken"}`
+		deliveries = []common.Delivery{{Body: []byte(mockMessage)}}
+	}
 
 	go func() {
 		defer close(msgsChan)
 
-		mockMessage := `{"Email": "test@example.com", "Token": "testtoken"}`
-		mockDelivery := amqp.Delivery{Body: []byte(mockMessage)}
-		msgsChan <- mockDelivery
+		for _, d := range deliveries {
+			msgsChan <- d
+		}
 	}()
 
 	return msgsChan, nil
 }
 
+func (m *MockMessageBroker) Publish(ctx context.Context, msg []byte, key common.BindingKey, exchange common.Exchange, opts ...common.PublishOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var o common.PublishOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	m.Published = append(m.Published, MockPublishing{Key: key, Exchange: exchange, Body: msg, Options: o})
+	return nil
+}
+
+func (m *MockMessageBroker) GetPublished() []MockPublishing {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]MockPublishing{}, m.Published...)
+}
+
+// MockAcknowledger records how a delivery was settled.
+type MockAcknowledger struct {
+	mu      sync.Mutex
+	Acked   bool
+	Nacked  bool
+	Requeue bool
+}
+
+func (a *MockAcknowledger) Ack() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Acked = true
+	return nil
+}
+
+func (a *MockAcknowledger) Nack(requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Nacked = true
+	a.Requeue = requeue
+	return nil
+}
+
+func (a *MockAcknowledger) Settled() (acked, nacked, requeue bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.Acked, a.Nacked, a.Requeue
+}
+
 type MockLogger struct {
 	mock.Mock
 }
@@ -84,3 +159,18 @@ func (m *MockLogger) Error(msg string, fields ...any) {
 func (m *MockLogger) Info(msg string, fields ...interface{}) {
 	m.Called(msg, fields)
 }
+
+// MockPreferences wants the notification emails of the kinds in Wanted, for every user.
+type MockPreferences struct {
+	Wanted map[string]bool
+	// Err is returned by WantsEmail when set.
+	Err error
+}
+
+func (p *MockPreferences) WantsEmail(ctx context.Context, userID int, kind string) (bool, error) {
+	if p.Err != nil {
+		return false, p.Err
+	}
+
+	return p.Wanted[kind], nil
+}
@@ -3,22 +3,149 @@ package mailservice
 import (
 	"bytes"
 	"embed"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
 )
 
-//go:embed templates/*
+//go:embed templates
 var templateFS embed.FS
 
-func NewTemplate() *Template {
-	return &Template{}
+// The names of the email templates. Each locale directory under templates has a file named after the template, which defines the "subject", "plainBody" and "content" templates. The "htmlBody" layout in templates/layouts wraps "content", and the templates in templates/partials can be used by any of them.
+const (
+	TemplateActivation    = "activation"
+	TemplatePasswordReset = "password_reset"
+	TemplateDigest        = "digest"
+	// TemplateTest is sent by the operators to check the mail settings.
+	TemplateTest = "test"
+)
+
+// DefaultLocale is the locale used when a template has no translation in the locale of the recipient. Every template must exist in it.
+const DefaultLocale = "en"
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// sharedDirs hold the layouts and partials, every other directory holds the templates of a locale.
+var sharedDirs = []string{"layouts", "partials"}
+
+// NewTemplates parses the embedded templates once. When overrides is not empty, a file in that directory replaces the embedded file at the same path, so operators can rebrand the emails or add locales without rebuilding.
+func NewTemplates(overrides string) (*Templates, error) {
+	fsys, err := fs.Sub(templateFS, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	if overrides != "" {
+		if _, err := os.Stat(overrides); err != nil {
+			return nil, fmt.Errorf("could not read the template overrides: %w", err)
+		}
+
+		fsys = overlayFS{upper: os.DirFS(overrides), lower: fsys}
+	}
+
+	return parseTemplates(fsys)
+}
+
+func parseTemplates(fsys fs.FS) (*Templates, error) {
+	var shared []string
+	for _, dir := range sharedDirs {
+		files, err := fs.Glob(fsys, dir+"/*.html")
+		if err != nil {
+			return nil, err
+		}
+		shared = append(shared, files...)
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	tp := &Templates{sets: make(map[string]map[string]*template.Template)}
+
+	for _, entry := range entries {
+		locale := entry.Name()
+		if !entry.IsDir() || isSharedDir(locale) {
+			continue
+		}
+
+		files, err := fs.Glob(fsys, locale+"/*.html")
+		if err != nil {
+			return nil, err
+		}
+
+		set := make(map[string]*template.Template)
+		for _, file := range files {
+			name := strings.TrimSuffix(path.Base(file), ".html")
+
+			t, err := parseTemplate(fsys, name, locale, append(append([]string{}, shared...), file))
+			if err != nil {
+				return nil, err
+			}
+
+			set[name] = t
+		}
+
+		tp.sets[strings.ToLower(locale)] = set
+	}
+
+	if _, ok := tp.sets[DefaultLocale]; !ok {
+		return nil, fmt.Errorf("no templates for the default locale %q", DefaultLocale)
+	}
+
+	return tp, nil
+}
+
+// parseTemplate parses the files into a single template. The files are parsed in order, so the template of the email comes last and can redefine a layout or partial. The "lang" template is defined as the locale.
+func parseTemplate(fsys fs.FS, name, locale string, files []string) (*template.Template, error) {
+	t := template.New(name)
+
+	_, err := t.New("lang").Parse(locale)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = t.New(file).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse template %s: %w", file, err)
+		}
+	}
+
+	for _, required := range []string{"subject", "plainBody", "htmlBody"} {
+		if t.Lookup(required) == nil {
+			return nil, fmt.Errorf("template %s/%s does not define %q", locale, name, required)
+		}
+	}
+
+	return t, nil
+}
+
+func isSharedDir(name string) bool {
+	for _, dir := range sharedDirs {
+		if name == dir {
+			return true
+		}
+	}
+
+	return false
 }
 
-// ParseTemplate function that parses the email template. The data parameter should be a struct that contains the data to be used in the template.
-func (tp *Template) ParseTemplate(name string, data any) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error) {
-	t, err := template.New("email").ParseFS(templateFS, "templates/"+name)
+// Render renders the template in the locale. A locale such as "pt-BR" falls back to "pt", and then to DefaultLocale, when the template has no translation in it.
+func (tp *Templates) Render(name, locale string, data any) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error) {
+	t, err := tp.lookup(name, locale)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("could not parse template: %w", err)
+		return nil, nil, nil, err
 	}
 
 	subject := new(bytes.Buffer)
@@ -41,3 +168,80 @@ func (tp *Template) ParseTemplate(name string, data any) (*bytes.Buffer, *bytes.
 
 	return subject, plainBody, htmlBody, nil
 }
+
+func (tp *Templates) lookup(name, locale string) (*template.Template, error) {
+	for _, l := range localeFallbacks(locale) {
+		if t, ok := tp.sets[l][name]; ok {
+			return t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+}
+
+// Locales returns the locales that have templates, sorted.
+func (tp *Templates) Locales() []string {
+	var locales []string
+	for l := range tp.sets {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+
+	return locales
+}
+
+// localeFallbacks returns the locales to try in order for the requested locale.
+func localeFallbacks(locale string) []string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+
+	var fallbacks []string
+	if locale != "" {
+		fallbacks = append(fallbacks, locale)
+	}
+	if lang, _, ok := strings.Cut(locale, "-"); ok {
+		fallbacks = append(fallbacks, lang)
+	}
+
+	return append(fallbacks, DefaultLocale)
+}
+
+// overlayFS reads a file from upper when it exists there and from lower otherwise. Directory listings are merged.
+type overlayFS struct {
+	upper, lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	return o.lower.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(o.upper, name)
+	lower, lowerErr := fs.ReadDir(o.lower, name)
+	if upperErr != nil && lowerErr != nil {
+		return nil, lowerErr
+	}
+
+	entries := make(map[string]fs.DirEntry)
+	for _, e := range lower {
+		entries[e.Name()] = e
+	}
+	for _, e := range upper {
+		entries[e.Name()] = e
+	}
+
+	merged := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		merged = append(merged, e)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+
+	return merged, nil
+}
@@ -1,48 +1,226 @@
 package mailservice
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestParseTemplate(t *testing.T) {
-	template := &Template{}
+func templateData() map[string]any {
+	return map[string]any{
+		"Email":    "test@example.com",
+		"Username": "testuser",
+		"Token":    "123456",
+		"BaseURL":  "https://blogist.example.com",
+		"Blogs": []any{
+			map[string]any{"Title": "First Blog", "Author": "otheruser"},
+			map[string]any{"Title": "Second Blog", "Author": "thirduser"},
+		},
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	tp, err := NewTemplates("")
+	assert.NoError(t, err)
 
 	testCases := []struct {
 		name         string
 		templateName string
-		data         any
-		expectedErr  bool
+		locale       string
+		wantSubject  string
+		wantBody     string
+		wantLang     string
+		expectedErr  error
 	}{
 		{
-			name:         "success",
-			templateName: "activation_email.html",
-			data: struct {
-				ActivationToken string
-			}{
-				ActivationToken: "123456",
-			},
-			expectedErr: false,
+			name:         "activation",
+			templateName: TemplateActivation,
+			wantSubject:  "Welcome to Blogist!",
+			wantBody:     "https://blogist.example.com/activate?token=123456",
+			wantLang:     "en",
+		},
+		{
+			name:         "password reset",
+			templateName: TemplatePasswordReset,
+			locale:       "en",
+			wantSubject:  "Reset your Blogist password",
+			wantBody:     "123456",
+			wantLang:     "en",
+		},
+		{
+			name:         "digest",
+			templateName: TemplateDigest,
+			wantSubject:  "Your Blogist digest",
+			wantBody:     "Second Blog by thirduser",
+			wantLang:     "en",
+		},
+		{
+			name:         "test",
+			templateName: TemplateTest,
+			wantSubject:  "Blogist test email",
+			wantBody:     "https://blogist.example.com",
+			wantLang:     "en",
+		},
+		{
+			name:         "translated",
+			templateName: TemplateActivation,
+			locale:       "es",
+			wantSubject:  "¡Bienvenido a Blogist!",
+			wantBody:     "Hola testuser",
+			wantLang:     "es",
+		},
+		{
+			name:         "regional locale falls back to its language",
+			templateName: TemplatePasswordReset,
+			locale:       "es_MX",
+			wantSubject:  "Restablece tu contraseña de Blogist",
+			wantLang:     "es",
 		},
 		{
-			name:         "invalid template name",
-			templateName: "invalid_template.html",
-			data:         nil,
-			expectedErr:  true,
+			name:         "missing translation falls back to the default locale",
+			templateName: TemplateDigest,
+			locale:       "es",
+			wantSubject:  "Your Blogist digest",
+			wantLang:     "en",
+		},
+		{
+			name:         "unknown locale falls back to the default locale",
+			templateName: TemplateActivation,
+			locale:       "pt-BR",
+			wantSubject:  "Welcome to Blogist!",
+			wantLang:     "en",
+		},
+		{
+			name:         "unknown template",
+			templateName: "invalid_template",
+			expectedErr:  ErrTemplateNotFound,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			s, p, h, err := template.ParseTemplate(tc.templateName, tc.data)
-			assert.Equal(t, tc.expectedErr, err != nil)
-
-			if err == nil {
-				assert.NotEmpty(t, s.String())
-				assert.NotEmpty(t, p.String())
-				assert.NotEmpty(t, h.String())
+			s, p, h, err := tp.Render(tc.templateName, tc.locale, templateData())
+			assert.ErrorIs(t, err, tc.expectedErr)
+			if err != nil {
+				return
 			}
+
+			assert.Equal(t, tc.wantSubject, s.String())
+			assert.Contains(t, p.String(), tc.wantBody)
+			assert.Contains(t, h.String(), `<html lang="`+tc.wantLang+`">`)
+			assert.Contains(t, h.String(), "Blogist</p>", "expected the footer partial")
+		})
+	}
+}
+
+func TestActivationLink(t *testing.T) {
+	tp, err := NewTemplates("")
+	assert.NoError(t, err)
+
+	for _, locale := range []string{"en", "es"} {
+		t.Run(locale, func(t *testing.T) {
+			_, p, h, err := tp.Render(TemplateActivation, locale, templateData())
+			assert.NoError(t, err)
+
+			assert.Contains(t, p.String(), "https://blogist.example.com/activate?token=123456")
+			assert.Contains(t, h.String(), `href="https://blogist.example.com/activate?token=123456"`)
+			// The token is still shown for the clients of the API.
+			assert.Contains(t, h.String(), `{"token": "123456"}`)
+		})
+	}
+}
+
+func TestUnsubscribeLink(t *testing.T) {
+	tp, err := NewTemplates("")
+	assert.NoError(t, err)
+
+	data := templateData()
+	data["UnsubscribeURL"] = "https://blogist.example.com/unsubscribe?token=abc.def"
+
+	_, p, h, err := tp.Render(TemplateDigest, "en", data)
+	assert.NoError(t, err)
+	assert.Contains(t, p.String(), "https://blogist.example.com/unsubscribe?token=abc.def")
+	assert.Contains(t, h.String(), `href="https://blogist.example.com/unsubscribe?token=abc.def"`)
+
+	// Without a link, as in the transactional emails, nothing is said about unsubscribing.
+	_, p, h, err = tp.Render(TemplateDigest, "en", templateData())
+	assert.NoError(t, err)
+	assert.NotContains(t, p.String(), "unsubscribe")
+	assert.NotContains(t, h.String(), "Unsubscribe")
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	write := func(t *testing.T, dir, name, content string) {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	t.Run("replace and add templates", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, dir, "en/activation.html", `{{define "subject"}}Welcome to Acme{{end}}{{define "plainBody"}}{{.Token}}{{end}}{{define "content"}}<p>{{.Token}}</p>{{end}}`)
+		write(t, dir, "partials/footer.html", `{{define "footer"}}<p>Acme Inc.</p>{{end}}`)
+		write(t, dir, "fr/activation.html", `{{define "subject"}}Bienvenue{{end}}{{define "plainBody"}}{{.Token}}{{end}}{{define "content"}}<p>{{.Token}}</p>{{end}}`)
+
+		tp, err := NewTemplates(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"en", "es", "fr"}, tp.Locales())
+
+		s, _, h, err := tp.Render(TemplateActivation, "en", templateData())
+		assert.NoError(t, err)
+		assert.Equal(t, "Welcome to Acme", s.String())
+		assert.Contains(t, h.String(), "<p>Acme Inc.</p>")
+
+		s, _, _, err = tp.Render(TemplateActivation, "fr", templateData())
+		assert.NoError(t, err)
+		assert.Equal(t, "Bienvenue", s.String())
+
+		// The templates that are not overridden are still embedded.
+		s, _, h, err = tp.Render(TemplatePasswordReset, "en", templateData())
+		assert.NoError(t, err)
+		assert.Equal(t, "Reset your Blogist password", s.String())
+		assert.Contains(t, h.String(), "<p>Acme Inc.</p>")
+	})
+
+	t.Run("incomplete template", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, dir, "en/activation.html", `{{define "subject"}}Welcome{{end}}`)
+
+		_, err := NewTemplates(dir)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		dir := t.TempDir()
+		write(t, dir, "en/activation.html", `{{define "subject"}}Welcome{{end`)
+
+		_, err := NewTemplates(dir)
+		assert.Error(t, err)
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		_, err := NewTemplates(filepath.Join(t.TempDir(), "missing"))
+		assert.Error(t, err)
+	})
+}
+
+func TestLocaleFallbacks(t *testing.T) {
+	testCases := []struct {
+		locale   string
+		expected []string
+	}{
+		{locale: "", expected: []string{"en"}},
+		{locale: "en", expected: []string{"en", "en"}},
+		{locale: "es", expected: []string{"es", "en"}},
+		{locale: "pt-BR", expected: []string{"pt-br", "pt", "en"}},
+		{locale: "pt_BR", expected: []string{"pt-br", "pt", "en"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.locale, func(t *testing.T) {
+			assert.Equal(t, tc.expected, localeFallbacks(tc.locale))
 		})
 	}
 }
@@ -0,0 +1,213 @@
+package mailservice
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Message is a rendered email, ready to be handed to a Transport.
+type Message struct {
+	From      string
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	// Headers are added to the standard From, To and Subject headers.
+	Headers map[string]string
+}
+
+// Transport delivers rendered emails.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// NewTransport creates the transport selected by kind, which is "smtp", "file", "log" or "memory". The file transport writes to dir.
+func NewTransport(kind, host string, port int, username, password, dir string, logger MailLogger) (Transport, error) {
+	switch kind {
+	case "", "smtp":
+		return NewSMTPTransport(host, port, username, password), nil
+	case "file":
+		return NewFileTransport(dir)
+	case "log":
+		return NewLogTransport(logger), nil
+	case "memory":
+		return NewMemoryTransport(), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", kind)
+	}
+}
+
+// newMailMessage builds the MIME message with a plain text body and an HTML alternative.
+func newMailMessage(msg *Message) *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("From", msg.From)
+	m.SetHeader("To", msg.To)
+	m.SetHeader("Subject", msg.Subject)
+	for k, v := range msg.Headers {
+		m.SetHeader(k, v)
+	}
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+
+	return m
+}
+
+// SMTPTransport sends emails through an SMTP server.
+type SMTPTransport struct {
+	dialer Dialer
+}
+
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+func (t *SMTPTransport) Send(msg *Message) error {
+	return t.dialer.DialAndSend(newMailMessage(msg))
+}
+
+// FileTransport writes every email to a .eml file in a directory, where it can be opened with any mail client. It is meant for local development.
+type FileTransport struct {
+	dir string
+}
+
+// NewFileTransport creates the directory if it does not exist yet.
+func NewFileTransport(dir string) (*FileTransport, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("the file mail transport needs a directory")
+	}
+
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Send(msg *Message) error {
+	// The timestamp keeps the files in the order they were sent, and the random suffix keeps them apart.
+	f, err := os.CreateTemp(t.dir, time.Now().UTC().Format("20060102T150405.000")+"-*.eml")
+	if err != nil {
+		return err
+	}
+
+	_, err = newMailMessage(msg).WriteTo(f)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	return f.Close()
+}
+
+// Files returns the paths of the emails written so far, oldest first.
+func (t *FileTransport) Files() ([]string, error) {
+	return filepath.Glob(filepath.Join(t.dir, "*.eml"))
+}
+
+// LogTransport logs the emails instead of sending them.
+type LogTransport struct {
+	logger MailLogger
+}
+
+func NewLogTransport(logger MailLogger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+func (t *LogTransport) Send(msg *Message) error {
+	t.logger.Info("email",
+		slog.String("from", msg.From),
+		slog.String("to", msg.To),
+		slog.String("subject", msg.Subject),
+		slog.Any("headers", msg.Headers),
+		slog.String("body", msg.PlainBody))
+
+	return nil
+}
+
+// MemoryTransport keeps the emails in memory so tests can assert on what was sent.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+	// err is returned by Send when set, and the email is not kept.
+	err error
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Send(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil {
+		return t.err
+	}
+
+	t.messages = append(t.messages, *msg)
+
+	return nil
+}
+
+// SetErr makes the following sends fail with err, or succeed again when err is nil.
+func (t *MemoryTransport) SetErr(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+}
+
+// Messages returns a copy of the emails sent so far.
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Message{}, t.messages...)
+}
+
+// SentTo returns the emails sent to the recipient.
+func (t *MemoryTransport) SentTo(recipient string) []Message {
+	var sent []Message
+	for _, msg := range t.Messages() {
+		if msg.To == recipient {
+			sent = append(sent, msg)
+		}
+	}
+
+	return sent
+}
+
+// Reset forgets the emails sent so far.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages = nil
+}
+
+// AssertSent waits up to timeout for an email to the recipient, since emails are sent by consumers in the background, and returns the last one.
+func (t *MemoryTransport) AssertSent(tt assert.TestingT, recipient string, timeout time.Duration) *Message {
+	ok := assert.Eventually(tt, func() bool {
+		return len(t.SentTo(recipient)) > 0
+	}, timeout, 10*time.Millisecond, "expected an email to %s", recipient)
+	if !ok {
+		return nil
+	}
+
+	sent := t.SentTo(recipient)
+	return &sent[len(sent)-1]
+}
+
+// AssertNotSent checks that no email was sent to the recipient.
+func (t *MemoryTransport) AssertNotSent(tt assert.TestingT, recipient string) bool {
+	return assert.Empty(tt, t.SentTo(recipient), "expected no email to %s", recipient)
+}
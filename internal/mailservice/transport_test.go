@@ -0,0 +1,129 @@
+package mailservice
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func testMessage() *Message {
+	return &Message{
+		From:      "sender@example.com",
+		To:        "test@example.com",
+		Subject:   "Test Subject",
+		PlainBody: "Test Plain Body",
+		HTMLBody:  "<p>Test HTML Body</p>",
+		Headers:   map[string]string{"X-Test": "yes"},
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		kind     string
+		expected Transport
+		err      bool
+	}{
+		{kind: "", expected: &SMTPTransport{}},
+		{kind: "smtp", expected: &SMTPTransport{}},
+		{kind: "file", expected: &FileTransport{}},
+		{kind: "log", expected: &LogTransport{}},
+		{kind: "memory", expected: &MemoryTransport{}},
+		{kind: "pigeon", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.kind, func(t *testing.T) {
+			transport, err := NewTransport(tc.kind, "localhost", 25, "user", "password", t.TempDir(), new(MockLogger))
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.IsType(t, tc.expected, transport)
+		})
+	}
+}
+
+func TestSMTPTransport(t *testing.T) {
+	mockDialer := new(MockDialer)
+	mockDialer.On("DialAndSend", mock.MatchedBy(func(msgs []*mail.Message) bool {
+		return len(msgs) == 1 &&
+			msgs[0].GetHeader("To")[0] == "test@example.com" &&
+			msgs[0].GetHeader("Subject")[0] == "Test Subject" &&
+			msgs[0].GetHeader("X-Test")[0] == "yes"
+	})).Return(nil)
+
+	transport := &SMTPTransport{dialer: mockDialer}
+	assert.NoError(t, transport.Send(testMessage()))
+
+	mockDialer.AssertExpectations(t)
+}
+
+func TestFileTransport(t *testing.T) {
+	transport, err := NewFileTransport(t.TempDir() + "/mail")
+	assert.NoError(t, err)
+
+	assert.NoError(t, transport.Send(testMessage()))
+	assert.NoError(t, transport.Send(testMessage()))
+
+	files, err := transport.Files()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	eml, err := os.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(eml), "To: test@example.com")
+	assert.Contains(t, string(eml), "Subject: Test Subject")
+	assert.Contains(t, string(eml), "X-Test: yes")
+	assert.Contains(t, string(eml), "Test Plain Body")
+	assert.Contains(t, string(eml), "<p>Test HTML Body</p>")
+
+	_, err = NewFileTransport("")
+	assert.Error(t, err)
+}
+
+func TestLogTransport(t *testing.T) {
+	mockLogger := new(MockLogger)
+	mockLogger.On("Info", "email", []any{
+		slog.String("from", "sender@example.com"),
+		slog.String("to", "test@example.com"),
+		slog.String("subject", "Test Subject"),
+		slog.Any("headers", map[string]string{"X-Test": "yes"}),
+		slog.String("body", "Test Plain Body"),
+	}).Return()
+
+	transport := NewLogTransport(mockLogger)
+	assert.NoError(t, transport.Send(testMessage()))
+
+	mockLogger.AssertExpectations(t)
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := NewMemoryTransport()
+	transport.AssertNotSent(t, "test@example.com")
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		transport.Send(testMessage())
+	}()
+
+	msg := transport.AssertSent(t, "test@example.com", time.Second)
+	if assert.NotNil(t, msg) {
+		assert.Equal(t, "Test Subject", msg.Subject)
+	}
+	assert.Empty(t, transport.SentTo("other@example.com"))
+
+	transport.SetErr(errors.New("unavailable"))
+	assert.Error(t, transport.Send(testMessage()))
+	assert.Len(t, transport.Messages(), 1)
+
+	transport.Reset()
+	assert.Empty(t, transport.Messages())
+}
@@ -3,19 +3,38 @@ package mailservice
 import (
 	"bytes"
 	"context"
+	"html/template"
 	"sync"
 
 	"github.com/go-mail/mail/v2"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/sushihentaime/blogist/internal/common"
 )
 
 type MailService struct {
-	mb     common.MessageConsumer
-	m      Mailer
+	mb MessageBroker
+	m  Mailer
+	// events are the events the service sends emails for, Events unless a test narrows them down.
+	events []Event
+	// baseURL is the public URL of the application without a trailing slash. It is handed to the templates as BaseURL.
+	baseURL string
+	// prefs tells whether the recipients want the notification emails, and signer signs the unsubscribe links in them.
+	prefs  Preferences
+	signer *common.Signer
+	// sends counts the attempts at sending an email by template and result.
+	sends  *prometheus.CounterVec
 	logger MailLogger
-	ctx    context.Context
-	cancel context.CancelFunc
+	// consumers runs the consumers of the events.
+	consumers common.ConsumerGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// MessageBroker consumes the events that trigger emails and publishes the messages that have to be retried.
+type MessageBroker interface {
+	common.MessageConsumer
+	common.MessageProducer
 }
 
 type MailLogger interface {
@@ -24,22 +43,31 @@ type MailLogger interface {
 }
 
 type Mail struct {
-	mu     sync.Mutex
-	dialer Dialer
-	parser TemplateParser
-	sender string
+	mu        sync.Mutex
+	transport Transport
+	parser    TemplateRenderer
+	sender    string
 }
 
 type Mailer interface {
-	send(recipient string, data any, templateFile string) error
+	send(recipient, locale, name string, data any, headers map[string]string) error
 }
 
-type Template struct{}
+// Preferences tells whether a user wants to receive the notification emails of a kind. The user service implements it.
+type Preferences interface {
+	WantsEmail(ctx context.Context, userID int, kind string) (bool, error)
+}
+
+// Templates holds the email templates of every locale, parsed once.
+type Templates struct {
+	// sets maps a locale to its templates by name.
+	sets map[string]map[string]*template.Template
+}
 
 type Dialer interface {
 	DialAndSend(m ...*mail.Message) error
 }
 
-type TemplateParser interface {
-	ParseTemplate(name string, data any) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error)
+type TemplateRenderer interface {
+	Render(name, locale string, data any) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error)
 }
@@ -0,0 +1,45 @@
+package mailservice
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// unsubscribePrefix keeps an unsubscribe token from being accepted as any other value signed with the same key.
+const unsubscribePrefix = "unsubscribe"
+
+// UnsubscribeToken returns the token of the link that stops the notification emails of the kind for the user. It does not expire, so the links in old emails keep working.
+func UnsubscribeToken(signer *common.Signer, userID int, kind string) string {
+	return signer.Sign(fmt.Sprintf("%s:%d:%s", unsubscribePrefix, userID, kind))
+}
+
+// ParseUnsubscribeToken returns the user and the kind of notification of a token created by UnsubscribeToken. It returns common.ErrInvalidSignature when the token was not created by the signer.
+func ParseUnsubscribeToken(signer *common.Signer, token string) (int, string, error) {
+	value, err := signer.Verify(token)
+	if err != nil {
+		return 0, "", err
+	}
+
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] != unsubscribePrefix {
+		return 0, "", common.ErrInvalidSignature
+	}
+
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, "", common.ErrInvalidSignature
+	}
+
+	return userID, parts[2], nil
+}
+
+// unsubscribeHeaders lets mail clients show their own unsubscribe button, which posts to the link without opening it (RFC 8058).
+func unsubscribeHeaders(unsubscribeURL string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
@@ -0,0 +1,34 @@
+package mailservice
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func testSigner(t *testing.T) *common.Signer {
+	signer, err := common.NewSigner(bytes.Repeat([]byte("k"), 32))
+	assert.NoError(t, err)
+	return signer
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	signer := testSigner(t)
+
+	userID, kind, err := ParseUnsubscribeToken(signer, UnsubscribeToken(signer, 42, "comments"))
+	assert.NoError(t, err)
+	assert.Equal(t, 42, userID)
+	assert.Equal(t, "comments", kind)
+
+	// A value signed for another purpose is not an unsubscribe token.
+	_, _, err = ParseUnsubscribeToken(signer, signer.Sign("webhook:42:comments"))
+	assert.ErrorIs(t, err, common.ErrInvalidSignature)
+
+	_, _, err = ParseUnsubscribeToken(signer, signer.Sign("unsubscribe:abc:comments"))
+	assert.ErrorIs(t, err, common.ErrInvalidSignature)
+
+	_, _, err = ParseUnsubscribeToken(signer, "invalid")
+	assert.ErrorIs(t, err, common.ErrInvalidSignature)
+}
@@ -0,0 +1,62 @@
+package notificationservice
+
+import (
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// Event is a domain event from the broker that notifies a user. The message is a JSON object with the UserID of the recipient, the time the event happened At, and the details of the kind of event.
+type Event struct {
+	Key      common.BindingKey
+	Exchange common.Exchange
+	Queue    common.Queue
+	// RetryDelays are the delays between attempts at storing the notification. The message is dead lettered once they are used up.
+	RetryDelays []time.Duration
+	Kind        Kind
+}
+
+// Events maps the events the notification service listens to onto the kinds of notifications.
+//
+// Comments and reactions do not exist yet, their notifications are to be added here together with their events.
+var Events = []Event{
+	{
+		Key:         common.UserFollowedKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.NotificationFollowedQueue,
+		RetryDelays: common.NotificationRetryDelays,
+		Kind:        KindNewFollower,
+	},
+	{
+		Key:         common.UserSuspendedKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.NotificationSuspendedQueue,
+		RetryDelays: common.NotificationRetryDelays,
+		Kind:        KindAccountSuspended,
+	},
+	{
+		Key:         common.UserReinstatedKey,
+		Exchange:    common.UserExchange,
+		Queue:       common.NotificationReinstatedQueue,
+		RetryDelays: common.NotificationRetryDelays,
+		Kind:        KindAccountReinstated,
+	},
+}
+
+// eventPayload holds the fields of the domain events the notifications are made of.
+type eventPayload struct {
+	UserID           int
+	At               time.Time
+	FollowerID       int
+	FollowerUsername string
+}
+
+// data returns the details the notification of the kind shows.
+func (p eventPayload) data(kind Kind) any {
+	switch kind {
+	case KindNewFollower:
+		return map[string]any{"follower_id": p.FollowerID, "follower_username": p.FollowerUsername}
+	default:
+		return map[string]any{}
+	}
+}
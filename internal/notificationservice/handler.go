@@ -0,0 +1,234 @@
+package notificationservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+const (
+	// DefaultPageSize is the number of notifications in a page when the request does not ask for one.
+	DefaultPageSize = 20
+	maxPageSize     = 100
+)
+
+func NewNotificationService(store Store, mb MessageBroker, logger *slog.Logger) *NotificationService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &NotificationService{
+		store:  store,
+		mb:     mb,
+		events: Events,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start consumes the events the notifications are made of.
+func (s *NotificationService) Start() {
+	for _, e := range s.events {
+		s.consume(e)
+	}
+}
+
+// Ready returns an error when one of the consumers of the service is not running.
+func (s *NotificationService) Ready() error {
+	return s.consumers.Check()
+}
+
+// Shutdown stops taking messages and waits for the ones being handled until ctx is done, when it cancels them. The messages that were not handled are requeued.
+func (s *NotificationService) Shutdown(ctx context.Context) error {
+	err := s.consumers.Shutdown(ctx)
+	s.cancel()
+
+	return err
+}
+
+// Close stops the consumers and cancels the messages being handled.
+func (s *NotificationService) Close() {
+	s.consumers.Stop()
+	s.cancel()
+}
+
+func (s *NotificationService) consume(e Event) {
+	msgs, err := s.mb.Consume(e.Key, e.Exchange, e.Queue)
+	if err != nil {
+		s.logger.Error("could not consume message", slog.String("queue", string(e.Queue)), slog.String("error", err.Error()))
+		s.consumers.Failed(e.Queue)
+		return
+	}
+
+	s.consumers.Consume(e.Queue, msgs, func(msg common.Delivery) { s.handle(e, msg) })
+}
+
+func (s *NotificationService) handle(e Event, msg common.Delivery) {
+	ctx := common.ExtractRequestID(s.ctx, msg.Headers)
+	logger := common.Logger(ctx, s.logger)
+
+	var p eventPayload
+
+	err := json.Unmarshal(msg.Body, &p)
+	if err != nil || p.UserID <= 0 {
+		// A malformed message will never succeed, so it goes straight to the dead letter queue.
+		logger.Error("could not read event", slog.String("queue", string(e.Queue)))
+		msg.Nack(false)
+		return
+	}
+
+	data, err := json.Marshal(p.data(e.Kind))
+	if err != nil {
+		logger.Error("could not marshal notification", slog.String("queue", string(e.Queue)), slog.String("error", err.Error()))
+		msg.Nack(false)
+		return
+	}
+
+	n := Notification{
+		UserID:   p.UserID,
+		Kind:     e.Kind,
+		Data:     data,
+		EventKey: eventKey(e.Key, msg.Body),
+	}
+
+	err = s.store.InsertNotification(ctx, &n)
+	switch {
+	case err == nil:
+		logger.Info("notification stored", slog.String("kind", string(e.Kind)), slog.Int("user_id", p.UserID))
+		msg.Ack()
+		s.announce(ctx, &n)
+	case errors.Is(err, ErrDuplicateEvent):
+		msg.Ack()
+	case errors.Is(err, common.ErrRecordNotFound):
+		// The user was deleted after the event, there is no one left to notify.
+		logger.Info("notification dropped, the user does not exist", slog.String("kind", string(e.Kind)), slog.Int("user_id", p.UserID))
+		msg.Ack()
+	default:
+		s.retry(ctx, msg, e.Queue, e.RetryDelays, p.UserID, err)
+	}
+}
+
+// announce publishes the stored notification for the streams of every replica. A notification that could not be announced is still stored, and the user receives it when the stream resumes or the notifications are listed.
+func (s *NotificationService) announce(ctx context.Context, n *Notification) {
+	logger := common.Logger(ctx, s.logger)
+
+	body, err := json.Marshal(CreatedEvent{UserID: n.UserID, Notification: *n})
+	if err != nil {
+		logger.Error("could not marshal notification", slog.Int64("id", n.ID), slog.String("error", err.Error()))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err = s.mb.Publish(ctx, body, common.NotificationCreatedKey, common.UserExchange)
+	if err != nil {
+		logger.Error("could not announce notification", slog.Int64("id", n.ID), slog.String("error", err.Error()))
+	}
+}
+
+// eventKey identifies an event by its routing key and body. The events carry the time they happened, so the key of two events only matches when the broker delivers the same event twice.
+func eventKey(key common.BindingKey, body []byte) string {
+	return fmt.Sprintf("%s:%x", key, sha256.Sum256(body))
+}
+
+// retry sends a failed message to the retry queue for its next attempt, like the mail service does. Once every delay has been used the message is rejected, and the broker moves it to the dead letter queue.
+func (s *NotificationService) retry(ctx context.Context, msg common.Delivery, queue common.Queue, delays []time.Duration, userID int, cause error) {
+	logger := common.Logger(ctx, s.logger)
+
+	r, err := common.Retry(ctx, s.mb, msg, queue, delays)
+	switch {
+	case err != nil:
+		logger.Error("could not schedule notification retry", slog.Int("user_id", userID), slog.String("error", err.Error()))
+	case r.DeadLettered:
+		logger.Error("could not store notification, moving it to the dead letter queue", slog.Int("user_id", userID), slog.Int("attempts", r.Attempt), slog.String("error", cause.Error()))
+	default:
+		logger.Info("delaying notification", slog.Int("user_id", userID), slog.Int("attempt", r.Attempt), slog.Duration("delay", r.Delay), slog.String("error", cause.Error()))
+	}
+}
+
+// GetNotifications returns a page of the notifications of the user, newest first, together with the number of unread notifications. The page starts after the cursor of the previous page, or at the newest notification when the cursor is empty.
+func (s *NotificationService) GetNotifications(ctx context.Context, userId int, cursor string, limit int) (*Page, error) {
+	v := common.NewValidator()
+	v.Check(userId > 0, "user_id", "must be greater than zero")
+	v.Check(limit >= 1 && limit <= maxPageSize, "limit", fmt.Sprintf("must be between 1 and %d", maxPageSize))
+	before, err := decodeCursor(cursor)
+	v.Check(err == nil, "cursor", "must be a cursor returned by the previous page")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	// One more notification than asked for tells whether there is a next page.
+	notifications, err := s.store.GetNotifications(ctx, userId, before, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	unread, err := s.store.CountUnread(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Notifications: notifications, UnreadCount: unread}
+	if len(notifications) > limit {
+		page.Notifications = notifications[:limit]
+		page.NextCursor = encodeCursor(notifications[limit-1].ID)
+	}
+
+	return page, nil
+}
+
+// MarkRead marks a notification of the user as read. It returns common.ErrRecordNotFound when the notification does not exist or belongs to someone else.
+func (s *NotificationService) MarkRead(ctx context.Context, userId int, id int64) error {
+	v := common.NewValidator()
+	v.Check(userId > 0, "user_id", "must be greater than zero")
+	v.Check(id > 0, "id", "must be greater than zero")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	return s.store.MarkRead(ctx, userId, id)
+}
+
+// MarkAllRead marks every notification of the user as read and returns how many were unread.
+func (s *NotificationService) MarkAllRead(ctx context.Context, userId int) (int, error) {
+	v := common.NewValidator()
+	v.Check(userId > 0, "user_id", "must be greater than zero")
+	if !v.Valid() {
+		return 0, v.ValidationError()
+	}
+
+	return s.store.MarkAllRead(ctx, userId)
+}
+
+// encodeCursor returns the cursor of the page after the notification. Cursors are opaque to clients so the pagination can change without breaking them.
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if id <= 0 {
+		return 0, errors.New("cursor out of range")
+	}
+
+	return id, nil
+}
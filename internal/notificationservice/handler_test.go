@@ -0,0 +1,183 @@
+package notificationservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func setupTestService(t *testing.T) (*NotificationService, *common.MemoryBroker, *userservice.User) {
+	t.Helper()
+	ctx := context.Background()
+
+	db := common.TestDB("file://../../migrations", t)
+	users := userservice.NewPostgresStore(db)
+	u := userservice.User{Username: "testuser", Email: "testuser@example.com"}
+	assert.NoError(t, users.InsertUser(ctx, &u))
+
+	mb := common.NewMemoryBroker()
+	assert.NoError(t, common.SetupUserExchange(mb))
+
+	s := NewNotificationService(NewPostgresStore(db), mb, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	t.Cleanup(func() {
+		s.Close()
+		mb.Close()
+	})
+
+	return s, mb, &u
+}
+
+func publish(t *testing.T, mb common.Broker, key common.BindingKey, event any) {
+	t.Helper()
+
+	body, err := json.Marshal(event)
+	assert.NoError(t, err)
+	assert.NoError(t, mb.Publish(context.Background(), body, key, common.UserExchange))
+}
+
+func TestConsumeEvents(t *testing.T) {
+	s, mb, u := setupTestService(t)
+	ctx := context.Background()
+
+	// Stands in for the queue of a stream.
+	announced := common.Queue("test_notification_created_queue")
+	assert.NoError(t, mb.Declare(common.Topology{
+		Queues:   []common.QueueSpec{{Name: announced, Exclusive: true}},
+		Bindings: []common.BindingSpec{{Queue: announced, Key: common.NotificationCreatedKey, Exchange: common.UserExchange}},
+	}))
+
+	s.Start()
+
+	at := time.Now()
+	followed := map[string]any{"UserID": u.ID, "FollowerID": 42, "FollowerUsername": "follower", "At": at}
+	publish(t, mb, common.UserFollowedKey, followed)
+	// The broker delivers the same event twice.
+	publish(t, mb, common.UserFollowedKey, followed)
+	publish(t, mb, common.UserSuspendedKey, map[string]any{"UserID": u.ID, "At": at})
+	publish(t, mb, common.UserReinstatedKey, map[string]any{"UserID": u.ID, "At": at})
+	// Nobody is left to notify.
+	publish(t, mb, common.UserFollowedKey, map[string]any{"UserID": u.ID + 1, "FollowerID": 42, "At": at})
+
+	assert.Eventually(t, func() bool {
+		unread, err := s.store.CountUnread(ctx, u.ID)
+		return err == nil && unread == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	page, err := s.GetNotifications(ctx, u.ID, "", DefaultPageSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, page.UnreadCount)
+
+	kinds := make(map[Kind]json.RawMessage)
+	for _, n := range page.Notifications {
+		kinds[n.Kind] = n.Data
+	}
+	assert.JSONEq(t, `{"follower_id": 42, "follower_username": "follower"}`, string(kinds[KindNewFollower]))
+	assert.Contains(t, kinds, KindAccountSuspended)
+	assert.Contains(t, kinds, KindAccountReinstated)
+
+	// Every stored notification is announced once.
+	assert.Eventually(t, func() bool {
+		msgs, err := mb.Peek(announced, 10)
+		return err == nil && len(msgs) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	msgs, err := mb.Peek(announced, 10)
+	assert.NoError(t, err)
+	var event CreatedEvent
+	assert.NoError(t, json.Unmarshal(msgs[0].Body, &event))
+	assert.Equal(t, u.ID, event.UserID)
+	assert.NotZero(t, event.Notification.ID)
+
+	// Every message was settled, a malformed one included.
+	publish(t, mb, common.UserFollowedKey, map[string]any{"FollowerID": 42})
+	assert.Eventually(t, func() bool {
+		dead, err := mb.Peek(common.NotificationFollowedDLQ, 10)
+		pending, perr := mb.Peek(common.NotificationFollowedQueue, 10)
+		return err == nil && perr == nil && len(dead) == 1 && len(pending) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestGetNotifications(t *testing.T) {
+	s, _, u := setupTestService(t)
+	ctx := context.Background()
+
+	for i := range 5 {
+		n := Notification{UserID: u.ID, Kind: KindNewFollower, EventKey: string(rune('a' + i))}
+		assert.NoError(t, s.store.InsertNotification(ctx, &n))
+	}
+
+	var seen []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, err := s.GetNotifications(ctx, u.ID, cursor, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, 5, page.UnreadCount)
+
+		for _, n := range page.Notifications {
+			seen = append(seen, n.ID)
+		}
+
+		if page.NextCursor == "" {
+			assert.Equal(t, 2, pages)
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(t, []int64{5, 4, 3, 2, 1}, seen)
+
+	for _, tc := range []struct {
+		name   string
+		cursor string
+		limit  int
+		field  string
+	}{
+		{"limit too small", "", 0, "limit"},
+		{"limit too large", "", maxPageSize + 1, "limit"},
+		{"not base64", "!!", 10, "cursor"},
+		{"not an id", encodeCursor(0) + "x", 10, "cursor"},
+		{"zero", encodeCursor(0), 10, "cursor"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := s.GetNotifications(ctx, u.ID, tc.cursor, tc.limit)
+			if assert.IsType(t, common.ValidationError{}, err) {
+				assert.Contains(t, err.(common.ValidationError).Errors, tc.field)
+			}
+		})
+	}
+}
+
+func TestMarkRead(t *testing.T) {
+	s, _, u := setupTestService(t)
+	ctx := context.Background()
+
+	var ids []int64
+	for _, key := range []string{"a", "b", "c"} {
+		n := Notification{UserID: u.ID, Kind: KindNewFollower, EventKey: key}
+		assert.NoError(t, s.store.InsertNotification(ctx, &n))
+		ids = append(ids, n.ID)
+	}
+
+	assert.NoError(t, s.MarkRead(ctx, u.ID, ids[0]))
+	assert.ErrorIs(t, s.MarkRead(ctx, u.ID+1, ids[1]), common.ErrRecordNotFound)
+	assert.IsType(t, common.ValidationError{}, s.MarkRead(ctx, u.ID, 0))
+
+	page, err := s.GetNotifications(ctx, u.ID, "", DefaultPageSize)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, page.UnreadCount)
+
+	n, err := s.MarkAllRead(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	page, err = s.GetNotifications(ctx, u.ID, "", DefaultPageSize)
+	assert.NoError(t, err)
+	assert.Zero(t, page.UnreadCount)
+}
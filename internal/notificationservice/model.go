@@ -0,0 +1,139 @@
+package notificationservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) InsertNotification(ctx context.Context, n *Notification) error {
+	query := `
+		INSERT INTO notifications (user_id, kind, data, event_key)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, event_key) DO NOTHING
+		RETURNING id, created_at`
+
+	data := n.Data
+	if data == nil {
+		data = []byte("{}")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.db.QueryRowContext(ctx, query, n.UserID, n.Kind, []byte(data), n.EventKey).Scan(&n.ID, &n.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrDuplicateEvent
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return common.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	n.Data = data
+
+	return nil
+}
+
+func (s *PostgresStore) GetNotifications(ctx context.Context, userID int, before int64, limit int) ([]Notification, error) {
+	query := `
+		SELECT id, user_id, kind, data, event_key, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND ($2::bigint = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var data []byte
+		err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &data, &n.EventKey, &n.ReadAt, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		n.Data = data
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+func (s *PostgresStore) CountUnread(ctx context.Context, userID int) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM notifications
+		WHERE user_id = $1 AND read_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var count int
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&count)
+
+	return count, err
+}
+
+func (s *PostgresStore) MarkRead(ctx context.Context, userID int, id int64) error {
+	query := `
+		UPDATE notifications
+		SET read_at = COALESCE(read_at, NOW())
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return common.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) MarkAllRead(ctx context.Context, userID int) (int, error) {
+	query := `
+		UPDATE notifications
+		SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+
+	return int(n), err
+}
@@ -0,0 +1,17 @@
+package notificationservice
+
+import "context"
+
+// Store is the persistence layer of the notification service.
+type Store interface {
+	// InsertNotification stores the notification and sets its ID and creation time. It returns ErrDuplicateEvent when the user already has a notification with the same event key, and common.ErrRecordNotFound when the user does not exist.
+	InsertNotification(ctx context.Context, n *Notification) error
+	// GetNotifications returns up to limit notifications of the user, newest first. When before is not zero only the notifications with a lower ID are returned.
+	GetNotifications(ctx context.Context, userID int, before int64, limit int) ([]Notification, error)
+	// CountUnread returns the number of notifications of the user that are not read.
+	CountUnread(ctx context.Context, userID int) (int, error)
+	// MarkRead marks the notification of the user as read. Marking a read notification keeps the time it was first read. It returns common.ErrRecordNotFound when the user has no such notification.
+	MarkRead(ctx context.Context, userID int, id int64) error
+	// MarkAllRead marks every notification of the user as read and returns how many were unread.
+	MarkAllRead(ctx context.Context, userID int) (int, error)
+}
@@ -0,0 +1,130 @@
+package notificationservice
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func TestPostgresStore(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+	ctx := context.Background()
+
+	s := NewPostgresStore(db)
+	users := userservice.NewPostgresStore(db)
+
+	setup := func(t *testing.T) (int, int) {
+		t.Cleanup(func() {
+			for _, table := range []string{"notifications", "users"} {
+				_, err := db.Exec("DELETE FROM " + table)
+				assert.NoError(t, err)
+			}
+		})
+
+		u := userservice.User{Username: "testuser", Email: "testuser@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &u))
+		other := userservice.User{Username: "other", Email: "other@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &other))
+
+		return u.ID, other.ID
+	}
+
+	insert := func(t *testing.T, userID int, key string) *Notification {
+		n := Notification{UserID: userID, Kind: KindNewFollower, Data: json.RawMessage(`{"follower_id":1}`), EventKey: key}
+		assert.NoError(t, s.InsertNotification(ctx, &n))
+		return &n
+	}
+
+	ids := func(notifications []Notification) []int64 {
+		var ids []int64
+		for _, n := range notifications {
+			ids = append(ids, n.ID)
+		}
+		return ids
+	}
+
+	t.Run("insert", func(t *testing.T) {
+		userID, _ := setup(t)
+
+		n := insert(t, userID, "a")
+		assert.NotZero(t, n.ID)
+		assert.False(t, n.CreatedAt.IsZero())
+
+		dup := Notification{UserID: userID, Kind: KindNewFollower, EventKey: "a"}
+		assert.ErrorIs(t, s.InsertNotification(ctx, &dup), ErrDuplicateEvent)
+
+		missing := Notification{UserID: userID + 100, Kind: KindNewFollower, EventKey: "b"}
+		assert.ErrorIs(t, s.InsertNotification(ctx, &missing), common.ErrRecordNotFound)
+
+		got, err := s.GetNotifications(ctx, userID, 0, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, got, 1) {
+			assert.Equal(t, KindNewFollower, got[0].Kind)
+			assert.JSONEq(t, `{"follower_id":1}`, string(got[0].Data))
+			assert.Nil(t, got[0].ReadAt)
+		}
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		userID, otherID := setup(t)
+
+		first := insert(t, userID, "1")
+		second := insert(t, userID, "2")
+		third := insert(t, userID, "3")
+		insert(t, otherID, "1")
+
+		got, err := s.GetNotifications(ctx, userID, 0, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{third.ID, second.ID}, ids(got))
+
+		got, err = s.GetNotifications(ctx, userID, second.ID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{first.ID}, ids(got))
+
+		got, err = s.GetNotifications(ctx, userID, first.ID, 2)
+		assert.NoError(t, err)
+		assert.Empty(t, got)
+	})
+
+	t.Run("read", func(t *testing.T) {
+		userID, otherID := setup(t)
+
+		first := insert(t, userID, "1")
+		insert(t, userID, "2")
+		others := insert(t, otherID, "1")
+
+		unread, err := s.CountUnread(ctx, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, unread)
+
+		assert.ErrorIs(t, s.MarkRead(ctx, userID, others.ID), common.ErrRecordNotFound)
+		assert.NoError(t, s.MarkRead(ctx, userID, first.ID))
+
+		got, err := s.GetNotifications(ctx, userID, 0, 10)
+		assert.NoError(t, err)
+		readAt := got[1].ReadAt
+		if assert.NotNil(t, readAt) {
+			// Reading it again keeps the first time.
+			assert.NoError(t, s.MarkRead(ctx, userID, first.ID))
+			got, err = s.GetNotifications(ctx, userID, 0, 10)
+			assert.NoError(t, err)
+			assert.True(t, readAt.Equal(*got[1].ReadAt))
+		}
+
+		n, err := s.MarkAllRead(ctx, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		unread, err = s.CountUnread(ctx, userID)
+		assert.NoError(t, err)
+		assert.Zero(t, unread)
+
+		unread, err = s.CountUnread(ctx, otherID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, unread)
+	})
+}
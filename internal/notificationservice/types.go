@@ -0,0 +1,73 @@
+package notificationservice
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// ErrDuplicateEvent is returned when the user already has the notification of an event, because the broker delivered the event again.
+var ErrDuplicateEvent = errors.New("notification already stored")
+
+// Kind is what a notification is about.
+type Kind string
+
+const (
+	KindNewFollower       Kind = "new_follower"
+	KindAccountSuspended  Kind = "account_suspended"
+	KindAccountReinstated Kind = "account_reinstated"
+)
+
+type Notification struct {
+	ID     int64 `json:"id"`
+	UserID int   `json:"-"`
+	Kind   Kind  `json:"kind"`
+	// Data holds the details of the notification, which depend on its kind, e.g. the follower of a new_follower notification.
+	Data json.RawMessage `json:"data"`
+	// EventKey identifies the event the notification was made from.
+	EventKey  string     `json:"-"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// CreatedEvent is the body of the notification.created message. Notification does not marshal its UserID, so it is carried next to it.
+type CreatedEvent struct {
+	UserID       int
+	Notification Notification
+}
+
+// Page is a page of the notifications of a user, newest first. NextCursor is empty on the last page.
+type Page struct {
+	Notifications []Notification `json:"notifications"`
+	UnreadCount   int            `json:"unread_count"`
+	NextCursor    string         `json:"next_cursor,omitempty"`
+}
+
+// NotificationService turns the domain events published on the broker into in-app notifications and serves them to their users.
+type NotificationService struct {
+	store Store
+	mb    MessageBroker
+	// events are the events the service makes notifications of, Events unless a test narrows them down.
+	events []Event
+	logger *slog.Logger
+	// consumers runs the consumers of the events.
+	consumers common.ConsumerGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// MessageBroker consumes the domain events and publishes the messages that have to be retried.
+type MessageBroker interface {
+	common.MessageConsumer
+	common.MessageProducer
+}
+
+// PostgresStore keeps the notifications in the notifications table.
+type PostgresStore struct {
+	db *sql.DB
+}
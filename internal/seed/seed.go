@@ -0,0 +1,221 @@
+// Package seed fills the database with example users, blog posts and follows for development and load testing. The data is drawn from a seeded random source, so the same options always produce the same data. There are no tags or comments in the schema yet, so none are generated.
+package seed
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Password is the password of every generated user.
+const Password = "Seed-Password1"
+
+// AdminUsername is the first generated user, who is granted the admin permission.
+const AdminUsername = "admin"
+
+// Options sets the scale of the generated data.
+type Options struct {
+	Users int
+	// BlogsPerUser is the average number of blog posts of a user, the users have between none and twice as many.
+	BlogsPerUser int
+	// FollowsPerUser is the number of authors each user follows, fewer when there are not enough users.
+	FollowsPerUser int
+	// Seed selects the data. Seeding an empty database twice with the same options gives the same content.
+	Seed uint64
+	// Now is the time the blog posts are dated before, over the year before it.
+	Now time.Time
+}
+
+// Result counts the generated rows.
+type Result struct {
+	Users    int           `json:"users"`
+	Blogs    int           `json:"blogs"`
+	Follows  int           `json:"follows"`
+	Password string        `json:"password"`
+	Duration time.Duration `json:"duration"`
+}
+
+// User is a generated user. Index is its position among the generated users, from 0.
+type User struct {
+	Index    int
+	Username string
+	Email    string
+	Locale   string
+}
+
+// Post is a generated blog post.
+type Post struct {
+	Title     string
+	Content   string
+	CreatedAt time.Time
+}
+
+// rng returns the random source of a part of the data, so that each user and its posts can be generated on their own and in any order.
+func (o Options) rng(part, i int) *rand.Rand {
+	return rand.New(rand.NewPCG(o.Seed, uint64(part)<<32|uint64(i)))
+}
+
+const (
+	partUser = iota
+	partPosts
+	partFollows
+)
+
+// User returns the i-th user. The index in the username keeps the usernames unique.
+func (o Options) User(i int) User {
+	if i == 0 {
+		return User{Index: 0, Username: AdminUsername, Email: AdminUsername + "@example.com", Locale: "en"}
+	}
+
+	r := o.rng(partUser, i)
+	username := pick(r, firstNames) + strconv.Itoa(i)
+
+	locale := "en"
+	if r.IntN(5) == 0 {
+		locale = "es"
+	}
+
+	return User{Index: i, Username: username, Email: username + "@example.com", Locale: locale}
+}
+
+// Posts returns the blog posts of the i-th user, oldest first.
+func (o Options) Posts(i int) []Post {
+	r := o.rng(partPosts, i)
+
+	n := 0
+	if o.BlogsPerUser > 0 {
+		n = r.IntN(2*o.BlogsPerUser + 1)
+	}
+
+	posts := make([]Post, n)
+	for j := range posts {
+		posts[j] = Post{
+			Title:     title(r),
+			Content:   markdown(r),
+			CreatedAt: o.Now.Add(-time.Duration(r.Int64N(int64(365 * 24 * time.Hour)))).Truncate(time.Second),
+		}
+	}
+	slices.SortFunc(posts, func(a, b Post) int { return a.CreatedAt.Compare(b.CreatedAt) })
+
+	return posts
+}
+
+// Follows returns the indexes of the users the i-th user follows, without the user itself.
+func (o Options) Follows(i int) []int {
+	n := min(o.FollowsPerUser, o.Users-1)
+	if n <= 0 {
+		return nil
+	}
+
+	r := o.rng(partFollows, i)
+	seen := map[int]bool{i: true}
+	authors := make([]int, 0, n)
+	for len(authors) < n {
+		author := r.IntN(o.Users)
+		if seen[author] {
+			continue
+		}
+		seen[author] = true
+		authors = append(authors, author)
+	}
+
+	return authors
+}
+
+func pick(r *rand.Rand, words []string) string {
+	return words[r.IntN(len(words))]
+}
+
+// title returns a title of letters and spaces, which the blog service accepts.
+func title(r *rand.Rand) string {
+	n := 3 + r.IntN(6)
+	words := make([]string, n)
+	for i := range words {
+		w := pick(r, vocabulary)
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+
+	return strings.Join(words, " ")
+}
+
+func sentence(r *rand.Rand) string {
+	n := 6 + r.IntN(14)
+	words := make([]string, n)
+	for i := range words {
+		words[i] = pick(r, vocabulary)
+		switch r.IntN(20) {
+		case 0:
+			words[i] = "**" + words[i] + "**"
+		case 1:
+			words[i] = "_" + words[i] + "_"
+		case 2:
+			words[i] = "`" + words[i] + "`"
+		}
+	}
+	words[0] = strings.ToUpper(words[0][:1]) + words[0][1:]
+
+	return strings.Join(words, " ") + "."
+}
+
+func paragraph(r *rand.Rand) string {
+	n := 2 + r.IntN(5)
+	sentences := make([]string, n)
+	for i := range sentences {
+		sentences[i] = sentence(r)
+	}
+
+	return strings.Join(sentences, " ")
+}
+
+// markdown returns a post of a few paragraphs, with some of the headings, lists, quotes, links and code blocks of the posts people write.
+func markdown(r *rand.Rand) string {
+	var b strings.Builder
+
+	b.WriteString(paragraph(r))
+	sections := 1 + r.IntN(6)
+	for i := 0; i < sections; i++ {
+		b.WriteString("\n\n")
+
+		switch r.IntN(6) {
+		case 0:
+			fmt.Fprintf(&b, "## %s\n\n%s", title(r), paragraph(r))
+		case 1:
+			for j := 2 + r.IntN(4); j > 0; j-- {
+				fmt.Fprintf(&b, "- %s\n", sentence(r))
+			}
+			b.WriteString("\n" + paragraph(r))
+		case 2:
+			fmt.Fprintf(&b, "> %s", sentence(r))
+		case 3:
+			fmt.Fprintf(&b, "```go\nfunc %s() error {\n\treturn nil\n}\n```", pick(r, vocabulary))
+		case 4:
+			fmt.Fprintf(&b, "%s See [%s](https://example.com/%s) for more.", paragraph(r), pick(r, vocabulary), pick(r, vocabulary))
+		default:
+			b.WriteString(paragraph(r))
+		}
+	}
+
+	return b.String()
+}
+
+var firstNames = []string{
+	"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy",
+	"mallory", "niaj", "olivia", "peggy", "rupert", "sybil", "trent", "victor", "walter", "yara",
+	"amara", "bao", "chidi", "dana", "elif", "farah", "goran", "hana", "ines", "jonas",
+	"kenji", "lucia", "mateo", "nadia", "omar", "priya", "quinn", "rosa", "sven", "tariq",
+}
+
+var vocabulary = []string{
+	"api", "build", "cache", "channel", "cloud", "code", "commit", "compiler", "concurrency", "container",
+	"context", "database", "debug", "deploy", "design", "error", "event", "feature", "garden", "goroutine",
+	"handler", "index", "interface", "journey", "kernel", "latency", "library", "logging", "memory", "message",
+	"metrics", "module", "network", "notes", "package", "pattern", "performance", "pipeline", "query", "queue",
+	"refactor", "release", "request", "review", "schema", "server", "service", "snapshot", "stream", "system",
+	"team", "test", "thread", "timeout", "trace", "travel", "type", "update", "version", "weekend",
+	"about", "after", "again", "always", "because", "before", "better", "every", "first", "great",
+	"learned", "little", "never", "often", "really", "simple", "small", "still", "through", "today",
+	"why", "with", "without", "writing", "yesterday", "reading", "running", "making", "keeping", "finding",
+}
@@ -0,0 +1,155 @@
+package seed
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/blogservice"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func testOptions() Options {
+	return Options{Users: 4, BlogsPerUser: 2, FollowsPerUser: 2, Seed: 7, Now: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+// expected counts the rows the options generate.
+func expected(opts Options) (blogs, follows int) {
+	for i := 0; i < opts.Users; i++ {
+		blogs += len(opts.Posts(i))
+		follows += len(opts.Follows(i))
+	}
+
+	return blogs, follows
+}
+
+func TestOptions(t *testing.T) {
+	opts := testOptions()
+
+	// The same seed generates the same data, another seed other data.
+	assert.Equal(t, opts.User(3), opts.User(3))
+	assert.Equal(t, opts.Posts(3), opts.Posts(3))
+	other := opts
+	other.Seed++
+	assert.NotEqual(t, opts.Posts(3), other.Posts(3))
+
+	assert.Equal(t, AdminUsername, opts.User(0).Username)
+
+	usernames := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		u := opts.User(i)
+		assert.Regexp(t, userservice.UsernameRX, u.Username)
+		assert.Regexp(t, userservice.EmailRX, u.Email)
+		assert.False(t, usernames[u.Username], u.Username)
+		usernames[u.Username] = true
+
+		posts := opts.Posts(i)
+		assert.LessOrEqual(t, len(posts), 2*opts.BlogsPerUser)
+		for j, post := range posts {
+			assert.Regexp(t, blogservice.TitleRX, post.Title)
+			assert.LessOrEqual(t, len(post.Title), 100)
+			assert.NotEmpty(t, post.Content)
+			assert.True(t, post.CreatedAt.Before(opts.Now))
+			if j > 0 {
+				assert.False(t, post.CreatedAt.Before(posts[j-1].CreatedAt))
+			}
+		}
+	}
+
+	for i := 0; i < opts.Users; i++ {
+		follows := opts.Follows(i)
+		assert.Len(t, follows, opts.FollowsPerUser)
+		assert.NotContains(t, follows, i)
+	}
+
+	// A user cannot follow more authors than there are.
+	opts.FollowsPerUser = 10
+	assert.Len(t, opts.Follows(0), opts.Users-1)
+}
+
+func TestServices(t *testing.T) {
+	ctx := context.Background()
+	cache := common.NewMemoryCache(5*time.Minute, 10*time.Minute)
+	userStore := userservice.NewMemoryStore(common.NewMemoryOutbox())
+	users := userservice.NewUserService(userStore, cache, time.Minute)
+	blogs := blogservice.NewBlogService(blogservice.NewMemoryStore(userStore, common.NewMemoryOutbox()), cache)
+
+	opts := testOptions()
+	start := time.Now()
+	res, err := Services(ctx, users, blogs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBlogs, wantFollows := expected(opts)
+	assert.Equal(t, opts.Users, res.Users)
+	assert.Equal(t, wantBlogs, res.Blogs)
+	assert.Equal(t, wantFollows, res.Follows)
+
+	// The services date the posts when they create them, not with the generated dates.
+	created, err := blogs.GetBlogs(ctx, 100, 0)
+	assert.NoError(t, err)
+	assert.Len(t, *created, wantBlogs)
+	for _, blog := range *created {
+		assert.False(t, blog.CreatedAt.Before(start))
+	}
+
+	// The permissions are loaded with the session.
+	login := func(username string) *userservice.User {
+		token, err := users.LoginUser(ctx, username, Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := users.GetUserByAccessToken(ctx, token.AccessTokenPlain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+
+	admin := login(AdminUsername)
+	assert.True(t, admin.HasPermission(userservice.PermissionAdmin))
+	assert.True(t, admin.HasPermission(userservice.PermissionWriteBlog))
+
+	user := login(opts.User(1).Username)
+	assert.True(t, user.HasPermission(userservice.PermissionWriteBlog))
+	assert.False(t, user.HasPermission(userservice.PermissionAdmin))
+}
+
+func TestCopy(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+	ctx := context.Background()
+
+	opts := testOptions()
+	res, err := Copy(ctx, db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBlogs, wantFollows := expected(opts)
+	assert.Equal(t, opts.Users, res.Users)
+	assert.Equal(t, wantBlogs, res.Blogs)
+	assert.Equal(t, wantFollows, res.Follows)
+
+	count := func(query string) int {
+		var n int
+		assert.NoError(t, db.QueryRowContext(ctx, query).Scan(&n))
+		return n
+	}
+	assert.Equal(t, opts.Users, count("SELECT COUNT(*) FROM users WHERE activated"))
+	assert.Equal(t, wantBlogs, count("SELECT COUNT(*) FROM blogs"))
+	assert.Equal(t, wantFollows, count("SELECT COUNT(*) FROM follows"))
+	assert.Equal(t, 1, count("SELECT COUNT(*) FROM user_permissions WHERE permission = 'admin:access'"))
+
+	users := userservice.NewUserService(userservice.NewPostgresStore(db), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	// The loaded users log in with the password like the others.
+	_, err = users.LoginUser(ctx, AdminUsername, Password)
+	assert.NoError(t, err)
+
+	// The users created afterwards get the ids after the reserved ones.
+	_, err = users.CreateUser(ctx, "latecomer", "latecomer@example.com", Password, "")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,68 @@
+package seed
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/blogservice"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+// Services creates the data through the services, so that it is validated, sanitized and published like the data of the users. The users are activated, which grants them the blog:write permission, and the admin is also granted admin:access. The users.created events send activation emails to the example.com addresses, seed a development setup with a MAIL_TRANSPORT that does not deliver them.
+//
+// The users are created before their posts and the follows after all the posts, so the followers are not notified of a year of posts at once. The posts are dated when they are created, only Copy keeps their generated dates.
+func Services(ctx context.Context, users *userservice.UserService, blogs *blogservice.BlogService, opts Options) (Result, error) {
+	start := time.Now()
+	res := Result{Password: Password}
+
+	ids := make([]int, opts.Users)
+	for i := range ids {
+		u := opts.User(i)
+
+		_, err := users.CreateUser(ctx, u.Username, u.Email, Password, u.Locale)
+		if err != nil {
+			return res, fmt.Errorf("failed to create the user %s: %w", u.Username, err)
+		}
+
+		user, err := users.GetUserByUsername(ctx, u.Username)
+		if err != nil {
+			return res, err
+		}
+		ids[i] = user.ID
+
+		err = users.ActivateUserByID(ctx, user.ID)
+		if err != nil {
+			return res, fmt.Errorf("failed to activate the user %s: %w", u.Username, err)
+		}
+
+		if i == 0 {
+			err = users.GrantPermission(ctx, user.ID, userservice.PermissionAdmin)
+			if err != nil {
+				return res, err
+			}
+		}
+		res.Users++
+
+		for _, post := range opts.Posts(i) {
+			err = blogs.CreateBlog(ctx, &blogservice.CreateBlogRequest{Title: post.Title, Content: post.Content, UserID: user.ID})
+			if err != nil {
+				return res, fmt.Errorf("failed to create a blog post of %s: %w", u.Username, err)
+			}
+			res.Blogs++
+		}
+	}
+
+	for i, follower := range ids {
+		for _, author := range opts.Follows(i) {
+			err := users.FollowUser(ctx, follower, ids[author])
+			if err != nil {
+				return res, err
+			}
+			res.Follows++
+		}
+	}
+	res.Duration = time.Since(start)
+
+	return res, nil
+}
@@ -0,0 +1,356 @@
+package streamservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+)
+
+const (
+	// ReplayLimit is the maximum number of notifications, and of blog posts, replayed when a stream resumes. The ready event tells the client when there were more, which it then lists through the API.
+	ReplayLimit = 100
+	// DefaultBuffer is the number of events a stream can fall behind by before it is closed. The client reconnects with the ID of the last event it received and gets the rest replayed.
+	DefaultBuffer = 64
+)
+
+// NewHub creates the hub of the replica. Its queue is named after the replica with a random suffix, so replicas never share one.
+func NewHub(mb MessageBroker, store Store, buffer int, logger *slog.Logger) (*Hub, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Hub{
+		mb:      mb,
+		store:   store,
+		queue:   common.Queue("stream." + hex.EncodeToString(suffix)),
+		logger:  logger,
+		buffer:  buffer,
+		streams: make(map[int]map[*Stream]struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// Start declares the queue of the replica and consumes the events of the streams. The user and blog exchanges must be declared already.
+func (h *Hub) Start() error {
+	err := h.mb.Declare(common.Topology{
+		Queues: []common.QueueSpec{{Name: h.queue, Exclusive: true}},
+		Bindings: []common.BindingSpec{
+			{Queue: h.queue, Key: common.NotificationCreatedKey, Exchange: common.UserExchange},
+			{Queue: h.queue, Key: common.BlogPublishedKey, Exchange: common.BlogExchange},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	msgs, err := h.mb.Consume(common.NotificationCreatedKey, common.UserExchange, h.queue)
+	if err != nil {
+		return err
+	}
+
+	// The events only matter to the streams that are open now, so they are never retried.
+	h.consumers.Consume(h.queue, msgs, func(msg common.Delivery) {
+		h.dispatch(msg)
+		msg.Ack()
+	})
+
+	return nil
+}
+
+// Ready returns an error when the hub is not consuming the events of the streams.
+func (h *Hub) Ready() error {
+	return h.consumers.Check()
+}
+
+// Close stops consuming and closes every stream.
+func (h *Hub) Close() {
+	h.consumers.Stop()
+	h.cancel()
+
+	h.mu.Lock()
+	var streams []*Stream
+	for _, byUser := range h.streams {
+		for s := range byUser {
+			streams = append(streams, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
+func (h *Hub) dispatch(msg common.Delivery) {
+	switch msg.RoutingKey {
+	case common.NotificationCreatedKey:
+		var event notificationservice.CreatedEvent
+		if err := json.Unmarshal(msg.Body, &event); err != nil {
+			h.logger.Error("could not read notification event", slog.String("error", err.Error()))
+			return
+		}
+
+		h.push(event.UserID, Event{Type: EventNotification, Data: event.Notification, notificationID: event.Notification.ID})
+
+	case common.BlogPublishedKey:
+		var event struct {
+			BlogID    int
+			UserID    int
+			Author    string
+			Title     string
+			CreatedAt time.Time
+		}
+		if err := json.Unmarshal(msg.Body, &event); err != nil {
+			h.logger.Error("could not read blog event", slog.String("error", err.Error()))
+			return
+		}
+
+		if !h.connected() {
+			return
+		}
+
+		followers, err := h.store.Followers(h.ctx, event.UserID)
+		if err != nil {
+			h.logger.Error("could not get followers", slog.Int("user_id", event.UserID), slog.String("error", err.Error()))
+			return
+		}
+
+		post := Post{ID: event.BlogID, UserID: event.UserID, Author: event.Author, Title: event.Title, CreatedAt: event.CreatedAt}
+		for _, id := range followers {
+			h.push(id, Event{Type: EventBlogPublished, Data: post, blogID: post.ID})
+		}
+	}
+}
+
+func (h *Hub) connected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.streams) > 0
+}
+
+// push hands the event to every stream of the user.
+func (h *Hub) push(userID int, e Event) {
+	h.mu.Lock()
+	streams := make([]*Stream, 0, len(h.streams[userID]))
+	for s := range h.streams[userID] {
+		streams = append(streams, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range streams {
+		s.push(e)
+	}
+}
+
+func (h *Hub) remove(s *Stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.streams[s.userID], s)
+	if len(h.streams[s.userID]) == 0 {
+		delete(h.streams, s.userID)
+	}
+}
+
+// Subscribe opens a stream for the user, and returns it with the events to send before the live ones. The stream resumes after lastEventID, the ID of the last event the client received, replaying what the user missed. Without a valid lastEventID the stream starts from now on.
+//
+// The stream is registered before the replay is read, so no event is lost in between, and the events that are both replayed and live are only sent once.
+func (h *Hub) Subscribe(ctx context.Context, userID int, lastEventID string) (*Stream, []Event, error) {
+	s := &Stream{
+		hub:     h,
+		userID:  userID,
+		logger:  common.Logger(ctx, h.logger),
+		pending: []Event{},
+		events:  make(chan Event, h.buffer),
+	}
+
+	h.mu.Lock()
+	if h.streams[userID] == nil {
+		h.streams[userID] = make(map[*Stream]struct{})
+	}
+	h.streams[userID][s] = struct{}{}
+	h.mu.Unlock()
+
+	replay, err := h.replay(ctx, s, lastEventID)
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	return s, replay, nil
+}
+
+// replay reads the events the user missed since the cursor and starts delivering the live events that came after them.
+func (h *Hub) replay(ctx context.Context, s *Stream, lastEventID string) ([]Event, error) {
+	cursor, err := ParseCursor(lastEventID)
+	if err != nil {
+		cursor, err = h.store.Latest(ctx, s.userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	notifications, err := h.store.NotificationsAfter(ctx, s.userID, cursor.Notification, ReplayLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	posts, err := h.store.PostsAfter(ctx, s.userID, cursor.Blog, ReplayLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	var missed []Event
+	for _, n := range notifications {
+		missed = append(missed, Event{Type: EventNotification, Data: n, notificationID: n.ID})
+	}
+	for _, p := range posts {
+		missed = append(missed, Event{Type: EventBlogPublished, Data: p, blogID: p.ID})
+	}
+	sort.SliceStable(missed, func(i, j int) bool { return createdAt(missed[i]).Before(createdAt(missed[j])) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursor = cursor
+	var events []Event
+	for _, e := range missed {
+		if s.advance(&e) {
+			events = append(events, e)
+		}
+	}
+
+	truncated := len(notifications) == ReplayLimit || len(posts) == ReplayLimit
+	events = append(events, Event{ID: s.cursor, Type: EventReady, Data: map[string]bool{"truncated": truncated}})
+
+	pending := s.pending
+	s.pending = nil
+	for _, e := range pending {
+		s.deliver(e)
+	}
+
+	return events, nil
+}
+
+func createdAt(e Event) time.Time {
+	switch data := e.Data.(type) {
+	case notificationservice.Notification:
+		return data.CreatedAt
+	case Post:
+		return data.CreatedAt
+	default:
+		return time.Time{}
+	}
+}
+
+// Events returns the live events of the stream. The channel is closed when the stream falls too far behind or the hub closes.
+func (s *Stream) Events() <-chan Event {
+	return s.events
+}
+
+// Close unregisters the stream from the hub.
+func (s *Stream) Close() {
+	s.hub.remove(s)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeLocked()
+}
+
+func (s *Stream) closeLocked() {
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+}
+
+func (s *Stream) push(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.pending != nil {
+		s.pending = append(s.pending, e)
+		return
+	}
+
+	s.deliver(e)
+}
+
+// deliver queues the event unless it was sent already. A stream that cannot keep up is closed rather than holding up the hub. The caller must hold mu.
+func (s *Stream) deliver(e Event) {
+	if !s.advance(&e) {
+		return
+	}
+
+	select {
+	case s.events <- e:
+	default:
+		s.logger.Info("closing a stream that fell behind", slog.Int("user_id", s.userID))
+		s.closeLocked()
+		// The hub lock cannot be taken while the stream is locked by a push, so the stream leaves the hub on its own.
+		go s.hub.remove(s)
+	}
+}
+
+// advance moves the cursor past the event and sets the ID of the event. It reports false for an event at or before the cursor. The caller must hold mu.
+func (s *Stream) advance(e *Event) bool {
+	switch {
+	case e.notificationID > 0:
+		if e.notificationID <= s.cursor.Notification {
+			return false
+		}
+		s.cursor.Notification = e.notificationID
+	case e.blogID > 0:
+		if e.blogID <= s.cursor.Blog {
+			return false
+		}
+		s.cursor.Blog = e.blogID
+	}
+
+	e.ID = s.cursor
+	return true
+}
+
+// String formats the cursor as an event ID.
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.Notification, c.Blog)
+}
+
+// ParseCursor parses the event ID of a stream.
+func ParseCursor(id string) (Cursor, error) {
+	notification, blog, ok := strings.Cut(id, "-")
+	if !ok {
+		return Cursor{}, fmt.Errorf("invalid event ID %q", id)
+	}
+
+	n, err := strconv.ParseInt(notification, 10, 64)
+	if err != nil || n < 0 {
+		return Cursor{}, fmt.Errorf("invalid event ID %q", id)
+	}
+
+	b, err := strconv.Atoi(blog)
+	if err != nil || b < 0 {
+		return Cursor{}, fmt.Errorf("invalid event ID %q", id)
+	}
+
+	return Cursor{Notification: n, Blog: b}, nil
+}
@@ -0,0 +1,224 @@
+package streamservice
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+)
+
+// fakeStore serves the notifications and posts of a single user.
+type fakeStore struct {
+	notifications []notificationservice.Notification
+	posts         []Post
+	followers     map[int][]int
+}
+
+func (s *fakeStore) Latest(ctx context.Context, userID int) (Cursor, error) {
+	var c Cursor
+	if len(s.notifications) > 0 {
+		c.Notification = s.notifications[len(s.notifications)-1].ID
+	}
+	if len(s.posts) > 0 {
+		c.Blog = s.posts[len(s.posts)-1].ID
+	}
+	return c, nil
+}
+
+func (s *fakeStore) NotificationsAfter(ctx context.Context, userID int, after int64, limit int) ([]notificationservice.Notification, error) {
+	var got []notificationservice.Notification
+	for _, n := range s.notifications {
+		if n.ID > after && len(got) < limit {
+			got = append(got, n)
+		}
+	}
+	return got, nil
+}
+
+func (s *fakeStore) PostsAfter(ctx context.Context, userID, after, limit int) ([]Post, error) {
+	var got []Post
+	for _, p := range s.posts {
+		if p.ID > after && len(got) < limit {
+			got = append(got, p)
+		}
+	}
+	return got, nil
+}
+
+func (s *fakeStore) Followers(ctx context.Context, authorID int) ([]int, error) {
+	return s.followers[authorID], nil
+}
+
+func newTestHub(t *testing.T, store Store, buffer int) (*Hub, *common.MemoryBroker) {
+	t.Helper()
+
+	mb := common.NewMemoryBroker()
+	assert.NoError(t, common.SetupUserExchange(mb))
+	assert.NoError(t, common.SetupBlogExchange(mb))
+
+	h, err := NewHub(mb, store, buffer, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		h.Close()
+		mb.Close()
+	})
+
+	return h, mb
+}
+
+func receive(t *testing.T, s *Stream) (Event, bool) {
+	t.Helper()
+
+	select {
+	case e, ok := <-s.Events():
+		return e, ok
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return Event{}, false
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	at := time.Now()
+	store := &fakeStore{
+		notifications: []notificationservice.Notification{
+			{ID: 1, Kind: notificationservice.KindNewFollower, CreatedAt: at},
+			{ID: 2, Kind: notificationservice.KindNewFollower, CreatedAt: at.Add(2 * time.Minute)},
+		},
+		posts: []Post{
+			{ID: 10, Title: "First", CreatedAt: at.Add(time.Minute)},
+			{ID: 11, Title: "Second", CreatedAt: at.Add(3 * time.Minute)},
+		},
+	}
+	h, _ := newTestHub(t, store, DefaultBuffer)
+	ctx := context.Background()
+
+	t.Run("new stream", func(t *testing.T) {
+		s, events, err := h.Subscribe(ctx, 1, "")
+		assert.NoError(t, err)
+		defer s.Close()
+
+		if !assert.Len(t, events, 1) {
+			return
+		}
+		assert.Equal(t, EventReady, events[0].Type)
+		assert.Equal(t, Cursor{Notification: 2, Blog: 11}, events[0].ID)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		s, events, err := h.Subscribe(ctx, 1, "1-0")
+		assert.NoError(t, err)
+		defer s.Close()
+
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.Type+" "+e.ID.String())
+		}
+		assert.Equal(t, []string{
+			"blog.published 1-10",
+			"notification 2-10",
+			"blog.published 2-11",
+			"ready 2-11",
+		}, ids)
+	})
+
+	t.Run("invalid event ID", func(t *testing.T) {
+		s, events, err := h.Subscribe(ctx, 1, "bogus")
+		assert.NoError(t, err)
+		defer s.Close()
+
+		assert.Len(t, events, 1)
+	})
+}
+
+func TestHubDispatch(t *testing.T) {
+	store := &fakeStore{followers: map[int][]int{7: {1, 2}}}
+	h, mb := newTestHub(t, store, DefaultBuffer)
+	ctx := context.Background()
+	assert.NoError(t, h.Start())
+
+	s, _, err := h.Subscribe(ctx, 1, "")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	publish := func(key common.BindingKey, exchange common.Exchange, event any) {
+		body, err := json.Marshal(event)
+		assert.NoError(t, err)
+		assert.NoError(t, mb.Publish(ctx, body, key, exchange))
+	}
+
+	publish(common.NotificationCreatedKey, common.UserExchange, notificationservice.CreatedEvent{UserID: 2, Notification: notificationservice.Notification{ID: 4}})
+	publish(common.NotificationCreatedKey, common.UserExchange, notificationservice.CreatedEvent{UserID: 1, Notification: notificationservice.Notification{ID: 5}})
+	// A notification the stream has seen already is not sent again.
+	publish(common.NotificationCreatedKey, common.UserExchange, notificationservice.CreatedEvent{UserID: 1, Notification: notificationservice.Notification{ID: 5}})
+	publish(common.BlogPublishedKey, common.BlogExchange, map[string]any{"BlogID": 20, "UserID": 8, "Author": "stranger", "Title": "Not followed"})
+	publish(common.BlogPublishedKey, common.BlogExchange, map[string]any{"BlogID": 21, "UserID": 7, "Author": "writer", "Title": "Followed"})
+
+	e, ok := receive(t, s)
+	assert.True(t, ok)
+	assert.Equal(t, EventNotification, e.Type)
+	assert.Equal(t, Cursor{Notification: 5}, e.ID)
+
+	e, ok = receive(t, s)
+	assert.True(t, ok)
+	assert.Equal(t, EventBlogPublished, e.Type)
+	assert.Equal(t, Cursor{Notification: 5, Blog: 21}, e.ID)
+	assert.Equal(t, "Followed", e.Data.(Post).Title)
+
+	select {
+	case e := <-s.Events():
+		t.Fatalf("unexpected event %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStreamFallsBehind(t *testing.T) {
+	h, _ := newTestHub(t, &fakeStore{}, 1)
+
+	s, _, err := h.Subscribe(context.Background(), 1, "")
+	assert.NoError(t, err)
+
+	h.push(1, Event{Type: EventNotification, notificationID: 1})
+	h.push(1, Event{Type: EventNotification, notificationID: 2})
+
+	_, ok := receive(t, s)
+	assert.True(t, ok)
+	_, ok = receive(t, s)
+	assert.False(t, ok, "the stream is closed")
+
+	assert.Eventually(t, func() bool { return !h.connected() }, time.Second, 10*time.Millisecond)
+	s.Close()
+}
+
+func TestHubClose(t *testing.T) {
+	h, _ := newTestHub(t, &fakeStore{}, DefaultBuffer)
+
+	s, _, err := h.Subscribe(context.Background(), 1, "")
+	assert.NoError(t, err)
+
+	h.Close()
+
+	_, ok := receive(t, s)
+	assert.False(t, ok)
+	assert.False(t, h.connected())
+}
+
+func TestParseCursor(t *testing.T) {
+	c, err := ParseCursor(Cursor{Notification: 12, Blog: 340}.String())
+	assert.NoError(t, err)
+	assert.Equal(t, Cursor{Notification: 12, Blog: 340}, c)
+
+	for _, id := range []string{"", "12", "a-1", "1-b", "-1-2", "1--2"} {
+		_, err := ParseCursor(id)
+		assert.Error(t, err, id)
+	}
+
+	assert.Equal(t, "0-0", Cursor{}.String())
+}
@@ -0,0 +1,118 @@
+package streamservice
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+)
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Latest(ctx context.Context, userID int) (Cursor, error) {
+	query := `
+		SELECT
+			(SELECT COALESCE(MAX(id), 0) FROM notifications WHERE user_id = $1),
+			(SELECT COALESCE(MAX(id), 0) FROM blogs)`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var c Cursor
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&c.Notification, &c.Blog)
+
+	return c, err
+}
+
+func (s *PostgresStore) NotificationsAfter(ctx context.Context, userID int, after int64, limit int) ([]notificationservice.Notification, error) {
+	query := `
+		SELECT id, user_id, kind, data, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, userID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []notificationservice.Notification
+	for rows.Next() {
+		var n notificationservice.Notification
+		var data []byte
+		err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &data, &n.ReadAt, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		n.Data = data
+		notifications = append(notifications, n)
+	}
+
+	return notifications, rows.Err()
+}
+
+func (s *PostgresStore) PostsAfter(ctx context.Context, userID, after, limit int) ([]Post, error) {
+	query := `
+		SELECT b.id, b.user_id, u.username, b.title, b.created_at
+		FROM blogs b
+		INNER JOIN follows f ON f.author_id = b.user_id
+		INNER JOIN users u ON u.id = b.user_id
+		WHERE f.follower_id = $1 AND b.id > $2
+		ORDER BY b.id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, userID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Author, &p.Title, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+
+	return posts, rows.Err()
+}
+
+func (s *PostgresStore) Followers(ctx context.Context, authorID int) ([]int, error) {
+	query := `
+		SELECT follower_id
+		FROM follows
+		WHERE author_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, authorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var followers []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		followers = append(followers, id)
+	}
+
+	return followers, rows.Err()
+}
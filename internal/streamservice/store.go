@@ -0,0 +1,19 @@
+package streamservice
+
+import (
+	"context"
+
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+)
+
+// Store reads what a stream replays when it resumes, from the notifications of the notification service and the posts and follows of the blog and user services.
+type Store interface {
+	// Latest returns the cursor of a new stream of the user: its newest notification and the newest blog post.
+	Latest(ctx context.Context, userID int) (Cursor, error)
+	// NotificationsAfter returns up to limit notifications of the user with an ID above after, oldest first.
+	NotificationsAfter(ctx context.Context, userID int, after int64, limit int) ([]notificationservice.Notification, error)
+	// PostsAfter returns up to limit posts with an ID above after of the authors the user follows, oldest first.
+	PostsAfter(ctx context.Context, userID, after, limit int) ([]Post, error)
+	// Followers returns the IDs of the users that follow the author.
+	Followers(ctx context.Context, authorID int) ([]int, error)
+}
@@ -0,0 +1,107 @@
+package streamservice
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/blogservice"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/notificationservice"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func TestPostgresStore(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+	ctx := context.Background()
+
+	users := userservice.NewPostgresStore(db)
+	blogs := blogservice.NewPostgresStore(db)
+	notifications := notificationservice.NewPostgresStore(db)
+	s := NewPostgresStore(db)
+
+	insertUser := func(t *testing.T, username string) int {
+		u := userservice.User{Username: username, Email: username + "@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &u))
+		return u.ID
+	}
+
+	reader := insertUser(t, "reader")
+	writer := insertUser(t, "writer")
+	other := insertUser(t, "other")
+	_, err := users.Follow(ctx, reader, writer)
+	assert.NoError(t, err)
+
+	insertBlog := func(t *testing.T, title string, userID int) int {
+		b := blogservice.Blog{Title: title, Content: "This is a test blog.", UserID: userID}
+		assert.NoError(t, blogs.InsertBlog(ctx, &b))
+		return b.ID
+	}
+
+	insertNotification := func(t *testing.T, userID int, key string) int64 {
+		n := notificationservice.Notification{UserID: userID, Kind: notificationservice.KindNewFollower, Data: json.RawMessage(`{}`), EventKey: key}
+		assert.NoError(t, notifications.InsertNotification(ctx, &n))
+		return n.ID
+	}
+
+	first := insertBlog(t, "First", writer)
+	insertNotification(t, reader, "first")
+
+	latest, err := s.Latest(ctx, reader)
+	assert.NoError(t, err)
+	assert.Equal(t, first, latest.Blog)
+
+	second := insertBlog(t, "Second", writer)
+	insertBlog(t, "Not followed", other)
+	third := insertBlog(t, "Third", writer)
+	n1 := insertNotification(t, reader, "second")
+	insertNotification(t, other, "other")
+	n2 := insertNotification(t, reader, "third")
+
+	t.Run("latest", func(t *testing.T) {
+		c, err := s.Latest(ctx, reader)
+		assert.NoError(t, err)
+		assert.Equal(t, n2, c.Notification)
+		assert.Equal(t, third, c.Blog)
+
+		c, err = s.Latest(ctx, 9999)
+		assert.NoError(t, err)
+		assert.Zero(t, c.Notification)
+	})
+
+	t.Run("notifications after", func(t *testing.T) {
+		got, err := s.NotificationsAfter(ctx, reader, latest.Notification, 10)
+		assert.NoError(t, err)
+		if !assert.Len(t, got, 2) {
+			return
+		}
+		assert.Equal(t, n1, got[0].ID)
+		assert.Equal(t, n2, got[1].ID)
+
+		got, err = s.NotificationsAfter(ctx, reader, latest.Notification, 1)
+		assert.NoError(t, err)
+		assert.Len(t, got, 1)
+	})
+
+	t.Run("posts after", func(t *testing.T) {
+		got, err := s.PostsAfter(ctx, reader, latest.Blog, 10)
+		assert.NoError(t, err)
+		if !assert.Len(t, got, 2) {
+			return
+		}
+		assert.Equal(t, second, got[0].ID)
+		assert.Equal(t, third, got[1].ID)
+		assert.Equal(t, "writer", got[0].Author)
+	})
+
+	t.Run("followers", func(t *testing.T) {
+		followers, err := s.Followers(ctx, writer)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{reader}, followers)
+
+		followers, err = s.Followers(ctx, other)
+		assert.NoError(t, err)
+		assert.Empty(t, followers)
+	})
+}
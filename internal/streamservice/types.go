@@ -0,0 +1,93 @@
+package streamservice
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+const (
+	// EventReady is sent once the events the client missed have been replayed. It carries the cursor the stream resumes from.
+	EventReady = "ready"
+	// EventNotification carries a new notification of the user.
+	EventNotification = "notification"
+	// EventBlogPublished carries a new post of an author the user follows.
+	EventBlogPublished = "blog.published"
+)
+
+// Event is a message of a stream.
+type Event struct {
+	// ID is the cursor of the stream once the event is received. The client sends it back as Last-Event-ID to resume after the event.
+	ID   Cursor
+	Type string
+	Data any
+
+	// notificationID and blogID are the position of the event in the notifications or the blog posts.
+	notificationID int64
+	blogID         int
+}
+
+// Cursor is a position in the stream of a user: the last notification and the last blog post the user has been sent.
+type Cursor struct {
+	Notification int64
+	Blog         int
+}
+
+// Post is a blog post as a blog.published event describes it.
+type Post struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Author    string    `json:"author"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Hub receives the new notifications and blog posts from the broker and pushes them to the streams of the users connected to this replica. Every replica has an exclusive queue bound to the events, so each one receives all of them.
+type Hub struct {
+	mb    MessageBroker
+	store Store
+	// queue is the exclusive queue of the replica.
+	queue  common.Queue
+	logger *slog.Logger
+	// buffer is the number of events a stream can fall behind before it is closed.
+	buffer int
+
+	mu      sync.Mutex
+	streams map[int]map[*Stream]struct{}
+
+	// consumers runs the consumer of the queue of the replica.
+	consumers common.ConsumerGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Stream is the connection of a user to the hub.
+type Stream struct {
+	hub    *Hub
+	userID int
+	// logger is the logger of the request that opened the stream.
+	logger *slog.Logger
+
+	// mu guards the cursor and the live events that arrive before the replay is done.
+	mu     sync.Mutex
+	cursor Cursor
+	// pending holds the live events until the replay is done, nil once it is.
+	pending []Event
+	events  chan Event
+	closed  bool
+}
+
+// MessageBroker declares the exclusive queue of the replica and consumes it.
+type MessageBroker interface {
+	common.MessageConsumer
+	Declare(t common.Topology) error
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
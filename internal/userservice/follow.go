@@ -0,0 +1,90 @@
+package userservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func (s *PostgresStore) Follow(ctx context.Context, followerID, authorID int) (bool, error) {
+	query := `
+		INSERT INTO follows (follower_id, author_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.q.ExecContext(ctx, query, followerID, authorID)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Code == "23503" && pqErr.Constraint == "follows_author_id_fkey":
+			return false, common.ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (s *PostgresStore) Unfollow(ctx context.Context, followerID, authorID int) error {
+	query := `
+		DELETE FROM follows
+		WHERE follower_id = $1 AND author_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.q.ExecContext(ctx, query, followerID, authorID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return common.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetFollowedAuthors(ctx context.Context, followerID int) ([]int, error) {
+	query := `
+		SELECT author_id
+		FROM follows
+		WHERE follower_id = $1
+		ORDER BY author_id`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, followerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authors := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		authors = append(authors, id)
+	}
+
+	return authors, rows.Err()
+}
@@ -2,7 +2,6 @@ package userservice
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,23 +12,34 @@ import (
 
 var (
 	ErrAuthenticationFailure = fmt.Errorf("unauthorized access")
+	ErrAccountSuspended      = fmt.Errorf("account suspended")
 )
 
-func NewUserService(db *sql.DB, mb *common.MessageBroker, c *common.Cache) *UserService {
+// NewUserService creates the user service. authCacheTTL bounds how long an access token lookup is served from the cache, DefaultAuthCacheTTL is used when it is not positive.
+func NewUserService(store Store, c common.Cache, authCacheTTL time.Duration) *UserService {
+	if authCacheTTL <= 0 {
+		authCacheTTL = DefaultAuthCacheTTL
+	}
+
 	return &UserService{
-		m:  newUserModel(db),
-		mb: mb,
-		c:  c,
+		store:        store,
+		c:            c,
+		authCacheTTL: authCacheTTL,
 	}
 }
 
-// CreateUser creates a new user account and publish an user.created event.
-func (s *UserService) CreateUser(ctx context.Context, username, email, password string) (*string, error) {
+// CreateUser creates a new user account and publish an user.created event. The locale selects the language of the emails sent to the user, DefaultLocale is used when it is empty.
+func (s *UserService) CreateUser(ctx context.Context, username, email, password, locale string) (*string, error) {
+	if locale == "" {
+		locale = DefaultLocale
+	}
+
 	// Perform validation
 	v := common.NewValidator()
 	validateUsername(v, username)
 	validateEmail(v, email)
 	validatePassword(v, password)
+	validateLocale(v, locale)
 	if !v.Valid() {
 		return nil, v.ValidationError()
 	}
@@ -38,6 +48,7 @@ func (s *UserService) CreateUser(ctx context.Context, username, email, password
 		Username: username,
 		Email:    email,
 		Password: Password{Plain: password},
+		Locale:   locale,
 	}
 
 	// Set the password hash
@@ -46,33 +57,40 @@ func (s *UserService) CreateUser(ctx context.Context, username, email, password
 		return nil, err
 	}
 
-	// Insert the user into the database
-	err = s.m.insertUser(&u)
-	if err != nil {
-		return nil, err
-	}
+	var token *Token
+	err = s.store.WithTx(ctx, func(tx Tx) error {
+		// Insert the user into the database
+		err := tx.InsertUser(ctx, &u)
+		if err != nil {
+			return err
+		}
 
-	// create the token
-	token, err := s.m.createToken(u.ID, ActivationTokenTime, TokenScopeActivate)
-	if err != nil {
-		return nil, err
-	}
+		// create the token
+		token, err = createToken(ctx, tx, u.ID, ActivationTokenTime, TokenScopeActivate)
+		if err != nil {
+			return err
+		}
 
-	data := struct {
-		Email string
-		Token string
-	}{
-		Email: u.Email,
-		Token: token.Plain,
-	}
+		data := struct {
+			Email    string
+			Token    string
+			Username string
+			Locale   string
+		}{
+			Email:    u.Email,
+			Token:    token.Plain,
+			Username: u.Username,
+			Locale:   u.Locale,
+		}
 
-	emailData, err := json.Marshal(data)
-	if err != nil {
-		return nil, err
-	}
+		emailData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
 
-	// Publish the user created event
-	err = s.mb.Publish(ctx, emailData, common.UserCreatedKey, common.UserExchange)
+		// Queue the user created event, it is published by the outbox relay once the user is stored
+		return tx.EnqueueOutbox(ctx, common.UserExchange, common.UserCreatedKey, emailData)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -92,42 +110,169 @@ func (s *UserService) ActivateUser(ctx context.Context, token string) error {
 	// Hash the token
 	hash := hashToken(token)
 
-	user, err := s.m.getUser(TokenScopeActivate, hash)
+	user, err := s.store.GetUserByToken(ctx, TokenScopeActivate, hash)
 	if err != nil {
 		return err
 	}
 
-	tx, err := s.m.db.BeginTx(ctx, nil)
+	return s.activate(ctx, user, true)
+}
+
+// ActivateUserByID activates the user account without the activation token, for the operators. The activation token of the user, if any, can no longer be used.
+func (s *UserService) ActivateUserByID(ctx context.Context, userId int) error {
+	v := common.NewValidator()
+	validateInt(v, userId, "user_id")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	user, err := s.store.GetUserByID(ctx, userId)
 	if err != nil {
 		return err
 	}
+	if user.Activated {
+		return nil
+	}
+
+	return s.activate(ctx, user, false)
+}
+
+// activate activates the user account, deletes the activation token and adds permission for the user to perform write operation. The token must exist when tokenUsed is set.
+func (s *UserService) activate(ctx context.Context, user *User, tokenUsed bool) error {
+	return s.store.WithTx(ctx, func(tx Tx) error {
+		// activate the user account
+		err := tx.ActivateUser(ctx, user.ID, user.Version)
+		if err != nil {
+			return err
+		}
 
-	// activate the user account
-	err = s.m.activateUserAccount(tx, user.ID, user.Version)
+		// delete the token
+		err = tx.DeleteToken(ctx, user.ID, TokenScopeActivate)
+		if err != nil && (tokenUsed || !errors.Is(err, common.ErrRecordNotFound)) {
+			return err
+		}
+
+		// add the blog:write permission
+		return tx.AddPermissions(ctx, user.ID, PermissionWriteBlog)
+	})
+}
+
+// GetUserByUsername returns the user with the username, for the operators.
+func (s *UserService) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	v := common.NewValidator()
+	v.Check(username != "", "username", "must be provided")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	u, err := s.store.GetUserByUsername(ctx, username)
 	if err != nil {
-		_ = tx.Rollback()
-		return err
+		return nil, err
+	}
+
+	// The lookup by username is made for the login, the lookup by ID returns the whole account.
+	return s.store.GetUserByID(ctx, u.ID)
+}
+
+// CheckActivationToken reports whether the activation token can still be used, without using it. It returns common.ErrRecordNotFound when the token has expired or was already used.
+func (s *UserService) CheckActivationToken(ctx context.Context, token string) error {
+	v := common.NewValidator()
+	ValidateToken(v, token)
+	if !v.Valid() {
+		return v.ValidationError()
 	}
 
-	// delete the token
-	err = s.m.deleteToken(tx, user.ID, TokenScopeActivate)
+	_, err := s.store.GetUserByToken(ctx, TokenScopeActivate, hashToken(token))
+	return err
+}
+
+// RequestPasswordReset sends a password reset email to the user with the email address, by publishing an user.password_reset event. Nothing is sent when there is no such user, or when the user is suspended, and no error is returned either so the response does not tell whether the address has an account.
+func (s *UserService) RequestPasswordReset(ctx context.Context, email string) error {
+	v := common.NewValidator()
+	validateEmail(v, email)
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	user, err := s.store.GetUserByEmail(ctx, email)
 	if err != nil {
-		_ = tx.Rollback()
-		return err
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	if user.Suspended {
+		return nil
 	}
 
-	// add the blog:write permission
-	err = s.m.addUserPermission(tx, ctx, user.ID, PermissionWriteBlog)
+	return s.store.WithTx(ctx, func(tx Tx) error {
+		// A new request replaces the token of the previous one.
+		err := tx.DeleteToken(ctx, user.ID, TokenScopePasswordReset)
+		if err != nil && !errors.Is(err, common.ErrRecordNotFound) {
+			return err
+		}
+
+		token, err := createToken(ctx, tx, user.ID, PasswordResetTokenTime, TokenScopePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		data := struct {
+			Email    string
+			Token    string
+			Username string
+			Locale   string
+		}{
+			Email:    user.Email,
+			Token:    token.Plain,
+			Username: user.Username,
+			Locale:   user.Locale,
+		}
+
+		emailData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		return tx.EnqueueOutbox(ctx, common.UserExchange, common.UserPasswordResetKey, emailData)
+	})
+}
+
+// ResetPassword sets a new password for the user holding the password reset token. The token can only be used once, and every session of the user is revoked.
+func (s *UserService) ResetPassword(ctx context.Context, token, password string) error {
+	v := common.NewValidator()
+	ValidateToken(v, token)
+	validatePassword(v, password)
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	user, err := s.store.GetUserByToken(ctx, TokenScopePasswordReset, hashToken(token))
 	if err != nil {
-		_ = tx.Rollback
 		return err
 	}
 
-	if err := tx.Commit(); err != nil {
+	pwd := Password{Plain: password}
+	if err := pwd.set(password); err != nil {
 		return err
 	}
 
-	return nil
+	err = s.store.WithTx(ctx, func(tx Tx) error {
+		err := tx.UpdateUserPassword(ctx, pwd, user.ID, user.Version)
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteToken(ctx, user.ID, TokenScopePasswordReset)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.RevokeSessions(ctx, user.ID)
 }
 
 // LoginUser logs in a user and returns the access token and refresh token.
@@ -141,7 +286,7 @@ func (s *UserService) LoginUser(ctx context.Context, username, password string)
 	}
 
 	// Get the user from the database
-	user, err := s.m.getUserByUsername(username)
+	user, err := s.store.GetUserByUsername(ctx, username)
 	if err != nil {
 		switch {
 		case errors.Is(err, common.ErrRecordNotFound):
@@ -159,20 +304,22 @@ func (s *UserService) LoginUser(ctx context.Context, username, password string)
 
 	if !ok {
 		return nil, ErrAuthenticationFailure
+	} else if user.Suspended {
+		return nil, ErrAccountSuspended
 	} else {
 		// rehash the password and update the user
 		if err := user.Password.set(password); err != nil {
 			return nil, err
 		}
 
-		if err := s.m.updateUserPassword(user.Password, user.ID, user.Version); err != nil {
+		if err := s.store.UpdateUserPassword(ctx, user.Password, user.ID, user.Version); err != nil {
 			return nil, err
 		}
 	}
 
 	// get the token from the database
-	dbToken, err := s.m.getAuthToken(user.ID)
-	if err != nil {
+	dbToken, err := s.store.GetAuthToken(ctx, user.ID)
+	if err != nil && !errors.Is(err, common.ErrRecordNotFound) {
 		return nil, err
 	}
 
@@ -181,66 +328,49 @@ func (s *UserService) LoginUser(ctx context.Context, username, password string)
 		if dbToken.AccessTokenExpiry.After(time.Now()) && dbToken.RefreshTokenExpiry.After(time.Now()) {
 			return dbToken, nil
 		} else {
-			tx, err := s.m.db.BeginTx(ctx, nil)
+			var hashes [][]byte
+			var authToken *AuthToken
+			err := s.store.WithTx(ctx, func(tx Tx) error {
+				// delete the token
+				var err error
+				hashes, err = tx.DeleteAuthTokens(ctx, user.ID)
+				if err != nil {
+					return err
+				}
+
+				authToken, err = createAuthToken(ctx, tx, user.ID)
+				return err
+			})
 			if err != nil {
 				return nil, err
 			}
 
-			// delete the token
-			err = s.m.deleteAuthToken(tx, user.ID)
-			if err != nil {
-				_ = tx.Rollback()
-				return nil, err
-			}
-
-			authToken, err := s.m.createAuthToken(tx, user.ID)
-			if err != nil {
-				_ = tx.Rollback()
-				return nil, err
-			}
-
-			if err := tx.Commit(); err != nil {
-				return nil, err
-			}
+			s.evictSessions(hashes)
 
 			return authToken, nil
 		}
 	}
 
-	tx, err := s.m.db.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	authToken, err := s.m.createAuthToken(tx, user.ID)
-	if err != nil {
-		_ = tx.Rollback()
-		return nil, err
-	}
-
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-
-	return authToken, nil
+	return createAuthToken(ctx, s.store, user.ID)
 }
 
-func (s *UserService) getUserByAccessToken(token string) (*User, error) {
+func (s *UserService) getUserByAccessToken(ctx context.Context, token string) (*User, error) {
 	hash := hashToken(token)
 
 	// get the user from the cache
-	if user, ok := s.c.Get(common.CacheKeyUserByAccessToken(hash)); ok {
-		return user.(*User), nil
+	var cached User
+	if common.TracedGet(ctx, s.c, common.CacheKeyUserByAccessToken(hash), &cached) {
+		return &cached, nil
 	}
 
 	// get the user from the database
-	user, err := s.m.getToken(hash)
+	user, err := s.store.GetUserByAccessToken(ctx, hash)
 	if err != nil {
 		return nil, err
 	}
 
-	// store the user in the cache
-	s.c.Set(common.CacheKeyUserByAccessToken(hash), user, AccessTokenTime)
+	// store the user in the cache, but only for as long as a revocation that misses the entry may be tolerated
+	s.c.Set(common.CacheKeyUserByAccessToken(hash), user, s.authCacheTTL)
 
 	return user, nil
 }
@@ -254,9 +384,10 @@ func (s *UserService) GetUserByAccessToken(ctx context.Context, token string) (*
 		return nil, v.ValidationError()
 	}
 
-	return s.getUserByAccessToken(token)
+	return s.getUserByAccessToken(ctx, token)
 }
 
+// LogoutUser deletes the authentication tokens of the user and evicts them from the cache so they are rejected straight away.
 func (s *UserService) LogoutUser(ctx context.Context, userId int) error {
 	// hash the token
 	v := common.NewValidator()
@@ -265,24 +396,304 @@ func (s *UserService) LogoutUser(ctx context.Context, userId int) error {
 		return v.ValidationError()
 	}
 
-	tx, err := s.m.db.BeginTx(ctx, nil)
+	hashes, err := s.store.DeleteAuthTokens(ctx, userId)
 	if err != nil {
 		return err
 	}
 
-	err = s.m.deleteAuthToken(tx, userId)
+	s.evictSessions(hashes)
+
+	return nil
+}
+
+// RevokeSessions logs the user out of every session.
+func (s *UserService) RevokeSessions(ctx context.Context, userId int) error {
+	err := s.LogoutUser(ctx, userId)
+	if err != nil && !errors.Is(err, common.ErrRecordNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// GrantPermission adds the permissions to the user. Cached sessions of the user are evicted so the change applies to the next request.
+func (s *UserService) GrantPermission(ctx context.Context, userId int, permissions ...Permission) error {
+	return s.changePermission(ctx, userId, permissions, func(tx Tx) error {
+		return tx.AddPermissions(ctx, userId, permissions...)
+	})
+}
+
+// RevokePermission removes the permissions from the user. Cached sessions of the user are evicted so the change applies to the next request.
+func (s *UserService) RevokePermission(ctx context.Context, userId int, permissions ...Permission) error {
+	return s.changePermission(ctx, userId, permissions, func(tx Tx) error {
+		return tx.RemovePermissions(ctx, userId, permissions...)
+	})
+}
+
+func (s *UserService) changePermission(ctx context.Context, userId int, permissions []Permission, change func(tx Tx) error) error {
+	v := common.NewValidator()
+	validateInt(v, userId, "user_id")
+	v.Check(len(permissions) > 0, "permissions", "must be provided")
+	for _, p := range permissions {
+		validatePermission(v, p)
+	}
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	err := s.store.WithTx(ctx, change)
 	if err != nil {
-		_ = tx.Rollback
 		return err
 	}
 
-	if err := tx.Commit(); err != nil {
+	return s.refreshSessions(ctx, userId)
+}
+
+// SuspendUser suspends the user account and revokes every session of the user.
+func (s *UserService) SuspendUser(ctx context.Context, userId int) error {
+	v := common.NewValidator()
+	validateInt(v, userId, "user_id")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	// Suspended users are rejected by the token lookup, so evicting the cache is enough to lock them out even if the tokens could not be deleted.
+	err := s.setUserSuspended(ctx, userId, true)
+	if err != nil {
+		return err
+	}
+
+	if err := s.refreshSessions(ctx, userId); err != nil {
 		return err
 	}
 
+	return s.RevokeSessions(ctx, userId)
+}
+
+// ReinstateUser lifts the suspension of the user account. The user has to log in again.
+func (s *UserService) ReinstateUser(ctx context.Context, userId int) error {
+	v := common.NewValidator()
+	validateInt(v, userId, "user_id")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	return s.setUserSuspended(ctx, userId, false)
+}
+
+// setUserSuspended suspends or reinstates the user and queues the user.suspended or user.reinstated event, which the user sees as a notification.
+func (s *UserService) setUserSuspended(ctx context.Context, userId int, suspended bool) error {
+	return s.store.WithTx(ctx, func(tx Tx) error {
+		err := tx.SetUserSuspended(ctx, userId, suspended)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(struct {
+			UserID int
+			At     time.Time
+		}{
+			UserID: userId,
+			At:     time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		key := common.UserReinstatedKey
+		if suspended {
+			key = common.UserSuspendedKey
+		}
+
+		return tx.EnqueueOutbox(ctx, common.UserExchange, key, data)
+	})
+}
+
+// GetNotificationPreferences returns the notification emails the user wants to receive.
+func (s *UserService) GetNotificationPreferences(ctx context.Context, userId int) (*NotificationPreferences, error) {
+	v := common.NewValidator()
+	validateInt(v, userId, "user_id")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	return s.store.GetNotificationPreferences(ctx, userId)
+}
+
+// UpdateNotificationPreferences changes the preferences that are set in the update and keeps the others.
+func (s *UserService) UpdateNotificationPreferences(ctx context.Context, userId int, update NotificationPreferencesUpdate) (*NotificationPreferences, error) {
+	v := common.NewValidator()
+	validateInt(v, userId, "user_id")
+	if update.Frequency != nil {
+		validateFrequency(v, *update.Frequency)
+	}
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	var p *NotificationPreferences
+	err := s.store.WithTx(ctx, func(tx Tx) (err error) {
+		p, err = tx.GetNotificationPreferences(ctx, userId)
+		if err != nil {
+			return err
+		}
+
+		if update.Comments != nil {
+			p.Comments = *update.Comments
+		}
+		if update.NewPosts != nil {
+			p.NewPosts = *update.NewPosts
+		}
+		if update.Frequency != nil {
+			p.Frequency = *update.Frequency
+		}
+
+		return tx.UpdateNotificationPreferences(ctx, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Unsubscribe stops the notification emails of the kind, as the unsubscribe link in those emails does. Unsubscribing from the digest turns every notification email off, since the digest is how the user receives them.
+func (s *UserService) Unsubscribe(ctx context.Context, userId int, kind string) error {
+	var update NotificationPreferencesUpdate
+	off := false
+
+	switch kind {
+	case NotificationComments:
+		update.Comments = &off
+	case NotificationNewPosts:
+		update.NewPosts = &off
+	case NotificationDigest:
+		frequency := FrequencyOff
+		update.Frequency = &frequency
+	default:
+		v := common.NewValidator()
+		v.AddError("kind", "unknown notification kind")
+		return v.ValidationError()
+	}
+
+	_, err := s.UpdateNotificationPreferences(ctx, userId, update)
+	return err
+}
+
+// WantsEmail reports whether the user wants to receive the notification emails of the kind. Suspended users and users that no longer exist receive none.
+func (s *UserService) WantsEmail(ctx context.Context, userId int, kind string) (bool, error) {
+	u, err := s.store.GetUserByID(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, common.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	if u.Suspended {
+		return false, nil
+	}
+
+	p, err := s.store.GetNotificationPreferences(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+
+	switch kind {
+	case NotificationDigest:
+		return p.Frequency == FrequencyDaily || p.Frequency == FrequencyWeekly, nil
+	case NotificationComments:
+		return p.Frequency == FrequencyInstant && p.Comments, nil
+	case NotificationNewPosts:
+		return p.Frequency == FrequencyInstant && p.NewPosts, nil
+	default:
+		return false, fmt.Errorf("unknown notification kind %q", kind)
+	}
+}
+
+// FollowUser makes the follower follow the author, whose new posts then appear in the digest emails of the follower. It returns common.ErrRecordNotFound when the author does not exist.
+func (s *UserService) FollowUser(ctx context.Context, followerId, authorId int) error {
+	v := common.NewValidator()
+	validateInt(v, followerId, "follower_id")
+	validateInt(v, authorId, "user_id")
+	v.Check(followerId != authorId, "user_id", "cannot follow yourself")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	return s.store.WithTx(ctx, func(tx Tx) error {
+		created, err := tx.Follow(ctx, followerId, authorId)
+		if err != nil || !created {
+			return err
+		}
+
+		follower, err := tx.GetUserByID(ctx, followerId)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(struct {
+			UserID           int
+			FollowerID       int
+			FollowerUsername string
+			At               time.Time
+		}{
+			UserID:           authorId,
+			FollowerID:       follower.ID,
+			FollowerUsername: follower.Username,
+			At:               time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		// Queue the user followed event for the notification of the author. Following an author again does not notify the author twice.
+		return tx.EnqueueOutbox(ctx, common.UserExchange, common.UserFollowedKey, data)
+	})
+}
+
+// UnfollowUser returns common.ErrRecordNotFound when the follower does not follow the author.
+func (s *UserService) UnfollowUser(ctx context.Context, followerId, authorId int) error {
+	v := common.NewValidator()
+	validateInt(v, followerId, "follower_id")
+	validateInt(v, authorId, "user_id")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	return s.store.Unfollow(ctx, followerId, authorId)
+}
+
+// GetFollowedAuthors returns the IDs of the authors the user follows.
+func (s *UserService) GetFollowedAuthors(ctx context.Context, followerId int) ([]int, error) {
+	v := common.NewValidator()
+	validateInt(v, followerId, "follower_id")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	return s.store.GetFollowedAuthors(ctx, followerId)
+}
+
+// refreshSessions evicts the cached sessions of the user so the next request reloads them from the database.
+func (s *UserService) refreshSessions(ctx context.Context, userId int) error {
+	hashes, err := s.store.GetAccessTokenHashes(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	s.evictSessions(hashes)
+
 	return nil
 }
 
+func (s *UserService) evictSessions(hashes [][]byte) {
+	for _, hash := range hashes {
+		s.c.Delete(common.CacheKeyUserByAccessToken(hash))
+	}
+}
+
 func (u *User) IsAnonymous() bool {
 	return u == &AnonymousUser
 }
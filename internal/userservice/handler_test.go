@@ -3,7 +3,7 @@ package userservice
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -27,20 +27,15 @@ func testUser() User {
 
 func setupTestEnvironment(t *testing.T) (*UserService, *sql.DB, func() error, error) {
 	db := common.TestDB("file://../../migrations", t)
-	connURL := common.TestRabbitMQ(t)
-	mb, err := common.NewMessageBroker(connURL)
-	cache := common.NewCache(5*time.Minute, 10*time.Minute)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("could not create message broker: %w", err)
-	}
-
-	err = common.SetupUserExchange(mb)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("could not setup user exchange: %w", err)
-	}
+	cache := common.NewMemoryCache(5*time.Minute, 10*time.Minute)
 
 	cleanup := func() error {
-		_, err := db.Exec("DELETE FROM user_permissions")
+		_, err := db.Exec("DELETE FROM outbox")
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec("DELETE FROM user_permissions")
 		if err != nil {
 			return err
 		}
@@ -65,7 +60,7 @@ func setupTestEnvironment(t *testing.T) (*UserService, *sql.DB, func() error, er
 		return nil
 	}
 
-	return NewUserService(db, mb, cache), db, cleanup, nil
+	return NewUserService(NewPostgresStore(db), cache, time.Minute), db, cleanup, nil
 }
 
 func TestSignUpUser(t *testing.T) {
@@ -111,6 +106,16 @@ func TestSignUpUser(t *testing.T) {
 			payload:     User{},
 			expectedErr: common.ValidationError{Errors: map[string]string{"username": "must be provided", "email": "must be provided", "password": "must be provided"}},
 		},
+		{
+			name: "invalid locale",
+			payload: User{
+				Username: testUser().Username,
+				Email:    testUser().Email,
+				Password: testUser().Password,
+				Locale:   "english",
+			},
+			expectedErr: common.ValidationError{Errors: map[string]string{"locale": "must be a language tag such as en or pt-BR"}},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -118,7 +123,7 @@ func TestSignUpUser(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
 
-			_, err := s.CreateUser(ctx, tc.payload.Username, tc.payload.Email, tc.payload.Password.Plain)
+			_, err := s.CreateUser(ctx, tc.payload.Username, tc.payload.Email, tc.payload.Password.Plain, tc.payload.Locale)
 			assert.Equal(t, tc.expectedErr, err)
 
 			var count int
@@ -132,11 +137,19 @@ func TestSignUpUser(t *testing.T) {
 				assert.NoError(t, err)
 				assert.Equal(t, 1, count)
 
+				err = db.QueryRow("SELECT COUNT(*) FROM outbox WHERE routing_key = $1", string(common.UserCreatedKey)).Scan(&count)
+				assert.NoError(t, err)
+				assert.Equal(t, 1, count)
+
 			} else {
 				var count int
 				err = db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
 				assert.NoError(t, err)
 				assert.Equal(t, 0, count)
+
+				err = db.QueryRow("SELECT COUNT(*) FROM outbox").Scan(&count)
+				assert.NoError(t, err)
+				assert.Equal(t, 0, count)
 			}
 
 			t.Cleanup(func() {
@@ -157,12 +170,12 @@ func TestActivateUser(t *testing.T) {
 			return nil, err
 		}
 
-		err = s.m.insertUser(&u)
+		err = s.store.InsertUser(ctx, &u)
 		if err != nil {
 			return nil, err
 		}
 
-		token, err := s.m.createToken(u.ID, ActivationTokenTime, TokenScopeActivate)
+		token, err := createToken(ctx, s.store, u.ID, ActivationTokenTime, TokenScopeActivate)
 		if err != nil {
 			return nil, err
 		}
@@ -259,7 +272,7 @@ func TestLoginUser(t *testing.T) {
 			return err
 		}
 
-		err = s.m.insertUser(&u)
+		err = s.store.InsertUser(ctx, &u)
 		if err != nil {
 			return err
 		}
@@ -343,7 +356,7 @@ func TestLoginUser(t *testing.T) {
 }
 
 func TestGetUserByAccessToken(t *testing.T) {
-	s, db, cleanup, err := setupTestEnvironment(t)
+	s, _, cleanup, err := setupTestEnvironment(t)
 	assert.NoError(t, err)
 
 	setup := func(ctx context.Context, s *UserService, u User) (*string, error) {
@@ -352,30 +365,19 @@ func TestGetUserByAccessToken(t *testing.T) {
 			return nil, err
 		}
 
-		err = s.m.insertUser(&u)
+		err = s.store.InsertUser(ctx, &u)
 		if err != nil {
 			return nil, err
 		}
 
-		tx, err := db.Begin()
+		token, err := createAuthToken(ctx, s.store, u.ID)
 		if err != nil {
 			return nil, err
 		}
 
-		token, err := s.m.createAuthToken(tx, u.ID)
-		if err != nil {
-			_ = tx.Rollback()
-			return nil, err
-		}
-
 		// add permissions
-		err = s.m.addUserPermission(tx, ctx, u.ID, PermissionWriteBlog)
+		err = s.store.AddPermissions(ctx, u.ID, PermissionWriteBlog)
 		if err != nil {
-			_ = tx.Rollback()
-			return nil, err
-		}
-
-		if err := tx.Commit(); err != nil {
 			return nil, err
 		}
 
@@ -442,27 +444,13 @@ func TestLogoutUser(t *testing.T) {
 			return err
 		}
 
-		err = s.m.insertUser(&u)
-		if err != nil {
-			return err
-		}
-
-		tx, err := db.Begin()
-		if err != nil {
-			return err
-		}
-
-		_, err = s.m.createAuthToken(tx, u.ID)
+		err = s.store.InsertUser(ctx, &u)
 		if err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-
-		if err := tx.Commit(); err != nil {
 			return err
 		}
 
-		return nil
+		_, err = createAuthToken(ctx, s.store, u.ID)
+		return err
 	}
 
 	testCases := []struct {
@@ -514,3 +502,377 @@ func TestLogoutUser(t *testing.T) {
 		})
 	}
 }
+
+// loginTestUser creates an activated test user with the blog:write permission and logs it in.
+func loginTestUser(ctx context.Context, s *UserService) (*User, *AuthToken, error) {
+	u := testUser()
+
+	err := u.Password.set(u.Password.Plain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.store.InsertUser(ctx, &u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.store.AddPermissions(ctx, u.ID, PermissionWriteBlog)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := s.LoginUser(ctx, u.Username, u.Password.Plain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &u, token, nil
+}
+
+func TestSessionRevocation(t *testing.T) {
+	s, _, cleanup, err := setupTestEnvironment(t)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		revoke func(ctx context.Context, userId int) error
+		check  func(t *testing.T, user *User, err error)
+	}{
+		{
+			name: "logout",
+			revoke: func(ctx context.Context, userId int) error {
+				return s.LogoutUser(ctx, userId)
+			},
+			check: func(t *testing.T, user *User, err error) {
+				assert.Equal(t, common.ErrRecordNotFound, err)
+			},
+		},
+		{
+			name: "revoke sessions",
+			revoke: func(ctx context.Context, userId int) error {
+				return s.RevokeSessions(ctx, userId)
+			},
+			check: func(t *testing.T, user *User, err error) {
+				assert.Equal(t, common.ErrRecordNotFound, err)
+			},
+		},
+		{
+			name: "suspension",
+			revoke: func(ctx context.Context, userId int) error {
+				return s.SuspendUser(ctx, userId)
+			},
+			check: func(t *testing.T, user *User, err error) {
+				assert.Equal(t, common.ErrRecordNotFound, err)
+			},
+		},
+		{
+			name: "permission change",
+			revoke: func(ctx context.Context, userId int) error {
+				return s.RevokePermission(ctx, userId, PermissionWriteBlog)
+			},
+			check: func(t *testing.T, user *User, err error) {
+				// a user without any permission is not authenticated at all, either way the cached permission must be gone
+				if err == nil {
+					assert.False(t, user.HasPermission(PermissionWriteBlog))
+				} else {
+					assert.Equal(t, common.ErrRecordNotFound, err)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			u, token, err := loginTestUser(ctx, s)
+			assert.NoError(t, err)
+
+			// warm the cache
+			_, err = s.GetUserByAccessToken(ctx, token.AccessTokenPlain)
+			assert.NoError(t, err)
+
+			err = tc.revoke(ctx, u.ID)
+			assert.NoError(t, err)
+
+			user, err := s.GetUserByAccessToken(ctx, token.AccessTokenPlain)
+			tc.check(t, user, err)
+
+			t.Cleanup(func() {
+				err := cleanup()
+				assert.NoError(t, err)
+			})
+		})
+	}
+}
+
+func TestLoginSuspendedUser(t *testing.T) {
+	s, _, cleanup, err := setupTestEnvironment(t)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	u, _, err := loginTestUser(ctx, s)
+	assert.NoError(t, err)
+
+	err = s.SuspendUser(ctx, u.ID)
+	assert.NoError(t, err)
+
+	_, err = s.LoginUser(ctx, u.Username, u.Password.Plain)
+	assert.Equal(t, ErrAccountSuspended, err)
+
+	err = s.ReinstateUser(ctx, u.ID)
+	assert.NoError(t, err)
+
+	_, err = s.LoginUser(ctx, u.Username, u.Password.Plain)
+	assert.NoError(t, err)
+
+	t.Cleanup(func() {
+		err := cleanup()
+		assert.NoError(t, err)
+	})
+}
+
+func TestSuspendUserEvents(t *testing.T) {
+	ctx := context.Background()
+	outbox := common.NewMemoryOutbox()
+	s := NewUserService(NewMemoryStore(outbox), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	u := testUser()
+	assert.NoError(t, s.store.InsertUser(ctx, &u))
+
+	assert.NoError(t, s.SuspendUser(ctx, u.ID))
+	assert.NoError(t, s.ReinstateUser(ctx, u.ID))
+	assert.ErrorIs(t, s.SuspendUser(ctx, u.ID+1), common.ErrRecordNotFound)
+
+	msgs := outbox.Messages()
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, common.UserSuspendedKey, msgs[0].RoutingKey)
+		assert.Equal(t, common.UserReinstatedKey, msgs[1].RoutingKey)
+
+		var event struct{ UserID int }
+		assert.NoError(t, json.Unmarshal(msgs[0].Payload, &event))
+		assert.Equal(t, u.ID, event.UserID)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	outbox := common.NewMemoryOutbox()
+	s := NewUserService(NewMemoryStore(outbox), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	u, _, err := loginTestUser(ctx, s)
+	assert.NoError(t, err)
+
+	// An unknown address is not reported, and nothing is sent.
+	err = s.RequestPasswordReset(ctx, "unknown@example.com")
+	assert.NoError(t, err)
+	assert.Empty(t, outbox.Messages())
+
+	err = s.RequestPasswordReset(ctx, "TestUser@Example.com")
+	assert.NoError(t, err)
+
+	messages := outbox.Messages()
+	if !assert.Len(t, messages, 1) {
+		return
+	}
+	assert.Equal(t, common.UserPasswordResetKey, messages[0].RoutingKey)
+
+	var data struct {
+		Email  string
+		Token  string
+		Locale string
+	}
+	assert.NoError(t, json.Unmarshal(messages[0].Payload, &data))
+	assert.Equal(t, u.Email, data.Email)
+	assert.Equal(t, DefaultLocale, data.Locale)
+
+	err = s.ResetPassword(ctx, data.Token, "weak")
+	assert.IsType(t, common.ValidationError{}, err)
+
+	err = s.ResetPassword(ctx, data.Token, "NewPassword123!")
+	assert.NoError(t, err)
+
+	// The token can only be used once.
+	err = s.ResetPassword(ctx, data.Token, "OtherPassword123!")
+	assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+	_, err = s.LoginUser(ctx, u.Username, u.Password.Plain)
+	assert.ErrorIs(t, err, ErrAuthenticationFailure)
+
+	_, err = s.LoginUser(ctx, u.Username, "NewPassword123!")
+	assert.NoError(t, err)
+}
+
+func TestCheckActivationToken(t *testing.T) {
+	ctx := context.Background()
+	s := NewUserService(NewMemoryStore(common.NewMemoryOutbox()), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	u := User{Username: "testuser", Email: "testuser@example.com"}
+	assert.NoError(t, s.store.InsertUser(ctx, &u))
+
+	token, err := createToken(ctx, s.store, u.ID, time.Hour, TokenScopeActivate)
+	assert.NoError(t, err)
+
+	err = s.CheckActivationToken(ctx, "invalid")
+	assert.IsType(t, common.ValidationError{}, err)
+
+	// Checking the token does not use it.
+	assert.NoError(t, s.CheckActivationToken(ctx, token.Plain))
+	assert.NoError(t, s.CheckActivationToken(ctx, token.Plain))
+
+	assert.NoError(t, s.ActivateUser(ctx, token.Plain))
+	assert.ErrorIs(t, s.CheckActivationToken(ctx, token.Plain), common.ErrRecordNotFound)
+
+	expired, err := createToken(ctx, s.store, u.ID, -time.Minute, TokenScopeActivate)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, s.CheckActivationToken(ctx, expired.Plain), common.ErrRecordNotFound)
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	ctx := context.Background()
+	s := NewUserService(NewMemoryStore(common.NewMemoryOutbox()), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	u := User{Username: "testuser", Email: "testuser@example.com"}
+	assert.NoError(t, s.store.InsertUser(ctx, &u))
+
+	wants := func(kind string) bool {
+		ok, err := s.WantsEmail(ctx, u.ID, kind)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	// Every notification is sent as it happens by default.
+	assert.True(t, wants(NotificationComments))
+	assert.True(t, wants(NotificationNewPosts))
+	assert.False(t, wants(NotificationDigest))
+
+	invalid := Frequency("monthly")
+	_, err := s.UpdateNotificationPreferences(ctx, u.ID, NotificationPreferencesUpdate{Frequency: &invalid})
+	assert.IsType(t, common.ValidationError{}, err)
+
+	off := false
+	p, err := s.UpdateNotificationPreferences(ctx, u.ID, NotificationPreferencesUpdate{Comments: &off})
+	assert.NoError(t, err)
+	assert.False(t, p.Comments)
+	assert.True(t, p.NewPosts)
+	assert.False(t, wants(NotificationComments))
+	assert.True(t, wants(NotificationNewPosts))
+
+	daily := FrequencyDaily
+	_, err = s.UpdateNotificationPreferences(ctx, u.ID, NotificationPreferencesUpdate{Frequency: &daily})
+	assert.NoError(t, err)
+	assert.False(t, wants(NotificationNewPosts))
+	assert.True(t, wants(NotificationDigest))
+
+	weekly := FrequencyWeekly
+	_, err = s.UpdateNotificationPreferences(ctx, u.ID, NotificationPreferencesUpdate{Frequency: &weekly})
+	assert.NoError(t, err)
+	assert.True(t, wants(NotificationDigest))
+
+	assert.NoError(t, s.Unsubscribe(ctx, u.ID, NotificationDigest))
+	p, err = s.GetNotificationPreferences(ctx, u.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, FrequencyOff, p.Frequency)
+	assert.False(t, wants(NotificationDigest))
+
+	assert.IsType(t, common.ValidationError{}, s.Unsubscribe(ctx, u.ID, "unknown"))
+	_, err = s.WantsEmail(ctx, u.ID, "unknown")
+	assert.Error(t, err)
+
+	// Unknown and suspended users receive no notification.
+	ok, err := s.WantsEmail(ctx, u.ID+1, NotificationComments)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	instant := FrequencyInstant
+	_, err = s.UpdateNotificationPreferences(ctx, u.ID, NotificationPreferencesUpdate{Frequency: &instant})
+	assert.NoError(t, err)
+	assert.True(t, wants(NotificationNewPosts))
+	assert.NoError(t, s.store.SetUserSuspended(ctx, u.ID, true))
+	assert.False(t, wants(NotificationNewPosts))
+}
+
+func TestFollowUser(t *testing.T) {
+	ctx := context.Background()
+	outbox := common.NewMemoryOutbox()
+	s := NewUserService(NewMemoryStore(outbox), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	follower := User{Username: "follower", Email: "follower@example.com"}
+	assert.NoError(t, s.store.InsertUser(ctx, &follower))
+	author := User{Username: "author", Email: "author@example.com"}
+	assert.NoError(t, s.store.InsertUser(ctx, &author))
+
+	err := s.FollowUser(ctx, follower.ID, follower.ID)
+	assert.IsType(t, common.ValidationError{}, err)
+
+	assert.ErrorIs(t, s.FollowUser(ctx, follower.ID, author.ID+1), common.ErrRecordNotFound)
+
+	assert.NoError(t, s.FollowUser(ctx, follower.ID, author.ID))
+	assert.NoError(t, s.FollowUser(ctx, follower.ID, author.ID))
+	authors, err := s.GetFollowedAuthors(ctx, follower.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{author.ID}, authors)
+
+	// The author is notified once.
+	msgs := outbox.Messages()
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, common.UserFollowedKey, msgs[0].RoutingKey)
+
+		var event struct {
+			UserID           int
+			FollowerID       int
+			FollowerUsername string
+		}
+		assert.NoError(t, json.Unmarshal(msgs[0].Payload, &event))
+		assert.Equal(t, author.ID, event.UserID)
+		assert.Equal(t, follower.ID, event.FollowerID)
+		assert.Equal(t, "follower", event.FollowerUsername)
+	}
+
+	assert.NoError(t, s.UnfollowUser(ctx, follower.ID, author.ID))
+	assert.ErrorIs(t, s.UnfollowUser(ctx, follower.ID, author.ID), common.ErrRecordNotFound)
+}
+
+func TestActivateUserByID(t *testing.T) {
+	ctx := context.Background()
+	s := NewUserService(NewMemoryStore(common.NewMemoryOutbox()), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	u := testUser()
+	token, err := s.CreateUser(ctx, u.Username, u.Email, u.Password.Plain, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := s.GetUserByUsername(ctx, u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, user.Activated)
+
+	assert.NoError(t, s.ActivateUserByID(ctx, user.ID))
+	user, err = s.GetUserByUsername(ctx, u.Username)
+	assert.NoError(t, err)
+	assert.True(t, user.Activated)
+
+	// The activation token was used up, and activating again changes nothing.
+	assert.ErrorIs(t, s.ActivateUser(ctx, *token), common.ErrRecordNotFound)
+	assert.NoError(t, s.ActivateUserByID(ctx, user.ID))
+
+	assert.ErrorIs(t, s.ActivateUserByID(ctx, user.ID+1), common.ErrRecordNotFound)
+	_, err = s.GetUserByUsername(ctx, "nobody")
+	assert.ErrorIs(t, err, common.ErrRecordNotFound)
+}
+
+func TestGrantUnknownPermission(t *testing.T) {
+	s := NewUserService(NewMemoryStore(common.NewMemoryOutbox()), common.NewMemoryCache(5*time.Minute, 10*time.Minute), time.Minute)
+
+	var verr common.ValidationError
+	err := s.GrantPermission(context.Background(), 1, "blog:delete")
+	if assert.ErrorAs(t, err, &verr) {
+		assert.Equal(t, `unknown permission "blog:delete"`, verr.Errors["permissions"])
+	}
+}
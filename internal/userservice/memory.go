@@ -0,0 +1,597 @@
+package userservice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// MemoryStore is a Store kept in memory. It follows the same contract as PostgresStore, including the unique constraints and version checks, so tests can run without a database.
+type MemoryStore struct {
+	mu     sync.Mutex
+	data   *memoryData
+	outbox *common.MemoryOutbox
+}
+
+type memoryData struct {
+	users       map[int]User
+	nextUserID  int
+	tokens      map[tokenKey]Token
+	sessions    []AuthToken
+	permissions map[int][]Permission
+	preferences map[int]NotificationPreferences
+	// follows maps a follower to the authors it follows.
+	follows map[int]map[int]bool
+}
+
+type tokenKey struct {
+	userID int
+	scope  tokenScope
+}
+
+// memoryTx works on a copy of the data, which replaces the data of the store when the transaction commits.
+type memoryTx struct {
+	*memoryData
+	outbox []common.OutboxMessage
+}
+
+// NewMemoryStore creates an empty store. The messages of committed transactions are appended to outbox.
+func NewMemoryStore(outbox *common.MemoryOutbox) *MemoryStore {
+	return &MemoryStore{
+		data: &memoryData{
+			users:       make(map[int]User),
+			tokens:      make(map[tokenKey]Token),
+			permissions: make(map[int][]Permission),
+			preferences: make(map[int]NotificationPreferences),
+			follows:     make(map[int]map[int]bool),
+		},
+		outbox: outbox,
+	}
+}
+
+func (s *MemoryStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{memoryData: s.data.clone()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.data = tx.memoryData
+	s.outbox.Append(tx.outbox...)
+
+	return nil
+}
+
+func (tx *memoryTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	tx.outbox = append(tx.outbox, common.OutboxMessage{Exchange: exchange, RoutingKey: key, Payload: payload, Headers: common.MessageHeaders(ctx, nil)})
+	return nil
+}
+
+// run applies fn to the data of the store, as a transaction of its own.
+func (s *MemoryStore) run(fn func(d *memoryData) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.data.clone()
+	if err := fn(d); err != nil {
+		return err
+	}
+	s.data = d
+
+	return nil
+}
+
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		users:       make(map[int]User, len(d.users)),
+		nextUserID:  d.nextUserID,
+		tokens:      make(map[tokenKey]Token, len(d.tokens)),
+		sessions:    append([]AuthToken{}, d.sessions...),
+		permissions: make(map[int][]Permission, len(d.permissions)),
+		preferences: make(map[int]NotificationPreferences, len(d.preferences)),
+		follows:     make(map[int]map[int]bool, len(d.follows)),
+	}
+
+	for id, u := range d.users {
+		c.users[id] = u
+	}
+	for k, t := range d.tokens {
+		c.tokens[k] = t
+	}
+	for id, p := range d.permissions {
+		c.permissions[id] = append(Permissions{}, p...)
+	}
+	for id, p := range d.preferences {
+		c.preferences[id] = p
+	}
+	for id, authors := range d.follows {
+		c.follows[id] = make(map[int]bool, len(authors))
+		for author := range authors {
+			c.follows[id][author] = true
+		}
+	}
+
+	return c
+}
+
+func (s *MemoryStore) InsertUser(ctx context.Context, u *User) error {
+	return s.run(func(d *memoryData) error { return d.InsertUser(ctx, u) })
+}
+
+func (d *memoryData) InsertUser(ctx context.Context, u *User) error {
+	for _, existing := range d.users {
+		if existing.Username == u.Username {
+			return ErrDuplicateUsername
+		}
+	}
+	// The email column is case insensitive.
+	for _, existing := range d.users {
+		if strings.EqualFold(existing.Email, u.Email) {
+			return ErrDuplicateEmail
+		}
+	}
+
+	if u.Locale == "" {
+		u.Locale = DefaultLocale
+	}
+
+	d.nextUserID++
+	now := time.Now()
+
+	d.users[d.nextUserID] = User{
+		ID:        d.nextUserID,
+		Username:  u.Username,
+		Email:     u.Email,
+		Password:  Password{hash: u.Password.hash},
+		Locale:    u.Locale,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}
+	u.ID = d.nextUserID
+
+	return nil
+}
+
+func (s *MemoryStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	var u *User
+	err := s.run(func(d *memoryData) (err error) { u, err = d.GetUserByID(ctx, id); return })
+	return u, err
+}
+
+func (d *memoryData) GetUserByID(ctx context.Context, id int) (*User, error) {
+	u, ok := d.users[id]
+	if !ok {
+		return nil, common.ErrRecordNotFound
+	}
+
+	return &User{
+		ID:        u.ID,
+		Username:  u.Username,
+		Email:     u.Email,
+		Activated: u.Activated,
+		Suspended: u.Suspended,
+		Locale:    u.Locale,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		Version:   u.Version,
+	}, nil
+}
+
+func (s *MemoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	var u *User
+	err := s.run(func(d *memoryData) (err error) { u, err = d.GetUserByEmail(ctx, email); return })
+	return u, err
+}
+
+func (d *memoryData) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	for _, u := range d.users {
+		if strings.EqualFold(u.Email, email) {
+			return d.GetUserByID(ctx, u.ID)
+		}
+	}
+
+	return nil, common.ErrRecordNotFound
+}
+
+func (s *MemoryStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	var u *User
+	err := s.run(func(d *memoryData) (err error) { u, err = d.GetUserByUsername(ctx, username); return })
+	return u, err
+}
+
+func (d *memoryData) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	for _, u := range d.users {
+		if u.Username == username {
+			return &User{
+				ID:        u.ID,
+				Username:  u.Username,
+				Email:     u.Email,
+				Password:  Password{hash: u.Password.hash},
+				Suspended: u.Suspended,
+				Locale:    u.Locale,
+				Version:   u.Version,
+			}, nil
+		}
+	}
+
+	return nil, common.ErrRecordNotFound
+}
+
+func (s *MemoryStore) ActivateUser(ctx context.Context, id, version int) error {
+	return s.run(func(d *memoryData) error { return d.ActivateUser(ctx, id, version) })
+}
+
+func (d *memoryData) ActivateUser(ctx context.Context, id, version int) error {
+	u, ok := d.users[id]
+	if !ok || u.Version != version {
+		return common.ErrRecordNotFound
+	}
+
+	u.Activated = true
+	u.UpdatedAt = time.Now()
+	d.users[id] = u
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateUserPassword(ctx context.Context, pwd Password, id, version int) error {
+	return s.run(func(d *memoryData) error { return d.UpdateUserPassword(ctx, pwd, id, version) })
+}
+
+func (d *memoryData) UpdateUserPassword(ctx context.Context, pwd Password, id, version int) error {
+	u, ok := d.users[id]
+	if !ok || u.Version != version {
+		return nil
+	}
+
+	u.Password = Password{hash: pwd.hash}
+	u.UpdatedAt = time.Now()
+	d.users[id] = u
+
+	return nil
+}
+
+func (s *MemoryStore) SetUserSuspended(ctx context.Context, id int, suspended bool) error {
+	return s.run(func(d *memoryData) error { return d.SetUserSuspended(ctx, id, suspended) })
+}
+
+func (d *memoryData) SetUserSuspended(ctx context.Context, id int, suspended bool) error {
+	u, ok := d.users[id]
+	if !ok {
+		return common.ErrRecordNotFound
+	}
+
+	u.Suspended = suspended
+	u.Version++
+	u.UpdatedAt = time.Now()
+	d.users[id] = u
+
+	return nil
+}
+
+func (s *MemoryStore) InsertToken(ctx context.Context, token *Token) error {
+	return s.run(func(d *memoryData) error { return d.InsertToken(ctx, token) })
+}
+
+func (d *memoryData) InsertToken(ctx context.Context, token *Token) error {
+	if _, ok := d.users[token.UserID]; !ok {
+		return fmt.Errorf("user %d does not exist", token.UserID)
+	}
+
+	key := tokenKey{userID: token.UserID, scope: token.Scope}
+	if _, ok := d.tokens[key]; ok {
+		return fmt.Errorf("user %d already has a %s token", token.UserID, token.Scope)
+	}
+
+	d.tokens[key] = *token
+
+	return nil
+}
+
+func (s *MemoryStore) GetUserByToken(ctx context.Context, scope tokenScope, hash []byte) (*User, error) {
+	var u *User
+	err := s.run(func(d *memoryData) (err error) { u, err = d.GetUserByToken(ctx, scope, hash); return })
+	return u, err
+}
+
+func (d *memoryData) GetUserByToken(ctx context.Context, scope tokenScope, hash []byte) (*User, error) {
+	now := time.Now()
+
+	for key, t := range d.tokens {
+		if key.scope != scope || !bytes.Equal(t.Hash, hash) || !t.Expiry.After(now) {
+			continue
+		}
+
+		u := d.users[key.userID]
+		return &User{
+			ID:        u.ID,
+			Username:  u.Username,
+			Email:     u.Email,
+			Activated: u.Activated,
+			Locale:    u.Locale,
+			Version:   u.Version,
+		}, nil
+	}
+
+	return nil, common.ErrRecordNotFound
+}
+
+func (s *MemoryStore) DeleteToken(ctx context.Context, userID int, scope tokenScope) error {
+	return s.run(func(d *memoryData) error { return d.DeleteToken(ctx, userID, scope) })
+}
+
+func (d *memoryData) DeleteToken(ctx context.Context, userID int, scope tokenScope) error {
+	key := tokenKey{userID: userID, scope: scope}
+	if _, ok := d.tokens[key]; !ok {
+		return common.ErrRecordNotFound
+	}
+
+	delete(d.tokens, key)
+
+	return nil
+}
+
+func (s *MemoryStore) InsertAuthToken(ctx context.Context, token *AuthToken) error {
+	return s.run(func(d *memoryData) error { return d.InsertAuthToken(ctx, token) })
+}
+
+func (d *memoryData) InsertAuthToken(ctx context.Context, token *AuthToken) error {
+	if _, ok := d.users[token.UserID]; !ok {
+		return fmt.Errorf("user %d does not exist", token.UserID)
+	}
+
+	for _, existing := range d.sessions {
+		if existing.UserID == token.UserID && bytes.Equal(existing.AccessTokenHash, token.AccessTokenHash) {
+			return fmt.Errorf("access token already exists")
+		}
+	}
+
+	d.sessions = append(d.sessions, AuthToken{
+		AccessTokenHash:    token.AccessTokenHash,
+		RefreshTokenHash:   token.RefreshTokenHash,
+		UserID:             token.UserID,
+		AccessTokenExpiry:  token.AccessTokenExpiry,
+		RefreshTokenExpiry: token.RefreshTokenExpiry,
+	})
+
+	return nil
+}
+
+func (s *MemoryStore) GetAuthToken(ctx context.Context, userID int) (*AuthToken, error) {
+	var t *AuthToken
+	err := s.run(func(d *memoryData) (err error) { t, err = d.GetAuthToken(ctx, userID); return })
+	return t, err
+}
+
+func (d *memoryData) GetAuthToken(ctx context.Context, userID int) (*AuthToken, error) {
+	for _, t := range d.sessions {
+		if t.UserID == userID {
+			return &t, nil
+		}
+	}
+
+	return nil, common.ErrRecordNotFound
+}
+
+func (s *MemoryStore) GetUserByAccessToken(ctx context.Context, hash []byte) (*User, error) {
+	var u *User
+	err := s.run(func(d *memoryData) (err error) { u, err = d.GetUserByAccessToken(ctx, hash); return })
+	return u, err
+}
+
+func (d *memoryData) GetUserByAccessToken(ctx context.Context, hash []byte) (*User, error) {
+	now := time.Now()
+
+	for _, t := range d.sessions {
+		if !bytes.Equal(t.AccessTokenHash, hash) || !t.AccessTokenExpiry.After(now) {
+			continue
+		}
+
+		u := d.users[t.UserID]
+		permissions := d.permissions[t.UserID]
+		if u.Suspended || len(permissions) == 0 {
+			continue
+		}
+
+		return &User{
+			ID:          u.ID,
+			Username:    u.Username,
+			Email:       u.Email,
+			Activated:   u.Activated,
+			Version:     u.Version,
+			Permissions: append(Permissions{}, permissions...),
+		}, nil
+	}
+
+	return nil, common.ErrRecordNotFound
+}
+
+func (s *MemoryStore) GetAccessTokenHashes(ctx context.Context, userID int) ([][]byte, error) {
+	var hashes [][]byte
+	err := s.run(func(d *memoryData) (err error) { hashes, err = d.GetAccessTokenHashes(ctx, userID); return })
+	return hashes, err
+}
+
+func (d *memoryData) GetAccessTokenHashes(ctx context.Context, userID int) ([][]byte, error) {
+	var hashes [][]byte
+	for _, t := range d.sessions {
+		if t.UserID == userID {
+			hashes = append(hashes, t.AccessTokenHash)
+		}
+	}
+
+	return hashes, nil
+}
+
+func (s *MemoryStore) DeleteAuthTokens(ctx context.Context, userID int) ([][]byte, error) {
+	var hashes [][]byte
+	err := s.run(func(d *memoryData) (err error) { hashes, err = d.DeleteAuthTokens(ctx, userID); return })
+	return hashes, err
+}
+
+func (d *memoryData) DeleteAuthTokens(ctx context.Context, userID int) ([][]byte, error) {
+	var hashes [][]byte
+	var kept []AuthToken
+	for _, t := range d.sessions {
+		if t.UserID == userID {
+			hashes = append(hashes, t.AccessTokenHash)
+			continue
+		}
+		kept = append(kept, t)
+	}
+
+	if len(hashes) == 0 {
+		return nil, common.ErrRecordNotFound
+	}
+
+	d.sessions = kept
+
+	return hashes, nil
+}
+
+func (s *MemoryStore) AddPermissions(ctx context.Context, userID int, permissions ...Permission) error {
+	return s.run(func(d *memoryData) error { return d.AddPermissions(ctx, userID, permissions...) })
+}
+
+func (d *memoryData) AddPermissions(ctx context.Context, userID int, permissions ...Permission) error {
+	if _, ok := d.users[userID]; !ok {
+		return fmt.Errorf("user %d does not exist", userID)
+	}
+
+	for _, p := range permissions {
+		if !Permissions(d.permissions[userID]).include(p) {
+			d.permissions[userID] = append(d.permissions[userID], p)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RemovePermissions(ctx context.Context, userID int, permissions ...Permission) error {
+	return s.run(func(d *memoryData) error { return d.RemovePermissions(ctx, userID, permissions...) })
+}
+
+func (d *memoryData) RemovePermissions(ctx context.Context, userID int, permissions ...Permission) error {
+	var kept []Permission
+	for _, p := range d.permissions[userID] {
+		if !Permissions(permissions).include(p) {
+			kept = append(kept, p)
+		}
+	}
+	d.permissions[userID] = kept
+
+	return nil
+}
+
+func (p Permissions) include(permission Permission) bool {
+	for _, existing := range p {
+		if existing == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *MemoryStore) GetNotificationPreferences(ctx context.Context, userID int) (*NotificationPreferences, error) {
+	var p *NotificationPreferences
+	err := s.run(func(d *memoryData) (err error) { p, err = d.GetNotificationPreferences(ctx, userID); return })
+	return p, err
+}
+
+func (d *memoryData) GetNotificationPreferences(ctx context.Context, userID int) (*NotificationPreferences, error) {
+	u, ok := d.users[userID]
+	if !ok {
+		return nil, common.ErrRecordNotFound
+	}
+
+	p, ok := d.preferences[userID]
+	if !ok {
+		p = *DefaultNotificationPreferences(userID)
+		p.UpdatedAt = u.CreatedAt
+	}
+
+	return &p, nil
+}
+
+func (s *MemoryStore) UpdateNotificationPreferences(ctx context.Context, p *NotificationPreferences) error {
+	return s.run(func(d *memoryData) error { return d.UpdateNotificationPreferences(ctx, p) })
+}
+
+func (d *memoryData) UpdateNotificationPreferences(ctx context.Context, p *NotificationPreferences) error {
+	if _, ok := d.users[p.UserID]; !ok {
+		return fmt.Errorf("user %d does not exist", p.UserID)
+	}
+
+	p.UpdatedAt = time.Now()
+	d.preferences[p.UserID] = *p
+
+	return nil
+}
+
+func (s *MemoryStore) Follow(ctx context.Context, followerID, authorID int) (bool, error) {
+	var created bool
+	err := s.run(func(d *memoryData) (err error) { created, err = d.Follow(ctx, followerID, authorID); return })
+	return created, err
+}
+
+func (d *memoryData) Follow(ctx context.Context, followerID, authorID int) (bool, error) {
+	if _, ok := d.users[authorID]; !ok {
+		return false, common.ErrRecordNotFound
+	}
+	if _, ok := d.users[followerID]; !ok {
+		return false, fmt.Errorf("user %d does not exist", followerID)
+	}
+	if followerID == authorID {
+		return false, fmt.Errorf("user %d cannot follow itself", followerID)
+	}
+
+	if d.follows[followerID] == nil {
+		d.follows[followerID] = make(map[int]bool)
+	}
+	if d.follows[followerID][authorID] {
+		return false, nil
+	}
+	d.follows[followerID][authorID] = true
+
+	return true, nil
+}
+
+func (s *MemoryStore) Unfollow(ctx context.Context, followerID, authorID int) error {
+	return s.run(func(d *memoryData) error { return d.Unfollow(ctx, followerID, authorID) })
+}
+
+func (d *memoryData) Unfollow(ctx context.Context, followerID, authorID int) error {
+	if !d.follows[followerID][authorID] {
+		return common.ErrRecordNotFound
+	}
+
+	delete(d.follows[followerID], authorID)
+
+	return nil
+}
+
+func (s *MemoryStore) GetFollowedAuthors(ctx context.Context, followerID int) ([]int, error) {
+	var authors []int
+	err := s.run(func(d *memoryData) (err error) { authors, err = d.GetFollowedAuthors(ctx, followerID); return })
+	return authors, err
+}
+
+func (d *memoryData) GetFollowedAuthors(ctx context.Context, followerID int) ([]int, error) {
+	authors := []int{}
+	for author := range d.follows[followerID] {
+		authors = append(authors, author)
+	}
+	sort.Ints(authors)
+
+	return authors, nil
+}
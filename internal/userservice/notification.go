@@ -0,0 +1,50 @@
+package userservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func (s *PostgresStore) GetNotificationPreferences(ctx context.Context, userID int) (*NotificationPreferences, error) {
+	// The defaults of the columns apply to the users without a row.
+	query := `
+		SELECT u.id, COALESCE(p.comments, TRUE), COALESCE(p.new_posts, TRUE), COALESCE(p.frequency, 'instant'), COALESCE(p.updated_at, u.created_at)
+		FROM users u
+		LEFT JOIN notification_preferences p ON p.user_id = u.id
+		WHERE u.id = $1`
+
+	var p NotificationPreferences
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, userID).Scan(&p.UserID, &p.Comments, &p.NewPosts, &p.Frequency, &p.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, common.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+func (s *PostgresStore) UpdateNotificationPreferences(ctx context.Context, p *NotificationPreferences) error {
+	query := `
+		INSERT INTO notification_preferences (user_id, comments, new_posts, frequency)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET comments = EXCLUDED.comments, new_posts = EXCLUDED.new_posts, frequency = EXCLUDED.frequency, updated_at = NOW()
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return s.q.QueryRowContext(ctx, query, p.UserID, p.Comments, p.NewPosts, p.Frequency).Scan(&p.UpdatedAt)
+}
@@ -2,13 +2,24 @@ package userservice
 
 import (
 	"context"
-	"database/sql"
 )
 
-func (m *DBModel) addUserPermission(tx *sql.Tx, ctx context.Context, id int, permissions ...Permission) error {
+func (s *PostgresStore) AddPermissions(ctx context.Context, id int, permissions ...Permission) error {
 	// Add the permissions to the user
 	for _, p := range permissions {
-		_, err := tx.ExecContext(ctx, "INSERT INTO user_permissions (user_id, permission) VALUES ($1, $2)", id, p)
+		_, err := s.q.ExecContext(ctx, "INSERT INTO user_permissions (user_id, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) RemovePermissions(ctx context.Context, id int, permissions ...Permission) error {
+	// Remove the permissions from the user
+	for _, p := range permissions {
+		_, err := s.q.ExecContext(ctx, "DELETE FROM user_permissions WHERE user_id = $1 AND permission = $2", id, p)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,92 @@
+package userservice
+
+import (
+	"context"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// Store is the persistence layer of the user service. PostgresStore is used in production and MemoryStore in tests, both follow the same contract, which is checked by the conformance suite in store_test.go.
+type Store interface {
+	UserStore
+	TokenStore
+	SessionStore
+	PermissionStore
+	NotificationStore
+	FollowStore
+
+	// WithTx runs fn in a transaction. A change to a user, such as its activation or a new follow, is committed with the outbox messages announcing it when fn returns nil, and neither is kept otherwise.
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
+}
+
+// Tx has the methods of Store and the outbox, all within the transaction of WithTx.
+type Tx interface {
+	UserStore
+	TokenStore
+	SessionStore
+	PermissionStore
+	NotificationStore
+	FollowStore
+	common.OutboxWriter
+}
+
+type UserStore interface {
+	// InsertUser stores the user and sets its ID, and its locale to DefaultLocale when it has none. It returns ErrDuplicateUsername or ErrDuplicateEmail when the username or email is taken.
+	InsertUser(ctx context.Context, u *User) error
+	// GetUserByID returns the user without its password hash or permissions.
+	GetUserByID(ctx context.Context, id int) (*User, error)
+	// GetUserByUsername returns the user with its password hash.
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	// GetUserByEmail returns the user without its password hash or permissions. Emails are compared case insensitively.
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	// ActivateUser activates the user if it is still at the given version.
+	ActivateUser(ctx context.Context, id, version int) error
+	// UpdateUserPassword replaces the password hash if the user is still at the given version. A user at another version is left unchanged without an error.
+	UpdateUserPassword(ctx context.Context, pwd Password, id, version int) error
+	// SetUserSuspended suspends or reinstates the user and moves it to the next version.
+	SetUserSuspended(ctx context.Context, id int, suspended bool) error
+}
+
+// TokenStore holds the single use tokens, such as the activation token. A user has at most one token per scope.
+type TokenStore interface {
+	InsertToken(ctx context.Context, token *Token) error
+	// GetUserByToken returns the user holding an unexpired token with the given hash and scope.
+	GetUserByToken(ctx context.Context, scope tokenScope, hash []byte) (*User, error)
+	DeleteToken(ctx context.Context, userID int, scope tokenScope) error
+}
+
+// SessionStore holds the authentication tokens issued at login.
+type SessionStore interface {
+	InsertAuthToken(ctx context.Context, token *AuthToken) error
+	// GetAuthToken returns an authentication token of the user, expired or not.
+	GetAuthToken(ctx context.Context, userID int) (*AuthToken, error)
+	// GetUserByAccessToken returns the user holding an unexpired access token with the given hash, together with its permissions. Suspended users and users without any permission are not found.
+	GetUserByAccessToken(ctx context.Context, hash []byte) (*User, error)
+	// GetAccessTokenHashes returns the hashes of every access token issued to the user.
+	GetAccessTokenHashes(ctx context.Context, userID int) ([][]byte, error)
+	// DeleteAuthTokens deletes every authentication token of the user and returns the hashes of the deleted access tokens. It returns common.ErrRecordNotFound when the user had none.
+	DeleteAuthTokens(ctx context.Context, userID int) ([][]byte, error)
+}
+
+type PermissionStore interface {
+	// AddPermissions grants the permissions, those the user already has are ignored.
+	AddPermissions(ctx context.Context, userID int, permissions ...Permission) error
+	RemovePermissions(ctx context.Context, userID int, permissions ...Permission) error
+}
+
+type NotificationStore interface {
+	// GetNotificationPreferences returns the preferences of the user, or the defaults when the user never changed them. It returns common.ErrRecordNotFound when there is no such user.
+	GetNotificationPreferences(ctx context.Context, userID int) (*NotificationPreferences, error)
+	// UpdateNotificationPreferences stores the preferences and sets UpdatedAt.
+	UpdateNotificationPreferences(ctx context.Context, p *NotificationPreferences) error
+}
+
+// FollowStore holds the authors each user follows. The digest emails are made of the new posts of the followed authors.
+type FollowStore interface {
+	// Follow makes the follower follow the author and reports whether the follower did not follow the author yet. Following an author twice is not an error. It returns common.ErrRecordNotFound when the author does not exist.
+	Follow(ctx context.Context, followerID, authorID int) (bool, error)
+	// Unfollow returns common.ErrRecordNotFound when the follower did not follow the author.
+	Unfollow(ctx context.Context, followerID, authorID int) error
+	// GetFollowedAuthors returns the IDs of the authors the user follows, in ascending order.
+	GetFollowedAuthors(ctx context.Context, followerID int) ([]int, error)
+}
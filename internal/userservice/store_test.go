@@ -0,0 +1,367 @@
+package userservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore(common.NewMemoryOutbox())
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+
+	testStore(t, func(t *testing.T) Store {
+		t.Cleanup(func() {
+			for _, table := range []string{"outbox", "follows", "notification_preferences", "user_permissions", "auth_tokens", "tokens", "users"} {
+				_, err := db.Exec("DELETE FROM " + table)
+				assert.NoError(t, err)
+			}
+		})
+
+		return NewPostgresStore(db)
+	})
+}
+
+func TestMemoryStore_Outbox(t *testing.T) {
+	ctx := context.Background()
+	outbox := common.NewMemoryOutbox()
+	store := NewMemoryStore(outbox)
+
+	err := store.WithTx(ctx, func(tx Tx) error {
+		return tx.EnqueueOutbox(ctx, common.UserExchange, common.UserCreatedKey, []byte("committed"))
+	})
+	assert.NoError(t, err)
+
+	err = store.WithTx(ctx, func(tx Tx) error {
+		err := tx.EnqueueOutbox(ctx, common.UserExchange, common.UserCreatedKey, []byte("discarded"))
+		assert.NoError(t, err)
+		return errors.New("rollback")
+	})
+	assert.Error(t, err)
+
+	messages := outbox.Messages()
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, []byte("committed"), messages[0].Payload)
+		assert.Equal(t, common.UserCreatedKey, messages[0].RoutingKey)
+	}
+}
+
+// testStore checks the contract of Store that the service relies on. newStore returns an empty store for each test case.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	ctx := context.Background()
+
+	insert := func(t *testing.T, s UserStore, username, email string) *User {
+		u := User{Username: username, Email: email}
+		assert.NoError(t, u.Password.set("TestPassword123!"))
+		assert.NoError(t, s.InsertUser(ctx, &u))
+		return &u
+	}
+
+	t.Run("insert user", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+		assert.NotZero(t, u.ID)
+
+		got, err := s.GetUserByID(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "testuser", got.Username)
+		assert.Equal(t, "testuser@example.com", got.Email)
+		assert.False(t, got.Activated)
+		assert.Equal(t, DefaultLocale, got.Locale)
+		assert.Equal(t, 1, got.Version)
+
+		got, err = s.GetUserByEmail(ctx, "TestUser@Example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, u.ID, got.ID)
+
+		got, err = s.GetUserByUsername(ctx, "testuser")
+		assert.NoError(t, err)
+		assert.Equal(t, u.ID, got.ID)
+		ok, err := got.Password.compare("TestPassword123!")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("duplicate user", func(t *testing.T) {
+		s := newStore(t)
+		insert(t, s, "testuser", "testuser@example.com")
+
+		u := User{Username: "testuser", Email: "other@example.com"}
+		assert.ErrorIs(t, s.InsertUser(ctx, &u), ErrDuplicateUsername)
+
+		u = User{Username: "otheruser", Email: "TestUser@Example.com"}
+		assert.ErrorIs(t, s.InsertUser(ctx, &u), ErrDuplicateEmail)
+	})
+
+	t.Run("user not found", func(t *testing.T) {
+		s := newStore(t)
+
+		_, err := s.GetUserByID(ctx, 1)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+		_, err = s.GetUserByUsername(ctx, "testuser")
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+		_, err = s.GetUserByEmail(ctx, "testuser@example.com")
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+		assert.ErrorIs(t, s.SetUserSuspended(ctx, 1, true), common.ErrRecordNotFound)
+	})
+
+	t.Run("activate user", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		assert.ErrorIs(t, s.ActivateUser(ctx, u.ID, 2), common.ErrRecordNotFound)
+		assert.NoError(t, s.ActivateUser(ctx, u.ID, 1))
+
+		got, err := s.GetUserByID(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.True(t, got.Activated)
+	})
+
+	t.Run("update password", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		var pwd Password
+		assert.NoError(t, pwd.set("OtherPassword123!"))
+
+		// A stale version leaves the password unchanged.
+		assert.NoError(t, s.UpdateUserPassword(ctx, pwd, u.ID, 2))
+		got, err := s.GetUserByUsername(ctx, u.Username)
+		assert.NoError(t, err)
+		ok, err := got.Password.compare("TestPassword123!")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		assert.NoError(t, s.UpdateUserPassword(ctx, pwd, u.ID, 1))
+		got, err = s.GetUserByUsername(ctx, u.Username)
+		assert.NoError(t, err)
+		ok, err = got.Password.compare("OtherPassword123!")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("suspend user", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		assert.NoError(t, s.SetUserSuspended(ctx, u.ID, true))
+		got, err := s.GetUserByID(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.True(t, got.Suspended)
+		assert.Equal(t, 2, got.Version)
+	})
+
+	t.Run("tokens", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		token, err := createToken(ctx, s, u.ID, time.Hour, TokenScopeActivate)
+		assert.NoError(t, err)
+
+		got, err := s.GetUserByToken(ctx, TokenScopeActivate, hashToken(token.Plain))
+		assert.NoError(t, err)
+		assert.Equal(t, u.ID, got.ID)
+
+		_, err = s.GetUserByToken(ctx, TokenScopeActivate, hashToken("unknown"))
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+		// A user has a single token per scope.
+		_, err = createToken(ctx, s, u.ID, time.Hour, TokenScopeActivate)
+		assert.Error(t, err)
+
+		assert.NoError(t, s.DeleteToken(ctx, u.ID, TokenScopeActivate))
+		assert.ErrorIs(t, s.DeleteToken(ctx, u.ID, TokenScopeActivate), common.ErrRecordNotFound)
+		_, err = s.GetUserByToken(ctx, TokenScopeActivate, hashToken(token.Plain))
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		token, err := createToken(ctx, s, u.ID, -time.Hour, TokenScopeActivate)
+		assert.NoError(t, err)
+
+		_, err = s.GetUserByToken(ctx, TokenScopeActivate, hashToken(token.Plain))
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		_, err := s.GetAuthToken(ctx, u.ID)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+		token, err := createAuthToken(ctx, s, u.ID)
+		assert.NoError(t, err)
+
+		got, err := s.GetAuthToken(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, token.AccessTokenHash, got.AccessTokenHash)
+
+		// The user is only found once it has a permission.
+		hash := hashToken(token.AccessTokenPlain)
+		_, err = s.GetUserByAccessToken(ctx, hash)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+		assert.NoError(t, s.AddPermissions(ctx, u.ID, PermissionWriteBlog))
+		user, err := s.GetUserByAccessToken(ctx, hash)
+		assert.NoError(t, err)
+		assert.Equal(t, u.ID, user.ID)
+		assert.Equal(t, Permissions{PermissionWriteBlog}, user.Permissions)
+
+		hashes, err := s.GetAccessTokenHashes(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{hash}, hashes)
+
+		hashes, err = s.DeleteAuthTokens(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{hash}, hashes)
+
+		_, err = s.DeleteAuthTokens(ctx, u.ID)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+		_, err = s.GetUserByAccessToken(ctx, hash)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("suspended session", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		token, err := createAuthToken(ctx, s, u.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, s.AddPermissions(ctx, u.ID, PermissionWriteBlog))
+		assert.NoError(t, s.SetUserSuspended(ctx, u.ID, true))
+
+		_, err = s.GetUserByAccessToken(ctx, hashToken(token.AccessTokenPlain))
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("permissions", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		token, err := createAuthToken(ctx, s, u.ID)
+		assert.NoError(t, err)
+		hash := hashToken(token.AccessTokenPlain)
+
+		assert.NoError(t, s.AddPermissions(ctx, u.ID, PermissionWriteBlog))
+		assert.NoError(t, s.AddPermissions(ctx, u.ID, PermissionWriteBlog, PermissionAdmin))
+
+		user, err := s.GetUserByAccessToken(ctx, hash)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, Permissions{PermissionWriteBlog, PermissionAdmin}, user.Permissions)
+
+		assert.NoError(t, s.RemovePermissions(ctx, u.ID, PermissionWriteBlog))
+		user, err = s.GetUserByAccessToken(ctx, hash)
+		assert.NoError(t, err)
+		assert.Equal(t, Permissions{PermissionAdmin}, user.Permissions)
+	})
+
+	t.Run("notification preferences", func(t *testing.T) {
+		s := newStore(t)
+		u := insert(t, s, "testuser", "testuser@example.com")
+
+		_, err := s.GetNotificationPreferences(ctx, u.ID+1)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+		p, err := s.GetNotificationPreferences(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, u.ID, p.UserID)
+		assert.True(t, p.Comments)
+		assert.True(t, p.NewPosts)
+		assert.Equal(t, FrequencyInstant, p.Frequency)
+
+		p.Comments = false
+		p.Frequency = FrequencyDaily
+		assert.NoError(t, s.UpdateNotificationPreferences(ctx, p))
+		assert.False(t, p.UpdatedAt.IsZero())
+
+		// Updating again replaces the stored preferences.
+		p.NewPosts = false
+		assert.NoError(t, s.UpdateNotificationPreferences(ctx, p))
+
+		got, err := s.GetNotificationPreferences(ctx, u.ID)
+		assert.NoError(t, err)
+		assert.False(t, got.Comments)
+		assert.False(t, got.NewPosts)
+		assert.Equal(t, FrequencyDaily, got.Frequency)
+	})
+
+	t.Run("follows", func(t *testing.T) {
+		s := newStore(t)
+		follower := insert(t, s, "follower", "follower@example.com")
+		first := insert(t, s, "first", "first@example.com")
+		second := insert(t, s, "second", "second@example.com")
+
+		_, err := s.Follow(ctx, follower.ID, second.ID+1)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+		for _, f := range []struct {
+			author  int
+			created bool
+		}{
+			{second.ID, true},
+			{first.ID, true},
+			{first.ID, false},
+		} {
+			created, err := s.Follow(ctx, follower.ID, f.author)
+			assert.NoError(t, err)
+			assert.Equal(t, f.created, created)
+		}
+
+		authors, err := s.GetFollowedAuthors(ctx, follower.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{first.ID, second.ID}, authors)
+
+		assert.NoError(t, s.Unfollow(ctx, follower.ID, first.ID))
+		assert.ErrorIs(t, s.Unfollow(ctx, follower.ID, first.ID), common.ErrRecordNotFound)
+
+		authors, err = s.GetFollowedAuthors(ctx, follower.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{second.ID}, authors)
+
+		authors, err = s.GetFollowedAuthors(ctx, first.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, authors)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		s := newStore(t)
+
+		var id int
+		err := s.WithTx(ctx, func(tx Tx) error {
+			u := insert(t, tx, "testuser", "testuser@example.com")
+			id = u.ID
+			return tx.AddPermissions(ctx, u.ID, PermissionWriteBlog)
+		})
+		assert.NoError(t, err)
+
+		_, err = s.GetUserByID(ctx, id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		s := newStore(t)
+
+		rollback := errors.New("rollback")
+		err := s.WithTx(ctx, func(tx Tx) error {
+			insert(t, tx, "testuser", "testuser@example.com")
+			return rollback
+		})
+		assert.ErrorIs(t, err, rollback)
+
+		_, err = s.GetUserByUsername(ctx, "testuser")
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+}
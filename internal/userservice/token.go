@@ -36,25 +36,26 @@ func newToken(userID int, ttl time.Duration, scope tokenScope) (*Token, error) {
 	return token, nil
 }
 
-func (m *DBModel) insertToken(token *Token) error {
+func (s *PostgresStore) InsertToken(ctx context.Context, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope_id)
 		VALUES ($1, $2, $3, (SELECT id FROM token_scopes WHERE name = $4))`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := m.db.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, string(token.Scope))
+	_, err := s.q.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, string(token.Scope))
 	return err
 }
 
-func (m *DBModel) createToken(userID int, ttl time.Duration, scope tokenScope) (*Token, error) {
+// createToken generates a token for the user and stores it.
+func createToken(ctx context.Context, store TokenStore, userID int, ttl time.Duration, scope tokenScope) (*Token, error) {
 	token, err := newToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.insertToken(token)
+	err = store.InsertToken(ctx, token)
 	if err != nil {
 		return nil, err
 	}
@@ -62,20 +63,20 @@ func (m *DBModel) createToken(userID int, ttl time.Duration, scope tokenScope) (
 	return token, nil
 }
 
-func (m *DBModel) getUser(tokenScope tokenScope, token []byte) (*User, error) {
+func (s *PostgresStore) GetUserByToken(ctx context.Context, tokenScope tokenScope, token []byte) (*User, error) {
 	var user User
 
 	query := `
-		SELECT u.id, u.username, u.email, u.activated, u.version
+		SELECT u.id, u.username, u.email, u.activated, u.locale, u.version
 		FROM users u
 		INNER JOIN tokens t ON u.id = t.user_id
 		INNER JOIN token_scopes s ON t.scope_id = s.id
 		WHERE t.hash = $1 AND s.name = $2 AND t.expiry > $3`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.db.QueryRowContext(ctx, query, token, tokenScope, time.Now()).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.Version)
+	err := s.q.QueryRowContext(ctx, query, token, tokenScope, time.Now()).Scan(&user.ID, &user.Username, &user.Email, &user.Activated, &user.Locale, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -88,15 +89,15 @@ func (m *DBModel) getUser(tokenScope tokenScope, token []byte) (*User, error) {
 	return &user, nil
 }
 
-func (m *DBModel) deleteToken(tx *sql.Tx, userID int, scope tokenScope) error {
+func (s *PostgresStore) DeleteToken(ctx context.Context, userID int, scope tokenScope) error {
 	query := `
 		DELETE FROM tokens
 		WHERE user_id = $1 AND scope_id = (SELECT id FROM token_scopes WHERE name = $2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	res, err := tx.ExecContext(ctx, query, userID, string(scope))
+	res, err := s.q.ExecContext(ctx, query, userID, string(scope))
 	if err != nil {
 		return err
 	}
@@ -145,13 +146,14 @@ func newAuthToken(userID int, accessTokenTTL time.Duration, refreshTokenTTL time
 	return token, nil
 }
 
-func (m *DBModel) createAuthToken(tx *sql.Tx, userID int) (*AuthToken, error) {
+// createAuthToken generates the authentication tokens for the user and stores them.
+func createAuthToken(ctx context.Context, store SessionStore, userID int) (*AuthToken, error) {
 	authToken, err := newAuthToken(userID, AccessTokenTime, RefreshTokenTime)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.insertAuthToken(tx, authToken)
+	err = store.InsertAuthToken(ctx, authToken)
 	if err != nil {
 		return nil, err
 	}
@@ -159,19 +161,19 @@ func (m *DBModel) createAuthToken(tx *sql.Tx, userID int) (*AuthToken, error) {
 	return authToken, nil
 }
 
-func (m *DBModel) insertAuthToken(tx *sql.Tx, authToken *AuthToken) error {
+func (s *PostgresStore) InsertAuthToken(ctx context.Context, authToken *AuthToken) error {
 	query := `
 		INSERT INTO auth_tokens (access_token, refresh_token, user_id, access_token_expiry, refresh_token_expiry)
 		VALUES ($1, $2, $3, $4, $5)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := tx.ExecContext(ctx, query, authToken.AccessTokenHash, authToken.RefreshTokenHash, authToken.UserID, authToken.AccessTokenExpiry, authToken.RefreshTokenExpiry)
+	_, err := s.q.ExecContext(ctx, query, authToken.AccessTokenHash, authToken.RefreshTokenHash, authToken.UserID, authToken.AccessTokenExpiry, authToken.RefreshTokenExpiry)
 	return err
 }
 
-func (m *DBModel) getAuthToken(userid int) (*AuthToken, error) {
+func (s *PostgresStore) GetAuthToken(ctx context.Context, userid int) (*AuthToken, error) {
 	var authToken AuthToken
 
 	query := `
@@ -179,14 +181,14 @@ func (m *DBModel) getAuthToken(userid int) (*AuthToken, error) {
 		FROM auth_tokens
 		WHERE user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.db.QueryRowContext(ctx, query, userid).Scan(&authToken.AccessTokenHash, &authToken.RefreshTokenHash, &authToken.UserID, &authToken.AccessTokenExpiry, &authToken.RefreshTokenExpiry)
+	err := s.q.QueryRowContext(ctx, query, userid).Scan(&authToken.AccessTokenHash, &authToken.RefreshTokenHash, &authToken.UserID, &authToken.AccessTokenExpiry, &authToken.RefreshTokenExpiry)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, nil
+			return nil, common.ErrRecordNotFound
 		default:
 			return nil, err
 		}
@@ -195,32 +197,68 @@ func (m *DBModel) getAuthToken(userid int) (*AuthToken, error) {
 	return &authToken, nil
 }
 
-func (m *DBModel) deleteAuthToken(tx *sql.Tx, userID int) error {
+func (s *PostgresStore) DeleteAuthTokens(ctx context.Context, userID int) ([][]byte, error) {
 	query := `
 		DELETE FROM auth_tokens
-		WHERE user_id = $1`
+		WHERE user_id = $1
+		RETURNING access_token`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	res, err := tx.ExecContext(ctx, query, userID)
+	rows, err := s.q.QueryContext(ctx, query, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	rows, err := res.RowsAffected()
+	var hashes [][]byte
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(hashes) == 0 {
+		return nil, common.ErrRecordNotFound
+	}
+
+	return hashes, nil
+}
+
+func (s *PostgresStore) GetAccessTokenHashes(ctx context.Context, userID int) ([][]byte, error) {
+	query := `
+		SELECT access_token
+		FROM auth_tokens
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if rows != 1 {
-		switch {
-		case rows == 0:
-			return common.ErrRecordNotFound
-		default:
-			return errors.New("too many rows affected")
+	var hashes [][]byte
+	for rows.Next() {
+		var hash []byte
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
 		}
+		hashes = append(hashes, hash)
 	}
 
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
 }
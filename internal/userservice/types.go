@@ -9,31 +9,70 @@ import (
 
 type tokenScope string
 
+// Frequency is how often a user receives the notification emails.
+type Frequency string
+
 type Permission string
 type Permissions []Permission
 
 const (
-	TokenScopeActivate tokenScope = "token:activate"
+	TokenScopeActivate      tokenScope = "token:activate"
+	TokenScopePasswordReset tokenScope = "token:password_reset"
 
 	ActivationTokenTime time.Duration = 3 * 24 * time.Hour
 	AccessTokenTime     time.Duration = 7 * 24 * time.Hour
 	RefreshTokenTime    time.Duration = 30 * 24 * time.Hour
+	// PasswordResetTokenTime is kept short since a reset token grants access to the account.
+	PasswordResetTokenTime time.Duration = 45 * time.Minute
+
+	// DefaultLocale is the locale of the users who did not choose one.
+	DefaultLocale = "en"
+
+	// DefaultAuthCacheTTL is how long an access token lookup is trusted from the cache when no other limit is configured.
+	DefaultAuthCacheTTL time.Duration = time.Minute
 
 	PermissionWriteBlog Permission = "blog:write"
+	// PermissionAdmin grants access to the operational endpoints under /api/v1/admin.
+	PermissionAdmin Permission = "admin:access"
+
+	// FrequencyInstant sends a notification email for every event, FrequencyDaily and FrequencyWeekly gather them into a digest and FrequencyOff sends none.
+	FrequencyInstant Frequency = "instant"
+	FrequencyDaily   Frequency = "daily"
+	FrequencyWeekly  Frequency = "weekly"
+	FrequencyOff     Frequency = "off"
+)
+
+// The kinds of notification emails. Emails that are not notifications, such as the activation email, are always sent.
+const (
+	NotificationComments = "comments"
+	NotificationNewPosts = "new_posts"
+	NotificationDigest   = "digest"
 )
 
 var (
 	AnonymousUser = User{}
+
+	// AllPermissions are the permissions that can be granted.
+	AllPermissions = Permissions{PermissionWriteBlog, PermissionAdmin}
 )
 
 type UserService struct {
-	m  *DBModel
-	mb common.MessageProducer
-	c  *common.Cache
+	store Store
+	c     common.Cache
+
+	// authCacheTTL bounds how long a cached access token lookup is trusted. Revocations evict the entries they know about, and this bounds the staleness of anything they miss.
+	authCacheTTL time.Duration
 }
 
-type DBModel struct {
+// PostgresStore keeps the users with their tokens, permissions, notification preferences and follows.
+type PostgresStore struct {
 	db *sql.DB
+	q  common.Querier
+}
+
+type postgresTx struct {
+	PostgresStore
+	tx *sql.Tx
 }
 
 type User struct {
@@ -42,6 +81,8 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  Password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Suspended bool      `json:"suspended"`
+	Locale    string    `json:"locale"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Version   int       `json:"version"`
@@ -62,6 +103,32 @@ type Token struct {
 	Scope  tokenScope `json:"-"`
 }
 
+// NotificationPreferences are the notification emails a user wants to receive. Users who never changed them get DefaultNotificationPreferences.
+type NotificationPreferences struct {
+	UserID    int       `json:"-"`
+	Comments  bool      `json:"comments"`
+	NewPosts  bool      `json:"new_posts"`
+	Frequency Frequency `json:"frequency"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// NotificationPreferencesUpdate holds the preferences to change, those that are nil are kept.
+type NotificationPreferencesUpdate struct {
+	Comments  *bool
+	NewPosts  *bool
+	Frequency *Frequency
+}
+
+// DefaultNotificationPreferences returns the preferences of a user who never changed them.
+func DefaultNotificationPreferences(userID int) *NotificationPreferences {
+	return &NotificationPreferences{
+		UserID:    userID,
+		Comments:  true,
+		NewPosts:  true,
+		Frequency: FrequencyInstant,
+	}
+}
+
 // Authentication Token
 type AuthToken struct {
 	AccessTokenPlain   string    `json:"access_token"`
@@ -14,27 +14,50 @@ var (
 	ErrDuplicateEmail    = errors.New("duplicate email")
 )
 
-func newUserModel(db *sql.DB) *DBModel {
-	return &DBModel{db: db}
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db, q: db}
 }
 
-func (m *DBModel) insertUser(u *User) error {
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&postgresTx{PostgresStore: PostgresStore{db: s.db, q: tx}, tx: tx})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (t *postgresTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	return common.EnqueueOutbox(ctx, t.tx, exchange, key, payload)
+}
+
+func (s *PostgresStore) InsertUser(ctx context.Context, u *User) error {
 	query := `
-		INSERT INTO users (username, email, password)
-		VALUES ($1, $2, $3)
+		INSERT INTO users (username, email, password, locale)
+		VALUES ($1, $2, $3, $4)
 		RETURNING id`
 
+	if u.Locale == "" {
+		u.Locale = DefaultLocale
+	}
+
 	args := []any{
 		u.Username,
 		u.Email,
 		u.Password.hash,
+		u.Locale,
 	}
 
-	// Create a new context for external calls
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.db.QueryRowContext(ctx, query, args...).Scan(&u.ID)
+	err := s.q.QueryRowContext(ctx, query, args...).Scan(&u.ID)
 	if err != nil {
 		switch {
 		case err.Error() == "pq: duplicate key value violates unique constraint \"users_username_key\"":
@@ -48,18 +71,66 @@ func (m *DBModel) insertUser(u *User) error {
 	return nil
 }
 
-func (m *DBModel) getUserByUsername(username string) (*User, error) {
+func (s *PostgresStore) GetUserByID(ctx context.Context, id int) (*User, error) {
+	query := `
+		SELECT id, username, email, activated, suspended, locale, created_at, updated_at, version
+		FROM users
+		WHERE id = $1`
+
+	var u User
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, id).Scan(&u.ID, &u.Username, &u.Email, &u.Activated, &u.Suspended, &u.Locale, &u.CreatedAt, &u.UpdatedAt, &u.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, common.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &u, nil
+}
+
+func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	query := `
+		SELECT id, username, email, activated, suspended, locale, created_at, updated_at, version
+		FROM users
+		WHERE email = $1`
+
+	var u User
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, email).Scan(&u.ID, &u.Username, &u.Email, &u.Activated, &u.Suspended, &u.Locale, &u.CreatedAt, &u.UpdatedAt, &u.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, common.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &u, nil
+}
+
+func (s *PostgresStore) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	query := `
-		SELECT id, username, email, password, version
+		SELECT id, username, email, password, suspended, locale, version
 		FROM users
 		WHERE username = $1`
 
 	var u User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	err := m.db.QueryRowContext(ctx, query, username).Scan(&u.ID, &u.Username, &u.Email, &u.Password.hash, &u.Version)
+	err := s.q.QueryRowContext(ctx, query, username).Scan(&u.ID, &u.Username, &u.Email, &u.Password.hash, &u.Suspended, &u.Locale, &u.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -72,16 +143,16 @@ func (m *DBModel) getUserByUsername(username string) (*User, error) {
 	return &u, nil
 }
 
-func (m *DBModel) activateUserAccount(tx *sql.Tx, id int, version int) error {
+func (s *PostgresStore) ActivateUser(ctx context.Context, id int, version int) error {
 	query := `
 		UPDATE users
 		SET activated = true
 		WHERE id = $1 AND version = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	res, err := tx.ExecContext(ctx, query, id, version)
+	res, err := s.q.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
@@ -102,16 +173,16 @@ func (m *DBModel) activateUserAccount(tx *sql.Tx, id int, version int) error {
 	return nil
 }
 
-func (m *DBModel) updateUserPassword(pwd Password, id int, version int) error {
+func (s *PostgresStore) UpdateUserPassword(ctx context.Context, pwd Password, id int, version int) error {
 	query := `
 		UPDATE users
 		SET password = $1
 		WHERE id = $2 AND version = $3`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	_, err := m.db.ExecContext(ctx, query, pwd.hash, id, version)
+	_, err := s.q.ExecContext(ctx, query, pwd.hash, id, version)
 	if err != nil {
 		return err
 	}
@@ -119,7 +190,7 @@ func (m *DBModel) updateUserPassword(pwd Password, id int, version int) error {
 	return nil
 }
 
-func (m *DBModel) getToken(token []byte) (*User, error) {
+func (s *PostgresStore) GetUserByAccessToken(ctx context.Context, token []byte) (*User, error) {
 	var u User
 
 	query := `
@@ -127,12 +198,12 @@ func (m *DBModel) getToken(token []byte) (*User, error) {
 		FROM users u
 		INNER JOIN auth_tokens t ON u.id = t.user_id
 		INNER JOIN user_permissions p on u.id = p.user_id
-		WHERE t.access_token = $1 AND t.access_token_expiry > $2`
+		WHERE t.access_token = $1 AND t.access_token_expiry > $2 AND NOT u.suspended`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	rows, err := m.db.QueryContext(ctx, query, token, time.Now())
+	rows, err := s.q.QueryContext(ctx, query, token, time.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -158,3 +229,28 @@ func (m *DBModel) getToken(token []byte) (*User, error) {
 
 	return &u, nil
 }
+
+func (s *PostgresStore) SetUserSuspended(ctx context.Context, id int, suspended bool) error {
+	query := `
+		UPDATE users
+		SET suspended = $1, version = version + 1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := s.q.ExecContext(ctx, query, suspended, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return common.ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -1,7 +1,9 @@
 package userservice
 
 import (
+	"fmt"
 	"regexp"
+	"slices"
 
 	"github.com/sushihentaime/blogist/internal/common"
 )
@@ -13,6 +15,8 @@ var (
 	LowercaseRX = regexp.MustCompile("[a-z]")
 	NumberRX    = regexp.MustCompile("[0-9]")
 	SymbolRX    = regexp.MustCompile(`[#?!@$%^&*_\\-]`)
+	// LocaleRX matches a language tag such as "en" or "pt-BR".
+	LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z]{2,4})?$`)
 )
 
 func validateUsername(v *common.Validator, username string) {
@@ -33,6 +37,18 @@ func validatePassword(v *common.Validator, password string) {
 	v.Check(value, "password", "must be between 8 and 72 characters long and contain at least one uppercase letter, one lowercase letter, one number, and one symbol")
 }
 
+func validateLocale(v *common.Validator, locale string) {
+	v.Check(LocaleRX.MatchString(locale), "locale", "must be a language tag such as en or pt-BR")
+}
+
+func validateFrequency(v *common.Validator, frequency Frequency) {
+	v.Check(frequency == FrequencyInstant || frequency == FrequencyDaily || frequency == FrequencyWeekly || frequency == FrequencyOff, "frequency", "must be instant, daily, weekly or off")
+}
+
+func validatePermission(v *common.Validator, permission Permission) {
+	v.Check(slices.Contains(AllPermissions, permission), "permissions", fmt.Sprintf("unknown permission %q", permission))
+}
+
 func ValidateToken(v *common.Validator, token string) {
 	v.Check(token != "", "token", "must be provided")
 	v.Check(len(token) == 26, "token", "invalid token")
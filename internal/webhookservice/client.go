@@ -0,0 +1,90 @@
+package webhookservice
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// EventHeader holds the type of the event.
+	EventHeader = "X-Blogist-Event"
+	// DeliveryHeader holds the ID of the delivery, which stays the same across its retries and redeliveries.
+	DeliveryHeader = "X-Blogist-Delivery"
+	// TimestampHeader holds the Unix time of the attempt. Receivers should reject deliveries whose timestamp is too old, so a captured delivery cannot be replayed.
+	TimestampHeader = "X-Blogist-Timestamp"
+	// SignatureHeader holds "sha256=" followed by the signature of the delivery, see Sign.
+	SignatureHeader = "X-Blogist-Signature"
+)
+
+// ErrPrivateAddress is returned when an endpoint resolves to an address that is not on the public internet.
+var ErrPrivateAddress = errors.New("endpoint address is not public")
+
+// Sign returns the hex encoded HMAC-SHA256, keyed with the secret of the endpoint, of the timestamp, a dot and the body. Receivers compute it the same way and compare it to the SignatureHeader.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newSecret returns a random signing secret.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "whsec_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewHTTPClient returns the client the deliveries are posted with. Redirects are not followed, an endpoint must answer itself. Unless allowPrivate is set, the client refuses to connect to loopback, private and link-local addresses, so an endpoint cannot reach the services next to the application.
+func NewHTTPClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		// The address is checked once it is resolved, so a hostname cannot point somewhere else than what was checked.
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, addrPort.Addr())
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// sharedAddressSpace is used behind carrier-grade NATs, which IsPrivate does not cover.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !sharedAddressSpace.Contains(addr)
+}
@@ -0,0 +1,55 @@
+package webhookservice
+
+import (
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// Event is a blog event the endpoints can subscribe to. Its type is the routing key of the event.
+type Event struct {
+	Key   common.BindingKey
+	Queue common.Queue
+	// RetryDelays are the delays between attempts at queueing the deliveries of the event. The message is dead lettered once they are used up.
+	RetryDelays []time.Duration
+}
+
+// Events are the events the webhook service delivers. comment.created is out of scope: the application has no comments, so nothing would publish it, and an endpoint that subscribes to it is rejected like any unknown event. It belongs here once a comment service publishes it.
+var Events = []Event{
+	{Key: common.BlogCreatedKey, Queue: common.WebhookBlogCreatedQueue, RetryDelays: common.WebhookEventRetryDelays},
+	{Key: common.BlogUpdatedKey, Queue: common.WebhookBlogUpdatedQueue, RetryDelays: common.WebhookEventRetryDelays},
+	{Key: common.BlogDeletedKey, Queue: common.WebhookBlogDeletedQueue, RetryDelays: common.WebhookEventRetryDelays},
+	{Key: common.BlogPublishedKey, Queue: common.WebhookBlogPublishedQueue, RetryDelays: common.WebhookEventRetryDelays},
+}
+
+// blogEvent is the body of the blog events.
+type blogEvent struct {
+	BlogID    int
+	UserID    int
+	Author    string
+	Title     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// payload is the body posted to the endpoints.
+type payload struct {
+	Type string   `json:"type"`
+	Data blogData `json:"data"`
+	// CreatedAt is when the event was received, the time of each attempt is in the TimestampHeader.
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type blogData struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Author    string    `json:"author"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// deliveryMessage is the body of the webhook.delivery messages.
+type deliveryMessage struct {
+	DeliveryID int64
+}
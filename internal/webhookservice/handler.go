@@ -0,0 +1,557 @@
+package webhookservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+const (
+	// DisableAfter is the number of deliveries in a row that have to fail, each after every retry, for an endpoint to be disabled.
+	DisableAfter = 5
+	// MaxEndpoints is the number of endpoints a user can have.
+	MaxEndpoints = 10
+	// DefaultDeliveriesLimit is the number of deliveries listed when the request does not ask for a number.
+	DefaultDeliveriesLimit = 20
+	maxDeliveriesLimit     = 100
+	// maxResponseBody is how much of a response is read before the connection is reused.
+	maxResponseBody = 64 << 10
+)
+
+// NewWebhookService creates the webhook service. The deliveries are posted with client, see NewHTTPClient.
+func NewWebhookService(store Store, mb MessageBroker, client *http.Client, logger *slog.Logger) *WebhookService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookService{
+		store:  store,
+		mb:     mb,
+		client: client,
+		events: Events,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start consumes the blog events and the deliveries they are turned into.
+func (s *WebhookService) Start() {
+	for _, e := range s.events {
+		s.consume(e.Key, common.BlogExchange, e.Queue, func(msg common.Delivery) { s.handleEvent(e, msg) })
+	}
+	s.consume(common.WebhookDeliveryKey, common.WebhookExchange, common.WebhookDeliveryQueue, s.handleDelivery)
+}
+
+// Ready returns an error when one of the consumers of the service is not running.
+func (s *WebhookService) Ready() error {
+	return s.consumers.Check()
+}
+
+// Shutdown stops taking messages and waits for the ones being handled until ctx is done, when it cancels them. The messages that were not handled are requeued.
+func (s *WebhookService) Shutdown(ctx context.Context) error {
+	err := s.consumers.Shutdown(ctx)
+	s.cancel()
+
+	return err
+}
+
+// Close stops the consumers and cancels the messages being handled.
+func (s *WebhookService) Close() {
+	s.consumers.Stop()
+	s.cancel()
+}
+
+func (s *WebhookService) consume(key common.BindingKey, exchange common.Exchange, queue common.Queue, handle func(common.Delivery)) {
+	msgs, err := s.mb.Consume(key, exchange, queue)
+	if err != nil {
+		s.logger.Error("could not consume message", slog.String("queue", string(queue)), slog.String("error", err.Error()))
+		s.consumers.Failed(queue)
+		return
+	}
+
+	s.consumers.Consume(queue, msgs, handle)
+}
+
+// handleEvent queues a delivery of the event for every endpoint subscribed to it. The deliveries and their messages are stored in the same transaction, so an event handled again after a failure does not queue a delivery twice.
+func (s *WebhookService) handleEvent(e Event, msg common.Delivery) {
+	ctx := common.ExtractRequestID(s.ctx, msg.Headers)
+	logger := common.Logger(ctx, s.logger)
+
+	var event blogEvent
+
+	err := json.Unmarshal(msg.Body, &event)
+	if err != nil || event.BlogID <= 0 || event.UserID <= 0 {
+		// A malformed message will never succeed, so it goes straight to the dead letter queue.
+		logger.Error("could not read event", slog.String("queue", string(e.Queue)))
+		msg.Nack(false)
+		return
+	}
+
+	endpoints, err := s.store.SubscribedEndpoints(ctx, string(e.Key), event.UserID)
+	if err != nil {
+		s.retry(ctx, msg, e.Queue, e.RetryDelays, err)
+		return
+	}
+	if len(endpoints) == 0 {
+		msg.Ack()
+		return
+	}
+
+	body, err := json.Marshal(payload{
+		Type: string(e.Key),
+		Data: blogData{
+			ID:        event.BlogID,
+			UserID:    event.UserID,
+			Author:    event.Author,
+			Title:     event.Title,
+			CreatedAt: event.CreatedAt,
+			UpdatedAt: event.UpdatedAt,
+		},
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		logger.Error("could not marshal payload", slog.String("queue", string(e.Queue)), slog.String("error", err.Error()))
+		msg.Nack(false)
+		return
+	}
+
+	key := fmt.Sprintf("%s:%x", e.Key, sha256.Sum256(msg.Body))
+	queued := 0
+
+	err = s.store.WithTx(ctx, func(tx Tx) error {
+		queued = 0
+
+		for _, endpoint := range endpoints {
+			d := Delivery{EndpointID: endpoint.ID, EventType: string(e.Key), EventKey: key, Payload: body}
+
+			err := tx.InsertDelivery(ctx, &d)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrDuplicateEvent), errors.Is(err, common.ErrRecordNotFound):
+				// The event was handled already, or the endpoint was deleted in the meantime.
+				continue
+			default:
+				return err
+			}
+
+			err = enqueueDelivery(ctx, tx, d.ID)
+			if err != nil {
+				return err
+			}
+			queued++
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.retry(ctx, msg, e.Queue, e.RetryDelays, err)
+		return
+	}
+
+	logger.Info("webhook deliveries queued", slog.String("event", string(e.Key)), slog.Int("blog_id", event.BlogID), slog.Int("count", queued))
+	msg.Ack()
+}
+
+func enqueueDelivery(ctx context.Context, tx Tx, id int64) error {
+	body, err := json.Marshal(deliveryMessage{DeliveryID: id})
+	if err != nil {
+		return err
+	}
+
+	return tx.EnqueueOutbox(ctx, common.WebhookExchange, common.WebhookDeliveryKey, body)
+}
+
+// handleDelivery posts a delivery to its endpoint and logs the attempt. A failed attempt is retried with the delays of common.WebhookDeliveryRetryDelays, and once they are used up the delivery fails and counts towards disabling the endpoint.
+func (s *WebhookService) handleDelivery(msg common.Delivery) {
+	ctx := common.ExtractRequestID(s.ctx, msg.Headers)
+	logger := common.Logger(ctx, s.logger)
+
+	var m deliveryMessage
+
+	err := json.Unmarshal(msg.Body, &m)
+	if err != nil || m.DeliveryID <= 0 {
+		logger.Error("could not read delivery", slog.String("queue", string(common.WebhookDeliveryQueue)))
+		msg.Nack(false)
+		return
+	}
+
+	d, err := s.store.GetDelivery(ctx, m.DeliveryID)
+	if err != nil {
+		if errors.Is(err, common.ErrRecordNotFound) {
+			// The endpoint was deleted together with its deliveries.
+			msg.Ack()
+			return
+		}
+		s.retry(ctx, msg, common.WebhookDeliveryQueue, common.WebhookDeliveryRetryDelays, err)
+		return
+	}
+
+	if d.Status != StatusPending {
+		// The broker delivered the message again after the delivery was done.
+		msg.Ack()
+		return
+	}
+
+	endpoint, err := s.store.GetEndpoint(ctx, d.EndpointID)
+	if err != nil {
+		if errors.Is(err, common.ErrRecordNotFound) {
+			msg.Ack()
+			return
+		}
+		s.retry(ctx, msg, common.WebhookDeliveryQueue, common.WebhookDeliveryRetryDelays, err)
+		return
+	}
+
+	if !endpoint.Enabled {
+		err := s.store.SetDeliveryStatus(ctx, d.ID, StatusFailed)
+		if err != nil {
+			logger.Error("could not update delivery", slog.Int64("delivery_id", d.ID), slog.String("error", err.Error()))
+		}
+		msg.Ack()
+		return
+	}
+
+	attempt := s.post(endpoint, d)
+	retries := common.RetryCount(msg.Headers)
+	succeeded := attempt.Error == ""
+	lastAttempt := retries >= len(common.WebhookDeliveryRetryDelays)
+
+	status := StatusPending
+	switch {
+	case succeeded:
+		status = StatusSucceeded
+	case lastAttempt:
+		status = StatusFailed
+	}
+
+	err = s.store.RecordAttempt(ctx, attempt, status)
+	if err != nil {
+		logger.Error("could not record delivery attempt", slog.Int64("delivery_id", d.ID), slog.String("error", err.Error()))
+	}
+
+	switch {
+	case succeeded:
+		logger.Info("webhook delivered", slog.Int64("delivery_id", d.ID), slog.Int64("endpoint_id", endpoint.ID))
+		if endpoint.Failures > 0 {
+			err := s.store.RecordSuccess(ctx, endpoint.ID)
+			if err != nil {
+				logger.Error("could not reset endpoint failures", slog.Int64("endpoint_id", endpoint.ID), slog.String("error", err.Error()))
+			}
+		}
+		msg.Ack()
+
+	case lastAttempt:
+		logger.Error("could not deliver webhook", slog.Int64("delivery_id", d.ID), slog.Int64("endpoint_id", endpoint.ID), slog.Int("attempts", retries+1), slog.String("error", attempt.Error))
+
+		reason := fmt.Sprintf("%d deliveries in a row failed, the last one with: %s", DisableAfter, attempt.Error)
+		disabled, err := s.store.RecordFailure(ctx, endpoint.ID, DisableAfter, reason)
+		if err != nil {
+			logger.Error("could not record endpoint failure", slog.Int64("endpoint_id", endpoint.ID), slog.String("error", err.Error()))
+		}
+		if disabled {
+			logger.Warn("webhook endpoint disabled", slog.Int64("endpoint_id", endpoint.ID))
+		}
+		msg.Ack()
+
+	default:
+		s.retry(ctx, msg, common.WebhookDeliveryQueue, common.WebhookDeliveryRetryDelays, errors.New(attempt.Error))
+	}
+}
+
+// post sends the delivery to the endpoint, signed with the time of the attempt. Any response but a 2xx is a failure.
+func (s *WebhookService) post(endpoint *Endpoint, d *Delivery) *Attempt {
+	attempt := &Attempt{DeliveryID: d.ID}
+
+	start := time.Now()
+	defer func() { attempt.DurationMS = int(time.Since(start).Milliseconds()) }()
+
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, endpoint.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := start.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Blogist-Webhooks/1.0")
+	req.Header.Set(EventHeader, d.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(endpoint.Secret, timestamp, d.Payload))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+
+	// Reading the body lets the connection be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxResponseBody))
+
+	attempt.ResponseCode = &res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint responded with %d", res.StatusCode)
+	}
+
+	return attempt
+}
+
+// retry sends a failed message to the retry queue for its next attempt, like the mail service does. Once every delay has been used the message is rejected, and the broker moves it to the dead letter queue.
+func (s *WebhookService) retry(ctx context.Context, msg common.Delivery, queue common.Queue, delays []time.Duration, cause error) {
+	logger := common.Logger(ctx, s.logger)
+
+	r, err := common.Retry(ctx, s.mb, msg, queue, delays)
+	switch {
+	case err != nil:
+		logger.Error("could not schedule webhook retry", slog.String("queue", string(queue)), slog.String("error", err.Error()))
+	case r.DeadLettered:
+		logger.Error("could not handle webhook message, moving it to the dead letter queue", slog.String("queue", string(queue)), slog.Int("attempts", r.Attempt), slog.String("error", cause.Error()))
+	default:
+		logger.Info("delaying webhook message", slog.String("queue", string(queue)), slog.Int("attempt", r.Attempt), slog.Duration("delay", r.Delay), slog.String("error", cause.Error()))
+	}
+}
+
+type CreateEndpointRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// AllUsers subscribes the endpoint to the events of every user. The caller must check that the user is an admin.
+	AllUsers bool `json:"all_users"`
+	UserID   int  `json:"-"`
+}
+
+// CreateEndpoint registers an endpoint of the user. The returned endpoint carries its Secret, which is not returned again.
+func (s *WebhookService) CreateEndpoint(ctx context.Context, req *CreateEndpointRequest) (*Endpoint, error) {
+	v := common.NewValidator()
+	v.Check(req.UserID > 0, "user_id", "must be greater than zero")
+	validateURL(v, req.URL)
+	validateEvents(v, req.Events)
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	existing, err := s.store.GetEndpointsByUser(ctx, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= MaxEndpoints {
+		v.AddError("webhooks", fmt.Sprintf("must not be more than %d", MaxEndpoints))
+		return nil, v.ValidationError()
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint{
+		UserID:   req.UserID,
+		URL:      req.URL,
+		Secret:   secret,
+		Events:   slices.Clone(req.Events),
+		AllUsers: req.AllUsers,
+	}
+
+	err = s.store.InsertEndpoint(ctx, &e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// GetEndpoints returns the endpoints of the user.
+func (s *WebhookService) GetEndpoints(ctx context.Context, userId int) ([]Endpoint, error) {
+	v := common.NewValidator()
+	v.Check(userId > 0, "user_id", "must be greater than zero")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	return s.store.GetEndpointsByUser(ctx, userId)
+}
+
+// GetEndpoint returns an endpoint of the user. It returns common.ErrRecordNotFound when the endpoint does not exist or belongs to someone else.
+func (s *WebhookService) GetEndpoint(ctx context.Context, userId int, id int64) (*Endpoint, error) {
+	v := common.NewValidator()
+	v.Check(userId > 0, "user_id", "must be greater than zero")
+	v.Check(id > 0, "id", "must be greater than zero")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	e, err := s.store.GetEndpoint(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if e.UserID != userId {
+		return nil, common.ErrRecordNotFound
+	}
+
+	return e, nil
+}
+
+// UpdateEndpointRequest changes the fields that are set.
+type UpdateEndpointRequest struct {
+	URL    *string  `json:"url"`
+	Events []string `json:"events"`
+	// Enabled turns the endpoint on or off. Turning a disabled endpoint on clears its failures.
+	Enabled *bool `json:"enabled"`
+}
+
+// UpdateEndpoint changes an endpoint of the user.
+func (s *WebhookService) UpdateEndpoint(ctx context.Context, userId int, id int64, req *UpdateEndpointRequest) (*Endpoint, error) {
+	e, err := s.GetEndpoint(ctx, userId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	v := common.NewValidator()
+	if req.URL != nil {
+		validateURL(v, *req.URL)
+		e.URL = *req.URL
+	}
+	if req.Events != nil {
+		validateEvents(v, req.Events)
+		e.Events = slices.Clone(req.Events)
+	}
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	if req.Enabled != nil {
+		if *req.Enabled && !e.Enabled {
+			e.Failures = 0
+			e.DisabledReason = ""
+		}
+		if !*req.Enabled && e.Enabled {
+			e.DisabledReason = "disabled by the user"
+		}
+		e.Enabled = *req.Enabled
+	}
+
+	err = s.store.UpdateEndpoint(ctx, e)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// DeleteEndpoint deletes an endpoint of the user together with its deliveries.
+func (s *WebhookService) DeleteEndpoint(ctx context.Context, userId int, id int64) error {
+	e, err := s.GetEndpoint(ctx, userId, id)
+	if err != nil {
+		return err
+	}
+
+	return s.store.DeleteEndpoint(ctx, e.ID)
+}
+
+// GetDeliveries returns the latest deliveries of an endpoint of the user, newest first.
+func (s *WebhookService) GetDeliveries(ctx context.Context, userId int, endpointId int64, limit int) ([]Delivery, error) {
+	v := common.NewValidator()
+	v.Check(limit >= 1 && limit <= maxDeliveriesLimit, "limit", fmt.Sprintf("must be between 1 and %d", maxDeliveriesLimit))
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	e, err := s.GetEndpoint(ctx, userId, endpointId)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.store.GetDeliveries(ctx, e.ID, limit)
+}
+
+// GetDelivery returns a delivery of an endpoint of the user together with its attempts, oldest first.
+func (s *WebhookService) GetDelivery(ctx context.Context, userId int, endpointId, id int64) (*Delivery, []Attempt, error) {
+	d, err := s.getDelivery(ctx, userId, endpointId, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attempts, err := s.store.GetAttempts(ctx, d.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return d, attempts, nil
+}
+
+func (s *WebhookService) getDelivery(ctx context.Context, userId int, endpointId, id int64) (*Delivery, error) {
+	v := common.NewValidator()
+	v.Check(id > 0, "delivery_id", "must be greater than zero")
+	if !v.Valid() {
+		return nil, v.ValidationError()
+	}
+
+	e, err := s.GetEndpoint(ctx, userId, endpointId)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := s.store.GetDelivery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if d.EndpointID != e.ID {
+		return nil, common.ErrRecordNotFound
+	}
+
+	return d, nil
+}
+
+// Redeliver sends a delivery that is done again, with a new set of retries. The endpoint must be enabled.
+func (s *WebhookService) Redeliver(ctx context.Context, userId int, endpointId, id int64) error {
+	d, err := s.getDelivery(ctx, userId, endpointId, id)
+	if err != nil {
+		return err
+	}
+
+	e, err := s.store.GetEndpoint(ctx, d.EndpointID)
+	if err != nil {
+		return err
+	}
+
+	v := common.NewValidator()
+	v.Check(d.Status != StatusPending, "delivery", "is still being delivered")
+	v.Check(e.Enabled, "webhook", "must be enabled")
+	if !v.Valid() {
+		return v.ValidationError()
+	}
+
+	return s.store.WithTx(ctx, func(tx Tx) error {
+		err := tx.SetDeliveryStatus(ctx, d.ID, StatusPending)
+		if err != nil {
+			return err
+		}
+
+		return enqueueDelivery(ctx, tx, d.ID)
+	})
+}
+
+func validateURL(v *common.Validator, rawURL string) {
+	u, err := url.Parse(rawURL)
+	v.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "url", "must be an absolute http or https URL")
+	v.Check(len(rawURL) <= 2048, "url", "must not be more than 2048 bytes long")
+	v.Check(err != nil || u.User == nil, "url", "must not contain credentials")
+}
+
+func validateEvents(v *common.Validator, events []string) {
+	v.Check(len(events) > 0, "events", "must contain at least one event")
+	for i, e := range events {
+		v.Check(slices.Contains(EventTypes, e), "events", fmt.Sprintf("%q is not one of %v", e, EventTypes))
+		v.Check(!slices.Contains(events[:i], e), "events", "must not contain duplicates")
+	}
+}
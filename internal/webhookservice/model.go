@@ -0,0 +1,387 @@
+package webhookservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db, q: db}
+}
+
+func (s *PostgresStore) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&postgresTx{PostgresStore: PostgresStore{db: s.db, q: tx}, tx: tx})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (t *postgresTx) EnqueueOutbox(ctx context.Context, exchange common.Exchange, key common.BindingKey, payload []byte) error {
+	return common.EnqueueOutbox(ctx, t.tx, exchange, key, payload)
+}
+
+const endpointColumns = `id, user_id, url, secret, events, all_users, enabled, failures, disabled_reason, created_at, updated_at`
+
+func scanEndpoint(row interface{ Scan(dest ...any) error }, e *Endpoint) error {
+	return row.Scan(&e.ID, &e.UserID, &e.URL, &e.Secret, pq.Array(&e.Events), &e.AllUsers, &e.Enabled, &e.Failures, &e.DisabledReason, &e.CreatedAt, &e.UpdatedAt)
+}
+
+func (s *PostgresStore) InsertEndpoint(ctx context.Context, e *Endpoint) error {
+	query := `
+		INSERT INTO webhook_endpoints (user_id, url, secret, events, all_users)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, enabled, failures, disabled_reason, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, e.UserID, e.URL, e.Secret, pq.Array(e.Events), e.AllUsers).Scan(&e.ID, &e.Enabled, &e.Failures, &e.DisabledReason, &e.CreatedAt, &e.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return common.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetEndpoint(ctx context.Context, id int64) (*Endpoint, error) {
+	query := `
+		SELECT ` + endpointColumns + `
+		FROM webhook_endpoints
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var e Endpoint
+	err := scanEndpoint(s.q.QueryRowContext(ctx, query, id), &e)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, common.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &e, nil
+}
+
+func (s *PostgresStore) GetEndpointsByUser(ctx context.Context, userID int) ([]Endpoint, error) {
+	query := `
+		SELECT ` + endpointColumns + `
+		FROM webhook_endpoints
+		WHERE user_id = $1
+		ORDER BY id`
+
+	return s.queryEndpoints(ctx, query, userID)
+}
+
+func (s *PostgresStore) SubscribedEndpoints(ctx context.Context, eventType string, userID int) ([]Endpoint, error) {
+	query := `
+		SELECT ` + endpointColumns + `
+		FROM webhook_endpoints
+		WHERE enabled AND $1 = ANY(events) AND (all_users OR user_id = $2)
+		ORDER BY id`
+
+	return s.queryEndpoints(ctx, query, eventType, userID)
+}
+
+func (s *PostgresStore) queryEndpoints(ctx context.Context, query string, args ...any) ([]Endpoint, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	endpoints := []Endpoint{}
+	for rows.Next() {
+		var e Endpoint
+		if err := scanEndpoint(rows, &e); err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	return endpoints, rows.Err()
+}
+
+func (s *PostgresStore) UpdateEndpoint(ctx context.Context, e *Endpoint) error {
+	query := `
+		UPDATE webhook_endpoints
+		SET url = $1, events = $2, enabled = $3, failures = $4, disabled_reason = $5
+		WHERE id = $6
+		RETURNING updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, e.URL, pq.Array(e.Events), e.Enabled, e.Failures, e.DisabledReason, e.ID).Scan(&e.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return common.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) DeleteEndpoint(ctx context.Context, id int64) error {
+	query := `
+		DELETE FROM webhook_endpoints
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.q.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return common.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) RecordFailure(ctx context.Context, endpointID int64, disableAfter int, reason string) (bool, error) {
+	query := `
+		UPDATE webhook_endpoints
+		SET
+			failures = failures + 1,
+			enabled = enabled AND failures + 1 < $2,
+			disabled_reason = CASE WHEN enabled AND failures + 1 >= $2 THEN $3 ELSE disabled_reason END
+		WHERE id = $1
+		RETURNING enabled`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var enabled bool
+	err := s.q.QueryRowContext(ctx, query, endpointID, disableAfter, reason).Scan(&enabled)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, common.ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+
+	return !enabled, nil
+}
+
+func (s *PostgresStore) RecordSuccess(ctx context.Context, endpointID int64) error {
+	query := `
+		UPDATE webhook_endpoints
+		SET failures = 0
+		WHERE id = $1 AND failures > 0`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := s.q.ExecContext(ctx, query, endpointID)
+
+	return err
+}
+
+func (s *PostgresStore) InsertDelivery(ctx context.Context, d *Delivery) error {
+	query := `
+		INSERT INTO webhook_deliveries (endpoint_id, event_type, event_key, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (endpoint_id, event_key) DO NOTHING
+		RETURNING id, status, attempts, created_at, updated_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, d.EndpointID, d.EventType, d.EventKey, []byte(d.Payload)).Scan(&d.ID, &d.Status, &d.Attempts, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrDuplicateEvent
+		case errors.As(err, &pqErr) && pqErr.Code == "23503":
+			return common.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	d.ResponseCode = nil
+
+	return nil
+}
+
+const deliveryColumns = `id, endpoint_id, event_type, event_key, payload, status, attempts, response_code, created_at, updated_at`
+
+func scanDelivery(row interface{ Scan(dest ...any) error }, d *Delivery) error {
+	var payload []byte
+	err := row.Scan(&d.ID, &d.EndpointID, &d.EventType, &d.EventKey, &payload, &d.Status, &d.Attempts, &d.ResponseCode, &d.CreatedAt, &d.UpdatedAt)
+	d.Payload = payload
+	return err
+}
+
+func (s *PostgresStore) GetDelivery(ctx context.Context, id int64) (*Delivery, error) {
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var d Delivery
+	err := scanDelivery(s.q.QueryRowContext(ctx, query, id), &d)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, common.ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &d, nil
+}
+
+func (s *PostgresStore) GetDeliveries(ctx context.Context, endpointID int64, limit int) ([]Delivery, error) {
+	query := `
+		SELECT ` + deliveryColumns + `
+		FROM webhook_deliveries
+		WHERE endpoint_id = $1
+		ORDER BY id DESC
+		LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, endpointID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		if err := scanDelivery(rows, &d); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (s *PostgresStore) SetDeliveryStatus(ctx context.Context, id int64, status Status) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	result, err := s.q.ExecContext(ctx, query, status, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return common.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) RecordAttempt(ctx context.Context, a *Attempt, status Status) error {
+	query := `
+		WITH delivery AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, response_code = $2, status = $5
+			WHERE id = $1
+			RETURNING id
+		)
+		INSERT INTO webhook_attempts (delivery_id, response_code, error, duration_ms)
+		SELECT id, $2, $3, $4 FROM delivery
+		RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := s.q.QueryRowContext(ctx, query, a.DeliveryID, a.ResponseCode, a.Error, a.DurationMS, status).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return common.ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) GetAttempts(ctx context.Context, deliveryID int64) ([]Attempt, error) {
+	query := `
+		SELECT id, delivery_id, response_code, error, duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.q.QueryContext(ctx, query, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		err := rows.Scan(&a.ID, &a.DeliveryID, &a.ResponseCode, &a.Error, &a.DurationMS, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
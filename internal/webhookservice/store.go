@@ -0,0 +1,53 @@
+package webhookservice
+
+import (
+	"context"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// Store is the persistence layer of the webhook service.
+type Store interface {
+	WebhookStore
+
+	// WithTx runs fn in a transaction, so that the deliveries of an event are queued with their outbox messages or not at all. The transaction commits when fn returns nil.
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
+}
+
+// Tx queues the deliveries and their outbox messages within the transaction of WithTx.
+type Tx interface {
+	WebhookStore
+	common.OutboxWriter
+}
+
+type WebhookStore interface {
+	// InsertEndpoint stores the endpoint enabled and sets its ID and timestamps. It returns common.ErrRecordNotFound when the user does not exist.
+	InsertEndpoint(ctx context.Context, e *Endpoint) error
+	// GetEndpoint returns the endpoint, or common.ErrRecordNotFound.
+	GetEndpoint(ctx context.Context, id int64) (*Endpoint, error)
+	// GetEndpointsByUser returns the endpoints of the user, oldest first.
+	GetEndpointsByUser(ctx context.Context, userID int) ([]Endpoint, error)
+	// UpdateEndpoint saves the URL, events, state and failures of the endpoint and sets its UpdatedAt.
+	UpdateEndpoint(ctx context.Context, e *Endpoint) error
+	// DeleteEndpoint deletes the endpoint together with its deliveries.
+	DeleteEndpoint(ctx context.Context, id int64) error
+	// SubscribedEndpoints returns the enabled endpoints subscribed to the event type that receive the events of the user, either because they belong to the user or because they receive those of every user.
+	SubscribedEndpoints(ctx context.Context, eventType string, userID int) ([]Endpoint, error)
+	// RecordFailure counts a failed delivery of the endpoint, and disables it with the reason once disableAfter deliveries in a row have failed. It reports whether the endpoint is now disabled.
+	RecordFailure(ctx context.Context, endpointID int64, disableAfter int, reason string) (bool, error)
+	// RecordSuccess resets the failures of the endpoint.
+	RecordSuccess(ctx context.Context, endpointID int64) error
+
+	// InsertDelivery stores the delivery as pending and sets its ID and timestamps. It returns ErrDuplicateEvent when the endpoint already has a delivery with the same event key.
+	InsertDelivery(ctx context.Context, d *Delivery) error
+	// GetDelivery returns the delivery, or common.ErrRecordNotFound.
+	GetDelivery(ctx context.Context, id int64) (*Delivery, error)
+	// GetDeliveries returns up to limit deliveries of the endpoint, newest first.
+	GetDeliveries(ctx context.Context, endpointID int64, limit int) ([]Delivery, error)
+	// SetDeliveryStatus changes the status of the delivery.
+	SetDeliveryStatus(ctx context.Context, id int64, status Status) error
+	// RecordAttempt logs the attempt, counts it on its delivery together with its response code, and sets the status of the delivery.
+	RecordAttempt(ctx context.Context, a *Attempt, status Status) error
+	// GetAttempts returns the attempts of the delivery, oldest first.
+	GetAttempts(ctx context.Context, deliveryID int64) ([]Attempt, error)
+}
@@ -0,0 +1,244 @@
+package webhookservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/sushihentaime/blogist/internal/common"
+	"github.com/sushihentaime/blogist/internal/userservice"
+)
+
+func TestPostgresStore(t *testing.T) {
+	db := common.TestDB("file://../../migrations", t)
+	ctx := context.Background()
+
+	s := NewPostgresStore(db)
+	users := userservice.NewPostgresStore(db)
+
+	setup := func(t *testing.T) (int, int) {
+		t.Cleanup(func() {
+			for _, table := range []string{"webhook_endpoints", "outbox", "users"} {
+				_, err := db.Exec("DELETE FROM " + table)
+				assert.NoError(t, err)
+			}
+		})
+
+		u := userservice.User{Username: "testuser", Email: "testuser@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &u))
+		other := userservice.User{Username: "other", Email: "other@example.com"}
+		assert.NoError(t, users.InsertUser(ctx, &other))
+
+		return u.ID, other.ID
+	}
+
+	insertEndpoint := func(t *testing.T, s WebhookStore, userID int, allUsers bool, events ...string) *Endpoint {
+		e := Endpoint{UserID: userID, URL: "https://example.com/hook", Secret: "secret", Events: events, AllUsers: allUsers}
+		assert.NoError(t, s.InsertEndpoint(ctx, &e))
+		return &e
+	}
+
+	insertDelivery := func(t *testing.T, s WebhookStore, endpointID int64, key string) *Delivery {
+		d := Delivery{EndpointID: endpointID, EventType: "blog.created", EventKey: key, Payload: json.RawMessage(`{"type":"blog.created"}`)}
+		assert.NoError(t, s.InsertDelivery(ctx, &d))
+		return &d
+	}
+
+	ids := func(endpoints []Endpoint) []int64 {
+		var ids []int64
+		for _, e := range endpoints {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+
+	t.Run("endpoints", func(t *testing.T) {
+		userID, otherID := setup(t)
+
+		e := insertEndpoint(t, s, userID, false, "blog.created", "blog.deleted")
+		assert.NotZero(t, e.ID)
+		assert.True(t, e.Enabled)
+		assert.False(t, e.CreatedAt.IsZero())
+
+		missing := Endpoint{UserID: userID + otherID + 100, URL: "https://example.com", Secret: "secret", Events: []string{"blog.created"}}
+		assert.ErrorIs(t, s.InsertEndpoint(ctx, &missing), common.ErrRecordNotFound)
+
+		got, err := s.GetEndpoint(ctx, e.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", got.Secret)
+		assert.Equal(t, []string{"blog.created", "blog.deleted"}, got.Events)
+
+		_, err = s.GetEndpoint(ctx, e.ID+100)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+
+		second := insertEndpoint(t, s, userID, false, "blog.updated")
+		insertEndpoint(t, s, otherID, false, "blog.updated")
+
+		endpoints, err := s.GetEndpointsByUser(ctx, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{e.ID, second.ID}, ids(endpoints))
+
+		got.URL = "https://example.com/other"
+		got.Events = []string{"blog.updated"}
+		got.Enabled = false
+		got.DisabledReason = "disabled by the user"
+		assert.NoError(t, s.UpdateEndpoint(ctx, got))
+
+		got, err = s.GetEndpoint(ctx, e.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "https://example.com/other", got.URL)
+		assert.Equal(t, []string{"blog.updated"}, got.Events)
+		assert.False(t, got.Enabled)
+		assert.Equal(t, "disabled by the user", got.DisabledReason)
+
+		assert.NoError(t, s.DeleteEndpoint(ctx, e.ID))
+		assert.ErrorIs(t, s.DeleteEndpoint(ctx, e.ID), common.ErrRecordNotFound)
+		_, err = s.GetEndpoint(ctx, e.ID)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("subscribed endpoints", func(t *testing.T) {
+		userID, otherID := setup(t)
+
+		own := insertEndpoint(t, s, userID, false, "blog.created", "blog.updated")
+		insertEndpoint(t, s, userID, false, "blog.deleted")
+		all := insertEndpoint(t, s, otherID, true, "blog.created")
+		insertEndpoint(t, s, otherID, false, "blog.created")
+
+		disabled := insertEndpoint(t, s, userID, false, "blog.created")
+		disabled.Enabled = false
+		assert.NoError(t, s.UpdateEndpoint(ctx, disabled))
+
+		endpoints, err := s.SubscribedEndpoints(ctx, "blog.created", userID)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{own.ID, all.ID}, ids(endpoints))
+
+		endpoints, err = s.SubscribedEndpoints(ctx, "blog.updated", otherID)
+		assert.NoError(t, err)
+		assert.Empty(t, endpoints)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		userID, _ := setup(t)
+		e := insertEndpoint(t, s, userID, false, "blog.created")
+
+		disabled, err := s.RecordFailure(ctx, e.ID, 2, "failing")
+		assert.NoError(t, err)
+		assert.False(t, disabled)
+
+		assert.NoError(t, s.RecordSuccess(ctx, e.ID))
+		got, err := s.GetEndpoint(ctx, e.ID)
+		assert.NoError(t, err)
+		assert.Zero(t, got.Failures)
+
+		for range 2 {
+			disabled, err = s.RecordFailure(ctx, e.ID, 2, "failing")
+			assert.NoError(t, err)
+		}
+		assert.True(t, disabled)
+
+		got, err = s.GetEndpoint(ctx, e.ID)
+		assert.NoError(t, err)
+		assert.False(t, got.Enabled)
+		assert.Equal(t, 2, got.Failures)
+		assert.Equal(t, "failing", got.DisabledReason)
+
+		_, err = s.RecordFailure(ctx, e.ID+100, 2, "failing")
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("deliveries", func(t *testing.T) {
+		userID, _ := setup(t)
+		e := insertEndpoint(t, s, userID, false, "blog.created")
+
+		first := insertDelivery(t, s, e.ID, "a")
+		assert.NotZero(t, first.ID)
+		assert.Equal(t, StatusPending, first.Status)
+
+		dup := Delivery{EndpointID: e.ID, EventType: "blog.created", EventKey: "a", Payload: json.RawMessage(`{}`)}
+		assert.ErrorIs(t, s.InsertDelivery(ctx, &dup), ErrDuplicateEvent)
+
+		missing := Delivery{EndpointID: e.ID + 100, EventType: "blog.created", EventKey: "a", Payload: json.RawMessage(`{}`)}
+		assert.ErrorIs(t, s.InsertDelivery(ctx, &missing), common.ErrRecordNotFound)
+
+		second := insertDelivery(t, s, e.ID, "b")
+
+		deliveries, err := s.GetDeliveries(ctx, e.ID, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, deliveries, 2) {
+			assert.Equal(t, second.ID, deliveries[0].ID)
+			assert.JSONEq(t, `{"type":"blog.created"}`, string(deliveries[0].Payload))
+		}
+
+		deliveries, err = s.GetDeliveries(ctx, e.ID, 1)
+		assert.NoError(t, err)
+		assert.Len(t, deliveries, 1)
+
+		code := 500
+		attempt := Attempt{DeliveryID: first.ID, ResponseCode: &code, Error: "endpoint responded with 500", DurationMS: 12}
+		assert.NoError(t, s.RecordAttempt(ctx, &attempt, StatusPending))
+		assert.NotZero(t, attempt.ID)
+
+		attempt = Attempt{DeliveryID: first.ID, Error: "connection refused", DurationMS: 3}
+		assert.NoError(t, s.RecordAttempt(ctx, &attempt, StatusFailed))
+
+		missingAttempt := Attempt{DeliveryID: first.ID + 100}
+		assert.ErrorIs(t, s.RecordAttempt(ctx, &missingAttempt, StatusFailed), common.ErrRecordNotFound)
+
+		got, err := s.GetDelivery(ctx, first.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusFailed, got.Status)
+		assert.Equal(t, 2, got.Attempts)
+		assert.Nil(t, got.ResponseCode)
+
+		attempts, err := s.GetAttempts(ctx, first.ID)
+		assert.NoError(t, err)
+		if assert.Len(t, attempts, 2) {
+			assert.Equal(t, 500, *attempts[0].ResponseCode)
+			assert.Equal(t, "connection refused", attempts[1].Error)
+		}
+
+		assert.NoError(t, s.SetDeliveryStatus(ctx, first.ID, StatusPending))
+		got, err = s.GetDelivery(ctx, first.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, got.Status)
+
+		// Deleting the endpoint deletes its deliveries.
+		assert.NoError(t, s.DeleteEndpoint(ctx, e.ID))
+		_, err = s.GetDelivery(ctx, first.ID)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		userID, _ := setup(t)
+		e := insertEndpoint(t, s, userID, false, "blog.created")
+
+		var id int64
+		err := s.WithTx(ctx, func(tx Tx) error {
+			id = insertDelivery(t, tx, e.ID, "a").ID
+			return tx.EnqueueOutbox(ctx, common.WebhookExchange, common.WebhookDeliveryKey, []byte("{}"))
+		})
+		assert.NoError(t, err)
+
+		_, err = s.GetDelivery(ctx, id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		userID, _ := setup(t)
+		e := insertEndpoint(t, s, userID, false, "blog.created")
+
+		rollback := errors.New("rollback")
+		var id int64
+		err := s.WithTx(ctx, func(tx Tx) error {
+			id = insertDelivery(t, tx, e.ID, "a").ID
+			return rollback
+		})
+		assert.ErrorIs(t, err, rollback)
+
+		_, err = s.GetDelivery(ctx, id)
+		assert.ErrorIs(t, err, common.ErrRecordNotFound)
+	})
+}
@@ -0,0 +1,112 @@
+package webhookservice
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/sushihentaime/blogist/internal/common"
+)
+
+// ErrDuplicateEvent is returned when the endpoint already has a delivery of an event, because the broker delivered the event again.
+var ErrDuplicateEvent = errors.New("delivery already stored")
+
+// EventTypes are the events an endpoint can subscribe to.
+var EventTypes = []string{
+	string(common.BlogCreatedKey),
+	string(common.BlogUpdatedKey),
+	string(common.BlogDeletedKey),
+	string(common.BlogPublishedKey),
+}
+
+// Status is where a delivery stands.
+type Status string
+
+const (
+	// StatusPending deliveries are waiting for their first attempt or their next retry.
+	StatusPending   Status = "pending"
+	StatusSucceeded Status = "succeeded"
+	// StatusFailed deliveries ran out of retries, or their endpoint was disabled before they were sent.
+	StatusFailed Status = "failed"
+)
+
+// Endpoint is a URL the events a user subscribed to are posted to.
+type Endpoint struct {
+	ID     int64  `json:"id"`
+	UserID int    `json:"user_id"`
+	URL    string `json:"url"`
+	// Secret signs the deliveries. It is only shown to the user once, when the endpoint is created.
+	Secret string   `json:"-"`
+	Events []string `json:"events"`
+	// AllUsers endpoints receive the events of every user instead of those of their owner. Only admins can create them.
+	AllUsers bool `json:"all_users"`
+	Enabled  bool `json:"enabled"`
+	// Failures is the number of deliveries in a row that failed after every retry. The endpoint is disabled when it reaches DisableAfter.
+	Failures       int       `json:"failures"`
+	DisabledReason string    `json:"disabled_reason,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Delivery is an event sent, or to be sent, to an endpoint.
+type Delivery struct {
+	ID         int64  `json:"id"`
+	EndpointID int64  `json:"endpoint_id"`
+	EventType  string `json:"event_type"`
+	// EventKey identifies the event the delivery was made from.
+	EventKey string `json:"-"`
+	// Payload is the body posted to the endpoint.
+	Payload  json.RawMessage `json:"payload"`
+	Status   Status          `json:"status"`
+	Attempts int             `json:"attempts"`
+	// ResponseCode is the status code of the last response, nil before the first one.
+	ResponseCode *int      `json:"response_code"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Attempt is an entry of the delivery log.
+type Attempt struct {
+	ID         int64 `json:"id"`
+	DeliveryID int64 `json:"-"`
+	// ResponseCode is nil when the endpoint could not be reached.
+	ResponseCode *int      `json:"response_code"`
+	Error        string    `json:"error,omitempty"`
+	DurationMS   int       `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// WebhookService queues a delivery for every endpoint subscribed to a blog event published on the broker, posts the deliveries and manages the endpoints of the users.
+type WebhookService struct {
+	store  Store
+	mb     MessageBroker
+	client *http.Client
+	// events are the events the service delivers, Events unless a test narrows them down.
+	events []Event
+	logger *slog.Logger
+	// consumers runs the consumers of the events and the deliveries.
+	consumers common.ConsumerGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// MessageBroker consumes the blog events and the deliveries and publishes the messages that have to be retried.
+type MessageBroker interface {
+	common.MessageConsumer
+	common.MessageProducer
+}
+
+// PostgresStore keeps the endpoints, their deliveries and the attempts at them in the webhook tables.
+type PostgresStore struct {
+	db *sql.DB
+	q  common.Querier
+}
+
+type postgresTx struct {
+	PostgresStore
+	tx *sql.Tx
+}
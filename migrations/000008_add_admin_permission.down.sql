@@ -0,0 +1,6 @@
+DELETE FROM user_permissions WHERE permission = 'admin:access';
+
+ALTER TYPE permission RENAME TO permission_old;
+CREATE TYPE permission AS ENUM ('blog:write');
+ALTER TABLE user_permissions ALTER COLUMN permission TYPE permission USING permission::text::permission;
+DROP TYPE permission_old;
@@ -0,0 +1 @@
+ALTER TYPE permission ADD VALUE IF NOT EXISTS 'admin:access';
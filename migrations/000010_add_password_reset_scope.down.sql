@@ -0,0 +1 @@
+DELETE FROM token_scopes WHERE name = 'token:password_reset';
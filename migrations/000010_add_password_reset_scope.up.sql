@@ -0,0 +1,4 @@
+INSERT INTO token_scopes (name)
+VALUES
+    ('token:password_reset')
+ON CONFLICT (name) DO NOTHING;
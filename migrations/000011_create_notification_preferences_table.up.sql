@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    comments BOOLEAN NOT NULL DEFAULT TRUE,
+    new_posts BOOLEAN NOT NULL DEFAULT TRUE,
+    frequency TEXT NOT NULL DEFAULT 'instant' CHECK (frequency IN ('instant', 'daily', 'off')),
+    updated_at timestamptz NOT NULL DEFAULT NOW()
+);
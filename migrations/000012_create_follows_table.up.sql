@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS follows (
+    follower_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    author_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (follower_id, author_id),
+    CHECK (follower_id <> author_id)
+);
+
+CREATE INDEX IF NOT EXISTS follows_author_id_idx ON follows (author_id);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS blogs_created_at_idx;
+
+DROP TABLE IF EXISTS digest_runs;
+
+UPDATE notification_preferences SET frequency = 'daily' WHERE frequency = 'weekly';
+ALTER TABLE notification_preferences DROP CONSTRAINT IF EXISTS notification_preferences_frequency_check;
+ALTER TABLE notification_preferences ADD CONSTRAINT notification_preferences_frequency_check CHECK (frequency IN ('instant', 'daily', 'off'));
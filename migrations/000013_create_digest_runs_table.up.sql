@@ -0,0 +1,14 @@
+ALTER TABLE notification_preferences DROP CONSTRAINT IF EXISTS notification_preferences_frequency_check;
+ALTER TABLE notification_preferences ADD CONSTRAINT notification_preferences_frequency_check CHECK (frequency IN ('instant', 'daily', 'weekly', 'off'));
+
+-- A digest covers the posts published between since and until. The primary key lets only one replica send the digest that starts at since.
+CREATE TABLE IF NOT EXISTS digest_runs (
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    since timestamptz NOT NULL,
+    until timestamptz NOT NULL,
+    post_count INTEGER NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, since)
+);
+
+CREATE INDEX IF NOT EXISTS blogs_created_at_idx ON blogs (created_at);
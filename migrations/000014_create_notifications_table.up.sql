@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS notifications (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    data JSONB NOT NULL DEFAULT '{}',
+    event_key TEXT NOT NULL,
+    read_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, event_key)
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id DESC);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
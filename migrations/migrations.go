@@ -0,0 +1,9 @@
+// Package migrations holds the migrations of the database schema, which are embedded in the binary.
+package migrations
+
+import "embed"
+
+// FS holds the migration files, in the format of golang-migrate, at its root.
+//
+//go:embed *.sql
+var FS embed.FS